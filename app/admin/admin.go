@@ -0,0 +1,190 @@
+package admin
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"taos-adapter/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// errNotFound is returned for a subscription name that is not in the config file
+var errNotFound = errors.New("subscription not found")
+
+// API serves the endpoints listing and changing the MQTT subscriptions at runtime. A change is written to the
+// config file and applied by reloading it, so it survives a restart.
+type API struct {
+	Token  string       // expected as a bearer token on every request, every request is refused when empty
+	Path   string       // the config file changes are written to
+	Reload func() error // applies the config file after a change was written
+
+	// changes are serialized so none is lost between reading and writing the file
+	mu sync.Mutex
+}
+
+// Register adds the endpoints under /admin
+func (a *API) Register(r gin.IRouter) {
+	group := r.Group("/admin", a.authorize)
+	group.GET("/subscriptions", a.list)
+	group.GET("/subscriptions/:name", a.get)
+	group.PUT("/subscriptions/:name", a.put)
+	group.DELETE("/subscriptions/:name", a.delete)
+	group.POST("/subscriptions/:name/pause", a.pause(true))
+	group.POST("/subscriptions/:name/resume", a.pause(false))
+}
+
+/* authorize refuses requests without the admin token */
+func (a *API) authorize(ctx *gin.Context) {
+	token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if a.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+		return
+	}
+
+	ctx.Next()
+}
+
+func (a *API) list(ctx *gin.Context) {
+	subs, err := config.ReadSubscriptions(a.Path)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"subscriptions": subs})
+}
+
+func (a *API) get(ctx *gin.Context) {
+	subs, err := config.ReadSubscriptions(a.Path)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	i := find(subs, ctx.Param("name"))
+	if i < 0 {
+		respondError(ctx, errNotFound)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, subs[i])
+}
+
+// put adds the subscription or replaces it, along with its parser and pipeline settings
+func (a *API) put(ctx *gin.Context) {
+	var sub config.Subscription
+
+	body, err := ctx.GetRawData()
+	if err == nil {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&sub)
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": errors.Wrap(err, "invalid subscription").Error()})
+		return
+	}
+
+	name := ctx.Param("name")
+	if sub.Name != "" && sub.Name != name {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "the name in the body must match the path"})
+		return
+	}
+	sub.Name = name
+
+	status := http.StatusOK
+	a.change(ctx, func(subs []config.Subscription) ([]config.Subscription, error) {
+		if i := find(subs, name); i >= 0 {
+			subs[i] = sub
+			return subs, nil
+		}
+
+		status = http.StatusCreated
+		return append(subs, sub), nil
+	}, func() {
+		ctx.JSON(status, sub)
+	})
+}
+
+func (a *API) delete(ctx *gin.Context) {
+	name := ctx.Param("name")
+
+	a.change(ctx, func(subs []config.Subscription) ([]config.Subscription, error) {
+		i := find(subs, name)
+		if i < 0 {
+			return nil, errNotFound
+		}
+
+		return append(subs[:i], subs[i+1:]...), nil
+	}, func() {
+		ctx.Status(http.StatusNoContent)
+	})
+}
+
+/* pause returns the handler pausing or resuming a subscription, a paused subscription stays in the config file */
+func (a *API) pause(paused bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		name := ctx.Param("name")
+
+		var sub config.Subscription
+		a.change(ctx, func(subs []config.Subscription) ([]config.Subscription, error) {
+			i := find(subs, name)
+			if i < 0 {
+				return nil, errNotFound
+			}
+
+			subs[i].Paused = paused
+			sub = subs[i]
+			return subs, nil
+		}, func() {
+			ctx.JSON(http.StatusOK, sub)
+		})
+	}
+}
+
+/* change writes the subscriptions returned by edit to the config file and reloads it before calling respond */
+func (a *API) change(ctx *gin.Context, edit func([]config.Subscription) ([]config.Subscription, error), respond func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := config.EditSubscriptions(a.Path, edit); err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	if err := a.Reload(); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": errors.Wrap(err, "the config file was changed but failed to reload").Error()})
+		return
+	}
+
+	respond()
+}
+
+func respondError(ctx *gin.Context, err error) {
+	var configErr *config.Error
+	switch {
+	case errors.As(err, &configErr):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid configuration", "problems": configErr.Problems})
+	case errors.Is(err, errNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, config.ErrNoConfigFile):
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func find(subs []config.Subscription, name string) int {
+	for i, sub := range subs {
+		if sub.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,126 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"taos-adapter/config"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const adminConfig = `
+server:
+  port: "8080"
+mqtt:
+  host: broker
+  user: adapter
+  pass: secret
+  client_id: adapter
+  sub_topic: "#"
+tdengine:
+  host: tdengine
+  user: root
+  pass: taosdata
+  dbname: test
+pipeline:
+  subscriptions:
+    - topic: office/#
+      processors: []
+`
+
+func TestAPI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	path := filepath.Join(t.TempDir(), "adapter.yaml")
+	if err := os.WriteFile(path, []byte(adminConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reloads := 0
+	r := gin.New()
+	api := &API{Token: "secret", Path: path, Reload: func() error {
+		reloads++
+		return nil
+	}}
+	api.Register(r)
+
+	// the steps run in order, each one sees the config file written by the previous ones
+	cases := []struct {
+		name     string
+		method   string
+		url      string
+		token    string
+		body     string
+		status   int
+		contains string
+	}{
+		{name: "Failure: Missing token", method: http.MethodGet, url: "/admin/subscriptions", status: http.StatusUnauthorized},
+		{name: "Failure: Wrong token", method: http.MethodGet, url: "/admin/subscriptions", token: "guess", status: http.StatusUnauthorized},
+		{name: "Success: Empty list", method: http.MethodGet, url: "/admin/subscriptions", token: "secret", status: http.StatusOK, contains: `{"subscriptions":[]}`},
+		{
+			name: "Success: Add", method: http.MethodPut, url: "/admin/subscriptions/thermostats", token: "secret",
+			body:   `{"topic": "factory/thermostats/#", "parser": "json", "pipeline": {"processors": [{"type": "rename", "field_map": {"temp": "temperature"}}], "dedup": {"window": "1m"}}}`,
+			status: http.StatusCreated, contains: `"name":"thermostats"`,
+		},
+		{
+			name: "Failure: Invalid processor", method: http.MethodPut, url: "/admin/subscriptions/meters", token: "secret",
+			body:   `{"topic": "factory/meters/#", "pipeline": {"processors": [{"type": "teleport"}]}}`,
+			status: http.StatusBadRequest, contains: "teleport",
+		},
+		{
+			name: "Failure: Unknown field", method: http.MethodPut, url: "/admin/subscriptions/meters", token: "secret",
+			body: `{"topic": "factory/meters/#", "qos": 2}`, status: http.StatusBadRequest, contains: "qos",
+		},
+		{
+			name: "Failure: Duplicate topic", method: http.MethodPut, url: "/admin/subscriptions/meters", token: "secret",
+			body: `{"topic": "factory/thermostats/#"}`, status: http.StatusBadRequest, contains: "duplicate topic",
+		},
+		{
+			name: "Failure: Single level topic", method: http.MethodPut, url: "/admin/subscriptions/sensors", token: "secret",
+			body: `{"topic": "sensors"}`, status: http.StatusBadRequest, contains: "topic must have a",
+		},
+		{name: "Success: Pause", method: http.MethodPost, url: "/admin/subscriptions/thermostats/pause", token: "secret", status: http.StatusOK, contains: `"paused":true`},
+		{name: "Success: Get", method: http.MethodGet, url: "/admin/subscriptions/thermostats", token: "secret", status: http.StatusOK, contains: `"window":"1m"`},
+		{name: "Success: Resume", method: http.MethodPost, url: "/admin/subscriptions/thermostats/resume", token: "secret", status: http.StatusOK, contains: `"paused":false`},
+		{name: "Failure: Pause unknown", method: http.MethodPost, url: "/admin/subscriptions/meters/pause", token: "secret", status: http.StatusNotFound},
+		{name: "Success: Delete", method: http.MethodDelete, url: "/admin/subscriptions/thermostats", token: "secret", status: http.StatusNoContent},
+		{name: "Failure: Get deleted", method: http.MethodGet, url: "/admin/subscriptions/thermostats", token: "secret", status: http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		req := httptest.NewRequest(c.method, c.url, strings.NewReader(c.body))
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != c.status {
+			t.Errorf("expected status %d, got %d: %s", c.status, w.Code, w.Body.String())
+		}
+
+		if !strings.Contains(w.Body.String(), c.contains) {
+			t.Errorf("expected body to contain %s, got %s", c.contains, w.Body.String())
+		}
+	}
+
+	// add, pause, resume and delete were applied
+	if reloads != 4 {
+		t.Errorf("expected 4 reloads, got %d", reloads)
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.MQTT.Subscriptions) != 0 || len(cfg.Pipeline.Subscriptions) != 1 || cfg.Pipeline.Subscriptions[0].Topic != "office/#" {
+		t.Errorf("expected the file to be back to its subscriptions, got %+v and %+v", cfg.MQTT.Subscriptions, cfg.Pipeline.Subscriptions)
+	}
+}
@@ -0,0 +1,414 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"taos-adapter/batch"
+	"taos-adapter/models"
+	"taos-adapter/mqtt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	RuleThreshold = "threshold"
+	RuleRate      = "rate"
+	RuleMissing   = "missing"
+
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+
+	// missingCheckInterval is how often series are checked for missing data and idle series are forgotten
+	missingCheckInterval = time.Second
+
+	// seriesTTL is how long threshold and rate rules keep a series that stopped reporting, missing rules keep
+	// them for missingTTLFactor times their missing duration
+	seriesTTL        = 24 * time.Hour
+	missingTTLFactor = 10
+)
+
+// Config holds the alert rules, read from their own file or from the alerts section of the adapter config
+type Config struct {
+	Rules []RuleConfig `yaml:"rules"`
+}
+
+// RuleConfig is a single rule evaluated on Field of every series received on topics matching Topic.
+// Threshold rules compare the value and rate rules the change per second to Above and Below, missing rules
+// fire when a series did not report Field for Missing.
+type RuleConfig struct {
+	Name    string        `yaml:"name"`
+	Type    string        `yaml:"type"`
+	Topic   string        `yaml:"topic,omitempty"` // MQTT topic filter, all topics when empty
+	Field   string        `yaml:"field"`
+	Above   *float64      `yaml:"above,omitempty"`
+	Below   *float64      `yaml:"below,omitempty"`
+	Missing time.Duration `yaml:"missing,omitempty"`
+}
+
+// Event is published when a rule starts or stops firing for a series
+type Event struct {
+	Rule      string            `json:"rule"`
+	Status    string            `json:"status"`
+	DB        string            `json:"db"`
+	Table     string            `json:"table"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Field     string            `json:"field"`
+	Value     *float64          `json:"value,omitempty"` // the value, or the rate for rate rules, absent for missing data
+	Above     *float64          `json:"above,omitempty"`
+	Below     *float64          `json:"below,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+type rule struct {
+	RuleConfig
+	series map[string]*seriesState
+}
+
+// seriesState is kept per db, table and tag set
+type seriesState struct {
+	db       string
+	table    string
+	tags     map[string]string
+	firing   bool
+	value    float64
+	time     time.Time // timestamp of the last value
+	lastSeen time.Time // adapter time the last value was received
+}
+
+// the rules and their series state outlive restarts of the alert sink, Apply replaces them on config changes.
+// Events that failed to publish are kept and published first when the sink restarts.
+var rulesMu sync.Mutex
+var rules []*rule
+var unpublished []Event
+
+// ReadConfig reads an alert rules file
+func ReadConfig(path string) (Config, error) {
+	var config Config
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return config, errors.Wrapf(err, "failed to read alert rules: %s", path)
+	}
+
+	if err := yaml.UnmarshalStrict(raw, &config); err != nil {
+		return config, errors.Wrapf(err, "failed to parse alert rules: %s", path)
+	}
+
+	return config, nil
+}
+
+// Validate compiles the alert rules without applying them
+func Validate(config Config) error {
+	_, err := compile(config)
+
+	return err
+}
+
+// Apply compiles the alert rules and replaces the current ones. Rules whose settings did not change keep the
+// state of their series, so firing series still resolve and do not fire again.
+func Apply(config Config) error {
+	compiled, err := compile(config)
+	if err != nil {
+		return err
+	}
+
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	prev := map[string]*rule{}
+	for _, r := range rules {
+		prev[r.Name] = r
+	}
+
+	for _, r := range compiled {
+		if old, ok := prev[r.Name]; ok && reflect.DeepEqual(old.RuleConfig, r.RuleConfig) {
+			r.series = old.series
+		}
+	}
+	rules = compiled
+
+	return nil
+}
+
+/* evaluateAll runs every rule on a point */
+func evaluateAll(m *models.TimeBasedMetrics, now time.Time) []Event {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	events := []Event{}
+	for _, r := range rules {
+		if event := r.evaluate(m, now); event != nil {
+			events = append(events, *event)
+		}
+	}
+
+	return events
+}
+
+/* checkAll runs every missing data rule and forgets idle series */
+func checkAll(now time.Time) []Event {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	events := []Event{}
+	for _, r := range rules {
+		events = append(events, r.checkMissing(now)...)
+		r.prune(now)
+	}
+
+	return events
+}
+
+// publishAll publishes events in order, keeping the ones left when publishing fails for the next start. An event
+// that can never be published is dropped.
+func publishAll(ctx context.Context, pub *publisher, events []Event) error {
+	for i, event := range events {
+		err := pub.publish(ctx, event)
+		if batch.IsPermanent(err) {
+			pub.log.Error(errors.Wrapf(err, "dropping alert %s", event.Rule))
+			continue
+		}
+
+		if err != nil {
+			rulesMu.Lock()
+			unpublished = append(unpublished, events[i:]...)
+			rulesMu.Unlock()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func compile(config Config) ([]*rule, error) {
+	compiled := make([]*rule, 0, len(config.Rules))
+	names := map[string]struct{}{}
+
+	for i, c := range config.Rules {
+		if c.Name == "" {
+			return nil, fmt.Errorf("rules[%d]: name is required", i)
+		}
+
+		// the name is the last level of the topic events are published on
+		if strings.ContainsAny(c.Name, "+#\x00") {
+			return nil, fmt.Errorf("rules[%d]: name must not contain +, # or NUL, got: %q", i, c.Name)
+		}
+
+		if _, ok := names[c.Name]; ok {
+			return nil, fmt.Errorf("rules[%d]: duplicate name %s", i, c.Name)
+		}
+		names[c.Name] = struct{}{}
+
+		if c.Field == "" {
+			return nil, fmt.Errorf("rules[%d] (%s): field is required", i, c.Name)
+		}
+
+		switch c.Type {
+		case RuleThreshold, RuleRate:
+			if c.Above == nil && c.Below == nil {
+				return nil, fmt.Errorf("rules[%d] (%s): %s requires above or below", i, c.Name, c.Type)
+			}
+		case RuleMissing:
+			if c.Missing <= 0 {
+				return nil, fmt.Errorf("rules[%d] (%s): missing requires a positive missing duration", i, c.Name)
+			}
+		default:
+			return nil, fmt.Errorf("rules[%d] (%s): type must be one of %s, %s, %s, got: %q", i, c.Name, RuleThreshold, RuleRate, RuleMissing, c.Type)
+		}
+
+		compiled = append(compiled, &rule{RuleConfig: c, series: map[string]*seriesState{}})
+	}
+
+	return compiled, nil
+}
+
+// seriesKey identifies a series by db, table and sorted tag set
+func seriesKey(m *models.TimeBasedMetrics) string {
+	keys := make([]string, 0, len(m.Tags))
+	for key := range m.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(m.DB)
+	b.WriteByte(0)
+	b.WriteString(m.Table)
+	for _, key := range keys {
+		b.WriteByte(0)
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(m.Tags[key])
+	}
+
+	return b.String()
+}
+
+func (r *rule) outside(val float64) bool {
+	return (r.Above != nil && val > *r.Above) || (r.Below != nil && val < *r.Below)
+}
+
+func (r *rule) event(state *seriesState, status string, value *float64, timestamp time.Time) Event {
+	// JSON has no NaN or infinity
+	if value != nil && (math.IsNaN(*value) || math.IsInf(*value, 0)) {
+		value = nil
+	}
+
+	return Event{
+		Rule:      r.Name,
+		Status:    status,
+		DB:        state.db,
+		Table:     state.table,
+		Tags:      state.tags,
+		Field:     r.Field,
+		Value:     value,
+		Above:     r.Above,
+		Below:     r.Below,
+		Timestamp: timestamp,
+	}
+}
+
+// evaluate updates the series state with a point, returning an event when the rule starts or stops firing. Points
+// that are not newer than the last one of their series are ignored.
+func (r *rule) evaluate(m *models.TimeBasedMetrics, now time.Time) *Event {
+	if r.Topic != "" && !mqtt.TopicMatches(r.Topic, m.Topic) {
+		return nil
+	}
+
+	val, ok := m.Metrics[r.Field]
+	if !ok {
+		return nil
+	}
+
+	key := seriesKey(m)
+	state, seen := r.series[key]
+	if seen && !m.Timestamp.After(state.time) {
+		return nil
+	}
+	if !seen {
+		state = &seriesState{db: m.DB, table: m.Table, tags: m.Tags}
+		r.series[key] = state
+	}
+
+	prevValue, prevTime := state.value, state.time
+	state.value = val
+	state.time = m.Timestamp
+	state.lastSeen = now
+
+	var firing bool
+	var reported *float64
+	switch r.Type {
+	case RuleThreshold:
+		firing = r.outside(val)
+		reported = &val
+	case RuleRate:
+		if !seen {
+			return nil
+		}
+		rate := (val - prevValue) / m.Timestamp.Sub(prevTime).Seconds()
+		firing = r.outside(rate)
+		reported = &rate
+	case RuleMissing:
+		// data arrived, so a missing data alert resolves
+		firing = false
+		reported = &val
+	}
+
+	if firing == state.firing {
+		return nil
+	}
+	state.firing = firing
+
+	status := StatusResolved
+	if firing {
+		status = StatusFiring
+	}
+
+	event := r.event(state, status, reported, m.Timestamp)
+
+	return &event
+}
+
+/* checkMissing fires missing data rules for series that did not report for the configured duration */
+func (r *rule) checkMissing(now time.Time) []Event {
+	if r.Type != RuleMissing {
+		return nil
+	}
+
+	events := []Event{}
+	for _, state := range r.series {
+		if state.firing || now.Sub(state.lastSeen) < r.Missing {
+			continue
+		}
+
+		state.firing = true
+		events = append(events, r.event(state, StatusFiring, nil, now))
+	}
+
+	return events
+}
+
+// prune forgets series that did not report for long, a series that is still firing then never resolves and fires
+// again once it reports outside the limits
+func (r *rule) prune(now time.Time) {
+	ttl := seriesTTL
+	if r.Type == RuleMissing {
+		ttl = missingTTLFactor * r.Missing
+	}
+
+	for key, state := range r.series {
+		if now.Sub(state.lastSeen) >= ttl {
+			delete(r.series, key)
+		}
+	}
+}
+
+// Evaluate runs the alert rules on every point of tbMetrics and publishes the resulting events, it is used as a
+// fanout sink so it has its own queue and restarts like the other sinks
+func (s *Sink) Evaluate(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+	pub, err := s.newPublisher(ctx, log)
+	if err != nil {
+		return err
+	}
+	defer pub.close()
+
+	rulesMu.Lock()
+	events := unpublished
+	unpublished = nil
+	rulesMu.Unlock()
+
+	if err := publishAll(ctx, pub, events); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(missingCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if err := publishAll(ctx, pub, checkAll(now)); err != nil {
+				return err
+			}
+		case m, ok := <-tbMetrics:
+			if !ok {
+				return nil
+			}
+
+			if err := publishAll(ctx, pub, evaluateAll(&m, time.Now())); err != nil {
+				return err
+			}
+		}
+	}
+}
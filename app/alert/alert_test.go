@@ -0,0 +1,265 @@
+package alert
+
+import (
+	"reflect"
+	"taos-adapter/models"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+func TestEvaluate(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1257894000, 0)
+
+	type point struct {
+		metrics        map[string]float64
+		tags           map[string]string
+		at             time.Duration // timestamp and arrival after start
+		expectedStatus string        // empty when no event is expected
+		expectedValue  float64
+	}
+
+	cases := []struct {
+		name   string
+		config string
+		points []point
+	}{
+		{
+			name:   "Success: Threshold",
+			config: `{name: hot, type: threshold, field: temp, above: 90}`,
+			points: []point{
+				{metrics: map[string]float64{"temp": 80}},
+				{metrics: map[string]float64{"temp": 95}, at: time.Second, expectedStatus: StatusFiring, expectedValue: 95},
+				{metrics: map[string]float64{"temp": 99}, at: 2 * time.Second},
+				{metrics: map[string]float64{"temp": 95}, tags: map[string]string{"room": "2"}, at: 2 * time.Second, expectedStatus: StatusFiring, expectedValue: 95},
+				{metrics: map[string]float64{"temp": 85}, at: 3 * time.Second, expectedStatus: StatusResolved, expectedValue: 85},
+				{metrics: map[string]float64{"hum": 100}, at: 4 * time.Second},
+			},
+		},
+		{
+			name:   "Success: Below",
+			config: `{name: cold, type: threshold, field: temp, below: 0, topic: db/+}`,
+			points: []point{
+				{metrics: map[string]float64{"temp": -5}, expectedStatus: StatusFiring, expectedValue: -5},
+				{metrics: map[string]float64{"temp": 5}, at: time.Second, expectedStatus: StatusResolved, expectedValue: 5},
+			},
+		},
+		{
+			name:   "Success: Rate",
+			config: `{name: rising, type: rate, field: temp, above: 1}`,
+			points: []point{
+				{metrics: map[string]float64{"temp": 20}},
+				{metrics: map[string]float64{"temp": 30}, at: 5 * time.Second, expectedStatus: StatusFiring, expectedValue: 2},
+				{metrics: map[string]float64{"temp": 31}, at: 10 * time.Second, expectedStatus: StatusResolved, expectedValue: 0.2},
+			},
+		},
+		{
+			name:   "Success: Older points ignored",
+			config: `{name: rising, type: rate, field: temp, above: 1}`,
+			points: []point{
+				{metrics: map[string]float64{"temp": 20}, at: 10 * time.Second},
+				{metrics: map[string]float64{"temp": 0}, at: 5 * time.Second},
+				{metrics: map[string]float64{"temp": 90}, at: 10 * time.Second},
+				{metrics: map[string]float64{"temp": 21}, at: 20 * time.Second},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		var config RuleConfig
+		if err := yaml.UnmarshalStrict([]byte(c.config), &config); err != nil {
+			t.Fatal(errors.Wrap(err, "failed to parse rule"))
+		}
+
+		rules, err := compile(Config{Rules: []RuleConfig{config}})
+		if err != nil {
+			t.Fatal(errors.Wrap(err, "unexpected error"))
+		}
+
+		for i, p := range c.points {
+			m := models.TimeBasedMetrics{
+				Metrics:   p.metrics,
+				Tags:      p.tags,
+				Timestamp: start.Add(p.at),
+				DB:        "db",
+				Table:     "t",
+				Topic:     "db/t",
+			}
+
+			event := rules[0].evaluate(&m, start.Add(p.at))
+			if p.expectedStatus == "" {
+				if event != nil {
+					t.Errorf("point %d: expected no event, got %+v", i, *event)
+				}
+				continue
+			}
+
+			if event == nil {
+				t.Errorf("point %d: expected %s event, got none", i, p.expectedStatus)
+				continue
+			}
+
+			if event.Status != p.expectedStatus || event.Value == nil || *event.Value != p.expectedValue {
+				t.Errorf("point %d: expected %s with value %g, got %+v", i, p.expectedStatus, p.expectedValue, *event)
+			}
+		}
+	}
+}
+
+func TestCheckMissing(t *testing.T) {
+	t.Parallel()
+
+	rules, err := compile(Config{Rules: []RuleConfig{{Name: "silent", Type: RuleMissing, Field: "temp", Missing: time.Minute}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rules[0]
+
+	start := time.Unix(1257894000, 0)
+	m := models.TimeBasedMetrics{Metrics: map[string]float64{"temp": 20}, Tags: map[string]string{"room": "1"}, Timestamp: start, DB: "db", Table: "t"}
+
+	if event := r.evaluate(&m, start); event != nil {
+		t.Fatalf("expected no event for the first point, got %+v", *event)
+	}
+
+	if events := r.checkMissing(start.Add(30 * time.Second)); len(events) != 0 {
+		t.Fatalf("expected no events before the missing duration, got %d", len(events))
+	}
+
+	events := r.checkMissing(start.Add(time.Minute))
+	if len(events) != 1 || events[0].Status != StatusFiring || events[0].Tags["room"] != "1" || events[0].Value != nil {
+		t.Fatalf("expected one firing event without value, got %+v", events)
+	}
+
+	if events := r.checkMissing(start.Add(2 * time.Minute)); len(events) != 0 {
+		t.Fatalf("expected firing alert not to repeat, got %d events", len(events))
+	}
+
+	m.Timestamp = start.Add(3 * time.Minute)
+	event := r.evaluate(&m, start.Add(3*time.Minute))
+	if event == nil || event.Status != StatusResolved {
+		t.Fatalf("expected resolved event, got %v", event)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	t.Parallel()
+
+	limit := 90.0
+	cases := []struct {
+		name           string
+		config         RuleConfig
+		idle           time.Duration
+		expectedSeries int
+	}{
+		{name: "Success: Threshold series kept", config: RuleConfig{Name: "hot", Type: RuleThreshold, Field: "temp", Above: &limit}, idle: time.Hour, expectedSeries: 1},
+		{name: "Success: Threshold series forgotten", config: RuleConfig{Name: "hot", Type: RuleThreshold, Field: "temp", Above: &limit}, idle: seriesTTL, expectedSeries: 0},
+		{name: "Success: Missing series kept", config: RuleConfig{Name: "silent", Type: RuleMissing, Field: "temp", Missing: time.Minute}, idle: 5 * time.Minute, expectedSeries: 1},
+		{name: "Success: Missing series forgotten", config: RuleConfig{Name: "silent", Type: RuleMissing, Field: "temp", Missing: time.Minute}, idle: 10 * time.Minute, expectedSeries: 0},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		rules, err := compile(Config{Rules: []RuleConfig{c.config}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := rules[0]
+
+		start := time.Unix(1257894000, 0)
+		m := models.TimeBasedMetrics{Metrics: map[string]float64{"temp": 20}, Timestamp: start, DB: "db", Table: "t"}
+		r.evaluate(&m, start)
+
+		r.prune(start.Add(c.idle))
+		if len(r.series) != c.expectedSeries {
+			t.Errorf("expected %d series, got %d", c.expectedSeries, len(r.series))
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	defer Apply(Config{})
+
+	limit, otherLimit := 30.0, 40.0
+	hot := RuleConfig{Name: "hot", Type: RuleThreshold, Field: "temp", Above: &limit}
+	start := time.Unix(1257894000, 0)
+	point := func(temp float64, at time.Time) *models.TimeBasedMetrics {
+		return &models.TimeBasedMetrics{Metrics: map[string]float64{"temp": temp}, DB: "db", Table: "t", Timestamp: at}
+	}
+
+	// the steps run in order, each one sees the rule state left by the previous ones
+	cases := []struct {
+		name             string
+		rules            []RuleConfig
+		temp             float64
+		expectedStatuses []string
+	}{
+		{name: "Success: Firing", rules: []RuleConfig{hot}, temp: 35, expectedStatuses: []string{StatusFiring}},
+		{name: "Success: Unchanged rule keeps firing", rules: []RuleConfig{hot}, temp: 36, expectedStatuses: []string{}},
+		{
+			name:  "Success: Unchanged rule resolves next to an added one",
+			rules: []RuleConfig{hot, {Name: "cold", Type: RuleThreshold, Field: "temp", Below: &limit}},
+			temp:  20, expectedStatuses: []string{StatusResolved, StatusFiring},
+		},
+		{
+			name:  "Success: Changed rule starts over",
+			rules: []RuleConfig{hot, {Name: "cold", Type: RuleThreshold, Field: "temp", Below: &otherLimit}},
+			temp:  20, expectedStatuses: []string{StatusFiring},
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if err := Apply(Config{Rules: c.rules}); err != nil {
+			t.Fatal(err)
+		}
+
+		at := start.Add(time.Duration(i) * time.Second)
+		statuses := []string{}
+		for _, event := range evaluateAll(point(c.temp, at), at) {
+			statuses = append(statuses, event.Status)
+		}
+
+		if !reflect.DeepEqual(statuses, c.expectedStatuses) {
+			t.Errorf("expected events %v, got %v", c.expectedStatuses, statuses)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	t.Parallel()
+
+	limit := 1.0
+
+	cases := []struct {
+		name          string
+		rules         []RuleConfig
+		expectedError bool
+	}{
+		{name: "Success: Threshold", rules: []RuleConfig{{Name: "a", Type: RuleThreshold, Field: "temp", Above: &limit}}},
+		{name: "Failure: Missing name", rules: []RuleConfig{{Type: RuleThreshold, Field: "temp", Above: &limit}}, expectedError: true},
+		{name: "Failure: Wildcard in name", rules: []RuleConfig{{Name: "hot/#", Type: RuleThreshold, Field: "temp", Above: &limit}}, expectedError: true},
+		{name: "Failure: NUL in name", rules: []RuleConfig{{Name: "hot\x00", Type: RuleThreshold, Field: "temp", Above: &limit}}, expectedError: true},
+		{name: "Failure: Duplicate name", rules: []RuleConfig{{Name: "a", Type: RuleThreshold, Field: "temp", Above: &limit}, {Name: "a", Type: RuleThreshold, Field: "temp", Above: &limit}}, expectedError: true},
+		{name: "Failure: Missing field", rules: []RuleConfig{{Name: "a", Type: RuleThreshold, Above: &limit}}, expectedError: true},
+		{name: "Failure: Threshold without limits", rules: []RuleConfig{{Name: "a", Type: RuleRate, Field: "temp"}}, expectedError: true},
+		{name: "Failure: Missing without duration", rules: []RuleConfig{{Name: "a", Type: RuleMissing, Field: "temp"}}, expectedError: true},
+		{name: "Failure: Unknown type", rules: []RuleConfig{{Name: "a", Type: "anomaly", Field: "temp"}}, expectedError: true},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if _, err := compile(Config{Rules: c.rules}); (err != nil) != c.expectedError {
+			t.Errorf("expected error: %t, got: %v", c.expectedError, err)
+		}
+	}
+}
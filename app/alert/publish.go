@@ -0,0 +1,120 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"taos-adapter/batch"
+	"taos-adapter/mqtt"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Sink publishes the events of the alert rules to <Topic>/<rule> over its own MQTT connection and posts them to
+// WebhookURL when set
+type Sink struct {
+	Topic      string
+	ClientID   string
+	WebhookURL string
+	Timeout    time.Duration
+	MaxRetries int
+}
+
+// publisher sends events to <topic>/<rule> over its own MQTT connection and to the webhook when configured
+type publisher struct {
+	*Sink
+	log    *logrus.Entry
+	client *paho.Client
+	http   *http.Client
+}
+
+func (s *Sink) newPublisher(ctx context.Context, log *logrus.Entry) (*publisher, error) {
+	c, err := mqtt.Connect(ctx, log, s.ClientID, func(*paho.Publish) {}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect alert publisher")
+	}
+
+	log.Infof("publishing alerts to %s/<rule>", s.Topic)
+
+	return &publisher{Sink: s, log: log, client: c, http: &http.Client{Timeout: s.Timeout}}, nil
+}
+
+func (p *publisher) close() {
+	if err := p.client.Disconnect(&paho.Disconnect{}); err != nil {
+		p.log.Error(errors.Wrap(err, "failed to disconnect alert publisher"))
+	}
+}
+
+// publish sends an event to MQTT, a failed webhook is logged but does not stop the evaluation. Errors that will not
+// go away by publishing again, like the broker rejecting the event, are marked with batch.Permanent.
+func (p *publisher) publish(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return batch.Permanent(errors.Wrap(err, "failed to encode alert"))
+	}
+
+	p.log.Infof("alert %s %s for %s.%s %v", event.Rule, event.Status, event.DB, event.Table, event.Tags)
+
+	pubCtx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	resp, err := p.client.Publish(pubCtx, &paho.Publish{
+		Topic:   p.Topic + "/" + event.Rule,
+		QoS:     1,
+		Payload: body,
+	})
+	if resp != nil && resp.ReasonCode >= 0x80 {
+		return batch.Permanent(errors.Wrapf(err, "broker rejected alert %s", event.Rule))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to publish alert %s", event.Rule)
+	}
+
+	if p.WebhookURL == "" {
+		return nil
+	}
+
+	err = batch.Retry(ctx, p.MaxRetries, time.Second, func() error {
+		return p.post(body)
+	})
+	if err != nil {
+		p.log.Error(errors.Wrapf(err, "failed to post alert %s", event.Rule))
+	}
+
+	return nil
+}
+
+func (p *publisher) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, p.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return batch.Permanent(errors.Wrap(err, "failed to build webhook request"))
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send webhook request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+
+	// client errors will fail the same way again, except for rate limiting
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return batch.Permanent(err)
+	}
+
+	return err
+}
@@ -0,0 +1,326 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"taos-adapter/batch"
+	"taos-adapter/models"
+	"taos-adapter/telemetry"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	FormatNDJSON  = "ndjson"
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+
+	partSuffix = ".part"
+)
+
+// Sink writes points to files under Dir, Name labels its metrics
+type Sink struct {
+	Name          string
+	Dir           string
+	Format        string // FormatNDJSON, FormatCSV or FormatParquet
+	Gzip          bool   // gzip ndjson and csv files, gzip compress parquet columns
+	MaxSize       int64  // bytes after which a file is rotated
+	MaxAge        time.Duration
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// fileSeq keeps file names unique when a partition rotates more than once within a second
+	fileSeq int
+}
+
+type columnKind int
+
+const (
+	kindTag columnKind = iota
+	kindField
+)
+
+// schema maps tag and field names to their kind, csv and parquet files keep one schema for their lifetime
+type schema map[string]columnKind
+
+func (s schema) fits(point models.TimeBasedMetrics) bool {
+	for key := range point.Tags {
+		if kind, ok := s[key]; !ok || kind != kindTag {
+			return false
+		}
+	}
+
+	for key := range point.Metrics {
+		if kind, ok := s[key]; !ok || kind != kindField {
+			return false
+		}
+	}
+
+	return true
+}
+
+// columns returns the schema keys in a stable order
+func (s schema) columns() []string {
+	columns := make([]string, 0, len(s))
+	for column := range s {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	return columns
+}
+
+func compileSchema(points []models.TimeBasedMetrics) schema {
+	s := schema{}
+	for _, point := range points {
+		for key := range point.Tags {
+			if _, ok := s[key]; !ok {
+				s[key] = kindTag
+			}
+		}
+
+		for key := range point.Metrics {
+			if _, ok := s[key]; !ok {
+				s[key] = kindField
+			}
+		}
+	}
+
+	return s
+}
+
+// encoder writes points in one of the archive formats
+type encoder interface {
+	encode(point models.TimeBasedMetrics) error
+	close() error
+}
+
+// partition is the currently open file for a db/table/date
+type partition struct {
+	path    string
+	file    *os.File
+	counter *countingWriter
+	enc     encoder
+	schema  schema
+	opened  time.Time
+}
+
+func (s *Sink) expired(p *partition, now time.Time) bool {
+	return p.counter.n >= s.MaxSize || now.Sub(p.opened) >= s.MaxAge
+}
+
+/* close finalizes the file and drops the part suffix so readers only ever see complete files */
+func (p *partition) close() error {
+	encErr := p.enc.close()
+	fileErr := p.file.Close()
+
+	if encErr != nil {
+		return errors.Wrapf(encErr, "failed to finalize %s", p.path)
+	}
+	if fileErr != nil {
+		return errors.Wrapf(fileErr, "failed to close %s", p.path)
+	}
+
+	return errors.Wrapf(os.Rename(p.path+partSuffix, p.path), "failed to rename %s", p.path)
+}
+
+type countingWriter struct {
+	f *os.File
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.f.Write(b)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// Write batches metrics into rotated files partitioned by database, table and date. Expired files are also rotated
+// on a ticker of their own, so a partition that stops receiving points is still finished.
+func (s *Sink) Write(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+	// mu guards partitions, which are shared by the batch flush and the rotation ticker
+	var mu sync.Mutex
+	partitions := map[string]*partition{}
+
+	closePartition := func(key string) {
+		if err := partitions[key].close(); err != nil {
+			log.Error(err)
+		}
+		delete(partitions, key)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(s.FlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				mu.Lock()
+				for key, p := range partitions {
+					if s.expired(p, now) {
+						closePartition(key)
+					}
+				}
+				mu.Unlock()
+			}
+		}
+	}()
+
+	defer func() {
+		close(done)
+		wg.Wait()
+
+		for key := range partitions {
+			closePartition(key)
+		}
+	}()
+
+	log.Infof("archiving %s to %s", s.Format, s.Dir)
+
+	batch.Consume(ctx, tbMetrics, s.BatchSize, s.FlushInterval, func(points []models.TimeBasedMetrics) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		groups := map[string][]models.TimeBasedMetrics{}
+		for _, point := range points {
+			key := partitionDir(point)
+			groups[key] = append(groups[key], point)
+		}
+
+		now := time.Now()
+
+		var written, failed []models.TimeBasedMetrics
+		var writeErr error
+
+		for key, group := range groups {
+			for i, point := range group {
+				p, ok := partitions[key]
+				if ok && (s.expired(p, now) || (s.Format != FormatNDJSON && !p.schema.fits(point))) {
+					closePartition(key)
+					ok = false
+				}
+
+				if !ok {
+					var err error
+					p, err = s.openPartition(key, compileSchema(group[i:]), now)
+					if err != nil {
+						log.Error(err)
+						failed, writeErr = append(failed, group[i:]...), err
+						break
+					}
+					partitions[key] = p
+				}
+
+				if err := p.enc.encode(point); err != nil {
+					log.Error(errors.Wrapf(err, "failed to write point to %s", p.path))
+					failed, writeErr = append(failed, point), err
+					continue
+				}
+				written = append(written, point)
+			}
+		}
+
+		if len(written) > 0 {
+			telemetry.ObserveWrite(s.Name, written, now, nil)
+		}
+		if len(failed) > 0 {
+			telemetry.ObserveWrite(s.Name, failed, now, writeErr)
+		}
+	})
+
+	return nil
+}
+
+func (s *Sink) openPartition(key string, columns schema, now time.Time) (*partition, error) {
+	if err := os.MkdirAll(filepath.Join(s.Dir, key), 0o755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create %s", key)
+	}
+
+	// fileSeq starts over with every run, skip the names files of an earlier run within the same second took
+	var path string
+	var file *os.File
+	var err error
+	for {
+		s.fileSeq++
+		name := fmt.Sprintf("%s-%06d.%s", now.UTC().Format("150405"), s.fileSeq, s.Format)
+		if s.Gzip && s.Format != FormatParquet {
+			name += ".gz"
+		}
+		path = filepath.Join(s.Dir, key, name)
+
+		if _, statErr := os.Stat(path); statErr == nil {
+			continue
+		}
+
+		file, err = os.OpenFile(path+partSuffix, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open %s", path)
+		}
+		break
+	}
+
+	p := &partition{
+		path:    path,
+		file:    file,
+		counter: &countingWriter{f: file},
+		schema:  columns,
+		opened:  now,
+	}
+
+	switch s.Format {
+	case FormatCSV:
+		p.enc, err = newCSVEncoder(p.counter, columns, s.Gzip)
+	case FormatParquet:
+		p.enc, err = newParquetEncoder(p.counter, columns, s.Gzip)
+	default:
+		p.enc, err = newNDJSONEncoder(p.counter, s.Gzip)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path + partSuffix)
+		return nil, errors.Wrapf(err, "failed to start %s", path)
+	}
+
+	return p, nil
+}
+
+/* partitionDir returns db/table/date for a point, the date is taken from the point timestamp in UTC */
+func partitionDir(point models.TimeBasedMetrics) string {
+	return filepath.Join(sanitizePathNode(point.DB), sanitizePathNode(point.Table), point.Timestamp.UTC().Format("2006-01-02"))
+}
+
+// sanitizePathNode keeps MQTT derived names from escaping the archive directory
+func sanitizePathNode(node string) string {
+	node = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+
+		return r
+	}, node)
+
+	if node == "" || strings.Trim(node, ".") == "" {
+		return "_"
+	}
+
+	return node
+}
@@ -0,0 +1,252 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"taos-adapter/models"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSanitizePathNode(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name         string
+		node         string
+		expectedNode string
+	}{
+		{
+			name:         "Success: Plain name",
+			node:         "test_db",
+			expectedNode: "test_db",
+		},
+		{
+			name:         "Success: Separators",
+			node:         "../etc/passwd",
+			expectedNode: ".._etc_passwd",
+		},
+		{
+			name:         "Success: Parent directory",
+			node:         "..",
+			expectedNode: "_",
+		},
+		{
+			name:         "Success: Empty name",
+			node:         "",
+			expectedNode: "_",
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if node := sanitizePathNode(c.node); node != c.expectedNode {
+			t.Errorf("expected node %q, got %q", c.expectedNode, node)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	cases := []struct {
+		name            string
+		format          string
+		expectedFiles   int
+		expectedContent []byte
+	}{
+		{
+			name:            "Success: NDJSON",
+			format:          FormatNDJSON,
+			expectedFiles:   1,
+			expectedContent: []byte(`{"timestamp":"2009-11-10T23:00:00Z","db":"test_db","table":"room","tags":{"name":"test_name"},"metrics":{"temp":12.34}}` + "\n" + `{"timestamp":"2009-11-10T23:00:01Z","db":"test_db","table":"room","metrics":{"count":9}}` + "\n"),
+		},
+		{
+			name:            "Success: CSV",
+			format:          FormatCSV,
+			expectedFiles:   1,
+			expectedContent: []byte("timestamp;count;name;temp\n1257894000;;test_name;12.34\n1257894001;9;;\n"),
+		},
+		{
+			name:            "Success: Parquet",
+			format:          FormatParquet,
+			expectedFiles:   1,
+			expectedContent: []byte("PAR1"),
+		},
+	}
+
+	points := []models.TimeBasedMetrics{
+		{
+			Metrics:   map[string]float64{"temp": 12.34},
+			Tags:      map[string]string{"name": "test_name"},
+			Timestamp: time.Unix(1257894000, 0).UTC(),
+			DB:        "test_db",
+			Table:     "room",
+		},
+		{
+			Metrics:   map[string]float64{"count": 9},
+			Timestamp: time.Unix(1257894001, 0).UTC(),
+			DB:        "test_db",
+			Table:     "room",
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		s := &Sink{Dir: t.TempDir(), Format: c.format, MaxSize: 1024 * 1024, MaxAge: time.Hour, BatchSize: 10, FlushInterval: time.Hour}
+
+		tbMetrics := make(chan models.TimeBasedMetrics, len(points))
+		for _, point := range points {
+			tbMetrics <- point
+		}
+		close(tbMetrics)
+
+		if err := s.Write(context.Background(), logrus.NewEntry(logrus.New()), tbMetrics); err != nil {
+			t.Fatal(err)
+		}
+
+		files, err := filepath.Glob(filepath.Join(s.Dir, "test_db", "room", "2009-11-10", "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(files) != c.expectedFiles {
+			t.Fatalf("expected no. of files %d, got %d: %v", c.expectedFiles, len(files), files)
+		}
+
+		if filepath.Ext(files[0]) != "."+c.format {
+			t.Errorf("expected a finished .%s file, got %s", c.format, files[0])
+		}
+
+		content, err := os.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.HasPrefix(content, c.expectedContent) {
+			t.Errorf("expected content %q, got %q", c.expectedContent, content)
+		}
+	}
+}
+
+func TestWriteIdle(t *testing.T) {
+	s := &Sink{Dir: t.TempDir(), Format: FormatNDJSON, MaxSize: 1024 * 1024, MaxAge: 50 * time.Millisecond, BatchSize: 10, FlushInterval: 10 * time.Millisecond}
+
+	// the channel stays open and nothing arrives after the first point, the file still has to be finished
+	tbMetrics := make(chan models.TimeBasedMetrics, 1)
+	tbMetrics <- models.TimeBasedMetrics{
+		Metrics:   map[string]float64{"temp": 12.34},
+		Timestamp: time.Unix(1257894000, 0).UTC(),
+		DB:        "test_db",
+		Table:     "room",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	written := make(chan error)
+	go func() {
+		written <- s.Write(ctx, logrus.NewEntry(logrus.New()), tbMetrics)
+	}()
+
+	pattern := filepath.Join(s.Dir, "test_db", "room", "2009-11-10", "*.ndjson")
+	deadline := time.Now().Add(5 * time.Second)
+	var files []string
+	for len(files) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+
+		var err error
+		if files, err = filepath.Glob(pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancel()
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("expected the idle partition to be rotated into 1 file, got %v", files)
+	}
+}
+
+func TestOpenPartitionExisting(t *testing.T) {
+	s := &Sink{Dir: t.TempDir(), Format: FormatNDJSON, MaxSize: 1024 * 1024, MaxAge: time.Hour, BatchSize: 10, FlushInterval: time.Hour}
+
+	// a file of an earlier run, which started counting at the same sequence number
+	now := time.Unix(1257894000, 0)
+	existing := filepath.Join(s.Dir, "test_db", now.UTC().Format("150405")+"-000001.ndjson")
+	if err := os.MkdirAll(filepath.Dir(existing), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(existing, []byte("earlier\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := s.openPartition("test_db", schema{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.path == existing {
+		t.Fatalf("expected a new file, got %s", p.path)
+	}
+
+	content, err := os.ReadFile(existing)
+	if err != nil || string(content) != "earlier\n" {
+		t.Errorf("expected the earlier file to be kept, got %q: %v", content, err)
+	}
+}
+
+func TestCompileParquetSchema(t *testing.T) {
+	t.Parallel()
+
+	names := map[string]string{}
+	compileParquetSchema(schema{"a.b": kindField, "a_b": kindField, "timestamp": kindTag}, names)
+
+	expectedNames := map[string]string{"a.b": "a_b", "a_b": "a_b_2", "timestamp": "timestamp_2"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("expected column names %v, got %v", expectedNames, names)
+	}
+}
+
+func TestCSVHeader(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name           string
+		columns        []string
+		expectedHeader []string
+	}{
+		{
+			name:           "Success: No collision",
+			columns:        []string{"name", "temp"},
+			expectedHeader: []string{"timestamp", "name", "temp"},
+		},
+		{
+			name:           "Success: Timestamp column",
+			columns:        []string{"temp", "timestamp"},
+			expectedHeader: []string{"timestamp", "temp", "timestamp_2"},
+		},
+		{
+			name:           "Success: Suffix taken",
+			columns:        []string{"timestamp", "timestamp_2"},
+			expectedHeader: []string{"timestamp", "timestamp_3", "timestamp_2"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if header := csvHeader(c.columns); !reflect.DeepEqual(header, c.expectedHeader) {
+			t.Errorf("expected header %v, got %v", c.expectedHeader, header)
+		}
+	}
+}
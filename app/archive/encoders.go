@@ -0,0 +1,237 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"taos-adapter/models"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const timestampColumn = "timestamp"
+
+// compressor wraps the file in a buffer and optionally gzip, close flushes both
+type compressor struct {
+	buf *bufio.Writer
+	gz  *gzip.Writer
+	w   io.Writer
+}
+
+func newCompressor(w io.Writer, gzipOutput bool) *compressor {
+	c := &compressor{buf: bufio.NewWriter(w)}
+	c.w = c.buf
+
+	if gzipOutput {
+		c.gz = gzip.NewWriter(c.buf)
+		c.w = c.gz
+	}
+
+	return c
+}
+
+func (c *compressor) close() error {
+	if c.gz != nil {
+		if err := c.gz.Close(); err != nil {
+			return err
+		}
+	}
+
+	return c.buf.Flush()
+}
+
+type ndjsonRecord struct {
+	Timestamp time.Time          `json:"timestamp"`
+	DB        string             `json:"db"`
+	Table     string             `json:"table"`
+	Tags      map[string]string  `json:"tags,omitempty"`
+	Metrics   map[string]float64 `json:"metrics,omitempty"`
+}
+
+type ndjsonEncoder struct {
+	c   *compressor
+	enc *json.Encoder
+}
+
+func newNDJSONEncoder(w io.Writer, gzipOutput bool) (encoder, error) {
+	c := newCompressor(w, gzipOutput)
+
+	return &ndjsonEncoder{c: c, enc: json.NewEncoder(c.w)}, nil
+}
+
+func (e *ndjsonEncoder) encode(point models.TimeBasedMetrics) error {
+	return e.enc.Encode(ndjsonRecord{
+		Timestamp: point.Timestamp,
+		DB:        point.DB,
+		Table:     point.Table,
+		Tags:      point.Tags,
+		Metrics:   point.Metrics,
+	})
+}
+
+func (e *ndjsonEncoder) close() error {
+	return e.c.close()
+}
+
+/* csvEncoder writes the same ; separated layout with a unix timestamp column that the mqtt csv parser reads */
+type csvEncoder struct {
+	c       *compressor
+	w       *csv.Writer
+	columns []string
+}
+
+func newCSVEncoder(w io.Writer, s schema, gzipOutput bool) (encoder, error) {
+	c := newCompressor(w, gzipOutput)
+
+	e := &csvEncoder{c: c, w: csv.NewWriter(c.w), columns: s.columns()}
+	e.w.Comma = ';'
+
+	if err := e.w.Write(csvHeader(e.columns)); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+/* csvHeader prepends the timestamp column, a tag or field of that name gets a numbered suffix no other column has */
+func csvHeader(columns []string) []string {
+	header := []string{timestampColumn}
+
+	taken := map[string]bool{timestampColumn: true}
+	for _, column := range columns {
+		taken[column] = true
+	}
+
+	for _, column := range columns {
+		name := column
+		if column == timestampColumn {
+			for i := 2; taken[name]; i++ {
+				name = fmt.Sprintf("%s_%d", column, i)
+			}
+			taken[name] = true
+		}
+		header = append(header, name)
+	}
+
+	return header
+}
+
+func (e *csvEncoder) encode(point models.TimeBasedMetrics) error {
+	row := make([]string, len(e.columns)+1)
+	row[0] = strconv.FormatInt(point.Timestamp.Unix(), 10)
+
+	for i, column := range e.columns {
+		if val, ok := point.Metrics[column]; ok {
+			row[i+1] = strconv.FormatFloat(val, 'f', -1, 64)
+		} else {
+			row[i+1] = point.Tags[column]
+		}
+	}
+
+	return e.w.Write(row)
+}
+
+func (e *csvEncoder) close() error {
+	e.w.Flush()
+	if err := e.w.Error(); err != nil {
+		return err
+	}
+
+	return e.c.close()
+}
+
+// parquetRowGroupSize keeps row groups small enough for size based rotation to be meaningful
+const parquetRowGroupSize = 8 * 1024 * 1024
+
+/* parquetEncoder writes a timestamp column followed by optional utf8 tag columns and double field columns */
+type parquetEncoder struct {
+	pw      *writer.JSONWriter
+	columns []string
+	names   map[string]string // schema key to parquet column name
+}
+
+func newParquetEncoder(w io.Writer, s schema, gzipOutput bool) (encoder, error) {
+	e := &parquetEncoder{columns: s.columns(), names: map[string]string{}}
+
+	pw, err := writer.NewJSONWriterFromWriter(compileParquetSchema(s, e.names), w, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	pw.RowGroupSize = parquetRowGroupSize
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	if gzipOutput {
+		pw.CompressionType = parquet.CompressionCodec_GZIP
+	}
+	e.pw = pw
+
+	return e, nil
+}
+
+func compileParquetSchema(s schema, names map[string]string) string {
+	fields := []string{
+		fmt.Sprintf(`{"Tag":"name=%s, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=REQUIRED"}`, timestampColumn),
+	}
+
+	// sanitized names of different columns can be the same, later columns get a numbered suffix
+	taken := map[string]bool{timestampColumn: true}
+	for _, column := range s.columns() {
+		name := sanitizeParquetName(column)
+		for i := 2; taken[name]; i++ {
+			name = fmt.Sprintf("%s_%d", sanitizeParquetName(column), i)
+		}
+		taken[name] = true
+		names[column] = name
+
+		if s[column] == kindTag {
+			fields = append(fields, fmt.Sprintf(`{"Tag":"name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"}`, name))
+		} else {
+			fields = append(fields, fmt.Sprintf(`{"Tag":"name=%s, type=DOUBLE, repetitiontype=OPTIONAL"}`, name))
+		}
+	}
+
+	return fmt.Sprintf(`{"Tag":"name=metrics, repetitiontype=REQUIRED","Fields":[%s]}`, strings.Join(fields, ","))
+}
+
+// sanitizeParquetName maps a name onto [a-zA-Z0-9_] as the schema tags cannot escape separators
+func sanitizeParquetName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+
+		return '_'
+	}, name)
+}
+
+func (e *parquetEncoder) encode(point models.TimeBasedMetrics) error {
+	row := map[string]interface{}{
+		timestampColumn: point.Timestamp.UnixMilli(),
+	}
+
+	for _, column := range e.columns {
+		if val, ok := point.Metrics[column]; ok {
+			row[e.names[column]] = val
+		} else if val, ok := point.Tags[column]; ok {
+			row[e.names[column]] = val
+		}
+	}
+
+	rowJSON, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+
+	return e.pw.Write(string(rowJSON))
+}
+
+func (e *parquetEncoder) close() error {
+	return e.pw.WriteStop()
+}
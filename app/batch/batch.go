@@ -0,0 +1,111 @@
+package batch
+
+import (
+	"context"
+	"taos-adapter/models"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Consume groups points read from in into batches of up to size points and hands them to flush.
+// A partial batch is flushed once interval passes without it filling up. Whatever is buffered
+// is flushed before returning, which happens when in is closed or ctx is done.
+func Consume(ctx context.Context, in <-chan models.TimeBasedMetrics, size int, interval time.Duration, flush func([]models.TimeBasedMetrics)) {
+	if size < 1 {
+		size = 1
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	buf := make([]models.TimeBasedMetrics, 0, size)
+	flushBuf := func() {
+		if len(buf) == 0 {
+			return
+		}
+
+		flush(buf)
+		buf = make([]models.TimeBasedMetrics, 0, size)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushBuf()
+			return
+		case <-ticker.C:
+			flushBuf()
+		case m, ok := <-in:
+			if !ok {
+				flushBuf()
+				return
+			}
+
+			buf = append(buf, m)
+			if len(buf) >= size {
+				flushBuf()
+			}
+		}
+	}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (p permanentError) Error() string {
+	return p.err.Error()
+}
+
+func (p permanentError) Cause() error {
+	return p.err
+}
+
+// Permanent marks err as not worth retrying, Retry returns it straight away.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return permanentError{err: err}
+}
+
+// IsPermanent reports whether err was marked with Permanent.
+func IsPermanent(err error) bool {
+	_, ok := err.(permanentError)
+
+	return ok
+}
+
+// Retry calls fn up to attempts times, doubling the wait between attempts starting from backoff.
+// It stops early when fn succeeds, returns an error wrapped with Permanent or ctx is done.
+func Retry(ctx context.Context, attempts int, backoff time.Duration, fn func() error) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+
+		if p, ok := err.(permanentError); ok {
+			return p.err
+		}
+
+		if i == attempts-1 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(err, "retry aborted")
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return errors.Wrapf(err, "giving up after %d attempts", attempts)
+}
@@ -0,0 +1,132 @@
+package batch
+
+import (
+	"context"
+	"taos-adapter/models"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestConsume(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name            string
+		points          int
+		size            int
+		expectedBatches []int
+	}{
+		{
+			name:            "Success: Full batches",
+			points:          6,
+			size:            3,
+			expectedBatches: []int{3, 3},
+		},
+		{
+			name:            "Success: Partial batch flushed on close",
+			points:          5,
+			size:            3,
+			expectedBatches: []int{3, 2},
+		},
+		{
+			name:            "Success: No points",
+			points:          0,
+			size:            3,
+			expectedBatches: []int{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		in := make(chan models.TimeBasedMetrics, c.points)
+		for i := 0; i < c.points; i++ {
+			in <- models.TimeBasedMetrics{}
+		}
+		close(in)
+
+		batches := []int{}
+		Consume(context.Background(), in, c.size, time.Hour, func(points []models.TimeBasedMetrics) {
+			batches = append(batches, len(points))
+		})
+
+		if len(batches) != len(c.expectedBatches) {
+			t.Fatalf("expected no. of batches %d, got %d", len(c.expectedBatches), len(batches))
+		}
+
+		for i := range batches {
+			if batches[i] != c.expectedBatches[i] {
+				t.Errorf("expected batch %d size %d, got %d", i, c.expectedBatches[i], batches[i])
+			}
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name          string
+		failures      int
+		permanent     bool
+		attempts      int
+		expectedCalls int
+		expectedError bool
+	}{
+		{
+			name:          "Success: First attempt",
+			failures:      0,
+			attempts:      3,
+			expectedCalls: 1,
+		},
+		{
+			name:          "Success: After retries",
+			failures:      2,
+			attempts:      3,
+			expectedCalls: 3,
+		},
+		{
+			name:          "Failure: Attempts exhausted",
+			failures:      5,
+			attempts:      3,
+			expectedCalls: 3,
+			expectedError: true,
+		},
+		{
+			name:          "Failure: Permanent error",
+			failures:      5,
+			permanent:     true,
+			attempts:      3,
+			expectedCalls: 1,
+			expectedError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		calls := 0
+		err := Retry(context.Background(), c.attempts, time.Millisecond, func() error {
+			calls++
+			if calls > c.failures {
+				return nil
+			}
+
+			if c.permanent {
+				return Permanent(errors.New("permanent failure"))
+			}
+
+			return errors.New("temporary failure")
+		})
+
+		if (err != nil) != c.expectedError {
+			t.Errorf("expected error: %t, got: %v", c.expectedError, err)
+		}
+
+		if calls != c.expectedCalls {
+			t.Errorf("expected calls: %d, got: %d", c.expectedCalls, calls)
+		}
+	}
+}
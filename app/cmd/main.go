@@ -7,40 +7,60 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"reflect"
 	"strings"
 	"sync"
 	"syscall"
+	"taos-adapter/admin"
+	"taos-adapter/alert"
+	"taos-adapter/archive"
+	"taos-adapter/config"
 	"taos-adapter/db"
+	"taos-adapter/fanout"
+	"taos-adapter/graphite"
+	"taos-adapter/health"
+	"taos-adapter/httpwrite"
 	"taos-adapter/models"
 	"taos-adapter/mqtt"
+	"taos-adapter/pgsql"
+	"taos-adapter/pipeline"
+	"taos-adapter/query"
+	"taos-adapter/queue"
+	"taos-adapter/remotewrite"
+	"taos-adapter/telemetry"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
-var serverPort string
-
 const (
-	envServerPort   = "SERVER_PORT"
-	envTDDBPort     = "TDENGINE_PORT"
-	envTDDBHost     = "TDENGINE_HOST"
-	envTDDBUser     = "TDENGINE_USER"
-	envTDDBPass     = "TDENGINE_PASS"
-	envTDDBName     = "TDENGINE_DBNAME"
-	envMQTTPort     = "MQTT_PORT"
-	envMQTTHost     = "MQTT_HOST"
-	envMQTTSubTopic = "MQTT_SUB_TOPIC"
-	envMQTTSubQos   = "MQTT_SUB_QOS"
-	envMQTTClientID = "MQTT_CLIENT_ID"
-	envMQTTUser     = "MQTT_USER"
-	envMQTTPass     = "MQTT_PASS"
+	// configReloadInterval is how often the config files are checked for changes
+	configReloadInterval = 5 * time.Second
+	// serverShutdownTimeout bounds waiting for open requests once the sinks are done
+	serverShutdownTimeout = 5 * time.Second
+	// tdenginePingInterval is how long the readiness check reuses a ping of a TDengine sink
+	tdenginePingInterval = 10 * time.Second
+	// tdenginePingTimeout fails a ping that has not returned by then
+	tdenginePingTimeout = 2 * time.Second
 )
 
+var serverConfig config.ServerConfig
+var configPath string
+
+// reloadMu serializes reloads started by SIGHUP, a file change or the admin API, it guards current
+var reloadMu sync.Mutex
+var current *config.Config
+var sinks []*fanout.Sink
+var ingestQueue *queue.Queue
+
 func init() {
 	envFileFlag := flag.String("env-file", "", "env file to read")
+	configFlag := flag.String("config", "", "YAML or TOML config file, env vars override its settings")
 	flag.Parse()
 
 	if envFileFlag != nil && *envFileFlag != "" {
@@ -49,114 +69,136 @@ func init() {
 		}
 	}
 
-	missingParams := []string{}
-	if serverPort = os.Getenv(envServerPort); serverPort == "" {
-		missingParams = append(missingParams, envServerPort)
-	}
-
-	// check TDEngine env vars
-
-	tddbPortStr := os.Getenv(envTDDBPort)
-	var tddbPort int64 = 6030
-	if tddbPortStr != "" {
-		var err error
-		tddbPort, err = strconv.ParseInt(tddbPortStr, 10, 64)
-
-		if err != nil {
-			panic(errors.Wrapf(err, "failed to read %s variable", envTDDBPort))
-		}
+	configPath = *configFlag
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		panic(err)
 	}
 
-	tddbHost := os.Getenv(envTDDBHost)
-	if tddbHost == "" {
-		missingParams = append(missingParams, envTDDBHost)
+	if err := apply(cfg); err != nil {
+		panic(err)
 	}
+}
 
-	tddbUser := os.Getenv(envTDDBUser)
-	if tddbUser == "" {
-		missingParams = append(missingParams, envTDDBUser)
-	}
+/* apply hands the validated configuration to the packages and builds the sinks */
+func apply(cfg *config.Config) error {
+	serverConfig = cfg.Server
+	current = cfg
 
-	tddbPass := os.Getenv(envTDDBPass)
-	if tddbPass == "" {
-		missingParams = append(missingParams, envTDDBPass)
-	}
+	mqtt.SetMQTTVars(cfg.MQTT.Port, *cfg.MQTT.SubQos, cfg.MQTT.Host, cfg.MQTT.User, cfg.MQTT.Pass, cfg.MQTT.ClientID, cfg.MQTT.Topics())
+	mqtt.SetProtobuf(cfg.Protobuf.Registry())
+	mqtt.SetSparkplug(cfg.Sparkplug.StringTags)
+	mqtt.SetParsers(cfg.MQTT.Parsers())
 
-	tddbName := os.Getenv(envTDDBName)
-	if tddbName == "" {
-		missingParams = append(missingParams, envTDDBName)
+	ingestQueue = &queue.Queue{
+		Size:     cfg.Ingest.QueueSize,
+		Policy:   cfg.Ingest.OnFull,
+		SpillDir: cfg.Ingest.SpillDir,
 	}
 
-	// check MQTT env vars
-	mqttPortStr := os.Getenv(envMQTTPort)
-	var mqttPort int64 = 1883
-	if mqttPortStr != "" {
-		var err error
-		mqttPort, err = strconv.ParseInt(mqttPortStr, 10, 64)
-
-		if err != nil {
-			panic(errors.Wrapf(err, "failed to read %s variable", envMQTTPort))
+	if cfg.Pipeline != nil {
+		if err := pipeline.Apply(*cfg.Pipeline); err != nil {
+			return errors.Wrap(err, "invalid pipeline config")
 		}
 	}
 
-	mqttHost := os.Getenv(envMQTTHost)
-	if mqttHost == "" {
-		missingParams = append(missingParams, envMQTTHost)
+	if err := alert.Apply(alert.Config{Rules: cfg.Alerts.Rules}); err != nil {
+		return errors.Wrap(err, "invalid alert rules")
 	}
 
-	mqttUser := os.Getenv(envMQTTUser)
-	if mqttUser == "" {
-		missingParams = append(missingParams, envMQTTUser)
-	}
+	sinks = buildSinks(cfg)
 
-	mqttPass := os.Getenv(envMQTTPass)
-	if mqttPass == "" {
-		missingParams = append(missingParams, envMQTTPass)
-	}
-
-	mqttClientID := os.Getenv(envMQTTClientID)
-	if mqttClientID == "" {
-		missingParams = append(missingParams, envMQTTClientID)
-	}
-
-	mqttSubTopic := os.Getenv(envMQTTSubTopic)
-	if mqttSubTopic == "" {
-		missingParams = append(missingParams, envMQTTSubTopic)
-	}
+	return nil
+}
 
-	var mqttSubQos int64 = 1
-	mqttSubQosStr := os.Getenv(envMQTTSubQos)
-	if mqttSubQosStr == "" {
-		missingParams = append(missingParams, envMQTTSubQos)
-	} else {
-		var err error
-		mqttSubQos, err = strconv.ParseInt(mqttSubQosStr, 10, 64)
-		if err != nil {
-			panic(err)
+// buildSinks creates the sinks of cfg, each with settings of its own. A reload builds the next sinks while the
+// current ones are still running.
+func buildSinks(cfg *config.Config) []*fanout.Sink {
+	var built []*fanout.Sink
+	for _, sinkConfig := range cfg.Sinks {
+		var write fanout.WriteFunc
+		var settings interface{}
+		switch sinkConfig.Type {
+		case config.SinkTDengine:
+			c := *sinkConfig.TDengine
+			settings = c
+			write = (&db.Sink{Name: sinkConfig.Name, Host: c.Host, Port: c.Port, User: c.User, Pass: c.Pass, DBName: c.DBName,
+				BatchSize: c.BatchSize, FlushInterval: c.FlushInterval}).InsertDatad
+		case config.SinkRemoteWrite:
+			c := *sinkConfig.RemoteWrite
+			settings = c
+			write = (&remotewrite.Sink{Name: sinkConfig.Name, URL: c.URL, User: c.User, Pass: c.Pass, Tenant: c.Tenant,
+				BatchSize: c.BatchSize, FlushInterval: c.FlushInterval, MaxRetries: *c.MaxRetries, Timeout: c.Timeout}).RemoteWrite
+		case config.SinkGraphite:
+			c := *sinkConfig.Graphite
+			settings = c
+			write = (&graphite.Sink{Name: sinkConfig.Name, Addr: c.Addr, Protocol: c.Protocol, Tagged: c.Tagged, PathTemplate: c.PathTemplate,
+				BatchSize: c.BatchSize, FlushInterval: c.FlushInterval, MaxRetries: *c.MaxRetries, Timeout: c.Timeout}).Send
+		case config.SinkPostgres:
+			c := *sinkConfig.Postgres
+			settings = c
+			write = (&pgsql.Sink{Name: sinkConfig.Name, DSN: c.DSN, Layout: c.Layout, ChunkInterval: c.ChunkInterval,
+				BatchSize: c.BatchSize, FlushInterval: c.FlushInterval, MaxRetries: *c.MaxRetries}).Insert
+		case config.SinkArchive:
+			c := *sinkConfig.Archive
+			settings = c
+			write = (&archive.Sink{Name: sinkConfig.Name, Dir: c.Dir, Format: c.Format, Gzip: c.Gzip, MaxSize: c.MaxSize, MaxAge: c.MaxAge,
+				BatchSize: c.BatchSize, FlushInterval: c.FlushInterval}).Write
 		}
-	}
 
-	if len(missingParams) > 0 {
-		panic(fmt.Sprintf("missing required env variables: %s", strings.Join(missingParams, ", ")))
+		built = append(built, newSink(sinkConfig.Name, sinkConfig.Type, write, settings, sinkConfig.QueueConfig))
 	}
 
-	db.SetDBVars(int(tddbPort), tddbHost, tddbUser, tddbPass, tddbName)
+	// alert rules run next to the sinks, with a dropping queue so they never hold back ingestion
+	if cfg.Alerts.Enabled() {
+		c := cfg.Alerts
+		clientID := cfg.MQTT.ClientID + "-alerts"
+		write := (&alert.Sink{Topic: c.Topic, ClientID: clientID, WebhookURL: c.WebhookURL, Timeout: c.Timeout, MaxRetries: *c.MaxRetries}).Evaluate
+
+		// the rules are applied with the config, so changing them does not restart the sink
+		c.Rules = nil
+		built = append(built, newSink(config.SinkAlert, config.SinkAlert, write, struct {
+			config.AlertsConfig
+			ClientID string
+		}{c, clientID}, c.QueueConfig))
+	}
 
-	mqtt.SetMQTTVars(int(mqttPort), int(mqttSubQos), mqttHost, mqttUser, mqttPass, mqttClientID, mqttSubTopic)
+	return built
 }
 
-var connLive bool
+func newSink(name, sinkType string, write fanout.WriteFunc, settings interface{}, c config.QueueConfig) *fanout.Sink {
+	return &fanout.Sink{
+		Name:      name,
+		Type:      sinkType,
+		Write:     write,
+		QueueSize: c.QueueSize,
+		Topics:    c.Topics,
+		OnFull:    c.OnFull,
+		OnError:   c.OnError,
+		Settings:  settings,
+	}
+}
 
 func main() {
-	// @todo add signals
 	r := gin.Default()
+	// ctx stops the MQTT subscription and marks the adapter as shutting down. The later stages run on drainCtx
+	// and stop once their input is closed, so the points in flight are written before exiting.
 	ctx, cancel := context.WithCancel(context.Background())
+	drainCtx, cancelDrain := context.WithCancel(context.Background())
+	defer cancelDrain()
 
 	log := logrus.New()
 
 	tbMetrics := make(chan models.TimeBasedMetrics, 10)
+	processedMetrics := make(chan models.TimeBasedMetrics, 10)
+	queuedMetrics := make(chan models.TimeBasedMetrics, 10)
+
+	registerMetrics(tbMetrics, processedMetrics, queuedMetrics)
+	registerHealth()
+	registerSinks(nil, sinks)
 
-	errChan := make(chan error)
+	// buffered so a stage failing while shutting down does not block on it
+	errChan := make(chan error, 5)
 
 	var wg sync.WaitGroup
 
@@ -164,9 +206,33 @@ func main() {
 
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	hupChan := make(chan os.Signal, 1)
+
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	sinkUpdates := make(chan []*fanout.Sink)
+	sinksDone := make(chan struct{})
+
+	// points written over HTTP join the ones received over MQTT
+	writeEndpoint := &httpwrite.Endpoint{Token: serverConfig.WriteToken, Databases: serverConfig.WriteDatabases, MaxBodySize: serverConfig.MaxWriteSize, Out: tbMetrics}
+
+	// query settings require a restart, so the API keeps the ones read at startup
+	var queryAPI *query.API
+	if current.Query.Enabled() {
+		q, c := current.Query, current.TDengine
+		queryAPI = &query.API{Clients: q.Clients, MaxRows: q.MaxRows, MaxRange: q.MaxRange, DefaultRange: q.DefaultRange,
+			Query: func(statement string, args ...interface{}) ([]string, [][]interface{}, error) {
+				return db.Query(c.Host, c.Port, c.User, c.Pass, statement, args...)
+			}}
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		// nothing is received after Sub returns and the write endpoint stopped, closing tbMetrics then drains the
+		// stages one after the other
+		defer close(tbMetrics)
+		defer writeEndpoint.Stop()
 		log.Info("starting mqtt")
 		defer log.Info("exiting mqtt")
 		logEntry := logrus.NewEntry(log).WithField("stage", "mqtt")
@@ -180,24 +246,87 @@ func main() {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		log.Info("starting tdengine")
-		defer log.Info("exiting tdengine")
-		logEntry := logrus.NewEntry(log).WithField("stage", "db")
-		err := db.InsertDatad(ctx, logEntry, tbMetrics)
+		defer discard(tbMetrics)
+		log.Info("starting pipeline")
+		defer log.Info("exiting pipeline")
+		logEntry := logrus.NewEntry(log).WithField("stage", "pipeline")
+		err := pipeline.Run(drainCtx, logEntry, tbMetrics, processedMetrics)
 		if err != nil {
-			log.Error(errors.Wrap(err, "exiting tdengine coroutine"))
+			log.Error(errors.Wrap(err, "exiting pipeline coroutine"))
 			errChan <- err
 		}
 	}()
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer discard(processedMetrics)
+		log.Info("starting ingest queue")
+		defer log.Info("exiting ingest queue")
+		logEntry := logrus.NewEntry(log).WithField("stage", "queue")
+		err := ingestQueue.Run(drainCtx, logEntry, processedMetrics, queuedMetrics)
+		if err != nil {
+			log.Error(errors.Wrap(err, "exiting ingest queue coroutine"))
+			errChan <- err
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer discard(queuedMetrics)
+		defer close(sinksDone)
+		log.Info("starting sinks")
+		defer log.Info("exiting sinks")
+		logEntry := logrus.NewEntry(log).WithField("stage", "sinks")
+		err := fanout.Run(drainCtx, logEntry, queuedMetrics, sinks, sinkUpdates)
+		if err != nil {
+			log.Error(errors.Wrap(err, "exiting sinks coroutine"))
+			errChan <- err
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		log.Info("starting config watcher")
+		defer log.Info("exiting config watcher")
+		logEntry := logrus.NewEntry(log).WithField("stage", "reload")
+		watchConfig(ctx, logEntry, hupChan, sinkUpdates)
+	}()
+
+	r.GET("/livez", livezHandler(ctx))
+	r.GET("/readyz", readyzHandler(ctx))
+	r.GET("/status", statusHandler)
+	r.GET("/queues", queuesHandler)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	if serverConfig.AdminToken != "" {
+		logEntry := logrus.NewEntry(log).WithField("stage", "admin")
+		api := &admin.API{Token: serverConfig.AdminToken, Path: configPath, Reload: func() error {
+			return reload(ctx, logEntry, sinkUpdates)
+		}}
+		api.Register(r)
+	}
+	if serverConfig.WriteToken != "" {
+		writeEndpoint.Register(r)
+	}
+	if queryAPI != nil {
+		queryAPI.Register(r)
+	}
+	server := &http.Server{Addr: fmt.Sprintf(":%s", serverConfig.Port), Handler: r}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		log.Info("starting status handler")
 		defer log.Info("exiting status handler")
-		r.GET("/status", k8sProbeHandler)
-		err := r.Run(fmt.Sprintf(":%s", serverPort))
-		if err != nil {
+		var err error
+		if serverConfig.TLSCert != "" {
+			err = server.ListenAndServeTLS(serverConfig.TLSCert, serverConfig.TLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Error(errors.Wrap(err, "exiting server coroutine"))
 			errChan <- err
 		}
@@ -207,18 +336,306 @@ func main() {
 	go func() {
 		defer wg.Done()
 		select {
-		case <-sigChan:
-			cancel()
+		case sig := <-sigChan:
+			log.Infof("received %s, shutting down", sig)
 		case <-errChan:
-			cancel()
-		case <-ctx.Done():
-			return
+			log.Info("shutting down after an error")
 		}
+
+		shutdown(log, cancel, cancelDrain, sigChan, sinksDone, server)
 	}()
 
 	wg.Wait()
 }
 
-func k8sProbeHandler(ctx *gin.Context) {
-	ctx.String(http.StatusOK, "")
+// shutdown stops the adapter in order: the MQTT subscription first, then the pipeline, the ingest queue and the
+// sinks drain and flush what they hold, giving up after the shutdown timeout or on a second signal. The HTTP
+// server goes last so the probes report the shutdown until the end.
+func shutdown(log *logrus.Logger, cancel, cancelDrain context.CancelFunc, sigChan chan os.Signal, sinksDone chan struct{}, server *http.Server) {
+	cancel()
+
+	timer := time.NewTimer(serverConfig.ShutdownTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-sinksDone:
+		log.Info("queues drained and sinks flushed")
+	case <-timer.C:
+		log.Warnf("queues not drained after %s, dropping the remaining points", serverConfig.ShutdownTimeout)
+	case sig := <-sigChan:
+		log.Warnf("received %s again, dropping the remaining points", sig)
+	}
+	// a spilling ingest queue writes the points it still holds to its spill file
+	cancelDrain()
+
+	serverCtx, cancelServer := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancelServer()
+
+	if err := server.Shutdown(serverCtx); err != nil {
+		log.Error(errors.Wrap(err, "failed to shut down server"))
+	}
+}
+
+/* discard empties a channel until it is closed, so the stage writing to it can stop when its reader stopped early */
+func discard(tbMetrics chan models.TimeBasedMetrics) {
+	for range tbMetrics {
+	}
+}
+
+// watchConfig reloads the config on SIGHUP and whenever the config, pipeline or rules file changes
+func watchConfig(ctx context.Context, log *logrus.Entry, hupChan chan os.Signal, sinkUpdates chan []*fanout.Sink) {
+	ticker := time.NewTicker(configReloadInterval)
+	defer ticker.Stop()
+
+	stamp := configStamp()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hupChan:
+			log.Info("reloading config on SIGHUP")
+		case <-ticker.C:
+			if configStamp() == stamp {
+				continue
+			}
+			log.Info("config files changed, reloading config")
+		}
+
+		if err := reload(ctx, log, sinkUpdates); err != nil {
+			log.Error(err)
+		}
+		// a config that failed to load is not retried until its files change again
+		stamp = configStamp()
+	}
+}
+
+/* configStamp identifies the files of the current config by their size and modification time */
+func configStamp() string {
+	reloadMu.Lock()
+	cfg := current
+	reloadMu.Unlock()
+
+	stamp := ""
+	paths := append([]string{configPath, cfg.PipelineFile, cfg.Alerts.RulesFile}, cfg.Protobuf.DescriptorSets...)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			stamp += path + ": missing;"
+			continue
+		}
+		stamp += fmt.Sprintf("%s: %d %d;", path, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return stamp
+}
+
+// reload applies a new config without dropping points: MQTT subscriptions are added and removed on the open
+// connection, the pipeline keeps the state of unchanged subscriptions and unchanged sinks keep their queue.
+// A config that fails to load or validate leaves the current one running.
+func reload(ctx context.Context, log *logrus.Entry, sinkUpdates chan []*fanout.Sink) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	next, err := config.Load(configPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to reload config, keeping the current one")
+	}
+
+	for _, section := range current.RestartRequired(next) {
+		log.Warnf("%s settings changed, they are applied on the next restart", section)
+	}
+
+	pipelineConfig := pipeline.Config{}
+	if next.Pipeline != nil {
+		pipelineConfig = *next.Pipeline
+	}
+	if err := pipeline.Apply(pipelineConfig); err != nil {
+		return errors.Wrap(err, "failed to reload pipeline config, keeping the current one")
+	}
+
+	// rules that did not change keep the state of their series
+	if err := alert.Apply(alert.Config{Rules: next.Alerts.Rules}); err != nil {
+		return errors.Wrap(err, "failed to reload alert rules, keeping the current ones")
+	}
+
+	mqtt.SetProtobuf(next.Protobuf.Registry())
+	mqtt.SetSparkplug(next.Sparkplug.StringTags)
+	mqtt.SetParsers(next.MQTT.Parsers())
+	subErr := mqtt.UpdateSubscriptions(ctx, log, next.MQTT.Topics())
+
+	prev := fanout.Active()
+	nextSinks := buildSinks(next)
+	select {
+	case sinkUpdates <- nextSinks:
+	case <-ctx.Done():
+		return errors.New("shutting down")
+	}
+	registerSinks(prev, nextSinks)
+
+	current = next
+	if subErr != nil {
+		return errors.Wrap(subErr, "config reloaded, but failed to update mqtt subscriptions")
+	}
+
+	log.Info("config reloaded")
+	return nil
+}
+
+// registerMetrics exposes the channels between the stages, the queues and the drop counters on /metrics
+func registerMetrics(tbMetrics, processedMetrics, queuedMetrics chan models.TimeBasedMetrics) {
+	telemetry.RegisterQueue("tbMetrics", func() int { return len(tbMetrics) })
+	telemetry.RegisterQueue("processedMetrics", func() int { return len(processedMetrics) })
+	telemetry.RegisterQueue("queuedMetrics", func() int { return len(queuedMetrics) })
+	telemetry.RegisterQueue("ingest", func() int { return int(ingestQueue.Depth()) })
+	telemetry.RegisterQueue("ingest_spill", func() int { return int(ingestQueue.Spilled()) })
+
+	telemetry.RegisterCounterMap(prometheus.DefaultRegisterer, "queue_dropped_total", "Points dropped because a queue was full.", "queue", func() map[string]uint64 {
+		dropped := map[string]uint64{"ingest": ingestQueue.Dropped()}
+		for _, sink := range fanout.Active() {
+			dropped["sink_"+sink.Name] = sink.Dropped()
+		}
+		return dropped
+	})
+	telemetry.RegisterCounterMap(prometheus.DefaultRegisterer, "duplicates_dropped_total", "Points dropped by deduplication per subscription.", "subscription", pipeline.DroppedDuplicates)
+	telemetry.RegisterCounterMap(prometheus.DefaultRegisterer, "schema_violations_total", "Points failing schema validation per subscription.", "subscription", pipeline.SchemaViolations)
+	telemetry.RegisterCounterMap(prometheus.DefaultRegisterer, "cardinality_violations_total", "Points exceeding cardinality limits per subscription.", "subscription", pipeline.CardinalityViolations)
+	telemetry.RegisterCounterMap(prometheus.DefaultRegisterer, "rate_limited_total", "Points dropped by rate limits per limit.", "limit", pipeline.RateLimited)
+}
+
+// registerHealth sets up the components readiness depends on: the MQTT subscription and the buffers which must
+// not be full for a blocking queue. TDengine sinks are added by registerSinks.
+func registerHealth() {
+	health.Register("mqtt", true)
+
+	health.RegisterCheck("buffers", true, func() error {
+		inMemory := ingestQueue.Depth() - ingestQueue.Spilled()
+		if ingestQueue.Policy == queue.PolicyBlock && inMemory >= int64(ingestQueue.Size) {
+			return fmt.Errorf("ingest queue full: %d/%d", inMemory, ingestQueue.Size)
+		}
+
+		for _, sink := range fanout.Active() {
+			if sink.OnFull == fanout.OnFullBlock && sink.Depth() >= sink.QueueSize {
+				return fmt.Errorf("sink %s queue full: %d/%d", sink.Name, sink.Depth(), sink.QueueSize)
+			}
+		}
+
+		return nil
+	})
+}
+
+// registerSinks exposes the queue of every sink in next and makes the TDengine sinks critical, with a ping of the
+// server as readiness check, dropping what was registered for the sinks of prev that are gone
+func registerSinks(prev, next []*fanout.Sink) {
+	names := map[string]bool{}
+	for _, sink := range next {
+		names[sink.Name] = true
+	}
+
+	// a kept TDengine sink keeps its health state and check
+	tdengine := map[string]*fanout.Sink{}
+	for _, sink := range prev {
+		if !names[sink.Name] {
+			telemetry.UnregisterQueue("sink_" + sink.Name)
+		}
+		if sink.Type == config.SinkTDengine {
+			tdengine[sink.Name] = sink
+		}
+	}
+
+	for _, sink := range next {
+		name := sink.Name
+		// a changed sink is a new instance, so the depth is looked up in the running sinks
+		telemetry.RegisterQueue("sink_"+name, func() int {
+			for _, sink := range fanout.Active() {
+				if sink.Name == name {
+					return sink.Depth()
+				}
+			}
+			return 0
+		})
+
+		if sink.Type != config.SinkTDengine {
+			continue
+		}
+		if kept, ok := tdengine[name]; !ok || !reflect.DeepEqual(kept.Settings, sink.Settings) {
+			c := sink.Settings.(config.TDengineConfig)
+			health.RegisterCheck(name, true, health.Cached(func() error {
+				return db.Ping(c.Host, c.Port, c.User, c.Pass)
+			}, tdenginePingInterval, tdenginePingTimeout))
+		}
+		delete(tdengine, name)
+	}
+
+	// tdengine now only holds the TDengine sinks that are gone
+	for name := range tdengine {
+		health.Unregister(name)
+	}
+}
+
+// livezHandler fails once the adapter is shutting down, otherwise a response means the process is alive
+func livezHandler(appCtx context.Context) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if appCtx.Err() != nil {
+			ctx.String(http.StatusServiceUnavailable, "shutting down")
+			return
+		}
+
+		ctx.String(http.StatusOK, "ok")
+	}
+}
+
+// readyzHandler fails while shutting down or while a critical component is unhealthy
+func readyzHandler(appCtx context.Context) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if appCtx.Err() != nil {
+			ctx.String(http.StatusServiceUnavailable, "shutting down")
+			return
+		}
+
+		ready, status := health.Status()
+		if !ready {
+			ctx.String(http.StatusServiceUnavailable, "not ready: %s", strings.Join(health.Unhealthy(status), ", "))
+			return
+		}
+
+		ctx.String(http.StatusOK, "ok")
+	}
+}
+
+// statusHandler reports every component with its last error, it always returns 200 so it can be scraped
+func statusHandler(ctx *gin.Context) {
+	ready, status := health.Status()
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"ready":      ready,
+		"components": status,
+	})
+}
+
+// queuesHandler reports the depth and drops of the ingest queue and of every sink queue
+func queuesHandler(ctx *gin.Context) {
+	sinkQueues := gin.H{}
+	for _, sink := range fanout.Active() {
+		sinkQueues[sink.Name] = gin.H{
+			"depth":   sink.Depth(),
+			"size":    sink.QueueSize,
+			"dropped": sink.Dropped(),
+		}
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"ingest": gin.H{
+			"depth":   ingestQueue.Depth(),
+			"size":    ingestQueue.Size,
+			"policy":  ingestQueue.Policy,
+			"spilled": ingestQueue.Spilled(),
+			"dropped": ingestQueue.Dropped(),
+		},
+		"sinks":        sinkQueues,
+		"rate_limited": pipeline.RateLimited(),
+	})
 }
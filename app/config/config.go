@@ -0,0 +1,558 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"taos-adapter/alert"
+	"taos-adapter/mqtt"
+	"taos-adapter/pipeline"
+	"taos-adapter/protobuf"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	SinkTDengine    = "tdengine"
+	SinkRemoteWrite = "remotewrite"
+	SinkGraphite    = "graphite"
+	SinkPostgres    = "postgres"
+	SinkArchive     = "archive"
+	SinkAlert       = "alert"
+
+	envSink = "SINK"
+)
+
+// SinkEnvPrefixes prefix the env vars overriding the queue settings of each sink type, e.g. GRAPHITE_QUEUE_SIZE
+var SinkEnvPrefixes = map[string]string{
+	SinkTDengine:    "TDENGINE_",
+	SinkRemoteWrite: "REMOTE_WRITE_",
+	SinkGraphite:    "GRAPHITE_",
+	SinkPostgres:    "POSTGRES_",
+	SinkArchive:     "ARCHIVE_",
+	SinkAlert:       "ALERT_",
+}
+
+// Config is the adapter configuration file. Fields tagged with env are overridden by that env var when it is
+// set, so a deployment can keep secrets out of the file or run from env vars alone as before.
+type Config struct {
+	Server      ServerConfig      `yaml:"server"`
+	MQTT        MQTTConfig        `yaml:"mqtt"`
+	Sinks       []SinkConfig      `yaml:"sinks"`
+	Ingest      IngestConfig      `yaml:"ingest"`
+	TDengine    TDengineConfig    `yaml:"tdengine"`
+	RemoteWrite RemoteWriteConfig `yaml:"remote_write"`
+	Graphite    GraphiteConfig    `yaml:"graphite"`
+	Postgres    PostgresConfig    `yaml:"postgres"`
+	Archive     ArchiveConfig     `yaml:"archive"`
+	Alerts      AlertsConfig      `yaml:"alerts"`
+	Query       QueryConfig       `yaml:"query"`
+	Protobuf    ProtobufConfig    `yaml:"protobuf"`
+	Sparkplug   SparkplugConfig   `yaml:"sparkplug"`
+
+	// the pipeline is configured inline or in its own file
+	Pipeline     *pipeline.Config `yaml:"pipeline,omitempty"`
+	PipelineFile string           `yaml:"pipeline_file,omitempty" env:"PIPELINE_CONFIG"`
+}
+
+type ServerConfig struct {
+	Port string `yaml:"port" env:"SERVER_PORT"`
+
+	// serve HTTPS instead of HTTP when both are set
+	TLSCert string `yaml:"tls_cert,omitempty" env:"SERVER_TLS_CERT"`
+	TLSKey  string `yaml:"tls_key,omitempty" env:"SERVER_TLS_KEY"`
+
+	// enables POST /write/<db>/<table>, requests must send it as a bearer token
+	WriteToken     string   `yaml:"write_token,omitempty" env:"WRITE_TOKEN"`
+	WriteDatabases []string `yaml:"write_databases" env:"WRITE_DATABASES"` // databases the write token may write to, * for any
+	MaxWriteSize   int64    `yaml:"max_write_size" env:"WRITE_MAX_SIZE"`   // request body limit in bytes
+
+	// enables the admin API, requests must send it as a bearer token
+	AdminToken string `yaml:"admin_token,omitempty" env:"ADMIN_TOKEN"`
+
+	// how long a shutdown waits for buffered points to be written before giving up on them
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+type MQTTConfig struct {
+	Host     string `yaml:"host" env:"MQTT_HOST"`
+	Port     int    `yaml:"port" env:"MQTT_PORT"`
+	User     string `yaml:"user" env:"MQTT_USER"`
+	Pass     string `yaml:"pass" env:"MQTT_PASS"`
+	ClientID string `yaml:"client_id" env:"MQTT_CLIENT_ID"`
+	SubTopic string `yaml:"sub_topic" env:"MQTT_SUB_TOPIC"`
+	SubQos   *int   `yaml:"sub_qos" env:"MQTT_SUB_QOS"`
+
+	// further subscriptions, unlike the connection settings they are changed by a reload or the admin API
+	Subscriptions []SubscriptionConfig `yaml:"subscriptions,omitempty"`
+}
+
+// SubscriptionConfig is an MQTT subscription with its own parser, which can be paused without removing it
+type SubscriptionConfig struct {
+	Name   string `yaml:"name" json:"name"`
+	Topic  string `yaml:"topic" json:"topic"`
+	Parser string `yaml:"parser,omitempty" json:"parser,omitempty"` // auto, json, csv, line, sparkplug or protobuf, auto when empty
+	Paused bool   `yaml:"paused,omitempty" json:"paused"`
+
+	// the protobuf message type of messages without one in their ContentType, selects the protobuf parser
+	Message string `yaml:"message,omitempty" json:"message,omitempty"`
+}
+
+// Topics returns sub_topic and the topics of the subscriptions that are not paused, without duplicates
+func (c MQTTConfig) Topics() []string {
+	topics := []string{}
+	seen := map[string]bool{}
+
+	candidates := []string{c.SubTopic}
+	for _, sub := range c.Subscriptions {
+		if !sub.Paused {
+			candidates = append(candidates, sub.Topic)
+		}
+	}
+
+	for _, topic := range candidates {
+		if topic != "" && !seen[topic] {
+			topics = append(topics, topic)
+			seen[topic] = true
+		}
+	}
+
+	return topics
+}
+
+// Parsers returns the parsers selected by the subscriptions
+func (c MQTTConfig) Parsers() []mqtt.TopicParser {
+	parsers := []mqtt.TopicParser{}
+	for _, sub := range c.Subscriptions {
+		parser := sub.Parser
+		if sub.Message != "" && (parser == "" || parser == mqtt.ParserAuto) {
+			parser = mqtt.ParserProtobuf
+		}
+
+		if parser != "" && parser != mqtt.ParserAuto {
+			parsers = append(parsers, mqtt.TopicParser{Filter: sub.Topic, Parser: parser, Message: sub.Message})
+		}
+	}
+
+	return parsers
+}
+
+// RestartRequired lists the sections of next that changed but are only read on startup
+func (c *Config) RestartRequired(next *Config) []string {
+	changed := []string{}
+
+	if !reflect.DeepEqual(c.Server, next.Server) {
+		changed = append(changed, "server")
+	}
+
+	connection, nextConnection := c.MQTT, next.MQTT
+	connection.SubTopic, connection.Subscriptions = "", nil
+	nextConnection.SubTopic, nextConnection.Subscriptions = "", nil
+	if !reflect.DeepEqual(connection, nextConnection) {
+		changed = append(changed, "mqtt")
+	}
+
+	if c.Ingest != next.Ingest {
+		changed = append(changed, "ingest")
+	}
+
+	if !reflect.DeepEqual(c.Query, next.Query) {
+		changed = append(changed, "query")
+	}
+
+	return changed
+}
+
+// QueueConfig are the fanout settings of a sink, the env vars are prefixed with the sink prefix
+type QueueConfig struct {
+	QueueSize int      `yaml:"queue_size,omitempty" env:"QUEUE_SIZE"`
+	Topics    []string `yaml:"topics,omitempty" env:"TOPICS"`
+	OnFull    string   `yaml:"on_full,omitempty" env:"ON_FULL"`
+	OnError   string   `yaml:"on_error,omitempty" env:"ON_ERROR"`
+}
+
+// SinkConfig enables a sink. Name tells sinks apart and defaults to the type. The settings of a sink are in the
+// section of its type within the sink, or in the top-level section of its type when it has none, so several sinks
+// of one type can each have their own settings while a single sink can still be set up with env vars alone. Load
+// fills in the section of the type of every sink.
+type SinkConfig struct {
+	Name        string `yaml:"name,omitempty"`
+	Type        string `yaml:"type"`
+	QueueConfig `yaml:",inline"`
+
+	TDengine    *TDengineConfig    `yaml:"tdengine,omitempty"`
+	RemoteWrite *RemoteWriteConfig `yaml:"remote_write,omitempty"`
+	Graphite    *GraphiteConfig    `yaml:"graphite,omitempty"`
+	Postgres    *PostgresConfig    `yaml:"postgres,omitempty"`
+	Archive     *ArchiveConfig     `yaml:"archive,omitempty"`
+}
+
+type IngestConfig struct {
+	QueueSize int    `yaml:"queue_size" env:"INGEST_QUEUE_SIZE"`
+	OnFull    string `yaml:"on_full" env:"INGEST_ON_FULL"`
+	SpillDir  string `yaml:"spill_dir" env:"INGEST_SPILL_DIR"`
+}
+
+type TDengineConfig struct {
+	Host          string        `yaml:"host" env:"TDENGINE_HOST"`
+	Port          int           `yaml:"port" env:"TDENGINE_PORT"`
+	User          string        `yaml:"user" env:"TDENGINE_USER"`
+	Pass          string        `yaml:"pass" env:"TDENGINE_PASS"`
+	DBName        string        `yaml:"dbname" env:"TDENGINE_DBNAME"`
+	BatchSize     int           `yaml:"batch_size" env:"TDENGINE_BATCH_SIZE"`
+	FlushInterval time.Duration `yaml:"flush_interval" env:"TDENGINE_FLUSH_INTERVAL"`
+}
+
+type RemoteWriteConfig struct {
+	URL           string        `yaml:"url" env:"REMOTE_WRITE_URL"`
+	User          string        `yaml:"user" env:"REMOTE_WRITE_USER"`
+	Pass          string        `yaml:"pass" env:"REMOTE_WRITE_PASS"`
+	Tenant        string        `yaml:"tenant" env:"REMOTE_WRITE_TENANT"`
+	BatchSize     int           `yaml:"batch_size" env:"REMOTE_WRITE_BATCH_SIZE"`
+	FlushInterval time.Duration `yaml:"flush_interval" env:"REMOTE_WRITE_FLUSH_INTERVAL"`
+	MaxRetries    *int          `yaml:"max_retries" env:"REMOTE_WRITE_MAX_RETRIES"`
+	Timeout       time.Duration `yaml:"timeout" env:"REMOTE_WRITE_TIMEOUT"`
+}
+
+type GraphiteConfig struct {
+	Addr          string        `yaml:"addr" env:"GRAPHITE_ADDR"`
+	Protocol      string        `yaml:"protocol" env:"GRAPHITE_PROTOCOL"`
+	Tagged        bool          `yaml:"tagged" env:"GRAPHITE_TAGGED"`
+	PathTemplate  string        `yaml:"path_template" env:"GRAPHITE_PATH_TEMPLATE"`
+	BatchSize     int           `yaml:"batch_size" env:"GRAPHITE_BATCH_SIZE"`
+	FlushInterval time.Duration `yaml:"flush_interval" env:"GRAPHITE_FLUSH_INTERVAL"`
+	MaxRetries    *int          `yaml:"max_retries" env:"GRAPHITE_MAX_RETRIES"`
+	Timeout       time.Duration `yaml:"timeout" env:"GRAPHITE_TIMEOUT"`
+}
+
+type PostgresConfig struct {
+	DSN           string        `yaml:"dsn" env:"POSTGRES_DSN"`
+	Layout        string        `yaml:"layout" env:"POSTGRES_LAYOUT"`
+	ChunkInterval string        `yaml:"chunk_interval" env:"POSTGRES_CHUNK_INTERVAL"`
+	BatchSize     int           `yaml:"batch_size" env:"POSTGRES_BATCH_SIZE"`
+	FlushInterval time.Duration `yaml:"flush_interval" env:"POSTGRES_FLUSH_INTERVAL"`
+	MaxRetries    *int          `yaml:"max_retries" env:"POSTGRES_MAX_RETRIES"`
+}
+
+type ArchiveConfig struct {
+	Dir           string        `yaml:"dir" env:"ARCHIVE_DIR"`
+	Format        string        `yaml:"format" env:"ARCHIVE_FORMAT"`
+	Gzip          bool          `yaml:"gzip" env:"ARCHIVE_GZIP"`
+	MaxSize       int64         `yaml:"max_size" env:"ARCHIVE_MAX_SIZE"`
+	MaxAge        time.Duration `yaml:"max_age" env:"ARCHIVE_MAX_AGE"`
+	BatchSize     int           `yaml:"batch_size" env:"ARCHIVE_BATCH_SIZE"`
+	FlushInterval time.Duration `yaml:"flush_interval" env:"ARCHIVE_FLUSH_INTERVAL"`
+}
+
+// AlertsConfig enables alerting when rules are configured inline or in their own file
+type AlertsConfig struct {
+	Rules       []alert.RuleConfig `yaml:"rules,omitempty"`
+	RulesFile   string             `yaml:"rules_file,omitempty" env:"ALERT_RULES"`
+	Topic       string             `yaml:"topic" env:"ALERT_TOPIC"`
+	WebhookURL  string             `yaml:"webhook_url" env:"ALERT_WEBHOOK_URL"`
+	Timeout     time.Duration      `yaml:"timeout" env:"ALERT_TIMEOUT"`
+	MaxRetries  *int               `yaml:"max_retries" env:"ALERT_MAX_RETRIES"`
+	QueueConfig `yaml:",inline" env:"ALERT_"`
+}
+
+// Enabled reports whether any alert rules are configured
+func (c AlertsConfig) Enabled() bool {
+	return len(c.Rules) > 0
+}
+
+// QueryConfig enables the read-only query endpoints when clients are configured, they read from the tdengine
+// connection settings
+type QueryConfig struct {
+	Clients      []QueryClientConfig `yaml:"clients,omitempty"`
+	MaxRows      int                 `yaml:"max_rows" env:"QUERY_MAX_ROWS"`
+	MaxRange     time.Duration       `yaml:"max_range" env:"QUERY_MAX_RANGE"`
+	DefaultRange time.Duration       `yaml:"default_range" env:"QUERY_DEFAULT_RANGE"`
+}
+
+// QueryClientConfig lets the holder of a token read the listed databases, * allows every database
+type QueryClientConfig struct {
+	Name      string   `yaml:"name"`
+	Token     string   `yaml:"token"`
+	Databases []string `yaml:"databases"`
+}
+
+// Enabled reports whether any query clients are configured
+func (c QueryConfig) Enabled() bool {
+	return len(c.Clients) > 0
+}
+
+// SparkplugConfig selects the string metrics of Sparkplug B payloads that are stored as tags, the others are skipped
+type SparkplugConfig struct {
+	StringTags []string `yaml:"string_tags,omitempty" env:"SPARKPLUG_STRING_TAGS"`
+}
+
+// ProtobufConfig lists the descriptor sets protobuf payloads are decoded with and how their message types map to
+// points. Message types without an entry are mapped from their top-level fields.
+type ProtobufConfig struct {
+	DescriptorSets []string                 `yaml:"descriptor_sets,omitempty" env:"PROTOBUF_DESCRIPTOR_SETS"`
+	Messages       []protobuf.MessageConfig `yaml:"messages,omitempty"`
+
+	registry *protobuf.Registry
+}
+
+// Registry returns the descriptor sets read by Load, nil when none are configured
+func (c ProtobufConfig) Registry() *protobuf.Registry {
+	return c.registry
+}
+
+// Load reads the config file at path, which may be empty to configure the adapter from env vars alone, applies
+// env overrides and defaults, reads the pipeline, alert rule and descriptor set files and validates the result.
+// Every problem found is reported in the returned error.
+func Load(path string) (*Config, error) {
+	config := &Config{}
+
+	if path != "" {
+		if err := read(path, config); err != nil {
+			return nil, err
+		}
+	}
+
+	return complete(config, pipeline.ReadConfig)
+}
+
+/* complete applies env overrides and defaults to a decoded file, reads the files it refers to and validates it */
+func complete(config *Config, readPipeline func(path string) (pipeline.Config, error)) (*Config, error) {
+	problems := applyEnv(config)
+	config.setDefaults()
+
+	if config.PipelineFile != "" {
+		if config.Pipeline != nil {
+			problems = append(problems, "pipeline and pipeline_file (PIPELINE_CONFIG) are mutually exclusive")
+		} else if pipelineConfig, err := readPipeline(config.PipelineFile); err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			config.Pipeline = &pipelineConfig
+		}
+	}
+
+	if config.Alerts.RulesFile != "" {
+		if len(config.Alerts.Rules) > 0 {
+			problems = append(problems, "alerts.rules and alerts.rules_file (ALERT_RULES) are mutually exclusive")
+		} else if alertConfig, err := alert.ReadConfig(config.Alerts.RulesFile); err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			config.Alerts.Rules = alertConfig.Rules
+		}
+	}
+
+	if len(config.Protobuf.DescriptorSets) > 0 {
+		if registry, err := protobuf.Load(config.Protobuf.DescriptorSets, config.Protobuf.Messages); err != nil {
+			problems = append(problems, "protobuf: "+err.Error())
+		} else {
+			config.Protobuf.registry = registry
+		}
+	}
+
+	problems = append(problems, config.validate()...)
+	if len(problems) > 0 {
+		return nil, &Error{Problems: problems}
+	}
+	config.resolveSinks()
+
+	return config, nil
+}
+
+/* resolveSinks gives every sink without a section of its own a copy of the top-level section of its type */
+func (c *Config) resolveSinks() {
+	for i := range c.Sinks {
+		sink := &c.Sinks[i]
+		switch sink.Type {
+		case SinkTDengine:
+			if sink.TDengine == nil {
+				settings := c.TDengine
+				sink.TDengine = &settings
+			}
+		case SinkRemoteWrite:
+			if sink.RemoteWrite == nil {
+				settings := c.RemoteWrite
+				sink.RemoteWrite = &settings
+			}
+		case SinkGraphite:
+			if sink.Graphite == nil {
+				settings := c.Graphite
+				sink.Graphite = &settings
+			}
+		case SinkPostgres:
+			if sink.Postgres == nil {
+				settings := c.Postgres
+				sink.Postgres = &settings
+			}
+		case SinkArchive:
+			if sink.Archive == nil {
+				settings := c.Archive
+				sink.Archive = &settings
+			}
+		}
+	}
+}
+
+// Error lists every problem found in the configuration
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+/* read parses a YAML or TOML file, TOML is converted to YAML so both are decoded strictly with the same tags */
+func read(path string, config *Config) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read config: %s", path)
+	}
+
+	return decode(raw, path, config)
+}
+
+/* decode parses the content of the file at path, its extension selects the format */
+func decode(raw []byte, path string, config *Config) error {
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		var doc map[string]interface{}
+		if err := toml.Unmarshal(raw, &doc); err != nil {
+			return errors.Wrapf(err, "failed to parse config: %s", path)
+		}
+
+		if raw, err = yaml.Marshal(doc); err != nil {
+			return errors.Wrapf(err, "failed to convert config: %s", path)
+		}
+	case ".yaml", ".yml":
+	default:
+		return errors.Errorf("config must be a .yaml, .yml or .toml file, got: %s", path)
+	}
+
+	if err := yaml.UnmarshalStrict(bytes.TrimSpace(raw), config); err != nil {
+		return errors.Wrapf(err, "failed to parse config: %s", path)
+	}
+
+	return nil
+}
+
+/* applyEnv overrides fields with the env vars that are set, returning the values that could not be parsed */
+func applyEnv(config *Config) []string {
+	problems := overrideStruct(reflect.ValueOf(config).Elem(), "")
+
+	if val := os.Getenv(envSink); val != "" {
+		sinks := []SinkConfig{}
+		for _, name := range strings.Split(val, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+
+			// keep the settings of sinks that are also in the file, other names are taken as the type
+			sink := SinkConfig{Type: name}
+			for _, existing := range config.Sinks {
+				if existing.Name == name || (existing.Name == "" && existing.Type == name) {
+					sink = existing
+				}
+			}
+			sinks = append(sinks, sink)
+		}
+		config.Sinks = sinks
+	}
+
+	for i := range config.Sinks {
+		if prefix, ok := SinkEnvPrefixes[config.Sinks[i].Type]; ok {
+			problems = append(problems, overrideStruct(reflect.ValueOf(&config.Sinks[i].QueueConfig).Elem(), prefix)...)
+		}
+	}
+
+	return problems
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func overrideStruct(v reflect.Value, prefix string) []string {
+	problems := []string{}
+
+	for i := 0; i < v.NumField(); i++ {
+		field, val := v.Type().Field(i), v.Field(i)
+		name, ok := field.Tag.Lookup("env")
+
+		// a struct tagged with env prefixes the env vars of its fields
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			problems = append(problems, overrideStruct(val, prefix+name)...)
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		name = prefix + name
+		str := os.Getenv(name)
+		if str == "" {
+			continue
+		}
+
+		if err := setValue(val, str); err != nil {
+			problems = append(problems, errors.Wrapf(err, "failed to read %s variable", name).Error())
+		}
+	}
+
+	return problems
+}
+
+func setValue(v reflect.Value, str string) error {
+	if v.Kind() == reflect.Ptr {
+		elem := reflect.New(v.Type().Elem())
+		if err := setValue(elem.Elem(), str); err != nil {
+			return err
+		}
+		v.Set(elem)
+
+		return nil
+	}
+
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(str)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(str, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return errors.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,460 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"taos-adapter/fanout"
+	"taos-adapter/mqtt"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const yamlConfig = `
+server:
+  port: "8080"
+mqtt:
+  host: broker
+  user: adapter
+  pass: secret
+  client_id: adapter
+  sub_topic: "#"
+  sub_qos: 0
+sinks:
+  - type: tdengine
+  - type: graphite
+    topics: [factory/#]
+    on_full: block
+tdengine:
+  host: tdengine
+  user: root
+  pass: taosdata
+  dbname: test
+graphite:
+  addr: carbon:2003
+  max_retries: 0
+pipeline:
+  subscriptions:
+    - topic: factory/#
+      processors:
+        - type: rename
+          field_map: {temp: temperature}
+`
+
+const tomlConfig = `
+[server]
+port = "8080"
+
+[mqtt]
+host = "broker"
+user = "adapter"
+pass = "secret"
+client_id = "adapter"
+sub_topic = "#"
+
+[[sinks]]
+type = "remotewrite"
+
+[remote_write]
+url = "http://prometheus/api/v1/write"
+flush_interval = "10s"
+
+[alerts]
+[[alerts.rules]]
+name = "hot"
+type = "threshold"
+field = "temp"
+above = 90
+`
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadYAML(t *testing.T) {
+	t.Setenv("MQTT_PASS", "from-env")
+	t.Setenv("GRAPHITE_QUEUE_SIZE", "50")
+
+	cfg, err := Load(writeConfig(t, "adapter.yaml", yamlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.MQTT.Pass != "from-env" {
+		t.Errorf("expected env to override mqtt.pass, got %q", cfg.MQTT.Pass)
+	}
+
+	if *cfg.MQTT.SubQos != 0 || *cfg.Graphite.MaxRetries != 0 {
+		t.Errorf("expected explicit zero values to be kept, got qos %d and retries %d", *cfg.MQTT.SubQos, *cfg.Graphite.MaxRetries)
+	}
+
+	// sinks without a section of their own get the top-level one
+	expectedSinks := []SinkConfig{
+		{
+			Name: SinkTDengine, Type: SinkTDengine, QueueConfig: QueueConfig{QueueSize: 1000, OnFull: fanout.OnFullDrop, OnError: fanout.OnErrorRestart},
+			TDengine: &cfg.TDengine,
+		},
+		{
+			Name: SinkGraphite, Type: SinkGraphite, QueueConfig: QueueConfig{QueueSize: 50, Topics: []string{"factory/#"}, OnFull: fanout.OnFullBlock, OnError: fanout.OnErrorRestart},
+			Graphite: &cfg.Graphite,
+		},
+	}
+	if !reflect.DeepEqual(cfg.Sinks, expectedSinks) {
+		t.Errorf("expected sinks %+v, got %+v", expectedSinks, cfg.Sinks)
+	}
+
+	if cfg.TDengine.Port != 6030 || cfg.TDengine.FlushInterval != time.Second {
+		t.Errorf("expected tdengine defaults, got %+v", cfg.TDengine)
+	}
+
+	if cfg.Server.ShutdownTimeout != 30*time.Second || cfg.Server.MaxWriteSize != 10*1024*1024 {
+		t.Errorf("expected default shutdown timeout and write size, got %s and %d", cfg.Server.ShutdownTimeout, cfg.Server.MaxWriteSize)
+	}
+
+	if !reflect.DeepEqual(cfg.Server.WriteDatabases, []string{"*"}) {
+		t.Errorf("expected every database to be writable by default, got %v", cfg.Server.WriteDatabases)
+	}
+
+	if cfg.Pipeline == nil || len(cfg.Pipeline.Subscriptions) != 1 {
+		t.Errorf("expected inline pipeline, got %+v", cfg.Pipeline)
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "adapter.toml", tomlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.RemoteWrite.FlushInterval != 10*time.Second || *cfg.RemoteWrite.MaxRetries != 3 {
+		t.Errorf("expected remote write settings, got %+v", cfg.RemoteWrite)
+	}
+
+	if !cfg.Alerts.Enabled() || *cfg.Alerts.Rules[0].Above != 90 || cfg.Alerts.OnFull != fanout.OnFullDrop {
+		t.Errorf("expected alert rules with a dropping queue, got %+v", cfg.Alerts)
+	}
+}
+
+func TestLoadEnvOnly(t *testing.T) {
+	env := map[string]string{
+		"SERVER_PORT":       "8080",
+		"MQTT_HOST":         "broker",
+		"MQTT_USER":         "adapter",
+		"MQTT_PASS":         "secret",
+		"MQTT_CLIENT_ID":    "adapter",
+		"MQTT_SUB_TOPIC":    "#",
+		"MQTT_SUB_QOS":      "2",
+		"SINK":              "archive, postgres",
+		"ARCHIVE_DIR":       "/data",
+		"ARCHIVE_GZIP":      "true",
+		"POSTGRES_DSN":      "postgres://localhost/metrics",
+		"POSTGRES_ON_FULL":  "block",
+		"INGEST_QUEUE_SIZE": "20",
+		"SHUTDOWN_TIMEOUT":  "1m",
+	}
+	for key, val := range env {
+		t.Setenv(key, val)
+	}
+
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Sinks) != 2 || cfg.Sinks[0].Type != SinkArchive || cfg.Sinks[1].OnFull != fanout.OnFullBlock {
+		t.Errorf("expected archive and blocking postgres sinks, got %+v", cfg.Sinks)
+	}
+
+	if !cfg.Archive.Gzip || *cfg.MQTT.SubQos != 2 || cfg.Ingest.QueueSize != 20 {
+		t.Errorf("expected env values, got archive %+v, qos %d, ingest %+v", cfg.Archive, *cfg.MQTT.SubQos, cfg.Ingest)
+	}
+
+	if cfg.Server.ShutdownTimeout != time.Minute {
+		t.Errorf("expected shutdown timeout from env, got %s", cfg.Server.ShutdownTimeout)
+	}
+}
+
+func TestLoadNamedSinks(t *testing.T) {
+	t.Setenv("REMOTE_WRITE_URL", "http://prometheus/api/v1/write")
+
+	cfg, err := Load(writeConfig(t, "adapter.yaml", `
+server:
+  port: "8080"
+mqtt:
+  host: broker
+  user: adapter
+  pass: secret
+  client_id: adapter
+  sub_topic: "#"
+sinks:
+  - name: mimir
+    type: remotewrite
+    remote_write:
+      url: http://mimir/api/v1/push
+      tenant: factory
+  - name: victoria
+    type: remotewrite
+    remote_write:
+      url: http://victoria/api/v1/write
+      batch_size: 100
+  - type: remotewrite
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"mimir":       "http://mimir/api/v1/push",
+		"victoria":    "http://victoria/api/v1/write",
+		"remotewrite": "http://prometheus/api/v1/write",
+	}
+	for _, sink := range cfg.Sinks {
+		if sink.RemoteWrite == nil || sink.RemoteWrite.URL != expected[sink.Name] {
+			t.Errorf("expected sink %s to write to %s, got %+v", sink.Name, expected[sink.Name], sink.RemoteWrite)
+		}
+	}
+
+	if victoria := cfg.Sinks[1].RemoteWrite; victoria.BatchSize != 100 || victoria.Tenant != "" || *victoria.MaxRetries != 3 {
+		t.Errorf("expected victoria settings with defaults, got %+v", victoria)
+	}
+
+	if cfg.Sinks[0].RemoteWrite.BatchSize != 500 || cfg.Sinks[0].RemoteWrite.Tenant != "factory" {
+		t.Errorf("expected mimir settings with defaults, got %+v", cfg.Sinks[0].RemoteWrite)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Setenv("MQTT_PORT", "one")
+
+	path := writeConfig(t, "adapter.yaml", `
+server:
+  tls_cert: /certs/adapter.pem
+  max_write_size: -1
+mqtt:
+  host: broker
+  sub_qos: 3
+sinks:
+  - type: influx
+  - type: graphite
+    on_full: wait
+  - name: second
+    type: graphite
+    graphite:
+      protocol: pickle
+    archive:
+      dir: /data
+  - name: second
+    type: archive
+graphite:
+  protocol: udp
+ingest:
+  on_full: spill
+query:
+  default_range: 48h
+  clients:
+    - name: ops
+      databases: []
+`)
+
+	_, err := Load(path)
+
+	var configErr *Error
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected config error, got %v", err)
+	}
+
+	expected := []string{
+		`failed to read MQTT_PORT variable: strconv.ParseInt: parsing "one": invalid syntax`,
+		"server.port (SERVER_PORT) is required",
+		"server.max_write_size must be positive, got: -1",
+		"server.tls_cert (SERVER_TLS_CERT) and server.tls_key (SERVER_TLS_KEY) must be set together",
+		"mqtt.user (MQTT_USER) is required",
+		"mqtt.pass (MQTT_PASS) is required",
+		"mqtt.client_id (MQTT_CLIENT_ID) is required",
+		"mqtt.sub_topic (MQTT_SUB_TOPIC) or an mqtt subscription that is not paused is required",
+		"mqtt.sub_qos must be 0, 1 or 2, got: 3",
+		`sinks[0]: type must be one of tdengine, remotewrite, graphite, postgres, archive, got: "influx"`,
+		"graphite.addr (GRAPHITE_ADDR) is required",
+		`graphite.protocol must be one of plaintext, pickle, got: "udp"`,
+		`sinks[1] (graphite).on_full must be one of block, drop, got: "wait"`,
+		"sinks[2] (second): archive is only read by archive sinks",
+		"sinks[2].graphite.addr is required",
+		"sinks[3] (second): duplicate name second",
+		"archive.dir (ARCHIVE_DIR) is required",
+		"ingest: spill policy requires a spill directory",
+		"query.default_range must not exceed query.max_range, got: 48h0m0s > 24h0m0s",
+		"query.clients[0] (ops).token is required",
+		"query.clients[0] (ops).databases: at least one database or * is required",
+		"tdengine.host (TDENGINE_HOST) is required",
+		"tdengine.user (TDENGINE_USER) is required",
+		"tdengine.pass (TDENGINE_PASS) is required",
+	}
+	if !reflect.DeepEqual(configErr.Problems, expected) {
+		t.Errorf("expected problems:\n%q\ngot:\n%q", expected, configErr.Problems)
+	}
+}
+
+func TestLoadProtobuf(t *testing.T) {
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(timestamppb.File_google_protobuf_timestamp_proto),
+	}}
+	raw, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptorSet := filepath.Join(t.TempDir(), "timestamp.pb")
+	if err := os.WriteFile(descriptorSet, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	base := `
+server:
+  port: "8080"
+tdengine:
+  host: tdengine
+  user: root
+  pass: taosdata
+  dbname: test
+mqtt:
+  host: broker
+  user: adapter
+  pass: secret
+  client_id: adapter
+`
+
+	t.Setenv("PROTOBUF_DESCRIPTOR_SETS", descriptorSet)
+	cfg, err := Load(writeConfig(t, "adapter.yaml", base+`  subscriptions:
+    - name: clocks
+      topic: clocks/#
+      message: google.protobuf.Timestamp
+    - name: meters
+      topic: meters/#
+      parser: protobuf
+protobuf:
+  messages:
+    - type: google.protobuf.Timestamp
+      fields: {nanos: nanos}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Protobuf.Registry() == nil || !cfg.Protobuf.Registry().Has("google.protobuf.Timestamp") {
+		t.Error("expected the descriptor set to be loaded")
+	}
+
+	expectedParsers := []mqtt.TopicParser{
+		{Filter: "clocks/#", Parser: mqtt.ParserProtobuf, Message: "google.protobuf.Timestamp"},
+		{Filter: "meters/#", Parser: mqtt.ParserProtobuf},
+	}
+	if parsers := cfg.MQTT.Parsers(); !reflect.DeepEqual(parsers, expectedParsers) {
+		t.Errorf("expected parsers %+v, got %+v", expectedParsers, parsers)
+	}
+
+	_, err = Load(writeConfig(t, "adapter.yaml", base+`  subscriptions:
+    - name: clocks
+      topic: clocks/#
+      message: google.protobuf.Duration
+    - name: meters
+      topic: meters/#
+      parser: json
+      message: google.protobuf.Timestamp
+`))
+
+	var configErr *Error
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected config error, got %v", err)
+	}
+
+	expected := []string{
+		"mqtt.subscriptions[0].message: unknown protobuf message type google.protobuf.Duration",
+		"mqtt.subscriptions[1].message is only read by the protobuf parser, got parser: json",
+	}
+	if !reflect.DeepEqual(configErr.Problems, expected) {
+		t.Errorf("expected problems:\n%q\ngot:\n%q", expected, configErr.Problems)
+	}
+
+	t.Setenv("PROTOBUF_DESCRIPTOR_SETS", "")
+	_, err = Load(writeConfig(t, "adapter.yaml", base+`  subscriptions:
+    - name: meters
+      topic: meters/#
+      parser: protobuf
+protobuf:
+  descriptor_sets: [`+filepath.Join(t.TempDir(), "missing.pb")+`]
+  messages:
+    - type: factory.v1.Reading
+`))
+	if !errors.As(err, &configErr) || len(configErr.Problems) != 1 || !strings.HasPrefix(configErr.Problems[0], "protobuf: failed to read descriptor set") {
+		t.Errorf("expected a single descriptor set problem, got %v", err)
+	}
+}
+
+func TestRead(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{name: "Failure: Unknown field", file: "adapter.yaml", content: "mqtt:\n  hostname: broker\n"},
+		{name: "Failure: Unknown extension", file: "adapter.json", content: "{}"},
+		{name: "Failure: Invalid TOML", file: "adapter.toml", content: "[mqtt"},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if err := read(writeConfig(t, c.file, c.content), &Config{}); err == nil {
+			t.Error("expected error")
+		}
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	t.Parallel()
+
+	qos, otherQos := 1, 2
+
+	cases := []struct {
+		name     string
+		update   func(c *Config)
+		expected []string
+	}{
+		{name: "Success: Topics only", update: func(c *Config) {
+			c.MQTT.SubTopic, c.MQTT.Subscriptions = "factory/#", []SubscriptionConfig{{Name: "office", Topic: "office/#"}}
+		}, expected: []string{}},
+		{name: "Success: Sinks only", update: func(c *Config) { c.Sinks = []SinkConfig{{Type: SinkArchive}} }, expected: []string{}},
+		{name: "Success: Connection", update: func(c *Config) { c.MQTT.SubQos = &otherQos }, expected: []string{"mqtt"}},
+		{name: "Success: Server and ingest", update: func(c *Config) { c.Server.Port, c.Ingest.QueueSize = "9090", 5 }, expected: []string{"server", "ingest"}},
+		{name: "Success: Query", update: func(c *Config) { c.Query.MaxRows = 10 }, expected: []string{"query"}},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		cfg := &Config{Server: ServerConfig{Port: "8080"}, MQTT: MQTTConfig{Host: "broker", SubTopic: "#", SubQos: &qos}}
+		next := *cfg
+		sameQos := qos
+		next.MQTT.SubQos = &sameQos
+		c.update(&next)
+
+		if changed := cfg.RestartRequired(&next); !reflect.DeepEqual(changed, c.expected) {
+			t.Errorf("expected %v, got %v", c.expected, changed)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"taos-adapter/pipeline"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// ErrNoConfigFile is returned by EditSubscriptions when the adapter runs from env vars alone
+var ErrNoConfigFile = errors.New("the adapter runs without a config file, start it with -config to change subscriptions")
+
+// Subscription is an MQTT subscription as kept in the config file, with the pipeline subscription of its topic
+type Subscription struct {
+	SubscriptionConfig
+	// the pipeline subscription without its topic, kept as written so values like durations keep their format
+	Pipeline map[string]interface{} `json:"pipeline,omitempty"`
+}
+
+// ReadSubscriptions returns the subscriptions of mqtt.subscriptions in the config file at path
+func ReadSubscriptions(path string) ([]Subscription, error) {
+	if path == "" {
+		return []Subscription{}, nil
+	}
+
+	f, err := readFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.subscriptions()
+}
+
+// EditSubscriptions passes the subscriptions of the config file at path to edit and writes back the ones it returns,
+// with their pipeline settings in the pipeline section or in pipeline_file. The files are only written when the
+// resulting config is valid, otherwise an *Error is returned. Everything else in them is kept, but YAML comments
+// are lost.
+func EditSubscriptions(path string, edit func(subs []Subscription) ([]Subscription, error)) error {
+	if path == "" {
+		return ErrNoConfigFile
+	}
+
+	// a config that is already invalid would make every change fail in a confusing way
+	if _, err := Load(path); err != nil {
+		return errors.Errorf("the config file must be fixed before changing subscriptions: %s", err)
+	}
+
+	f, err := readFiles(path)
+	if err != nil {
+		return err
+	}
+
+	subs, err := f.subscriptions()
+	if err != nil {
+		return err
+	}
+
+	next, err := edit(subs)
+	if err != nil {
+		return err
+	}
+
+	f.setSubscriptions(subs, next)
+
+	raw, pipelineRaw, err := f.encode()
+	if err != nil {
+		return err
+	}
+
+	if err := f.validate(raw, pipelineRaw); err != nil {
+		return err
+	}
+
+	if f.pipelinePath != "" {
+		if err := writeFile(f.pipelinePath, pipelineRaw); err != nil {
+			return err
+		}
+	}
+
+	return writeFile(f.path, raw)
+}
+
+// configFiles is the config file and the pipeline file decoded without types, so what a change does not touch is
+// written back as it was read
+type configFiles struct {
+	path         string
+	doc          yaml.MapSlice
+	pipelinePath string        // pipeline_file, empty when the pipeline is a section of doc
+	pipelineDoc  yaml.MapSlice // the content of pipeline_file or the pipeline section
+}
+
+func readFiles(path string) (*configFiles, error) {
+	f := &configFiles{path: path}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read config: %s", path)
+	}
+
+	if f.doc, err = decodeDocument(raw, path); err != nil {
+		return nil, err
+	}
+
+	// the env var wins over the file, as in Load
+	f.pipelinePath = os.Getenv("PIPELINE_CONFIG")
+	if f.pipelinePath == "" {
+		f.pipelinePath, _ = lookup(f.doc, "pipeline_file").(string)
+	}
+
+	if f.pipelinePath == "" {
+		f.pipelineDoc, _ = lookup(f.doc, "pipeline").(yaml.MapSlice)
+		return f, nil
+	}
+
+	raw, err = os.ReadFile(f.pipelinePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read pipeline config: %s", f.pipelinePath)
+	}
+
+	if err := yaml.Unmarshal(raw, &f.pipelineDoc); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse pipeline config: %s", f.pipelinePath)
+	}
+
+	return f, nil
+}
+
+/* decodeDocument parses a config file into a MapSlice, TOML is converted like in read */
+func decodeDocument(raw []byte, path string) (yaml.MapSlice, error) {
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		var doc map[string]interface{}
+		if err := toml.Unmarshal(raw, &doc); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse config: %s", path)
+		}
+
+		var err error
+		if raw, err = yaml.Marshal(doc); err != nil {
+			return nil, errors.Wrapf(err, "failed to convert config: %s", path)
+		}
+	}
+
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse config: %s", path)
+	}
+
+	return doc, nil
+}
+
+func (f *configFiles) subscriptions() ([]Subscription, error) {
+	mqttSection, _ := lookup(f.doc, "mqtt").(yaml.MapSlice)
+	entries, _ := lookup(mqttSection, "subscriptions").([]interface{})
+	pipelineSubs, _ := lookup(f.pipelineDoc, "subscriptions").([]interface{})
+
+	subs := []Subscription{}
+	for _, entry := range entries {
+		// decoded again with types, the same way Load reads it
+		raw, err := yaml.Marshal(entry)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read mqtt.subscriptions")
+		}
+
+		sub := Subscription{}
+		if err := yaml.UnmarshalStrict(raw, &sub.SubscriptionConfig); err != nil {
+			return nil, errors.Wrap(err, "failed to read mqtt.subscriptions")
+		}
+
+		for _, pipelineSub := range pipelineSubs {
+			settings, _ := pipelineSub.(yaml.MapSlice)
+			if lookup(settings, "topic") != sub.Topic {
+				continue
+			}
+
+			sub.Pipeline = map[string]interface{}{}
+			for _, item := range settings {
+				if item.Key != "topic" {
+					sub.Pipeline[fmt.Sprint(item.Key)] = plain(item.Value)
+				}
+			}
+			break
+		}
+
+		subs = append(subs, sub)
+	}
+
+	return subs, nil
+}
+
+// setSubscriptions replaces the subscriptions prev read from the files with next. Pipeline subscriptions of the
+// topics of prev are replaced in place, so the order in which they match is kept, new ones are appended.
+func (f *configFiles) setSubscriptions(prev, next []Subscription) {
+	entries := []interface{}{}
+	pipelineByTopic := map[string]yaml.MapSlice{}
+	for _, sub := range next {
+		entry := yaml.MapSlice{{Key: "name", Value: sub.Name}, {Key: "topic", Value: sub.Topic}}
+		if sub.Parser != "" {
+			entry = append(entry, yaml.MapItem{Key: "parser", Value: sub.Parser})
+		}
+		if sub.Message != "" {
+			entry = append(entry, yaml.MapItem{Key: "message", Value: sub.Message})
+		}
+		if sub.Paused {
+			entry = append(entry, yaml.MapItem{Key: "paused", Value: true})
+		}
+		entries = append(entries, entry)
+
+		if sub.Pipeline != nil {
+			pipelineByTopic[sub.Topic] = pipelineEntry(sub)
+		}
+	}
+
+	mqttSection, _ := lookup(f.doc, "mqtt").(yaml.MapSlice)
+	if len(entries) > 0 {
+		mqttSection = set(mqttSection, "subscriptions", entries)
+	} else {
+		mqttSection = remove(mqttSection, "subscriptions")
+	}
+	f.doc = set(f.doc, "mqtt", mqttSection)
+
+	// the topics of prev and the ones given pipeline settings now, which replace a pipeline subscription
+	// that was written by hand for the same topic
+	managed := map[string]bool{}
+	for _, sub := range prev {
+		managed[sub.Topic] = true
+	}
+	for topic := range pipelineByTopic {
+		managed[topic] = true
+	}
+
+	pipelineSubs := []interface{}{}
+	existing, _ := lookup(f.pipelineDoc, "subscriptions").([]interface{})
+	for _, pipelineSub := range existing {
+		settings, _ := pipelineSub.(yaml.MapSlice)
+		topic, _ := lookup(settings, "topic").(string)
+		if !managed[topic] {
+			pipelineSubs = append(pipelineSubs, pipelineSub)
+		} else if entry, ok := pipelineByTopic[topic]; ok {
+			pipelineSubs = append(pipelineSubs, entry)
+			delete(pipelineByTopic, topic)
+		}
+	}
+
+	for _, sub := range next {
+		if entry, ok := pipelineByTopic[sub.Topic]; ok {
+			pipelineSubs = append(pipelineSubs, entry)
+		}
+	}
+
+	if len(pipelineSubs) == 0 && len(existing) == 0 {
+		return
+	}
+
+	f.pipelineDoc = set(f.pipelineDoc, "subscriptions", pipelineSubs)
+	if f.pipelinePath == "" {
+		f.doc = set(f.doc, "pipeline", f.pipelineDoc)
+	}
+}
+
+/* pipelineEntry builds the pipeline subscription of sub, with the topic first and the settings sorted */
+func pipelineEntry(sub Subscription) yaml.MapSlice {
+	keys := []string{}
+	for key := range sub.Pipeline {
+		if key != "topic" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	entry := yaml.MapSlice{{Key: "topic", Value: sub.Topic}}
+	for _, key := range keys {
+		entry = append(entry, yaml.MapItem{Key: key, Value: sub.Pipeline[key]})
+	}
+
+	return entry
+}
+
+/* encode returns the content of the config file and of the pipeline file, in the format of their extension */
+func (f *configFiles) encode() ([]byte, []byte, error) {
+	var raw []byte
+	var err error
+	if strings.ToLower(filepath.Ext(f.path)) == ".toml" {
+		raw, err = toml.Marshal(plain(f.doc))
+	} else {
+		raw, err = yaml.Marshal(f.doc)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to encode config: %s", f.path)
+	}
+
+	if f.pipelinePath == "" {
+		return raw, nil, nil
+	}
+
+	pipelineRaw, err := yaml.Marshal(f.pipelineDoc)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to encode pipeline config: %s", f.pipelinePath)
+	}
+
+	return raw, pipelineRaw, nil
+}
+
+/* validate loads the encoded files the way Load would read them from disk */
+func (f *configFiles) validate(raw, pipelineRaw []byte) error {
+	config := &Config{}
+	if err := decode(raw, f.path, config); err != nil {
+		return &Error{Problems: []string{err.Error()}}
+	}
+
+	_, err := complete(config, func(path string) (pipeline.Config, error) {
+		if path != f.pipelinePath {
+			return pipeline.ReadConfig(path)
+		}
+
+		var pipelineConfig pipeline.Config
+		if err := yaml.UnmarshalStrict(pipelineRaw, &pipelineConfig); err != nil {
+			return pipelineConfig, errors.Wrapf(err, "failed to parse pipeline config: %s", path)
+		}
+
+		return pipelineConfig, nil
+	})
+
+	return err
+}
+
+/* writeFile replaces the file at path through a rename, so a reload never reads it half written */
+func writeFile(path string, raw []byte) error {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(raw)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	return errors.Wrapf(err, "failed to write %s", path)
+}
+
+func lookup(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+
+	return nil
+}
+
+func set(m yaml.MapSlice, key string, val interface{}) yaml.MapSlice {
+	for i, item := range m {
+		if item.Key == key {
+			m[i].Value = val
+			return m
+		}
+	}
+
+	return append(m, yaml.MapItem{Key: key, Value: val})
+}
+
+func remove(m yaml.MapSlice, key string) yaml.MapSlice {
+	kept := yaml.MapSlice{}
+	for _, item := range m {
+		if item.Key != key {
+			kept = append(kept, item)
+		}
+	}
+
+	return kept
+}
+
+/* plain converts decoded YAML into maps with string keys, as JSON and TOML encoding need them */
+func plain(val interface{}) interface{} {
+	switch v := val.(type) {
+	case yaml.MapSlice:
+		m := make(map[string]interface{}, len(v))
+		for _, item := range v {
+			m[fmt.Sprint(item.Key)] = plain(item.Value)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = plain(item)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = plain(item)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			l[i] = plain(item)
+		}
+		return l
+	default:
+		return val
+	}
+}
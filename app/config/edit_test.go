@@ -0,0 +1,82 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEditSubscriptions(t *testing.T) {
+	dir := t.TempDir()
+	pipelinePath := filepath.Join(dir, "pipeline.yaml")
+	if err := os.WriteFile(pipelinePath, []byte("subscriptions:\n  - topic: office/#\n    processors: []\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeConfig(t, "adapter.toml", `pipeline_file = "`+pipelinePath+`"
+
+[server]
+port = "8080"
+
+[mqtt]
+host = "broker"
+user = "adapter"
+pass = "secret"
+client_id = "adapter"
+sub_topic = "#"
+
+[[sinks]]
+type = "remotewrite"
+
+[remote_write]
+url = "http://prometheus/api/v1/write"
+flush_interval = "10s"
+`)
+
+	add := func(subs []Subscription) ([]Subscription, error) {
+		return append(subs, Subscription{
+			SubscriptionConfig: SubscriptionConfig{Name: "meters", Topic: "factory/meters/#", Parser: "csv"},
+			Pipeline:           map[string]interface{}{"processors": []interface{}{map[string]interface{}{"type": "drop", "fields": []interface{}{"debug"}}}},
+		}), nil
+	}
+	if err := EditSubscriptions(path, add); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.RemoteWrite.FlushInterval.String() != "10s" || len(cfg.MQTT.Subscriptions) != 1 || cfg.MQTT.Subscriptions[0].Parser != "csv" {
+		t.Errorf("expected the subscription next to the untouched settings, got %+v and %+v", cfg.MQTT, cfg.RemoteWrite)
+	}
+
+	if len(cfg.Pipeline.Subscriptions) != 2 || cfg.Pipeline.Subscriptions[1].Topic != "factory/meters/#" {
+		t.Errorf("expected the pipeline subscription in the pipeline file, got %+v", cfg.Pipeline.Subscriptions)
+	}
+
+	invalid := func(subs []Subscription) ([]Subscription, error) {
+		subs[0].Parser = "xml"
+		return subs, nil
+	}
+	var configErr *Error
+	if err := EditSubscriptions(path, invalid); !errors.As(err, &configErr) || !strings.Contains(err.Error(), "parser") {
+		t.Errorf("expected invalid parser error, got %v", err)
+	}
+
+	subs, err := ReadSubscriptions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(subs) != 1 || subs[0].Parser != "csv" || subs[0].Pipeline == nil {
+		t.Errorf("expected an invalid change to leave the files alone, got %+v", subs)
+	}
+
+	if err := EditSubscriptions("", add); !errors.Is(err, ErrNoConfigFile) {
+		t.Errorf("expected missing config file error, got %v", err)
+	}
+}
@@ -0,0 +1,451 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"taos-adapter/alert"
+	"taos-adapter/archive"
+	"taos-adapter/fanout"
+	"taos-adapter/graphite"
+	"taos-adapter/mqtt"
+	"taos-adapter/pgsql"
+	"taos-adapter/pipeline"
+	"taos-adapter/queue"
+	"time"
+)
+
+/* setDefaults fills in every setting left empty by both the file and the env vars */
+func (c *Config) setDefaults() {
+	setDefault(&c.Server.ShutdownTimeout, 30*time.Second)
+	setDefault(&c.Server.MaxWriteSize, 10*1024*1024)
+	if len(c.Server.WriteDatabases) == 0 {
+		c.Server.WriteDatabases = []string{"*"}
+	}
+
+	setDefault(&c.MQTT.Port, 1883)
+	setDefaultPtr(&c.MQTT.SubQos, 1)
+
+	if len(c.Sinks) == 0 {
+		c.Sinks = []SinkConfig{{Type: SinkTDengine}}
+	}
+
+	// a single sink keeps the old blocking behaviour, with several sinks a full queue drops points by default so
+	// one sink can not stall the others
+	for i := range c.Sinks {
+		c.Sinks[i].setDefaults(len(c.Sinks) > 1)
+	}
+
+	setDefault(&c.Ingest.QueueSize, 10000)
+	setDefault(&c.Ingest.OnFull, queue.PolicyBlock)
+
+	c.TDengine.setDefaults()
+	c.RemoteWrite.setDefaults()
+	c.Graphite.setDefaults()
+	c.Postgres.setDefaults()
+	c.Archive.setDefaults()
+
+	setDefault(&c.Query.MaxRows, 1000)
+	setDefault(&c.Query.MaxRange, 24*time.Hour)
+	setDefault(&c.Query.DefaultRange, time.Hour)
+
+	// alerts run next to the sinks and always drop points when their queue is full so they never hold back ingestion
+	setDefault(&c.Alerts.Topic, "alerts")
+	setDefault(&c.Alerts.Timeout, 10*time.Second)
+	setDefaultPtr(&c.Alerts.MaxRetries, 3)
+	c.Alerts.QueueConfig.setDefaults(true)
+}
+
+func (c *SinkConfig) setDefaults(multiple bool) {
+	setDefault(&c.Name, c.Type)
+	c.QueueConfig.setDefaults(multiple)
+
+	if c.TDengine != nil {
+		c.TDengine.setDefaults()
+	}
+	if c.RemoteWrite != nil {
+		c.RemoteWrite.setDefaults()
+	}
+	if c.Graphite != nil {
+		c.Graphite.setDefaults()
+	}
+	if c.Postgres != nil {
+		c.Postgres.setDefaults()
+	}
+	if c.Archive != nil {
+		c.Archive.setDefaults()
+	}
+}
+
+func (c *TDengineConfig) setDefaults() {
+	setDefault(&c.Port, 6030)
+	setDefault(&c.BatchSize, 100)
+	setDefault(&c.FlushInterval, time.Second)
+}
+
+func (c *RemoteWriteConfig) setDefaults() {
+	setDefault(&c.BatchSize, 500)
+	setDefault(&c.FlushInterval, 5*time.Second)
+	setDefaultPtr(&c.MaxRetries, 3)
+	setDefault(&c.Timeout, 10*time.Second)
+}
+
+func (c *GraphiteConfig) setDefaults() {
+	setDefault(&c.Protocol, graphite.ProtocolPlaintext)
+	setDefault(&c.PathTemplate, graphite.DefaultPathTemplate)
+	setDefault(&c.BatchSize, 500)
+	setDefault(&c.FlushInterval, 5*time.Second)
+	setDefaultPtr(&c.MaxRetries, 3)
+	setDefault(&c.Timeout, 10*time.Second)
+}
+
+func (c *PostgresConfig) setDefaults() {
+	setDefault(&c.Layout, pgsql.LayoutWide)
+	setDefault(&c.ChunkInterval, "1 day")
+	setDefault(&c.BatchSize, 500)
+	setDefault(&c.FlushInterval, 5*time.Second)
+	setDefaultPtr(&c.MaxRetries, 3)
+}
+
+func (c *ArchiveConfig) setDefaults() {
+	setDefault(&c.Format, archive.FormatNDJSON)
+	setDefault(&c.MaxSize, 100*1024*1024)
+	setDefault(&c.MaxAge, time.Hour)
+	setDefault(&c.BatchSize, 500)
+	setDefault(&c.FlushInterval, 5*time.Second)
+}
+
+func (c *QueueConfig) setDefaults(multiple bool) {
+	setDefault(&c.QueueSize, 1000)
+	setDefault(&c.OnError, fanout.OnErrorRestart)
+
+	if multiple {
+		setDefault(&c.OnFull, fanout.OnFullDrop)
+	} else {
+		setDefault(&c.OnFull, fanout.OnFullBlock)
+	}
+}
+
+func setDefault[T comparable](val *T, defaultVal T) {
+	var zero T
+	if *val == zero {
+		*val = defaultVal
+	}
+}
+
+func setDefaultPtr[T any](val **T, defaultVal T) {
+	if *val == nil {
+		*val = &defaultVal
+	}
+}
+
+// problems collects every validation error of the configuration
+type problems []string
+
+func (p *problems) add(format string, args ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+/* required reports a missing setting with the env var that sets it, if any */
+func (p *problems) required(val, name, env string) {
+	if val == "" && env == "" {
+		p.add("%s is required", name)
+	} else if val == "" {
+		p.add("%s (%s) is required", name, env)
+	}
+}
+
+func (p *problems) oneOf(val, name string, allowed ...string) {
+	for _, a := range allowed {
+		if val == a {
+			return
+		}
+	}
+
+	p.add("%s must be one of %s, got: %q", name, strings.Join(allowed, ", "), val)
+}
+
+func (p *problems) positive(val int64, name string) {
+	if val <= 0 {
+		p.add("%s must be positive, got: %d", name, val)
+	}
+}
+
+/* validate checks the whole configuration after the defaults are set */
+func (c *Config) validate() []string {
+	p := problems{}
+
+	p.required(c.Server.Port, "server.port", "SERVER_PORT")
+	p.positive(int64(c.Server.ShutdownTimeout), "server.shutdown_timeout")
+	p.positive(c.Server.MaxWriteSize, "server.max_write_size")
+	if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+		p.add("server.tls_cert (SERVER_TLS_CERT) and server.tls_key (SERVER_TLS_KEY) must be set together")
+	}
+
+	p.required(c.MQTT.Host, "mqtt.host", "MQTT_HOST")
+	p.required(c.MQTT.User, "mqtt.user", "MQTT_USER")
+	p.required(c.MQTT.Pass, "mqtt.pass", "MQTT_PASS")
+	p.required(c.MQTT.ClientID, "mqtt.client_id", "MQTT_CLIENT_ID")
+	if c.MQTT.SubTopic != "" && singleLevel(c.MQTT.SubTopic) {
+		p.add("mqtt.sub_topic (MQTT_SUB_TOPIC) must have a <db>/<table> level, got: %s", c.MQTT.SubTopic)
+	}
+	validateSubscriptions(&p, c.MQTT.Subscriptions, c.Protobuf)
+	if len(c.MQTT.Topics()) == 0 {
+		p.add("mqtt.sub_topic (MQTT_SUB_TOPIC) or an mqtt subscription that is not paused is required")
+	}
+	if *c.MQTT.SubQos < 0 || *c.MQTT.SubQos > 2 {
+		p.add("mqtt.sub_qos must be 0, 1 or 2, got: %d", *c.MQTT.SubQos)
+	}
+
+	validateSinks(&p, c)
+
+	ingest := queue.Queue{Size: c.Ingest.QueueSize, Policy: c.Ingest.OnFull, SpillDir: c.Ingest.SpillDir}
+	if err := ingest.Validate(); err != nil {
+		p.add("ingest: %s", err)
+	}
+
+	if c.Pipeline != nil {
+		if err := pipeline.Validate(*c.Pipeline); err != nil {
+			p.add("pipeline: %s", err)
+		}
+	}
+
+	if c.Query.Enabled() {
+		validateQuery(&p, c.Query)
+		p.required(c.TDengine.Host, "tdengine.host", "TDENGINE_HOST")
+		p.required(c.TDengine.User, "tdengine.user", "TDENGINE_USER")
+		p.required(c.TDengine.Pass, "tdengine.pass", "TDENGINE_PASS")
+	}
+
+	if len(c.Protobuf.Messages) > 0 && len(c.Protobuf.DescriptorSets) == 0 {
+		p.add("protobuf.messages require protobuf.descriptor_sets (PROTOBUF_DESCRIPTOR_SETS)")
+	}
+
+	if c.Alerts.Enabled() {
+		if err := alert.Validate(alert.Config{Rules: c.Alerts.Rules}); err != nil {
+			p.add("alerts: %s", err)
+		}
+		c.Alerts.QueueConfig.validate(&p, "alerts")
+	}
+
+	return p
+}
+
+// validateSinks checks that every sink has a name of its own and valid settings. A top-level section shared by
+// several sinks is reported once, with the env vars that set it.
+func validateSinks(p *problems, c *Config) {
+	names := map[string]bool{}
+	shared := map[string]bool{}
+	for i, sink := range c.Sinks {
+		name := fmt.Sprintf("sinks[%d] (%s)", i, sink.Name)
+
+		if names[sink.Name] {
+			p.add("%s: duplicate name %s", name, sink.Name)
+		} else if sink.Name == SinkAlert {
+			p.add("%s: the name %s is taken by the alert rules", name, SinkAlert)
+		}
+		names[sink.Name] = true
+
+		section, ok := sinkSections[sink.Type]
+		if !ok {
+			p.add("sinks[%d]: type must be one of %s, %s, %s, %s, %s, got: %q", i,
+				SinkTDengine, SinkRemoteWrite, SinkGraphite, SinkPostgres, SinkArchive, sink.Type)
+			continue
+		}
+
+		own := sink.sections()
+		for sinkType := range own {
+			if sinkType != sink.Type {
+				p.add("%s: %s is only read by %s sinks", name, sinkSections[sinkType], sinkType)
+			}
+		}
+
+		// a sink without a section of its own reads the top-level one and the env vars
+		if settings, ok := own[sink.Type]; ok {
+			settings.validate(p, fmt.Sprintf("sinks[%d].%s", i, section), false)
+		} else if !shared[sink.Type] {
+			c.topSection(sink.Type).validate(p, section, true)
+			shared[sink.Type] = true
+		}
+
+		sink.QueueConfig.validate(p, name)
+	}
+}
+
+// sinkSections are the keys of the settings sections of the sink types
+var sinkSections = map[string]string{
+	SinkTDengine:    "tdengine",
+	SinkRemoteWrite: "remote_write",
+	SinkGraphite:    "graphite",
+	SinkPostgres:    "postgres",
+	SinkArchive:     "archive",
+}
+
+// sinkSettings is a settings section of a sink type, top is set for the top-level sections that env vars override
+type sinkSettings interface {
+	validate(p *problems, section string, top bool)
+}
+
+/* sections returns the settings sections set within the sink by sink type */
+func (c SinkConfig) sections() map[string]sinkSettings {
+	sections := map[string]sinkSettings{}
+	if c.TDengine != nil {
+		sections[SinkTDengine] = c.TDengine
+	}
+	if c.RemoteWrite != nil {
+		sections[SinkRemoteWrite] = c.RemoteWrite
+	}
+	if c.Graphite != nil {
+		sections[SinkGraphite] = c.Graphite
+	}
+	if c.Postgres != nil {
+		sections[SinkPostgres] = c.Postgres
+	}
+	if c.Archive != nil {
+		sections[SinkArchive] = c.Archive
+	}
+
+	return sections
+}
+
+/* topSection returns the top-level settings section of a sink type */
+func (c *Config) topSection(sinkType string) sinkSettings {
+	switch sinkType {
+	case SinkTDengine:
+		return &c.TDengine
+	case SinkRemoteWrite:
+		return &c.RemoteWrite
+	case SinkGraphite:
+		return &c.Graphite
+	case SinkPostgres:
+		return &c.Postgres
+	default:
+		return &c.Archive
+	}
+}
+
+/* env returns the env var of a setting of a top-level section, sections within a sink have none */
+func env(name string, top bool) string {
+	if !top {
+		return ""
+	}
+
+	return name
+}
+
+func (c *TDengineConfig) validate(p *problems, section string, top bool) {
+	p.required(c.Host, section+".host", env("TDENGINE_HOST", top))
+	p.required(c.User, section+".user", env("TDENGINE_USER", top))
+	p.required(c.Pass, section+".pass", env("TDENGINE_PASS", top))
+	p.required(c.DBName, section+".dbname", env("TDENGINE_DBNAME", top))
+	p.positive(int64(c.BatchSize), section+".batch_size")
+}
+
+func (c *RemoteWriteConfig) validate(p *problems, section string, top bool) {
+	p.required(c.URL, section+".url", env("REMOTE_WRITE_URL", top))
+	p.positive(int64(c.BatchSize), section+".batch_size")
+}
+
+func (c *GraphiteConfig) validate(p *problems, section string, top bool) {
+	p.required(c.Addr, section+".addr", env("GRAPHITE_ADDR", top))
+	p.oneOf(c.Protocol, section+".protocol", graphite.ProtocolPlaintext, graphite.ProtocolPickle)
+	p.positive(int64(c.BatchSize), section+".batch_size")
+}
+
+func (c *PostgresConfig) validate(p *problems, section string, top bool) {
+	p.required(c.DSN, section+".dsn", env("POSTGRES_DSN", top))
+	p.oneOf(c.Layout, section+".layout", pgsql.LayoutWide, pgsql.LayoutNarrow)
+	p.positive(int64(c.BatchSize), section+".batch_size")
+}
+
+func (c *ArchiveConfig) validate(p *problems, section string, top bool) {
+	p.required(c.Dir, section+".dir", env("ARCHIVE_DIR", top))
+	p.oneOf(c.Format, section+".format", archive.FormatNDJSON, archive.FormatCSV, archive.FormatParquet)
+	p.positive(int64(c.BatchSize), section+".batch_size")
+	p.positive(c.MaxSize, section+".max_size")
+}
+
+/* validateQuery checks the limits and that every query client has a token of its own */
+func validateQuery(p *problems, c QueryConfig) {
+	p.positive(int64(c.MaxRows), "query.max_rows")
+	p.positive(int64(c.MaxRange), "query.max_range")
+	p.positive(int64(c.DefaultRange), "query.default_range")
+	if c.DefaultRange > c.MaxRange {
+		p.add("query.default_range must not exceed query.max_range, got: %s > %s", c.DefaultRange, c.MaxRange)
+	}
+
+	tokens := map[string]bool{}
+	for i, client := range c.Clients {
+		name := fmt.Sprintf("query.clients[%d]", i)
+		if client.Name != "" {
+			name = fmt.Sprintf("%s (%s)", name, client.Name)
+		}
+
+		if client.Token == "" {
+			p.add("%s.token is required", name)
+		} else if tokens[client.Token] {
+			p.add("%s: duplicate token", name)
+		}
+		tokens[client.Token] = true
+
+		if len(client.Databases) == 0 {
+			p.add("%s.databases: at least one database or * is required", name)
+		}
+	}
+}
+
+/* validateSubscriptions checks the MQTT subscriptions, which are also changed through the admin API */
+func validateSubscriptions(p *problems, subs []SubscriptionConfig, pb ProtobufConfig) {
+	names := map[string]bool{}
+	topics := map[string]bool{}
+	for i, sub := range subs {
+		name := fmt.Sprintf("mqtt.subscriptions[%d]", i)
+
+		if sub.Name == "" {
+			p.add("%s.name is required", name)
+		} else if names[sub.Name] {
+			p.add("%s: duplicate name %s", name, sub.Name)
+		}
+		names[sub.Name] = true
+
+		if sub.Topic == "" {
+			p.add("%s.topic is required", name)
+		} else if singleLevel(sub.Topic) {
+			p.add("%s.topic must have a <db>/<table> level, got: %s", name, sub.Topic)
+		} else if topics[sub.Topic] {
+			p.add("%s: duplicate topic %s", name, sub.Topic)
+		}
+		topics[sub.Topic] = true
+
+		if sub.Parser != "" {
+			p.oneOf(sub.Parser, name+".parser", mqtt.ParserAuto, mqtt.ParserJSON, mqtt.ParserCSV, mqtt.ParserLine, mqtt.ParserSparkplug,
+				mqtt.ParserProtobuf)
+		}
+
+		if sub.Parser == mqtt.ParserProtobuf || sub.Message != "" {
+			if len(pb.DescriptorSets) == 0 {
+				p.add("%s: protobuf.descriptor_sets (PROTOBUF_DESCRIPTOR_SETS) is required to parse protobuf", name)
+			}
+		}
+		if sub.Message != "" {
+			if sub.Parser != "" && sub.Parser != mqtt.ParserAuto && sub.Parser != mqtt.ParserProtobuf {
+				p.add("%s.message is only read by the protobuf parser, got parser: %s", name, sub.Parser)
+			}
+			// descriptor sets that failed to load are already reported
+			if pb.registry != nil && !pb.registry.Has(sub.Message) {
+				p.add("%s.message: unknown protobuf message type %s", name, sub.Message)
+			}
+		}
+	}
+}
+
+// singleLevel reports whether a topic filter only matches topics without a table level, like sensors or +. Filters
+// such as # that also match longer topics are allowed, the messages without a table are dropped.
+func singleLevel(filter string) bool {
+	return !strings.Contains(filter, "/") && filter != "#"
+}
+
+func (c QueueConfig) validate(p *problems, name string) {
+	p.positive(int64(c.QueueSize), name+".queue_size")
+	p.oneOf(c.OnFull, name+".on_full", fanout.OnFullBlock, fanout.OnFullDrop)
+	p.oneOf(c.OnError, name+".on_error", fanout.OnErrorRestart, fanout.OnErrorExit)
+}
@@ -6,29 +6,36 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"taos-adapter/batch"
+	"taos-adapter/health"
 	"taos-adapter/models"
+	"taos-adapter/telemetry"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/taosdata/driver-go/v3/af"
 )
 
-var databaseMap = map[string]struct{}{}
-var host, user, pass, dbName, serverPort string
-var port int = 6030
-
-func SetDBVars(portVar int, hostVar, userVar, passVar, dbNameVar string) {
-	port = portVar
-	host = hostVar
-	user = userVar
-	pass = passVar
-	dbName = dbNameVar
+// Sink is a TDengine server, Name labels its metrics and health component
+type Sink struct {
+	Name          string
+	Host          string
+	Port          int
+	User          string
+	Pass          string
+	DBName        string
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// databases that are known to exist, kept across restarts of the sink
+	databaseMap map[string]struct{}
 }
 
 /* PingDatabase is used to check if the database is reachable for connections and get current table list */
-func InitDatabase(ctx context.Context) {
-	logrus.Infof("Connecting to %s:%d %s//%s\n", host, int(port), user, pass)
-	conn, err := getConn("")
+func (s *Sink) InitDatabase(ctx context.Context) {
+	logrus.Infof("Connecting to %s:%d %s//%s\n", s.Host, int(s.Port), s.User, s.Pass)
+	conn, err := s.getConn("")
 	if err != nil {
 		logrus.Error("failed to init connect, err: ", err)
 	}
@@ -36,7 +43,7 @@ func InitDatabase(ctx context.Context) {
 
 	rows, err := conn.Query("SHOW DATABASES;")
 	if err != nil {
-		logrus.Printf("failed to create database %s", dbName)
+		logrus.Printf("failed to create database %s", s.DBName)
 		panic(err)
 	}
 	defer rows.Close()
@@ -71,16 +78,16 @@ func InitDatabase(ctx context.Context) {
 
 }
 
-func CreateDatabase(ctx context.Context, dbName string) error {
+func (s *Sink) CreateDatabase(ctx context.Context, dbName string) error {
 	logrus.Infof("Creating database: %s", dbName)
 
-	conn, err := getConn(dbName)
+	conn, err := s.getConn(dbName)
 	if err != nil {
 		return errors.Wrapf(err, "failed to create database: %s", dbName)
 	}
 	defer conn.Close()
 
-	_, err = conn.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s;", dbName))
+	_, err = conn.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`;", dbName))
 	if err != nil {
 		errMsg := fmt.Sprintf("failed to create database %s", dbName)
 		logrus.Error(errMsg)
@@ -91,9 +98,9 @@ func CreateDatabase(ctx context.Context, dbName string) error {
 }
 
 /* GetConn gets tdengine connection. Remember to close it */
-func getConn(dbName string) (*af.Connector, error) {
-	logrus.Printf("Connecting to %s:%d %s//%s\n", host, int(port), user, pass)
-	conn, err := af.Open(host, user, pass, "", int(port))
+func (s *Sink) getConn(dbName string) (*af.Connector, error) {
+	logrus.Printf("Connecting to %s:%d %s//%s\n", s.Host, int(s.Port), s.User, s.Pass)
+	conn, err := af.Open(s.Host, s.User, s.Pass, "", int(s.Port))
 	if err != nil {
 		logrus.Println("failed to init connect, err: ", err)
 		return nil, errors.Wrap(err, "failed to connect to tdengine")
@@ -103,57 +110,103 @@ func getConn(dbName string) (*af.Connector, error) {
 	return conn, nil
 }
 
-func InsertDatad(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
-	conn, err := getConn("")
+func (s *Sink) InsertDatad(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+	conn, err := s.getConn("")
 	if err != nil {
 		log.Error(errors.Wrap(err, "failed to initial connect to database"))
+		health.Set(s.Name, err)
 		return err
 	}
 	defer conn.Close()
 
-	for tbMetric := range tbMetrics {
-		log.Info(tbMetric.DB)
-		if _, ok := databaseMap[tbMetric.DB]; !ok {
-			log.Infof("creating database %s", tbMetric.DB)
+	// besides the ping of the readiness check, every insert reports whether it reached the server
+	health.Set(s.Name, nil)
+
+	if s.databaseMap == nil {
+		s.databaseMap = map[string]struct{}{}
+	}
+
+	var insertErr error
+	batchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batch.Consume(batchCtx, tbMetrics, s.BatchSize, s.FlushInterval, func(points []models.TimeBasedMetrics) {
+		dbNames := []string{}
+		linesByDB := map[string][]string{}
+		pointsByDB := map[string][]models.TimeBasedMetrics{}
 
-			if _, err := conn.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s;", tbMetric.DB)); err != nil {
-				errMsg := fmt.Sprintf("failed to create database %s", tbMetric.DB)
-				log.Error(errMsg)
-				return errors.Wrapf(err, errMsg)
+		for _, tbMetric := range points {
+			if _, ok := linesByDB[tbMetric.DB]; !ok {
+				dbNames = append(dbNames, tbMetric.DB)
 			}
 
-			databaseMap[tbMetric.DB] = struct{}{}
+			linesByDB[tbMetric.DB] = append(linesByDB[tbMetric.DB], compileInfluxLine(tbMetric))
+			pointsByDB[tbMetric.DB] = append(pointsByDB[tbMetric.DB], tbMetric)
 		}
 
-		if _, err := conn.Exec(fmt.Sprintf("USE %s", tbMetric.DB)); err != nil {
-			log.Error(err)
-			continue
-		}
+		for _, dbName := range dbNames {
+			started := time.Now()
 
-		tagSlice, metricSlice := compileTDEngineMetricsAndTags(tbMetric)
+			if _, ok := s.databaseMap[dbName]; !ok {
+				log.Infof("creating database %s", dbName)
 
-		tagStr := ""
-		if len(tagSlice) > 0 {
-			tagStr = fmt.Sprintf(",%s", strings.Join(tagSlice, ","))
-		}
-		tdenginePayload := []string{fmt.Sprintf("%s%s %s %d", tbMetric.Table, tagStr, strings.Join(metricSlice, ","), tbMetric.Timestamp.Unix())}
-		log.Info(tdenginePayload[0])
+				if _, err := conn.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`;", dbName)); err != nil {
+					errMsg := fmt.Sprintf("failed to create database %s", dbName)
+					log.Error(errMsg)
+					insertErr = errors.Wrapf(err, errMsg)
+					telemetry.ObserveWrite(s.Name, pointsByDB[dbName], started, insertErr)
+					health.Set(s.Name, insertErr)
+					cancel()
+					return
+				}
 
-		if err := conn.InfluxDBInsertLines(tdenginePayload, "s"); err != nil {
-			log.Error(errors.Wrap(err, "failed to insert influxdb lines"))
+				s.databaseMap[dbName] = struct{}{}
+			}
+
+			if _, err := conn.Exec(fmt.Sprintf("USE `%s`", dbName)); err != nil {
+				log.Error(err)
+				telemetry.ObserveWrite(s.Name, pointsByDB[dbName], started, err)
+				health.Set(s.Name, err)
+				continue
+			}
+
+			log.Infof("inserting %d lines into %s", len(linesByDB[dbName]), dbName)
+
+			err := conn.InfluxDBInsertLines(linesByDB[dbName], "s")
+			if err != nil {
+				log.Error(errors.Wrap(err, "failed to insert influxdb lines"))
+			}
+			telemetry.ObserveWrite(s.Name, pointsByDB[dbName], started, err)
+			health.Set(s.Name, err)
 		}
+	})
+
+	return insertErr
+}
+
+func compileInfluxLine(tbMetric models.TimeBasedMetrics) string {
+	tagSlice, metricSlice := compileTDEngineMetricsAndTags(tbMetric)
+
+	tagStr := ""
+	if len(tagSlice) > 0 {
+		tagStr = fmt.Sprintf(",%s", strings.Join(tagSlice, ","))
 	}
 
-	return nil
+	return fmt.Sprintf("%s%s %s %d", measurementEscaper.Replace(tbMetric.Table), tagStr, strings.Join(metricSlice, ","), tbMetric.Timestamp.Unix())
 }
 
+// line protocol separates measurements, tags and fields with commas, equals signs and spaces, so names and tag
+// values containing them are escaped with a backslash
+var measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+var keyEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+
 func compileTDEngineMetricsAndTags(tbMetric models.TimeBasedMetrics) (tagSlice, metricSlice []string) {
 	for key, val := range tbMetric.Tags {
-		tagSlice = append(tagSlice, fmt.Sprintf("%s=%s", key, val))
+		tagSlice = append(tagSlice, fmt.Sprintf("%s=%s", keyEscaper.Replace(key), keyEscaper.Replace(val)))
 	}
 
 	for key, val := range tbMetric.Metrics {
-		metricSlice = append(metricSlice, fmt.Sprintf("%s=%g", key, val))
+		metricSlice = append(metricSlice, fmt.Sprintf("%s=%g", keyEscaper.Replace(key), val))
 	}
 
 	if len(metricSlice) == 0 {
@@ -1,8 +1,11 @@
 package db
 
 import (
+	"database/sql/driver"
+	"reflect"
 	"taos-adapter/models"
 	"testing"
+	"time"
 )
 
 func TestCompileTDEngineMetricsAndTags(t *testing.T) {
@@ -38,6 +41,19 @@ func TestCompileTDEngineMetricsAndTags(t *testing.T) {
 				"location=test_location": struct{}{},
 			},
 		},
+		{
+			name: "Success: escaped names and values",
+			metrics: models.TimeBasedMetrics{
+				Metrics: map[string]float64{"flow rate": 1.5},
+				Tags:    map[string]string{"invalid_reason": "field temp is missing, tag a=b is missing"},
+			},
+			expectedMetrics: map[string]struct{}{
+				`flow\ rate=1.5`: struct{}{},
+			},
+			expectedTags: map[string]struct{}{
+				`invalid_reason=field\ temp\ is\ missing\,\ tag\ a\=b\ is\ missing`: struct{}{},
+			},
+		},
 		{
 			name: "Success: empty metrics",
 			metrics: models.TimeBasedMetrics{
@@ -97,3 +113,15 @@ func TestCompileTDEngineMetricsAndTags(t *testing.T) {
 		}
 	}
 }
+
+func TestQuoteArgs(t *testing.T) {
+	t.Parallel()
+
+	ts := time.Unix(1700000000, 0)
+	args := []interface{}{"kitchen", `it's \ here`, ts, int64(5)}
+
+	expected := []driver.Value{"'kitchen'", `'it\'s \\ here'`, ts, int64(5)}
+	if quoted := quoteArgs(args); !reflect.DeepEqual(quoted, expected) {
+		t.Errorf("expected %q, got %q", expected, quoted)
+	}
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"database/sql/driver"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/taosdata/driver-go/v3/af"
+)
+
+// Ping opens and closes a connection to check that the server accepts them
+func Ping(host string, port int, user, pass string) error {
+	conn, err := af.Open(host, user, pass, "", port)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to tdengine")
+	}
+
+	return conn.Close()
+}
+
+// Query runs a read-only statement on a connection of its own and returns the column names and every row. The
+// driver pastes arguments into the statement as they are, so string arguments are quoted and escaped here.
+func Query(host string, port int, user, pass, query string, args ...interface{}) ([]string, [][]interface{}, error) {
+	conn, err := af.Open(host, user, pass, "", port)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to connect to tdengine")
+	}
+	defer conn.Close()
+
+	rows, err := conn.Query(query, quoteArgs(args)...)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to query tdengine")
+	}
+	defer rows.Close()
+
+	columns := rows.Columns()
+	values := [][]interface{}{}
+	for {
+		row := make([]driver.Value, len(columns))
+		if err := rows.Next(row); err != nil {
+			if errors.Is(err, io.EOF) {
+				return columns, values, nil
+			}
+			return nil, nil, errors.Wrap(err, "failed to read rows")
+		}
+
+		converted := make([]interface{}, len(row))
+		for i, val := range row {
+			converted[i] = val
+		}
+		values = append(values, converted)
+	}
+}
+
+/* quoteArgs turns string arguments into SQL string literals, other arguments are formatted by the driver */
+func quoteArgs(args []interface{}) []driver.Value {
+	quoted := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if s, ok := arg.(string); ok {
+			arg = "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+		}
+		quoted[i] = arg
+	}
+
+	return quoted
+}
@@ -0,0 +1,299 @@
+package fanout
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"taos-adapter/models"
+	"taos-adapter/mqtt"
+	"taos-adapter/telemetry"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	OnFullBlock = "block"
+	OnFullDrop  = "drop"
+
+	OnErrorRestart = "restart"
+	OnErrorExit    = "exit"
+
+	maxRestartBackoff = time.Minute
+	dropLogInterval   = 10 * time.Second
+)
+
+// WriteFunc consumes metrics until the channel is closed or ctx is done, like db.Sink.InsertDatad
+type WriteFunc func(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error
+
+// Sink is a single destination with its own queue
+type Sink struct {
+	Name      string // unique among the sinks
+	Type      string // the kind of destination, several sinks can have the same type
+	Write     WriteFunc
+	QueueSize int
+	Topics    []string    // MQTT topic filters, empty receives every topic
+	OnFull    string      // OnFullBlock waits for queue space, OnFullDrop discards the point
+	OnError   string      // OnErrorRestart restarts the sink with backoff, OnErrorExit stops the adapter
+	Settings  interface{} // the sink settings, a sink whose settings changed is restarted by an update
+
+	queue   chan models.TimeBasedMetrics
+	closed  chan struct{} // closed along with queue
+	done    chan struct{}
+	dropped uint64
+}
+
+// active are the sinks of the running Run
+var activeMu sync.Mutex
+var active []*Sink
+
+// Active returns the sinks currently receiving points
+func Active() []*Sink {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	return active
+}
+
+func setActive(sinks []*Sink) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	active = sinks
+}
+
+/* close stops the sink once it has written the points left in its queue */
+func (s *Sink) close() {
+	close(s.queue)
+	close(s.closed)
+}
+
+/* drained reports whether the queue is closed and every point in it was taken */
+func (s *Sink) drained() bool {
+	select {
+	case <-s.closed:
+		return len(s.queue) == 0
+	default:
+		return false
+	}
+}
+
+/* unchanged reports whether an update can keep s running in place of next */
+func (s *Sink) unchanged(next *Sink) bool {
+	return s.Name == next.Name &&
+		s.Type == next.Type &&
+		s.QueueSize == next.QueueSize &&
+		reflect.DeepEqual(s.Topics, next.Topics) &&
+		s.OnFull == next.OnFull &&
+		s.OnError == next.OnError &&
+		reflect.DeepEqual(s.Settings, next.Settings)
+}
+
+// Dropped returns how many points were discarded because the sink queue was full
+func (s *Sink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Depth returns the number of points waiting in the sink queue
+func (s *Sink) Depth() int {
+	return len(s.queue)
+}
+
+func (s *Sink) accepts(topic string) bool {
+	if len(s.Topics) == 0 {
+		return true
+	}
+
+	for _, filter := range s.Topics {
+		if mqtt.TopicMatches(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Run copies every point from tbMetrics to the queue of each sink subscribed to its topic.
+// A sink with OnErrorExit that fails makes Run return its error, every other failure is handled per sink.
+// Sink lists received on updates replace the running sinks, see update.
+func Run(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics, sinks []*Sink, updates chan []*Sink) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(sinks))
+
+	// a sink replacing a stopping one starts writing once that one is done, its queue takes points meanwhile
+	start := func(sink *Sink, after <-chan struct{}) {
+		sink.queue = make(chan models.TimeBasedMetrics, sink.QueueSize)
+		sink.closed = make(chan struct{})
+		sink.done = make(chan struct{})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(sink.done)
+
+			select {
+			case <-after:
+			case <-ctx.Done():
+				return
+			}
+
+			if err := runSink(ctx, log.WithField("sink", sink.Name), sink); err != nil {
+				select {
+				case errChan <- err:
+				default:
+				}
+				cancel()
+			}
+		}()
+	}
+
+	started := make(chan struct{})
+	close(started)
+	for _, sink := range sinks {
+		start(sink, started)
+	}
+	setActive(sinks)
+
+	sinks = distribute(ctx, log, tbMetrics, sinks, updates, start)
+
+	for _, sink := range sinks {
+		sink.close()
+	}
+	wg.Wait()
+	setActive(nil)
+
+	select {
+	case err := <-errChan:
+		return err
+	default:
+		return nil
+	}
+}
+
+// update swaps the running sinks for next. Unchanged sinks keep running with their queue, removed and changed
+// ones drain their queue and stop in the background. A changed sink starts writing once its previous instance is
+// done, as sinks share package settings, so a sink that can not drain never holds up the others.
+func update(log *logrus.Entry, sinks, next []*Sink, start func(*Sink, <-chan struct{})) []*Sink {
+	running := map[string]*Sink{}
+	for _, sink := range sinks {
+		running[sink.Name] = sink
+	}
+
+	stop := func(sink *Sink) {
+		log.WithField("sink", sink.Name).Infof("stopping sink, draining %d points", len(sink.queue))
+		sink.close()
+		delete(running, sink.Name)
+	}
+
+	updated := make([]*Sink, 0, len(next))
+	for _, sink := range next {
+		after := make(chan struct{})
+		close(after)
+
+		if prev, ok := running[sink.Name]; ok {
+			if prev.unchanged(sink) {
+				updated = append(updated, prev)
+				delete(running, sink.Name)
+				continue
+			}
+			stop(prev)
+			after = prev.done
+		}
+
+		start(sink, after)
+		updated = append(updated, sink)
+	}
+
+	for _, sink := range running {
+		stop(sink)
+	}
+
+	return updated
+}
+
+/* distribute copies points to the sinks until tbMetrics closes or ctx is done, it returns the sinks running then */
+func distribute(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics, sinks []*Sink, updates chan []*Sink, start func(*Sink, <-chan struct{})) []*Sink {
+	lastDropLog := map[string]time.Time{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return sinks
+		case next := <-updates:
+			sinks = update(log, sinks, next, start)
+			setActive(sinks)
+		case m, ok := <-tbMetrics:
+			if !ok {
+				return sinks
+			}
+
+			for _, sink := range sinks {
+				if !sink.accepts(m.Topic) {
+					continue
+				}
+
+				if sink.OnFull == OnFullBlock {
+					select {
+					case sink.queue <- m:
+					case <-ctx.Done():
+						return sinks
+					}
+					continue
+				}
+
+				select {
+				case sink.queue <- m:
+				default:
+					dropped := atomic.AddUint64(&sink.dropped, 1)
+					if time.Since(lastDropLog[sink.Name]) > dropLogInterval {
+						log.WithField("sink", sink.Name).Warnf("queue full, %d points dropped so far", dropped)
+						lastDropLog[sink.Name] = time.Now()
+					}
+				}
+			}
+		}
+	}
+}
+
+/* runSink runs the sink write function, restarting it with backoff until its queue is closed and drained */
+func runSink(ctx context.Context, log *logrus.Entry, sink *Sink) error {
+	backoff := time.Second
+
+	for {
+		log.Info("starting sink")
+		err := sink.Write(ctx, log, sink.queue)
+		if err == nil {
+			log.Info("exiting sink")
+			return nil
+		}
+
+		err = errors.Wrapf(err, "sink %s failed", sink.Name)
+		if sink.OnError == OnErrorExit {
+			return err
+		}
+
+		if sink.drained() {
+			log.Error(errors.Wrap(err, "queue drained, not restarting"))
+			return nil
+		}
+
+		log.Error(errors.Wrapf(err, "restarting in %s", backoff))
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		telemetry.SinkRestarts.WithLabelValues(sink.Name).Inc()
+
+		if backoff *= 2; backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
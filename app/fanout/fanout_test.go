@@ -0,0 +1,285 @@
+package fanout
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"taos-adapter/models"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	topics := []string{"test_db/room", "test_db/hall", "other_db/room"}
+
+	cases := []struct {
+		name           string
+		sinkTopics     []string
+		expectedTopics []string
+	}{
+		{
+			name:           "Success: All topics",
+			expectedTopics: []string{"test_db/room", "test_db/hall", "other_db/room"},
+		},
+		{
+			name:           "Success: Wildcard filter",
+			sinkTopics:     []string{"test_db/+"},
+			expectedTopics: []string{"test_db/room", "test_db/hall"},
+		},
+		{
+			name:           "Success: Several filters",
+			sinkTopics:     []string{"+/room", "test_db/hall"},
+			expectedTopics: []string{"test_db/room", "test_db/hall", "other_db/room"},
+		},
+		{
+			name:           "Success: No matching filter",
+			sinkTopics:     []string{"unknown/#"},
+			expectedTopics: []string{},
+		},
+	}
+
+	received := make([][]string, len(cases))
+	sinks := []*Sink{}
+	for i, c := range cases {
+		i := i
+		sinks = append(sinks, &Sink{
+			Name:      c.name,
+			QueueSize: len(topics),
+			Topics:    c.sinkTopics,
+			OnFull:    OnFullBlock,
+			Write: func(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+				for m := range tbMetrics {
+					received[i] = append(received[i], m.Topic)
+				}
+				return nil
+			},
+		})
+	}
+
+	tbMetrics := make(chan models.TimeBasedMetrics, len(topics))
+	for _, topic := range topics {
+		tbMetrics <- models.TimeBasedMetrics{Topic: topic}
+	}
+	close(tbMetrics)
+
+	if err := Run(context.Background(), logrus.NewEntry(logrus.New()), tbMetrics, sinks, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if len(received[i]) != len(c.expectedTopics) {
+			t.Errorf("expected no. of points %d, got %d", len(c.expectedTopics), len(received[i]))
+			continue
+		}
+
+		for j := range received[i] {
+			if received[i][j] != c.expectedTopics[j] {
+				t.Errorf("expected topic %s, got %s", c.expectedTopics[j], received[i][j])
+			}
+		}
+	}
+}
+
+func TestRunFailures(t *testing.T) {
+	t.Parallel()
+
+	block := make(chan struct{})
+	slow := &Sink{
+		Name:      "slow",
+		QueueSize: 1,
+		OnFull:    OnFullDrop,
+		Write: func(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+			<-block
+			for range tbMetrics {
+			}
+			return nil
+		},
+	}
+
+	fast := &Sink{
+		Name:      "fast",
+		QueueSize: 3,
+		OnFull:    OnFullBlock,
+		Write: func(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+			for range tbMetrics {
+			}
+			close(block)
+			return nil
+		},
+	}
+
+	tbMetrics := make(chan models.TimeBasedMetrics, 3)
+	for i := 0; i < 3; i++ {
+		tbMetrics <- models.TimeBasedMetrics{}
+	}
+	close(tbMetrics)
+
+	if err := Run(context.Background(), logrus.NewEntry(logrus.New()), tbMetrics, []*Sink{slow, fast}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if slow.Dropped() != 2 {
+		t.Errorf("expected slow sink to drop %d points, got %d", 2, slow.Dropped())
+	}
+
+	if fast.Dropped() != 0 {
+		t.Errorf("expected fast sink to drop %d points, got %d", 0, fast.Dropped())
+	}
+
+	failing := &Sink{
+		Name:    "failing",
+		OnError: OnErrorExit,
+		Write: func(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+			return errors.New("connection refused")
+		},
+	}
+
+	if err := Run(context.Background(), logrus.NewEntry(logrus.New()), make(chan models.TimeBasedMetrics), []*Sink{failing}, nil); err == nil {
+		t.Error("expected error from failing sink")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	received := map[string]int{}
+
+	// instance tells sinks with the same name and settings apart
+	newSink := func(name, settings, instance string) *Sink {
+		return &Sink{
+			Name:      name,
+			QueueSize: 10,
+			OnFull:    OnFullBlock,
+			Settings:  settings,
+			Write: func(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+				for range tbMetrics {
+					mu.Lock()
+					received[name+"/"+settings+"/"+instance]++
+					mu.Unlock()
+				}
+				return nil
+			},
+		}
+	}
+
+	kept := newSink("kept", "v1", "first")
+	changed := newSink("changed", "v1", "first")
+	removed := newSink("removed", "v1", "first")
+
+	tbMetrics := make(chan models.TimeBasedMetrics)
+	updates := make(chan []*Sink)
+	errChan := make(chan error)
+
+	go func() {
+		errChan <- Run(context.Background(), logrus.NewEntry(logrus.New()), tbMetrics, []*Sink{kept, changed, removed}, updates)
+	}()
+
+	tbMetrics <- models.TimeBasedMetrics{}
+	updates <- []*Sink{newSink("kept", "v1", "second"), newSink("changed", "v2", "second"), newSink("added", "v1", "second")}
+	tbMetrics <- models.TimeBasedMetrics{}
+
+	close(tbMetrics)
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	// the unchanged sink keeps running, the others drain before they stop
+	expected := map[string]int{
+		"kept/v1/first":     2,
+		"changed/v1/first":  1,
+		"changed/v2/second": 1,
+		"removed/v1/first":  1,
+		"added/v1/second":   1,
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected points %v, got %v", expected, received)
+	}
+}
+
+func TestUpdateFailingSink(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan models.TimeBasedMetrics, 10)
+	up := func(settings string) *Sink {
+		return &Sink{
+			Name:      "up",
+			QueueSize: 10,
+			OnFull:    OnFullBlock,
+			Settings:  settings,
+			Write: func(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+				for m := range tbMetrics {
+					received <- m
+				}
+				return nil
+			},
+		}
+	}
+
+	// a sink whose backend is down keeps the points of its queue and retries
+	down := &Sink{
+		Name:      "down",
+		QueueSize: 10,
+		OnFull:    OnFullBlock,
+		OnError:   OnErrorRestart,
+		Write: func(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+			return errors.New("connection refused")
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tbMetrics := make(chan models.TimeBasedMetrics)
+	updates := make(chan []*Sink)
+	errChan := make(chan error)
+
+	go func() {
+		errChan <- Run(ctx, logrus.NewEntry(logrus.New()), tbMetrics, []*Sink{down, up("v1")}, updates)
+	}()
+
+	tbMetrics <- models.TimeBasedMetrics{Topic: "first"}
+	<-received
+
+	// removing the failing sink must not hold up the points of the others
+	updates <- []*Sink{up("v2")}
+	tbMetrics <- models.TimeBasedMetrics{Topic: "second"}
+
+	select {
+	case m := <-received:
+		if m.Topic != "second" {
+			t.Errorf("expected the second point, got %s", m.Topic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected points to reach the running sinks while the removed sink retries")
+	}
+
+	cancel()
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunSinkDrained(t *testing.T) {
+	t.Parallel()
+
+	sink := &Sink{
+		Name:    "down",
+		OnError: OnErrorRestart,
+		Write: func(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+			return errors.New("connection refused")
+		},
+		queue:  make(chan models.TimeBasedMetrics),
+		closed: make(chan struct{}),
+	}
+	sink.close()
+
+	if err := runSink(context.Background(), logrus.NewEntry(logrus.New()), sink); err != nil {
+		t.Errorf("expected a drained sink to stop without restarting, got %v", err)
+	}
+}
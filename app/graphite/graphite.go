@@ -0,0 +1,242 @@
+package graphite
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"taos-adapter/batch"
+	"taos-adapter/models"
+	"taos-adapter/telemetry"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ProtocolPlaintext = "plaintext"
+	ProtocolPickle    = "pickle"
+
+	DefaultPathTemplate = "{db}.{table}.{tags}.{field}"
+)
+
+// tag placeholders left after the tags of a point were replaced, their tag is missing
+var missingTagPattern = regexp.MustCompile(`\{tag:[^}]*\}`)
+
+// Sink is a carbon receiver, Name labels its metrics
+type Sink struct {
+	Name          string
+	Addr          string // host:port
+	Protocol      string // ProtocolPlaintext or ProtocolPickle
+	Tagged        bool   // send tags as graphite tagged series instead of path nodes
+	PathTemplate  string
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	Timeout       time.Duration
+}
+
+// Send batches metrics and writes them to a carbon receiver, reconnecting whenever a write fails. A retry sends the
+// whole batch again, as the receiver may have stored part of it the delivery is at least once.
+func (s *Sink) Send(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+	var conn net.Conn
+	var connected bool
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	log.Infof("sending %s to %s", s.Protocol, s.Addr)
+
+	batch.Consume(ctx, tbMetrics, s.BatchSize, s.FlushInterval, func(points []models.TimeBasedMetrics) {
+		datapoints := s.compileDatapoints(points)
+		if len(datapoints) == 0 {
+			return
+		}
+
+		var payload []byte
+		if s.Protocol == ProtocolPickle {
+			payload = encodePickle(datapoints)
+		} else {
+			payload = encodePlaintext(datapoints)
+		}
+
+		started := time.Now()
+		err := batch.Retry(ctx, s.MaxRetries, time.Second, func() error {
+			if conn == nil {
+				var err error
+				conn, err = net.DialTimeout("tcp", s.Addr, s.Timeout)
+				if err != nil {
+					return errors.Wrapf(err, "failed to connect to %s", s.Addr)
+				}
+				log.Infof("connected to %s", s.Addr)
+
+				if connected {
+					telemetry.Reconnects.WithLabelValues(s.Name).Inc()
+				}
+				connected = true
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(s.Timeout))
+			if _, err := conn.Write(payload); err != nil {
+				conn.Close()
+				conn = nil
+				return errors.Wrap(err, "failed to write to carbon")
+			}
+
+			return nil
+		})
+		if err != nil {
+			log.Error(errors.Wrapf(err, "failed to send %d points", len(points)))
+		}
+		telemetry.ObserveWrite(s.Name, points, started, err)
+	})
+
+	return nil
+}
+
+type datapoint struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+func (s *Sink) compileDatapoints(points []models.TimeBasedMetrics) []datapoint {
+	datapoints := []datapoint{}
+
+	for _, point := range points {
+		for field, value := range point.Metrics {
+			datapoints = append(datapoints, datapoint{
+				path:      s.compilePath(point, field),
+				value:     value,
+				timestamp: point.Timestamp.Unix(),
+			})
+		}
+	}
+
+	return datapoints
+}
+
+/* compilePath renders the path template for a single field, tags are appended graphite tag style when Tagged is set */
+func (s *Sink) compilePath(point models.TimeBasedMetrics, field string) string {
+	tagKeys := make([]string, 0, len(point.Tags))
+	for key := range point.Tags {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+
+	tagValues := []string{}
+	if !s.Tagged {
+		for _, key := range tagKeys {
+			tagValues = append(tagValues, sanitizeNode(point.Tags[key]))
+		}
+	}
+
+	replacements := []string{
+		"{db}", sanitizeNode(point.DB),
+		"{table}", sanitizeNode(point.Table),
+		"{field}", sanitizeNode(field),
+		"{tags}", strings.Join(tagValues, "."),
+	}
+	for key, val := range point.Tags {
+		replacements = append(replacements, fmt.Sprintf("{tag:%s}", key), sanitizeNode(val))
+	}
+
+	path := strings.NewReplacer(replacements...).Replace(s.PathTemplate)
+	path = missingTagPattern.ReplaceAllString(path, "")
+
+	// drop empty nodes left behind by empty placeholders and missing tags
+	nodes := []string{}
+	for _, node := range strings.Split(path, ".") {
+		if node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	path = strings.Join(nodes, ".")
+
+	if s.Tagged {
+		for _, key := range tagKeys {
+			path = fmt.Sprintf("%s;%s=%s", path, sanitizeTag(key), sanitizeTag(point.Tags[key]))
+		}
+	}
+
+	return path
+}
+
+// sanitizeNode keeps a value within a single path node
+func sanitizeNode(node string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ' ', '\t', '\n', ';', '/', '\\':
+			return '_'
+		}
+
+		return r
+	}, node)
+}
+
+// sanitizeTag strips characters graphite does not allow in tag names and values
+func sanitizeTag(tag string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', ';', '~', '!', '^', '=':
+			return '_'
+		}
+
+		return r
+	}, tag)
+}
+
+func encodePlaintext(datapoints []datapoint) []byte {
+	var buf bytes.Buffer
+	for _, dp := range datapoints {
+		fmt.Fprintf(&buf, "%s %s %d\n", dp.path, strconv.FormatFloat(dp.value, 'f', -1, 64), dp.timestamp)
+	}
+
+	return buf.Bytes()
+}
+
+const (
+	pickleProto     = 0x80
+	pickleEmptyList = ']'
+	pickleMark      = '('
+	pickleAppends   = 'e'
+	pickleStop      = '.'
+	pickleUnicode   = 'X'
+	pickleFloat     = 'G'
+	pickleTuple2    = 0x86
+)
+
+/* encodePickle builds a length prefixed protocol 2 pickle of [(path, (timestamp, value)), ...] as carbon expects */
+func encodePickle(datapoints []datapoint) []byte {
+	var body bytes.Buffer
+	body.Write([]byte{pickleProto, 2, pickleEmptyList, pickleMark})
+
+	for _, dp := range datapoints {
+		body.WriteByte(pickleUnicode)
+		binary.Write(&body, binary.LittleEndian, uint32(len(dp.path)))
+		body.WriteString(dp.path)
+
+		body.WriteByte(pickleFloat)
+		binary.Write(&body, binary.BigEndian, math.Float64bits(float64(dp.timestamp)))
+		body.WriteByte(pickleFloat)
+		binary.Write(&body, binary.BigEndian, math.Float64bits(dp.value))
+
+		body.Write([]byte{pickleTuple2, pickleTuple2})
+	}
+
+	body.Write([]byte{pickleAppends, pickleStop})
+
+	payload := make([]byte, 4, 4+body.Len())
+	binary.BigEndian.PutUint32(payload, uint32(body.Len()))
+
+	return append(payload, body.Bytes()...)
+}
@@ -0,0 +1,119 @@
+package graphite
+
+import (
+	"bytes"
+	"taos-adapter/models"
+	"testing"
+	"time"
+)
+
+func TestCompilePath(t *testing.T) {
+	cases := []struct {
+		name         string
+		template     string
+		tagged       bool
+		point        models.TimeBasedMetrics
+		expectedPath string
+	}{
+		{
+			name:     "Success: Default template",
+			template: DefaultPathTemplate,
+			point: models.TimeBasedMetrics{
+				Tags: map[string]string{
+					"name":     "test_metric",
+					"location": "test location",
+				},
+				DB:    "test_db",
+				Table: "room.1",
+			},
+			expectedPath: "test_db.room_1.test_location.test_metric.temp",
+		},
+		{
+			name:     "Success: Default template without tags",
+			template: DefaultPathTemplate,
+			point: models.TimeBasedMetrics{
+				DB:    "test_db",
+				Table: "room",
+			},
+			expectedPath: "test_db.room.temp",
+		},
+		{
+			name:     "Success: Single tag placeholder",
+			template: "sensors.{tag:location}.{field}",
+			point: models.TimeBasedMetrics{
+				Tags: map[string]string{
+					"name":     "test_metric",
+					"location": "test_location",
+				},
+				DB:    "test_db",
+				Table: "room",
+			},
+			expectedPath: "sensors.test_location.temp",
+		},
+		{
+			name:     "Success: Missing tag placeholder",
+			template: "sensors.{tag:location}.{tag:floor}.{field}",
+			point: models.TimeBasedMetrics{
+				Tags: map[string]string{
+					"location": "test_location",
+				},
+				DB:    "test_db",
+				Table: "room",
+			},
+			expectedPath: "sensors.test_location.temp",
+		},
+		{
+			name:     "Success: Tagged series",
+			template: DefaultPathTemplate,
+			tagged:   true,
+			point: models.TimeBasedMetrics{
+				Tags: map[string]string{
+					"name":     "test_metric",
+					"location": "test;location",
+				},
+				DB:    "test_db",
+				Table: "room",
+			},
+			expectedPath: "test_db.room.temp;location=test_location;name=test_metric",
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		s := &Sink{PathTemplate: c.template, Tagged: c.tagged}
+		if path := s.compilePath(c.point, "temp"); path != c.expectedPath {
+			t.Errorf("expected path %q, got %q", c.expectedPath, path)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	t.Parallel()
+
+	datapoints := []datapoint{
+		{
+			path:      "test_db.room.temp",
+			value:     22.5,
+			timestamp: time.Unix(1257894000, 0).Unix(),
+		},
+	}
+
+	expectedPlaintext := []byte("test_db.room.temp 22.5 1257894000\n")
+	if plaintext := encodePlaintext(datapoints); !bytes.Equal(plaintext, expectedPlaintext) {
+		t.Errorf("expected plaintext %q, got %q", expectedPlaintext, plaintext)
+	}
+
+	expectedPickle := []byte{
+		0, 0, 0, 48, // length header
+		0x80, 2, ']', '(',
+		'X', 17, 0, 0, 0, 't', 'e', 's', 't', '_', 'd', 'b', '.', 'r', 'o', 'o', 'm', '.', 't', 'e', 'm', 'p',
+		'G', 0x41, 0xd2, 0xbe, 0x7c, 0x1c, 0x00, 0x00, 0x00,
+		'G', 0x40, 0x36, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x86, 0x86,
+		'e', '.',
+	}
+	if pickle := encodePickle(datapoints); !bytes.Equal(pickle, expectedPickle) {
+		t.Errorf("expected pickle %v, got %v", expectedPickle, pickle)
+	}
+}
@@ -0,0 +1,179 @@
+package health
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Component is the state of a dependency of the adapter as reported on /status
+type Component struct {
+	Healthy       bool       `json:"healthy"`
+	Critical      bool       `json:"critical"` // the adapter is not ready while a critical component is unhealthy
+	Since         time.Time  `json:"since"`    // when Healthy last changed
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+// errNotReported is shown until a registered component reports for the first time
+const errNotReported = "not reported yet"
+
+var mu sync.Mutex
+var components = map[string]*Component{}
+var checks = map[string]func() error{}
+
+// Register adds a component that is unhealthy until it reports with Set
+func Register(name string, critical bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	components[name] = &Component{Critical: critical, Since: time.Now(), LastError: errNotReported}
+}
+
+// RegisterCheck adds a component whose state is found by calling check whenever the status is read
+func RegisterCheck(name string, critical bool, check func() error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	components[name] = &Component{Critical: critical, Since: time.Now()}
+	checks[name] = check
+}
+
+// Unregister removes a component the adapter no longer depends on
+func Unregister(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	delete(components, name)
+	delete(checks, name)
+}
+
+// Set records the state of a component, err is nil when it is healthy. Components that were not registered
+// are added as non critical.
+func Set(name string, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	set(name, err, time.Now())
+}
+
+func set(name string, err error, now time.Time) {
+	c, ok := components[name]
+	if !ok {
+		c = &Component{Since: now}
+		components[name] = c
+	}
+
+	healthy := err == nil
+	if healthy != c.Healthy {
+		c.Healthy = healthy
+		c.Since = now
+	}
+
+	if err != nil {
+		c.LastError = err.Error()
+		c.LastErrorTime = &now
+	} else if c.LastError == errNotReported {
+		c.LastError = ""
+	}
+}
+
+// Status runs the checks and returns whether every critical component is healthy, along with a copy of all
+// components. The checks run without holding the lock, so a slow one does not hold back Set.
+func Status() (bool, map[string]Component) {
+	mu.Lock()
+	pending := make(map[string]func() error, len(checks))
+	for name, check := range checks {
+		pending[name] = check
+	}
+	mu.Unlock()
+
+	results := make(map[string]error, len(pending))
+	for name, check := range pending {
+		results[name] = check()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	for name, err := range results {
+		// a component unregistered while its check ran stays gone
+		if _, ok := checks[name]; ok {
+			set(name, err, now)
+		}
+	}
+
+	ready := true
+	status := make(map[string]Component, len(components))
+	for name, c := range components {
+		status[name] = *c
+		if c.Critical && !c.Healthy {
+			ready = false
+		}
+	}
+
+	return ready, status
+}
+
+// Unhealthy returns the sorted names of the critical components that are unhealthy
+func Unhealthy(status map[string]Component) []string {
+	names := []string{}
+	for name, c := range status {
+		if c.Critical && !c.Healthy {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Cached wraps check so it runs at most once per interval, reads in between get the last result. A check taking
+// longer than timeout fails and is not started again before it returned, its late result is kept.
+func Cached(check func() error, interval, timeout time.Duration) func() error {
+	var mu sync.Mutex
+	var last error
+	var checked time.Time
+	running := false
+
+	return func() error {
+		mu.Lock()
+		if running || (!checked.IsZero() && time.Since(checked) < interval) {
+			defer mu.Unlock()
+			return last
+		}
+		running = true
+		mu.Unlock()
+
+		done := make(chan error, 1)
+		go func() {
+			err := check()
+
+			mu.Lock()
+			running = false
+			last = err
+			checked = time.Now()
+			mu.Unlock()
+
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(timeout):
+			err := fmt.Errorf("check timed out after %s", timeout)
+
+			mu.Lock()
+			if running {
+				last = err
+				checked = time.Now()
+			}
+			mu.Unlock()
+
+			return err
+		}
+	}
+}
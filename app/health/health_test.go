@@ -0,0 +1,147 @@
+package health
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestStatus(t *testing.T) {
+	t.Parallel()
+
+	var bufferErr error
+
+	Register("mqtt", true)
+	Register("graphite", false)
+	RegisterCheck("buffers", true, func() error { return bufferErr })
+
+	cases := []struct {
+		name              string
+		update            func()
+		expectedReady     bool
+		expectedUnhealthy []string
+	}{
+		{
+			name:              "Failure: Not reported yet",
+			update:            func() {},
+			expectedUnhealthy: []string{"mqtt"},
+		},
+		{
+			name:          "Success: Critical components healthy",
+			update:        func() { Set("mqtt", nil) },
+			expectedReady: true,
+		},
+		{
+			name:          "Success: Non critical component failing",
+			update:        func() { Set("graphite", errors.New("connection refused")) },
+			expectedReady: true,
+		},
+		{
+			name:              "Failure: Check failing",
+			update:            func() { bufferErr = errors.New("ingest queue full") },
+			expectedUnhealthy: []string{"buffers"},
+		},
+		{
+			name: "Failure: Connection lost",
+			update: func() {
+				bufferErr = nil
+				Set("mqtt", errors.New("connection reset"))
+			},
+			expectedUnhealthy: []string{"mqtt"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		c.update()
+
+		ready, status := Status()
+		if ready != c.expectedReady {
+			t.Errorf("expected ready: %t, got: %t", c.expectedReady, ready)
+		}
+
+		if unhealthy := Unhealthy(status); len(unhealthy) != len(c.expectedUnhealthy) || (len(unhealthy) > 0 && !reflect.DeepEqual(unhealthy, c.expectedUnhealthy)) {
+			t.Errorf("expected unhealthy %v, got %v", c.expectedUnhealthy, unhealthy)
+		}
+	}
+
+	_, status := Status()
+	if c := status["mqtt"]; c.LastError != "connection reset" || c.LastErrorTime == nil {
+		t.Errorf("expected last error to be kept, got %+v", c)
+	}
+
+	if c := status["buffers"]; !c.Healthy || c.LastError != "ingest queue full" {
+		t.Errorf("expected recovered check to keep its last error, got %+v", c)
+	}
+}
+
+func TestStatusCheckUnlocked(t *testing.T) {
+	t.Parallel()
+
+	// a check that reports another component would deadlock if checks ran under the lock
+	RegisterCheck("reporting", false, func() error {
+		Set("reported", nil)
+		return nil
+	})
+	defer Unregister("reporting")
+	defer Unregister("reported")
+
+	if _, status := Status(); !status["reporting"].Healthy {
+		t.Errorf("expected check to be healthy, got %+v", status["reporting"])
+	}
+}
+
+func TestCached(t *testing.T) {
+	t.Parallel()
+
+	calls := make(chan struct{}, 10)
+	release := make(chan struct{})
+	var result error
+
+	check := Cached(func() error {
+		calls <- struct{}{}
+		<-release
+		return result
+	}, time.Hour, 10*time.Millisecond)
+
+	cases := []struct {
+		name          string
+		expectedError bool
+		expectedCalls int
+	}{
+		{name: "Failure: Timed out", expectedError: true, expectedCalls: 1},
+		{name: "Failure: Still running", expectedError: true, expectedCalls: 0},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if err := check(); (err != nil) != c.expectedError {
+			t.Errorf("expected error: %t, got: %v", c.expectedError, err)
+		}
+		if len(calls) != c.expectedCalls {
+			t.Errorf("expected %d calls, got %d", c.expectedCalls, len(calls))
+		}
+		for len(calls) > 0 {
+			<-calls
+		}
+	}
+
+	// the late result replaces the timeout and is cached for the interval
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for check() != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	result = errors.New("unreachable")
+	if err := check(); err != nil {
+		t.Errorf("expected cached result, got: %v", err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("expected no call within the interval, got %d", len(calls))
+	}
+}
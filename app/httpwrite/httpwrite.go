@@ -0,0 +1,298 @@
+package httpwrite
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"taos-adapter/models"
+	"taos-adapter/mqtt"
+	"taos-adapter/query"
+	"taos-adapter/telemetry"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// precisions are the timestamp units of line protocol accepted by the precision query parameter
+var precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// LineError reports a record of a request that was rejected
+type LineError struct {
+	Line  int    `json:"line"` // the line of the body, or the position in a JSON array, counted from 1
+	Error string `json:"error"`
+}
+
+// Endpoint accepts the payloads MQTT messages carry over HTTP, for devices that can not speak MQTT. Points are
+// passed to the same channel as the ones of mqtt.Sub, so they go through the pipeline and the sinks alike.
+type Endpoint struct {
+	Token       string   // expected as a bearer token on every request, every request is refused when empty
+	Databases   []string // the databases requests may write to, * for any
+	MaxBodySize int64
+	Out         chan models.TimeBasedMetrics
+
+	// held for reading while a request sends points, so Stop can wait for them before Out is closed
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// Register adds POST /write/<db>/<table>
+func (e *Endpoint) Register(r gin.IRouter) {
+	r.POST("/write/:db/:table", e.authorize, e.write)
+}
+
+// Stop refuses new requests and waits for the ones sending points, after it returns Out can be closed
+func (e *Endpoint) Stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stopped = true
+}
+
+/* authorize refuses requests without the write token and databases it may not write to */
+func (e *Endpoint) authorize(ctx *gin.Context) {
+	token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if e.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(e.Token)) != 1 {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid write token"})
+		return
+	}
+
+	if !query.Allowed(e.Databases, ctx.Param("db")) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("not allowed to write database %s", ctx.Param("db"))})
+		return
+	}
+
+	ctx.Next()
+}
+
+// write parses every record of the body and passes the valid ones on. It answers 200 when at least one record was
+// accepted and 400 when none was, listing the rejected records either way. A request cancelled while points are sent
+// reports the ones already passed on, so a client does not send them twice.
+func (e *Endpoint) write(ctx *gin.Context) {
+	db, table := ctx.Param("db"), ctx.Param("table")
+	for _, name := range []string{db, table} {
+		if err := query.ValidateName(name); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	topic := db + "/" + table
+
+	body, err := io.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, e.MaxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("body exceeds %d bytes", e.MaxBodySize)})
+			return
+		}
+
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": errors.Wrap(err, "failed to read body").Error()})
+		return
+	}
+
+	parser, err := selectParser(ctx, topic, body)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	precision, ok := precisions[ctx.DefaultQuery("precision", "ns")]
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "precision must be one of ns, us, ms, s"})
+		return
+	}
+
+	records, lineErrors := split(parser, body)
+	if len(records) == 0 && len(lineErrors) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "empty body"})
+		return
+	}
+
+	points := []models.TimeBasedMetrics{}
+	for _, r := range records {
+		point, err := mqtt.ParseRecord(parser, r.data, precision)
+		if err != nil {
+			telemetry.ParseFailures.WithLabelValues(parser).Inc()
+			lineErrors = append(lineErrors, LineError{Line: r.line, Error: err.Error()})
+			continue
+		}
+
+		if point.Timestamp.IsZero() {
+			point.Timestamp = time.Now()
+		}
+
+		points = append(points, models.TimeBasedMetrics{
+			Metrics:   point.Metrics,
+			Tags:      point.Tags,
+			Timestamp: point.Timestamp,
+			DB:        db,
+			Table:     table,
+			Topic:     topic,
+		})
+	}
+
+	if len(points) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"accepted": 0, "rejected": len(lineErrors), "errors": lineErrors})
+		return
+	}
+
+	sent, err := e.send(ctx, points)
+	if sent == 0 {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	telemetry.MessagesReceived.WithLabelValues(topic).Inc()
+
+	if err != nil {
+		ctx.JSON(http.StatusOK, gin.H{"accepted": sent, "rejected": len(lineErrors), "errors": lineErrors, "error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"accepted": len(points), "rejected": len(lineErrors), "errors": lineErrors})
+}
+
+// send passes points on unless the endpoint stopped, waiting like an MQTT message when the pipeline is busy. It returns
+// how many were passed on, the first ones in order, along with the error that stopped it before the rest.
+func (e *Endpoint) send(ctx *gin.Context, points []models.TimeBasedMetrics) (int, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.stopped {
+		return 0, errors.New("shutting down")
+	}
+
+	for i, point := range points {
+		select {
+		case e.Out <- point:
+		case <-ctx.Request.Context().Done():
+			return i, fmt.Errorf("request cancelled after %d of %d points", i, len(points))
+		}
+	}
+
+	return len(points), nil
+}
+
+// selectParser picks the parser from the parser query parameter, then the content type, then the parser of the
+// MQTT subscription matching db/table, falling back to detecting JSON or CSV from the body
+func selectParser(ctx *gin.Context, topic string, body []byte) (string, error) {
+	parser := ctx.Query("parser")
+
+	if parser == "" {
+		mediaType, _, _ := mime.ParseMediaType(ctx.ContentType())
+		switch mediaType {
+		case "application/json", "application/x-ndjson":
+			parser = mqtt.ParserJSON
+		case "text/csv":
+			parser = mqtt.ParserCSV
+		case "text/plain":
+			parser = mqtt.ParserLine
+		default:
+			parser = mqtt.ParserFor(topic)
+		}
+	}
+
+	switch parser {
+	case mqtt.ParserAuto:
+		return mqtt.DetectParser(body), nil
+	case mqtt.ParserJSON, mqtt.ParserCSV, mqtt.ParserLine:
+		return parser, nil
+	default:
+		return "", fmt.Errorf("parser must be one of %s, %s, %s, %s, got: %q", mqtt.ParserAuto, mqtt.ParserJSON, mqtt.ParserCSV, mqtt.ParserLine, parser)
+	}
+}
+
+type record struct {
+	line int
+	data []byte
+}
+
+// split cuts the body into records: JSON into its array elements, the whole body when it is a single value or one
+// record per value of a value stream, CSV into a record per row with the header of the first line, and line protocol
+// into a record per line without comments
+func split(parser string, body []byte) ([]record, []LineError) {
+	if parser == mqtt.ParserJSON {
+		return splitJSON(body)
+	}
+
+	records := []record{}
+	var header []byte
+	for i, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || (parser == mqtt.ParserLine && line[0] == '#') {
+			continue
+		}
+
+		if parser == mqtt.ParserCSV {
+			if header == nil {
+				header = line
+				continue
+			}
+			line = bytes.Join([][]byte{header, line}, []byte("\n"))
+		}
+
+		records = append(records, record{line: i + 1, data: line})
+	}
+
+	if parser == mqtt.ParserCSV && len(records) == 0 {
+		return records, []LineError{{Line: 1, Error: "expected a header and at least one row"}}
+	}
+
+	return records, []LineError{}
+}
+
+/* splitJSON cuts a JSON body into records, see split */
+func splitJSON(body []byte) ([]record, []LineError) {
+	records := []record{}
+
+	trimmed := bytes.TrimSpace(body)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		var elements []json.RawMessage
+		if err := json.Unmarshal(trimmed, &elements); err != nil {
+			return records, []LineError{{Line: 1, Error: errors.Wrap(err, "failed to parse JSON array").Error()}}
+		}
+
+		for i, element := range elements {
+			records = append(records, record{line: i + 1, data: element})
+		}
+		return records, []LineError{}
+	}
+
+	if len(trimmed) == 0 {
+		return records, []LineError{}
+	}
+
+	if json.Valid(trimmed) {
+		return append(records, record{line: 1, data: trimmed}), []LineError{}
+	}
+
+	// newline delimited JSON, every value is numbered by the line it starts on; the stream can not be resynchronized
+	// after a syntax error, so the remaining values are reported as one error
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for {
+		start := decoder.InputOffset()
+		start += int64(len(body[start:]) - len(bytes.TrimLeft(body[start:], " \t\r\n")))
+		line := bytes.Count(body[:start], []byte("\n")) + 1
+
+		var value json.RawMessage
+		err := decoder.Decode(&value)
+		if err == io.EOF {
+			return records, []LineError{}
+		}
+		if err != nil {
+			return records, []LineError{{Line: line, Error: errors.Wrap(err, "failed to parse JSON").Error()}}
+		}
+
+		records = append(records, record{line: line, data: value})
+	}
+}
@@ -0,0 +1,204 @@
+package httpwrite
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"taos-adapter/models"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWrite(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cases := []struct {
+		name        string
+		url         string
+		token       string
+		contentType string
+		body        string
+		stopped     bool
+		status      int
+		contains    string
+		points      int
+	}{
+		{name: "Failure: Missing token", url: "/write/test/sensor", body: `{"temp": 21.5}`, status: http.StatusUnauthorized},
+		{name: "Failure: Wrong token", url: "/write/test/sensor", token: "guess", body: `{"temp": 21.5}`, status: http.StatusUnauthorized},
+		{
+			name: "Failure: Database not allowed", url: "/write/other/sensor", token: "secret",
+			body: `{"temp": 21.5}`, status: http.StatusForbidden, contains: "not allowed to write database other",
+		},
+		{
+			name: "Failure: Invalid table", url: "/write/test/sensor%3F", token: "secret",
+			body: `{"temp": 21.5}`, status: http.StatusBadRequest, contains: "invalid name",
+		},
+		{
+			name: "Success: JSON array with an invalid element", url: "/write/test/sensor", token: "secret", contentType: "application/json",
+			body: `[{"temp": 21.5}, "garbage", {"temp": 22}]`, status: http.StatusOK, contains: `"accepted":2,"errors":[{"line":2`, points: 2,
+		},
+		{
+			name: "Success: Newline delimited JSON", url: "/write/test/sensor", token: "secret", contentType: "application/x-ndjson",
+			body: "{\"temp\": 21.5}\n\n{\"temp\": 22}\n", status: http.StatusOK, contains: `"accepted":2`, points: 2,
+		},
+		{
+			name: "Success: Indented JSON object", url: "/write/test/sensor", token: "secret", contentType: "application/json",
+			body: "{\n  \"temp\": 21.5,\n  \"humidity\": 40\n}\n", status: http.StatusOK, contains: `"accepted":1`, points: 1,
+		},
+		{
+			name: "Success: Stream of indented JSON objects", url: "/write/test/sensor", token: "secret", contentType: "application/x-ndjson",
+			body: "{\n  \"temp\": 21.5\n}\n{\n  \"temp\": 22\n}\n{\"temp\": }\n", status: http.StatusOK,
+			contains: `"accepted":2,"errors":[{"line":7`, points: 2,
+		},
+		{
+			name: "Success: CSV rows", url: "/write/test/sensor", token: "secret", contentType: "text/csv",
+			body: "temp;humidity\n21.5;40\n22;41\n", status: http.StatusOK, contains: `"accepted":2`, points: 2,
+		},
+		{
+			name: "Success: Line protocol with precision", url: "/write/test/sensor?precision=s", token: "secret", contentType: "text/plain",
+			body: "# a comment\nweather,room=kitchen temp=21.5 1700000000\nweather temp=oops\n", status: http.StatusOK,
+			contains: `"accepted":1,"errors":[{"line":3`, points: 1,
+		},
+		{
+			name: "Success: Parser from query", url: "/write/test/sensor?parser=line", token: "secret", contentType: "application/json",
+			body: "weather temp=21.5", status: http.StatusOK, contains: `"accepted":1`, points: 1,
+		},
+		{
+			name: "Success: Detected parser", url: "/write/test/sensor", token: "secret",
+			body: `{"temp": 21.5}`, status: http.StatusOK, contains: `"accepted":1`, points: 1,
+		},
+		{
+			name: "Failure: All records invalid", url: "/write/test/sensor", token: "secret", contentType: "text/plain",
+			body: "weather\nweather temp=\n", status: http.StatusBadRequest, contains: `"accepted":0,"errors":[{"line":1`,
+		},
+		{name: "Failure: Empty body", url: "/write/test/sensor", token: "secret", contentType: "text/plain", body: "\n", status: http.StatusBadRequest, contains: "empty body"},
+		{
+			name: "Failure: Unknown parser", url: "/write/test/sensor?parser=xml", token: "secret",
+			body: `{"temp": 21.5}`, status: http.StatusBadRequest, contains: "parser must be one of",
+		},
+		{
+			name: "Failure: Unknown precision", url: "/write/test/sensor?precision=h", token: "secret", contentType: "text/plain",
+			body: "weather temp=21.5", status: http.StatusBadRequest, contains: "precision must be one of",
+		},
+		{
+			name: "Failure: Too large", url: "/write/test/sensor", token: "secret", contentType: "text/plain",
+			body: strings.Repeat("weather temp=21.5\n", 10), status: http.StatusRequestEntityTooLarge, contains: "exceeds 128 bytes",
+		},
+		{
+			name: "Failure: Stopped", url: "/write/test/sensor", token: "secret", contentType: "text/plain",
+			body: "weather temp=21.5", stopped: true, status: http.StatusServiceUnavailable, contains: "shutting down",
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			t.Logf("starting test case: %s", c.name)
+
+			out := make(chan models.TimeBasedMetrics, 10)
+			e := &Endpoint{Token: "secret", Databases: []string{"test"}, MaxBodySize: 128, Out: out}
+			if c.stopped {
+				e.Stop()
+			}
+
+			r := gin.New()
+			e.Register(r)
+
+			req := httptest.NewRequest(http.MethodPost, c.url, strings.NewReader(c.body))
+			if c.token != "" {
+				req.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			if c.contentType != "" {
+				req.Header.Set("Content-Type", c.contentType)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != c.status {
+				t.Errorf("expected status %d, got %d: %s", c.status, w.Code, w.Body.String())
+			}
+
+			if !strings.Contains(w.Body.String(), c.contains) {
+				t.Errorf("expected body to contain %s, got %s", c.contains, w.Body.String())
+			}
+
+			if len(out) != c.points {
+				t.Fatalf("expected %d points, got %d", c.points, len(out))
+			}
+
+			for i := 0; i < c.points; i++ {
+				point := <-out
+				if point.DB != "test" || point.Table != "sensor" || point.Topic != "test/sensor" {
+					t.Errorf("expected point for test/sensor, got %+v", point)
+				}
+
+				if point.Timestamp.IsZero() {
+					t.Errorf("expected a timestamp, got none")
+				}
+			}
+		})
+	}
+}
+
+func TestWritePrecision(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	out := make(chan models.TimeBasedMetrics, 1)
+	e := &Endpoint{Token: "secret", Databases: []string{"*"}, MaxBodySize: 1024, Out: out}
+	r := gin.New()
+	e.Register(r)
+
+	req := httptest.NewRequest(http.MethodPost, "/write/test/sensor?precision=ms", strings.NewReader("weather,room=kitchen temp=21.5,on=t 1700000000123"))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	point := <-out
+	if !point.Timestamp.Equal(time.UnixMilli(1700000000123)) {
+		t.Errorf("expected timestamp in milliseconds, got %s", point.Timestamp)
+	}
+
+	if point.Metrics["temp"] != 21.5 || point.Metrics["on"] != 1 || point.Tags["room"] != "kitchen" {
+		t.Errorf("expected metrics and tags of the line, got %+v and %+v", point.Metrics, point.Tags)
+	}
+}
+
+func TestWriteCancelled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// room for one of the two points, the second waits until the request is cancelled
+	out := make(chan models.TimeBasedMetrics, 1)
+	e := &Endpoint{Token: "secret", Databases: []string{"*"}, MaxBodySize: 1024, Out: out}
+	r := gin.New()
+	e.Register(r)
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req := httptest.NewRequest(http.MethodPost, "/write/test/sensor", strings.NewReader("weather temp=21.5\nweather temp=22\n")).WithContext(reqCtx)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if !strings.Contains(w.Body.String(), `"accepted":1`) || !strings.Contains(w.Body.String(), "cancelled after 1 of 2 points") {
+		t.Errorf("expected the sent point to be reported, got %s", w.Body.String())
+	}
+
+	if len(out) != 1 {
+		t.Errorf("expected 1 point, got %d", len(out))
+	}
+}
@@ -3,9 +3,11 @@ package models
 import "time"
 
 type TimeBasedMetrics struct {
-	Metrics   map[string]float64 // ints also fall here, however they're formatted with %g
-	Tags      map[string]string
-	Timestamp time.Time
-	DB        string
-	Table     string
+	Metrics    map[string]float64 // ints also fall here, however they're formatted with %g
+	Tags       map[string]string
+	Timestamp  time.Time
+	DB         string
+	Table      string
+	Topic      string            // MQTT topic the metrics were received on
+	Properties map[string]string // MQTT v5 user properties of the message
 }
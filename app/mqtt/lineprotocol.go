@@ -0,0 +1,148 @@
+package mqtt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// parseLine parses a line of InfluxDB line protocol: measurement[,tag=value...] field=value[,field=value...]
+// [timestamp]. The measurement is ignored as the table comes from the topic. Integer, unsigned and boolean fields
+// become metrics like floats, string fields become tags like JSON strings. The timestamp is counted in precision.
+func parseLine(line []byte, precision time.Duration) (map[string]float64, map[string]string, time.Time, error) {
+	var timestamp time.Time
+
+	sections := []string{}
+	for _, section := range splitUnescaped(strings.TrimSpace(string(line)), ' ') {
+		if section != "" {
+			sections = append(sections, section)
+		}
+	}
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, nil, timestamp, fmt.Errorf("expected measurement, fields and an optional timestamp, got %d sections", len(sections))
+	}
+
+	key := splitUnescaped(sections[0], ',')
+	if unescape(key[0]) == "" {
+		return nil, nil, timestamp, errors.New("missing measurement")
+	}
+
+	tags := map[string]string{}
+	for _, tag := range key[1:] {
+		name, val, ok := cutUnescaped(tag, '=')
+		if !ok || name == "" || val == "" {
+			return nil, nil, timestamp, fmt.Errorf("invalid tag: %s", tag)
+		}
+		tags[unescape(name)] = unescape(val)
+	}
+
+	metrics := map[string]float64{}
+	for _, field := range splitUnescaped(sections[1], ',') {
+		name, val, ok := cutUnescaped(field, '=')
+		if !ok || name == "" || val == "" {
+			return nil, nil, timestamp, fmt.Errorf("invalid field: %s", field)
+		}
+
+		if strings.HasPrefix(val, `"`) {
+			if len(val) < 2 || !strings.HasSuffix(val, `"`) {
+				return nil, nil, timestamp, fmt.Errorf("unterminated string field: %s", field)
+			}
+			tags[unescape(name)] = unescape(val[1 : len(val)-1])
+			continue
+		}
+
+		num, err := parseLineValue(val)
+		if err != nil {
+			return nil, nil, timestamp, errors.Wrapf(err, "invalid value of field %s", unescape(name))
+		}
+		metrics[unescape(name)] = num
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, nil, timestamp, errors.Wrap(err, "invalid timestamp")
+		}
+		timestamp = time.Unix(0, ts*int64(precision))
+	}
+
+	return metrics, tags, timestamp, nil
+}
+
+/* parseLineValue parses a float, an integer with an i or u suffix, or a boolean stored as 1 or 0 */
+func parseLineValue(val string) (float64, error) {
+	switch val {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+
+	switch val[len(val)-1] {
+	case 'i':
+		num, err := strconv.ParseInt(val[:len(val)-1], 10, 64)
+		return float64(num), err
+	case 'u':
+		num, err := strconv.ParseUint(val[:len(val)-1], 10, 64)
+		return float64(num), err
+	}
+
+	return strconv.ParseFloat(val, 64)
+}
+
+/* splitUnescaped splits s at every sep that is neither escaped with a backslash nor inside double quotes */
+func splitUnescaped(s string, sep byte) []string {
+	parts := []string{}
+	start := 0
+	quoted := false
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+/* cutUnescaped splits s at the first sep that is not escaped */
+func cutUnescaped(s string, sep byte) (string, string, bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+
+	return s, "", false
+}
+
+/* unescape drops the backslashes escaping the next character */
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
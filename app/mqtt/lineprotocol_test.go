@@ -0,0 +1,90 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name              string
+		line              string
+		precision         time.Duration
+		expectedMetrics   map[string]float64
+		expectedTags      map[string]string
+		expectedTimestamp time.Time
+		expectedError     bool
+	}{
+		{
+			name:              "Success: Tags, fields and timestamp",
+			line:              "weather,location=us-midwest,season=summer temperature=82,humidity=71i 1465839830100400200",
+			precision:         time.Nanosecond,
+			expectedMetrics:   map[string]float64{"temperature": 82, "humidity": 71},
+			expectedTags:      map[string]string{"location": "us-midwest", "season": "summer"},
+			expectedTimestamp: time.Unix(0, 1465839830100400200),
+		},
+		{
+			name:              "Success: Second precision",
+			line:              "weather temperature=82 1465839830",
+			precision:         time.Second,
+			expectedMetrics:   map[string]float64{"temperature": 82},
+			expectedTags:      map[string]string{},
+			expectedTimestamp: time.Unix(1465839830, 0),
+		},
+		{
+			name:            "Success: Strings, booleans and escapes",
+			line:            `weather,location=us\ midwest,zone\,id=a\=b raining=true,dry=F,count=3u,note="light, \"warm\" rain"`,
+			precision:       time.Nanosecond,
+			expectedMetrics: map[string]float64{"raining": 1, "dry": 0, "count": 3},
+			expectedTags:    map[string]string{"location": "us midwest", "zone,id": "a=b", "note": `light, "warm" rain`},
+		},
+		{
+			name:          "Failure: Missing fields",
+			line:          "weather,location=us-midwest",
+			precision:     time.Nanosecond,
+			expectedError: true,
+		},
+		{
+			name:          "Failure: Invalid value",
+			line:          "weather temperature=hot",
+			precision:     time.Nanosecond,
+			expectedError: true,
+		},
+		{
+			name:          "Failure: Invalid timestamp",
+			line:          "weather temperature=82 yesterday",
+			precision:     time.Nanosecond,
+			expectedError: true,
+		},
+		{
+			name:          "Failure: Unterminated string",
+			line:          `weather note="rain`,
+			precision:     time.Nanosecond,
+			expectedError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		metrics, tags, timestamp, err := parseLine([]byte(c.line), c.precision)
+		if c.expectedError {
+			if err == nil {
+				t.Errorf("%s: expected error", c.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(metrics, c.expectedMetrics) || !reflect.DeepEqual(tags, c.expectedTags) || !timestamp.Equal(c.expectedTimestamp) {
+			t.Errorf("%s: expected %v %v %s, got %v %v %s", c.name, c.expectedMetrics, c.expectedTags, c.expectedTimestamp, metrics, tags, timestamp)
+		}
+	}
+}
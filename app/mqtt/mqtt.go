@@ -8,7 +8,12 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"taos-adapter/health"
 	"taos-adapter/models"
+	"taos-adapter/sparkplug"
+	"taos-adapter/telemetry"
 	"time"
 
 	"github.com/eclipse/paho.golang/paho"
@@ -16,44 +21,59 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-var host, user, pass, clientID, subTopic string
+var host, user, pass, clientID string
+var subTopics []string
 var port int = 1883
 var subQos int = 1
 
 const TIMESTAMP_FIELD string = "timestamp"
 
-func SetMQTTVars(portVar, subQosVar int, hostVar, userVar, passVar, clientIDVar, subTopicVar string) {
+// component reports the subscription state to the health checks
+const component = "mqtt"
+
+// how long a Sparkplug B rebirth request may take to publish
+const rebirthTimeout = 10 * time.Second
+
+// connected holds the client ids that connected before, so that connecting again counts as a reconnect
+var connected sync.Map
+
+func SetMQTTVars(portVar, subQosVar int, hostVar, userVar, passVar, clientIDVar string, subTopicsVar []string) {
 	port = portVar
 	host = hostVar
 	user = userVar
 	pass = passVar
 	clientID = clientIDVar
-	subTopic = subTopicVar
+	subTopics = subTopicsVar
 	subQos = subQosVar
 }
 
-func Sub(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
-	server := fmt.Sprintf("%s:%d", host, port)
+// Connect opens a new MQTT v5 connection to the configured broker, incoming messages are passed to handler.
+// onLost is called when the connection fails or the broker disconnects, it may be nil.
+func Connect(ctx context.Context, log *logrus.Entry, connClientID string, handler func(*paho.Publish), onLost func(error)) (*paho.Client, error) {
+	server := net.JoinHostPort(host, strconv.Itoa(port))
 
 	conn, err := net.Dial("tcp", server)
 	if err != nil {
-		log.Fatalf("Failed to connect to %s: %s", server, err)
-		return err
+		return nil, errors.Wrapf(err, "failed to connect to %s", server)
 	}
 
-	msgChan := make(chan *paho.Publish)
+	config := paho.ClientConfig{
+		Router: paho.NewSingleHandlerRouter(handler),
+		Conn:   conn,
+	}
+	if onLost != nil {
+		config.OnClientError = onLost
+		config.OnServerDisconnect = func(d *paho.Disconnect) {
+			onLost(fmt.Errorf("disconnected by %s : %d", server, d.ReasonCode))
+		}
+	}
 
-	c := paho.NewClient(paho.ClientConfig{
-		Router: paho.NewSingleHandlerRouter(func(m *paho.Publish) {
-			msgChan <- m
-		}),
-		Conn: conn,
-	})
+	c := paho.NewClient(config)
 	c.SetErrorLogger(log)
 
 	cp := &paho.Connect{
 		KeepAlive:  30,
-		ClientID:   clientID,
+		ClientID:   connClientID,
 		CleanStart: true,
 		Username:   user,
 		Password:   []byte(pass),
@@ -68,101 +88,274 @@ func Sub(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBased
 
 	ca, err := c.Connect(ctx, cp)
 	if err != nil {
-		log.Fatalln(err)
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to connect to %s", server)
+	}
+
+	if ca.ReasonCode != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to %s : %d - %s", server, ca.ReasonCode, ca.Properties.ReasonString)
+	}
+
+	if _, loaded := connected.LoadOrStore(connClientID, struct{}{}); loaded {
+		telemetry.Reconnects.WithLabelValues("mqtt").Inc()
+	}
+
+	return c, nil
+}
+
+func Sub(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+	server := net.JoinHostPort(host, strconv.Itoa(port))
+
+	msgChan := make(chan *paho.Publish)
+
+	// messages wait in the handler until the loop below picks them up
+	var pending int64
+	telemetry.RegisterQueue("msgChan", func() int {
+		return int(atomic.LoadInt64(&pending))
+	})
+
+	c, err := Connect(ctx, log, clientID, func(m *paho.Publish) {
+		atomic.AddInt64(&pending, 1)
+		msgChan <- m
+	}, func(err error) {
+		log.Error(errors.Wrap(err, "lost mqtt connection"))
+		health.Set(component, err)
+	})
+	if err != nil {
+		health.Set(component, err)
 		return err
 	}
 
 	defer func() {
+		health.Set(component, errors.New("disconnected"))
 		err = c.Disconnect(&paho.Disconnect{})
 		if err != nil {
 			log.Error(errors.Wrap(err, "failed to disconnect from mqtt"))
 		}
 	}()
 
-	if ca.ReasonCode != 0 {
-		log.Fatalf("Failed to connect to %s : %d - %s", server, ca.ReasonCode, ca.Properties.ReasonString)
-		return err
-	}
-
 	log.Infof("Connected to %s\n", server)
 
-	sa, err := c.Subscribe(context.Background(), &paho.Subscribe{
-		Subscriptions: map[string]paho.SubscribeOptions{
-			subTopic: {QoS: byte(subQos)},
-		},
-	})
-
-	if err != nil {
-		log.Fatalln(err)
+	if err := setClient(ctx, log, c); err != nil {
+		health.Set(component, err)
 		return err
 	}
+	defer setClient(ctx, log, nil)
 
-	if sa.Reasons[0] != byte(subQos) {
-		log.Fatalf("Failed to subscribe to %s : %d", subTopic, sa.Reasons[0])
-	}
+	health.Set(component, nil)
+
+	// once ctx is done the topics are unsubscribed in the background, messages delivered until the broker
+	// acknowledges it are still passed on so none are lost between the last point and the disconnect
+	done := ctx.Done()
+	var unsubscribed chan struct{}
 
-	log.Infof("Subscribed to topic: %s", subTopic)
+	// Sparkplug B aliases and deaths are tracked for this session, a new session starts from the next births
+	decoder := sparkplug.NewDecoder()
 
 	for {
 		select {
-		case <-ctx.Done():
-			log.Info("context done")
+		case <-done:
+			log.Info("context done, unsubscribing")
+			done = nil
+			unsubscribed = make(chan struct{})
+			go func() {
+				defer close(unsubscribed)
+				if err := unsubscribeAll(log); err != nil {
+					log.Error(err)
+				}
+			}()
+		case <-unsubscribed:
 			return nil
 		case m := <-msgChan:
+			atomic.AddInt64(&pending, -1)
 			log.Infof("Reading from topic: %s", m.Topic)
+			telemetry.MessagesReceived.WithLabelValues(m.Topic).Inc()
+
+			var properties map[string]string
+			if m.Properties != nil && len(m.Properties.User) > 0 {
+				properties = make(map[string]string, len(m.Properties.User))
+				for _, prop := range m.Properties.User {
+					properties[prop.Key] = prop.Value
+				}
+			}
+
+			// a protobuf content type names the message type or selects the protobuf parser of an auto topic
+			selected := parserFor(m.Topic)
+			parser, messageType := selected.Parser, selected.Message
+			var contentType string
+			if m.Properties != nil {
+				contentType = m.Properties.ContentType
+			}
+			if name, ok := protobufType(contentType); ok && (parser == ParserAuto || parser == ParserProtobuf) {
+				parser = ParserProtobuf
+				if name != "" {
+					messageType = name
+				}
+			}
+
+			if parser == ParserAuto && sparkplug.IsTopic(m.Topic) {
+				parser = ParserSparkplug
+			} else if parser == ParserAuto {
+				parser = DetectParser(m.Payload)
+			}
+
+			if parser == ParserSparkplug {
+				decoder.StringTags = stringTags()
+				points, err := decoder.Decode(m.Topic, m.Payload, time.Now())
+				if err != nil {
+					log.Error(err)
+					telemetry.ParseFailures.WithLabelValues(parser).Inc()
+				}
+
+				// the adapter subscribed after the births, ask the node to publish them again
+				var unknown *sparkplug.UnknownAliasesError
+				if errors.As(err, &unknown) {
+					if topic, payload, ok := decoder.Rebirth(unknown, time.Now()); ok {
+						go requestRebirth(ctx, log, c, topic, payload)
+					}
+				}
+
+				for _, point := range points {
+					point.Properties = properties
+					tbMetrics <- point
+				}
+				continue
+			}
 
 			// topic should be structured as db_name/table
 			topicSlice := strings.Split(m.Topic, "/")
+			if len(topicSlice) < 2 {
+				log.Errorf("dropping message on %s, expected a <db>/<table> topic", m.Topic)
+				continue
+			}
 			dbName := topicSlice[0]
 			table := topicSlice[1]
 
-			var timestamp time.Time
-			var err error
-
-			var metrics map[string]float64
-			var tags map[string]string
-			if bytes.Contains(m.Payload, []byte("{")) {
-				metrics, tags, timestamp, err = parseJSON(m.Payload, log)
-			} else {
-				metrics, tags, timestamp, err = parseCSV(m.Payload, log)
+			// line protocol carries a point per line, the other payloads a single point
+			records := [][]byte{m.Payload}
+			if parser == ParserLine {
+				records = bytes.Split(m.Payload, []byte("\n"))
 			}
 
-			if err != nil {
-				log.Error(err)
-				continue
-			}
+			for _, record := range records {
+				if parser == ParserLine && len(bytes.TrimSpace(record)) == 0 {
+					continue
+				}
 
-			var emptyTime time.Time
+				var point Point
+				var err error
+				if parser == ParserProtobuf {
+					point, err = decodeProtobuf(messageType, record)
+				} else {
+					point, err = ParseRecord(parser, record, time.Nanosecond)
+				}
+				if err != nil {
+					log.Error(err)
+					telemetry.ParseFailures.WithLabelValues(parser).Inc()
+					continue
+				}
 
-			if timestamp == emptyTime {
-				for _, prop := range m.Properties.User {
-					if prop.Key == TIMESTAMP_FIELD {
-						timestamp, err = time.Parse(time.RFC3339, prop.Value)
+				timestamp := point.Timestamp
+				var emptyTime time.Time
+
+				if timestamp == emptyTime {
+					if val, ok := properties[TIMESTAMP_FIELD]; ok {
+						timestamp, err = time.Parse(time.RFC3339, val)
 						if err != nil {
 							log.Error(err)
-							continue
 						}
 					}
+
+					// @todo set to brokers time if no timestamp has been found.
+					// set to adapters time if no timestamp has been found.
+					if timestamp == emptyTime {
+						timestamp = time.Now()
+					}
 				}
 
-				// @todo set to brokers time if no timestamp has been found.
-				// set to adapters time if no timestamp has been found.
-				if timestamp == emptyTime {
-					timestamp = time.Now()
+				tbMetrics <- models.TimeBasedMetrics{
+					Metrics:    point.Metrics,
+					Tags:       point.Tags,
+					Timestamp:  timestamp,
+					DB:         dbName,
+					Table:      table, // @todo determine way to set table and db name
+					Topic:      m.Topic,
+					Properties: properties,
 				}
 			}
+		}
+	}
+}
 
-			tbMetrics <- models.TimeBasedMetrics{
-				Metrics:   metrics,
-				Tags:      tags,
-				Timestamp: timestamp,
-				DB:        dbName,
-				Table:     table, // @todo determine way to set table and db name
-			}
+// requestRebirth publishes the NCMD returned by sparkplug.Decoder.Rebirth, Sparkplug commands are sent with QoS 0.
+// A failed request is repeated by the next unknown alias once the decoder's interval passed.
+func requestRebirth(ctx context.Context, log *logrus.Entry, c *paho.Client, topic string, payload []byte) {
+	pubCtx, cancel := context.WithTimeout(ctx, rebirthTimeout)
+	defer cancel()
+
+	log.Infof("requesting rebirth on %s", topic)
+	if _, err := c.Publish(pubCtx, &paho.Publish{Topic: topic, QoS: 0, Payload: payload}); err != nil {
+		log.Error(errors.Wrapf(err, "failed to request rebirth on %s", topic))
+	}
+}
+
+/* TopicMatches reports whether topic matches an MQTT topic filter, supporting the + and # wildcards */
+func TopicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
 		}
+
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// Point is a record parsed from a payload, its db and table come from the topic
+type Point struct {
+	Metrics   map[string]float64
+	Tags      map[string]string
+	Timestamp time.Time // zero when the record has none
+}
+
+// DetectParser picks the parser for ParserAuto: JSON when the payload contains a {, CSV otherwise
+func DetectParser(payload []byte) string {
+	if bytes.Contains(payload, []byte("{")) {
+		return ParserJSON
+	}
+
+	return ParserCSV
+}
+
+// ParseRecord parses a single record: a JSON object, a CSV header followed by rows, or a line of line protocol
+// with its timestamp counted in precision. JSON and CSV timestamps are UNIX seconds.
+func ParseRecord(parser string, record []byte, precision time.Duration) (Point, error) {
+	var point Point
+	var err error
+
+	switch parser {
+	case ParserJSON:
+		point.Metrics, point.Tags, point.Timestamp, err = parseJSON(record, nil)
+	case ParserCSV:
+		point.Metrics, point.Tags, point.Timestamp, err = parseCSV(record, nil)
+	case ParserLine:
+		point.Metrics, point.Tags, point.Timestamp, err = parseLine(record, precision)
+	default:
+		err = fmt.Errorf("unknown parser: %s", parser)
 	}
 
-	return nil
+	return point, err
 }
 
 func parseCSV(body []byte, log *logrus.Entry) (map[string]float64, map[string]string, time.Time, error) {
@@ -1,12 +1,19 @@
 package mqtt
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
+	"taos-adapter/protobuf"
 	"testing"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestParseJSON(t *testing.T) {
@@ -327,3 +334,165 @@ testCaseLoop:
 		t.Errorf("failure in test cases: %s", strings.Join(failedTests, ","))
 	}
 }
+
+func TestTopicMatches(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name          string
+		filter        string
+		topic         string
+		expectedMatch bool
+	}{
+		{
+			name:          "Success: Exact match",
+			filter:        "test_db/room",
+			topic:         "test_db/room",
+			expectedMatch: true,
+		},
+		{
+			name:          "Success: Single level wildcard",
+			filter:        "test_db/+",
+			topic:         "test_db/room",
+			expectedMatch: true,
+		},
+		{
+			name:          "Success: Multi level wildcard",
+			filter:        "test_db/#",
+			topic:         "test_db/room/1",
+			expectedMatch: true,
+		},
+		{
+			name:          "Success: Multi level wildcard matches parent",
+			filter:        "test_db/#",
+			topic:         "test_db",
+			expectedMatch: true,
+		},
+		{
+			name:          "Success: Match everything",
+			filter:        "#",
+			topic:         "test_db/room",
+			expectedMatch: true,
+		},
+		{
+			name:   "Failure: Different level",
+			filter: "test_db/hall",
+			topic:  "test_db/room",
+		},
+		{
+			name:   "Failure: Single level wildcard does not match deeper levels",
+			filter: "test_db/+",
+			topic:  "test_db/room/1",
+		},
+		{
+			name:   "Failure: Topic shorter than filter",
+			filter: "test_db/+/temp",
+			topic:  "test_db/room",
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if match := TopicMatches(c.filter, c.topic); match != c.expectedMatch {
+			t.Errorf("expected %s to match %s: %t, got: %t", c.topic, c.filter, c.expectedMatch, match)
+		}
+	}
+}
+
+func TestParserFor(t *testing.T) {
+	SetParsers([]TopicParser{
+		{Filter: "factory/meters/#", Parser: ParserCSV},
+		{Filter: "factory/#", Parser: ParserJSON},
+	})
+	defer SetParsers(nil)
+
+	cases := []struct {
+		name           string
+		topic          string
+		expectedParser string
+	}{
+		{name: "Success: First matching filter", topic: "factory/meters/1", expectedParser: ParserCSV},
+		{name: "Success: Broader filter", topic: "factory/thermostats/1", expectedParser: ParserJSON},
+		{name: "Success: No filter", topic: "office/room", expectedParser: ParserAuto},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if parser := ParserFor(c.topic); parser != c.expectedParser {
+			t.Errorf("expected parser %s, got %s", c.expectedParser, parser)
+		}
+	}
+}
+
+func TestCheckSuback(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+
+	cases := []struct {
+		name          string
+		reasons       []byte
+		expectedError bool
+	}{
+		{name: "Success: Granted QoS", reasons: []byte{1}},
+		{name: "Success: Downgraded QoS", reasons: []byte{0}},
+		{name: "Failure: Not authorized", reasons: []byte{0x87}, expectedError: true},
+		{name: "Failure: Unspecified error", reasons: []byte{0x80}, expectedError: true},
+		{name: "Failure: No reason code", reasons: []byte{}, expectedError: true},
+		{name: "Failure: Several reason codes", reasons: []byte{1, 1}, expectedError: true},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if err := checkSuback(log, "factory/#", 1, c.reasons); (err != nil) != c.expectedError {
+			t.Errorf("expected error: %t, got: %v", c.expectedError, err)
+		}
+	}
+}
+
+func TestProtobufType(t *testing.T) {
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(timestamppb.File_google_protobuf_timestamp_proto),
+	}}
+	raw, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "timestamp.pb")
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	registry, err := protobuf.Load([]string{path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetProtobuf(registry)
+	defer SetProtobuf(nil)
+
+	cases := []struct {
+		name             string
+		contentType      string
+		expectedType     string
+		expectedProtobuf bool
+	}{
+		{name: "Success: Media type with proto", contentType: "application/x-protobuf; proto=factory.v1.Reading", expectedType: "factory.v1.Reading", expectedProtobuf: true},
+		{name: "Success: Media type with messagetype", contentType: "application/vnd.google.protobuf;messagetype=factory.v1.Reading", expectedType: "factory.v1.Reading", expectedProtobuf: true},
+		{name: "Success: Media type without a message type", contentType: "application/protobuf", expectedProtobuf: true},
+		{name: "Success: Known message type", contentType: "google.protobuf.Timestamp", expectedType: "google.protobuf.Timestamp", expectedProtobuf: true},
+		{name: "Success: Unknown message type", contentType: "factory.v1.Missing"},
+		{name: "Success: Other media type", contentType: "application/json"},
+		{name: "Success: No content type"},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		name, ok := protobufType(c.contentType)
+		if ok != c.expectedProtobuf || (ok && name != c.expectedType) {
+			t.Errorf("expected %q (%t), got %q (%t)", c.expectedType, c.expectedProtobuf, name, ok)
+		}
+	}
+}
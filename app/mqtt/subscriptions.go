@@ -0,0 +1,302 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+	"sync"
+	"taos-adapter/protobuf"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// subscribeTimeout bounds waiting for the broker to acknowledge a subscription change
+const subscribeTimeout = 10 * time.Second
+
+const (
+	ParserAuto      = "auto" // Sparkplug B on spBv1.0/ topics, else JSON when the payload contains a {, CSV otherwise
+	ParserJSON      = "json"
+	ParserCSV       = "csv"
+	ParserLine      = "line"      // InfluxDB line protocol, one point per line
+	ParserSparkplug = "sparkplug" // Sparkplug B protobuf, db, table and tags come from the topic
+	ParserProtobuf  = "protobuf"  // a message type of the descriptor sets set by SetProtobuf
+)
+
+// protobufMediaTypes are the content types of protobuf payloads, their proto or messagetype parameter names the
+// message type
+var protobufMediaTypes = map[string]bool{
+	"application/x-protobuf":          true,
+	"application/protobuf":            true,
+	"application/vnd.google.protobuf": true,
+}
+
+// TopicParser selects the parser of the messages received on topics matching Filter. Message is the protobuf
+// message type of messages without one in their ContentType.
+type TopicParser struct {
+	Filter  string
+	Parser  string
+	Message string
+}
+
+var parsersMu sync.Mutex
+var parsers []TopicParser
+var protobufRegistry *protobuf.Registry
+var sparkplugStringTags = map[string]bool{}
+
+// the client of Sub and the topics it is subscribed to, so UpdateSubscriptions can change them while it runs
+var subMu sync.Mutex
+var subClient *paho.Client
+var subscribed = map[string]struct{}{}
+
+/* setClient subscribes a newly connected client to the configured topics, or forgets the client when c is nil */
+func setClient(ctx context.Context, log *logrus.Entry, c *paho.Client) error {
+	subMu.Lock()
+	defer subMu.Unlock()
+
+	subClient = c
+	subscribed = map[string]struct{}{}
+	if c == nil {
+		return nil
+	}
+
+	for _, topic := range subTopics {
+		if err := subscribe(ctx, log, c, topic); err != nil {
+			return err
+		}
+
+		subscribed[topic] = struct{}{}
+		log.Infof("Subscribed to topic: %s", topic)
+	}
+
+	return nil
+}
+
+// UpdateSubscriptions subscribes to added topics and unsubscribes from removed ones without reconnecting. Before
+// Sub connects the topics are only stored. Every topic is tried, failed ones are listed in the error.
+func UpdateSubscriptions(ctx context.Context, log *logrus.Entry, topics []string) error {
+	subMu.Lock()
+	defer subMu.Unlock()
+
+	subTopics = topics
+	if subClient == nil {
+		return nil
+	}
+
+	wanted := map[string]struct{}{}
+	failed := []string{}
+
+	for _, topic := range topics {
+		wanted[topic] = struct{}{}
+		if _, ok := subscribed[topic]; ok {
+			continue
+		}
+
+		if err := subscribe(ctx, log, subClient, topic); err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+
+		subscribed[topic] = struct{}{}
+		log.Infof("Subscribed to topic: %s", topic)
+	}
+
+	removed := []string{}
+	for topic := range subscribed {
+		if _, ok := wanted[topic]; !ok {
+			removed = append(removed, topic)
+		}
+	}
+	sort.Strings(removed)
+
+	if len(removed) > 0 {
+		unsubCtx, cancel := context.WithTimeout(ctx, subscribeTimeout)
+		defer cancel()
+
+		if _, err := subClient.Unsubscribe(unsubCtx, &paho.Unsubscribe{Topics: removed}); err != nil {
+			failed = append(failed, errors.Wrapf(err, "failed to unsubscribe from %s", strings.Join(removed, ", ")).Error())
+		} else {
+			for _, topic := range removed {
+				delete(subscribed, topic)
+				log.Infof("Unsubscribed from topic: %s", topic)
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// unsubscribeAll stops the broker sending messages before disconnecting, messages sent before the broker
+// acknowledges it are delivered to the handler first. Later calls to UpdateSubscriptions only store the topics.
+func unsubscribeAll(log *logrus.Entry) error {
+	subMu.Lock()
+	defer subMu.Unlock()
+
+	c := subClient
+	subClient = nil
+	if c == nil || len(subscribed) == 0 {
+		return nil
+	}
+
+	topics := []string{}
+	for topic := range subscribed {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	subscribed = map[string]struct{}{}
+
+	// the subscription context is already done when shutting down
+	unsubCtx, cancel := context.WithTimeout(context.Background(), subscribeTimeout)
+	defer cancel()
+
+	if _, err := c.Unsubscribe(unsubCtx, &paho.Unsubscribe{Topics: topics}); err != nil {
+		return errors.Wrapf(err, "failed to unsubscribe from %s", strings.Join(topics, ", "))
+	}
+	log.Infof("Unsubscribed from topics: %s", strings.Join(topics, ", "))
+
+	return nil
+}
+
+// SetParsers selects the parser of messages by topic filter, the first matching filter wins. Topics matching none
+// are parsed with ParserAuto.
+func SetParsers(parsersVar []TopicParser) {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+
+	parsers = parsersVar
+}
+
+// SetProtobuf sets the descriptor sets protobuf payloads are decoded with, nil when none are configured
+func SetProtobuf(registry *protobuf.Registry) {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+
+	protobufRegistry = registry
+}
+
+// SetSparkplug sets the names of the string metrics of Sparkplug B payloads that are stored as tags
+func SetSparkplug(stringTags []string) {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+
+	sparkplugStringTags = make(map[string]bool, len(stringTags))
+	for _, name := range stringTags {
+		sparkplugStringTags[name] = true
+	}
+}
+
+/* stringTags returns the names set by SetSparkplug, the map is replaced rather than changed */
+func stringTags() map[string]bool {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+
+	return sparkplugStringTags
+}
+
+// ParserFor returns the parser selected for messages received on topic
+func ParserFor(topic string) string {
+	return parserFor(topic).Parser
+}
+
+func parserFor(topic string) TopicParser {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+
+	for _, p := range parsers {
+		if TopicMatches(p.Filter, topic) && p.Parser != "" {
+			return p
+		}
+	}
+
+	return TopicParser{Filter: "#", Parser: ParserAuto}
+}
+
+// protobufType reads the MQTT v5 content type of a message: a protobuf media type, optionally naming the message
+// type in its proto or messagetype parameter, or the bare name of a message type of the descriptor sets
+func protobufType(contentType string) (string, bool) {
+	if contentType == "" {
+		return "", false
+	}
+
+	if !strings.Contains(contentType, "/") {
+		parsersMu.Lock()
+		defer parsersMu.Unlock()
+
+		return contentType, protobufRegistry != nil && protobufRegistry.Has(contentType)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !protobufMediaTypes[mediaType] {
+		return "", false
+	}
+
+	if name := params["proto"]; name != "" {
+		return name, true
+	}
+
+	return params["messagetype"], true
+}
+
+/* decodeProtobuf decodes a payload of type name with the descriptor sets set by SetProtobuf */
+func decodeProtobuf(name string, payload []byte) (Point, error) {
+	parsersMu.Lock()
+	registry := protobufRegistry
+	parsersMu.Unlock()
+
+	var point Point
+	var err error
+
+	switch {
+	case registry == nil:
+		err = errors.New("no protobuf descriptor sets are configured")
+	case name == "":
+		err = errors.New("unknown protobuf message type, set the message of the subscription or send it as the content type")
+	default:
+		point.Metrics, point.Tags, point.Timestamp, err = registry.Decode(name, payload)
+	}
+
+	return point, err
+}
+
+/* subscribe subscribes to a single topic, so the reason code of the acknowledgement belongs to it */
+func subscribe(ctx context.Context, log *logrus.Entry, c *paho.Client, topic string) error {
+	subCtx, cancel := context.WithTimeout(ctx, subscribeTimeout)
+	defer cancel()
+
+	sa, err := c.Subscribe(subCtx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{
+			topic: {QoS: byte(subQos)},
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to subscribe to %s", topic)
+	}
+
+	return checkSuback(log, topic, byte(subQos), sa.Reasons)
+}
+
+// checkSuback fails when the broker refused the subscription to topic, reason codes from 0x80 on, or acknowledged
+// something other than a single topic. A subscription granted with a lower QoS than requested is only logged.
+func checkSuback(log *logrus.Entry, topic string, qos byte, reasons []byte) error {
+	if len(reasons) != 1 {
+		return fmt.Errorf("failed to subscribe to %s: expected 1 reason code, got %d", topic, len(reasons))
+	}
+
+	if reasons[0] >= 0x80 {
+		return fmt.Errorf("failed to subscribe to %s: reason code 0x%02x", topic, reasons[0])
+	}
+
+	if reasons[0] < qos {
+		log.Warnf("subscribed to %s with QoS %d instead of %d", topic, reasons[0], qos)
+	}
+
+	return nil
+}
@@ -0,0 +1,363 @@
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"taos-adapter/batch"
+	"taos-adapter/models"
+	"taos-adapter/telemetry"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	LayoutWide   = "wide"
+	LayoutNarrow = "narrow"
+
+	timeColumn  = "time"
+	tagType     = "TEXT"
+	fieldType   = "DOUBLE PRECISION"
+	tagsColumn  = "tags"
+	fieldColumn = "field"
+	valueColumn = "value"
+)
+
+// Sink is a PostgreSQL database, Name labels its metrics
+type Sink struct {
+	Name          string
+	DSN           string
+	Layout        string // LayoutWide or LayoutNarrow
+	ChunkInterval string // chunk interval of TimescaleDB hypertables
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+}
+
+// writer keeps track of the tables and columns that are known to exist
+type writer struct {
+	*Sink
+	conn      *sql.DB
+	log       *logrus.Entry
+	timescale bool
+	schemas   map[string]struct{}
+	columns   map[string]map[string]string // column types keyed by schema.table
+}
+
+/* Insert batches metrics and copies them into postgres, one schema per database and one table per table */
+func (s *Sink) Insert(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+	conn, err := sql.Open("postgres", s.DSN)
+	if err != nil {
+		return errors.Wrap(err, "failed to open postgres connection")
+	}
+	defer conn.Close()
+
+	if err := conn.PingContext(ctx); err != nil {
+		return errors.Wrap(err, "failed to connect to postgres")
+	}
+
+	w := &writer{
+		Sink:    s,
+		conn:    conn,
+		log:     log,
+		schemas: map[string]struct{}{},
+		columns: map[string]map[string]string{},
+	}
+
+	var version string
+	err = conn.QueryRowContext(ctx, "SELECT extversion FROM pg_extension WHERE extname = 'timescaledb';").Scan(&version)
+	switch {
+	case err == nil:
+		w.timescale = true
+		log.Infof("timescaledb %s detected, tables are created as hypertables", version)
+	case errors.Is(err, sql.ErrNoRows):
+		log.Info("timescaledb not installed, using plain tables")
+	default:
+		return errors.Wrap(err, "failed to check for timescaledb")
+	}
+
+	log.Infof("writing %s layout to postgres", s.Layout)
+
+	batch.Consume(ctx, tbMetrics, s.BatchSize, s.FlushInterval, func(points []models.TimeBasedMetrics) {
+		for _, group := range groupByTable(points) {
+			started := time.Now()
+			err := batch.Retry(ctx, s.MaxRetries, time.Second, func() error {
+				return w.write(ctx, group)
+			})
+			if err != nil {
+				log.Error(errors.Wrapf(err, "failed to write %d points to %s.%s", len(group), group[0].DB, group[0].Table))
+			}
+			telemetry.ObserveWrite(s.Name, group, started, err)
+		}
+	})
+
+	return nil
+}
+
+func (w *writer) write(ctx context.Context, points []models.TimeBasedMetrics) error {
+	schema, table := points[0].DB, points[0].Table
+
+	if err := w.ensureTable(ctx, schema, table); err != nil {
+		return err
+	}
+
+	var columns []string
+	var rows [][]interface{}
+	if w.Layout == LayoutNarrow {
+		columns, rows = compileNarrowRows(points)
+	} else {
+		wide := compileWideColumns(points, w.columns[fmt.Sprintf("%s.%s", schema, table)])
+		if err := w.ensureColumns(ctx, schema, table, wide); err != nil {
+			return err
+		}
+		columns, rows = wide.columns, compileWideRows(points, wide)
+	}
+
+	txn, err := w.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer txn.Rollback()
+
+	stmt, err := txn.PrepareContext(ctx, pq.CopyInSchema(schema, table, columns...))
+	if err != nil {
+		return errors.Wrap(err, "failed to prepare copy")
+	}
+
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			return errors.Wrap(err, "failed to copy row")
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return errors.Wrap(err, "failed to flush copy")
+	}
+
+	if err := stmt.Close(); err != nil {
+		return errors.Wrap(err, "failed to close copy")
+	}
+
+	return errors.Wrap(txn.Commit(), "failed to commit copy")
+}
+
+/* ensureTable creates the schema and table the first time they are written to */
+func (w *writer) ensureTable(ctx context.Context, schema, table string) error {
+	key := fmt.Sprintf("%s.%s", schema, table)
+	if _, ok := w.columns[key]; ok {
+		return nil
+	}
+
+	if _, ok := w.schemas[schema]; !ok {
+		w.log.Infof("creating schema %s", schema)
+		if _, err := w.conn.ExecContext(ctx, fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s;", pq.QuoteIdentifier(schema))); err != nil {
+			return errors.Wrapf(err, "failed to create schema %s", schema)
+		}
+		w.schemas[schema] = struct{}{}
+	}
+
+	w.log.Infof("creating table %s", key)
+	if _, err := w.conn.ExecContext(ctx, createTableStmt(schema, table, w.Layout)); err != nil {
+		return errors.Wrapf(err, "failed to create table %s", key)
+	}
+
+	if w.timescale {
+		_, err := w.conn.ExecContext(ctx, "SELECT create_hypertable($1::regclass, $2, if_not_exists => TRUE, chunk_time_interval => $3::interval);",
+			qualifiedTable(schema, table), timeColumn, w.ChunkInterval)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create hypertable %s", key)
+		}
+	}
+
+	existing, err := w.loadColumns(ctx, schema, table)
+	if err != nil {
+		return err
+	}
+	w.columns[key] = existing
+
+	return nil
+}
+
+func (w *writer) loadColumns(ctx context.Context, schema, table string) (map[string]string, error) {
+	rows, err := w.conn.QueryContext(ctx, "SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2;", schema, table)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read columns of %s.%s", schema, table)
+	}
+	defer rows.Close()
+
+	columns := map[string]string{}
+	for rows.Next() {
+		var column, dataType string
+		if err := rows.Scan(&column, &dataType); err != nil {
+			return nil, errors.Wrapf(err, "failed to read columns of %s.%s", schema, table)
+		}
+		columns[column] = dataType
+	}
+
+	return columns, rows.Err()
+}
+
+/* ensureColumns adds columns for tags and fields that have not been seen before in the wide layout */
+func (w *writer) ensureColumns(ctx context.Context, schema, table string, wide wideColumns) error {
+	known := w.columns[fmt.Sprintf("%s.%s", schema, table)]
+	for _, column := range wide.columns {
+		if _, ok := known[column]; ok {
+			continue
+		}
+
+		w.log.Infof("adding column %s %s to %s.%s", column, wide.types[column], schema, table)
+		stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s;", qualifiedTable(schema, table), pq.QuoteIdentifier(column), wide.types[column])
+		if _, err := w.conn.ExecContext(ctx, stmt); err != nil {
+			return errors.Wrapf(err, "failed to add column %s to %s.%s", column, schema, table)
+		}
+		known[column] = wide.types[column]
+	}
+
+	return nil
+}
+
+func qualifiedTable(schema, table string) string {
+	return fmt.Sprintf("%s.%s", pq.QuoteIdentifier(schema), pq.QuoteIdentifier(table))
+}
+
+func createTableStmt(schema, table, layout string) string {
+	if layout == LayoutNarrow {
+		return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s TIMESTAMPTZ NOT NULL, %s JSONB NOT NULL, %s TEXT NOT NULL, %s DOUBLE PRECISION);",
+			qualifiedTable(schema, table), timeColumn, tagsColumn, fieldColumn, valueColumn)
+	}
+
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s TIMESTAMPTZ NOT NULL);", qualifiedTable(schema, table), timeColumn)
+}
+
+/* groupByTable splits a batch into one group per db/table, keeping the order points arrived in */
+func groupByTable(points []models.TimeBasedMetrics) [][]models.TimeBasedMetrics {
+	groups := [][]models.TimeBasedMetrics{}
+	groupIdx := map[string]int{}
+
+	for _, point := range points {
+		key := fmt.Sprintf("%s.%s", point.DB, point.Table)
+		idx, ok := groupIdx[key]
+		if !ok {
+			idx = len(groups)
+			groupIdx[key] = idx
+			groups = append(groups, []models.TimeBasedMetrics{})
+		}
+
+		groups[idx] = append(groups[idx], point)
+	}
+
+	return groups
+}
+
+// wideColumns maps the tags and fields of a batch onto the columns of a wide table
+type wideColumns struct {
+	columns []string          // the time column followed by the others sorted
+	types   map[string]string // the type of every column but time
+	tags    map[string]string // tag name to column
+	fields  map[string]string // field name to column
+}
+
+// compileWideColumns returns the columns of the tags and fields in points, tags are stored as text and fields as
+// doubles. A name whose column has the other type, in known or as a field of the same batch, gets a _tag or _field
+// suffix, so a name used both ways never changes the type of its column.
+func compileWideColumns(points []models.TimeBasedMetrics, known map[string]string) wideColumns {
+	fieldNames := map[string]struct{}{}
+	for _, point := range points {
+		for key := range point.Metrics {
+			fieldNames[key] = struct{}{}
+		}
+	}
+
+	wide := wideColumns{types: map[string]string{}, tags: map[string]string{}, fields: map[string]string{}}
+	columnFor := func(name, columnType, suffix string) string {
+		knownType, ok := known[name]
+		_, isField := fieldNames[name]
+
+		switch {
+		case name == timeColumn:
+		case ok && strings.EqualFold(knownType, columnType):
+			return name
+		case !ok && (columnType == fieldType || !isField):
+			return name
+		}
+
+		return name + suffix
+	}
+
+	for _, point := range points {
+		for key := range point.Tags {
+			column := columnFor(key, tagType, "_tag")
+			wide.tags[key], wide.types[column] = column, tagType
+		}
+		for key := range point.Metrics {
+			column := columnFor(key, fieldType, "_field")
+			wide.fields[key], wide.types[column] = column, fieldType
+		}
+	}
+
+	columns := make([]string, 0, len(wide.types))
+	for column := range wide.types {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	wide.columns = append([]string{timeColumn}, columns...)
+
+	return wide
+}
+
+func compileWideRows(points []models.TimeBasedMetrics, wide wideColumns) [][]interface{} {
+	positions := make(map[string]int, len(wide.columns))
+	for i, column := range wide.columns {
+		positions[column] = i
+	}
+
+	rows := make([][]interface{}, 0, len(points))
+	for _, point := range points {
+		row := make([]interface{}, len(wide.columns))
+		row[0] = point.Timestamp
+
+		for key, val := range point.Tags {
+			row[positions[wide.tags[key]]] = val
+		}
+		for key, val := range point.Metrics {
+			row[positions[wide.fields[key]]] = val
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+/* compileNarrowRows returns one row per field with the tag set stored as jsonb */
+func compileNarrowRows(points []models.TimeBasedMetrics) ([]string, [][]interface{}) {
+	rows := [][]interface{}{}
+
+	for _, point := range points {
+		tags := point.Tags
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		tagsJSON, _ := json.Marshal(tags)
+
+		fields := make([]string, 0, len(point.Metrics))
+		for field := range point.Metrics {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			rows = append(rows, []interface{}{point.Timestamp, string(tagsJSON), field, point.Metrics[field]})
+		}
+	}
+
+	return []string{timeColumn, tagsColumn, fieldColumn, valueColumn}, rows
+}
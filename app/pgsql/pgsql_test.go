@@ -0,0 +1,158 @@
+package pgsql
+
+import (
+	"reflect"
+	"taos-adapter/models"
+	"testing"
+	"time"
+)
+
+func TestGroupByTable(t *testing.T) {
+	t.Parallel()
+
+	points := []models.TimeBasedMetrics{
+		{DB: "test_db", Table: "room"},
+		{DB: "test_db", Table: "hall"},
+		{DB: "other_db", Table: "room"},
+		{DB: "test_db", Table: "room"},
+	}
+
+	groups := groupByTable(points)
+
+	expectedSizes := []int{2, 1, 1}
+	if len(groups) != len(expectedSizes) {
+		t.Fatalf("expected no. of groups %d, got %d", len(expectedSizes), len(groups))
+	}
+
+	for i, group := range groups {
+		if len(group) != expectedSizes[i] {
+			t.Errorf("expected group %d size %d, got %d", i, expectedSizes[i], len(group))
+		}
+
+		for _, point := range group {
+			if point.DB != group[0].DB || point.Table != group[0].Table {
+				t.Errorf("group %d mixes %s.%s with %s.%s", i, group[0].DB, group[0].Table, point.DB, point.Table)
+			}
+		}
+	}
+}
+
+func TestCompileRows(t *testing.T) {
+	t.Parallel()
+
+	timestamp := time.Unix(1257894000, 0)
+	points := []models.TimeBasedMetrics{
+		{
+			Metrics: map[string]float64{
+				"temp":  22.11,
+				"count": 2,
+			},
+			Tags: map[string]string{
+				"name": "test_metric",
+			},
+			Timestamp: timestamp,
+		},
+		{
+			Metrics: map[string]float64{
+				"preassure": 14.695,
+			},
+			Timestamp: timestamp,
+		},
+	}
+
+	cases := []struct {
+		name            string
+		layout          string
+		expectedColumns []string
+		expectedRows    [][]interface{}
+	}{
+		{
+			name:            "Success: Wide layout",
+			layout:          LayoutWide,
+			expectedColumns: []string{"time", "count", "name", "preassure", "temp"},
+			expectedRows: [][]interface{}{
+				{timestamp, 2.0, "test_metric", nil, 22.11},
+				{timestamp, nil, nil, 14.695, nil},
+			},
+		},
+		{
+			name:            "Success: Narrow layout",
+			layout:          LayoutNarrow,
+			expectedColumns: []string{"time", "tags", "field", "value"},
+			expectedRows: [][]interface{}{
+				{timestamp, `{"name":"test_metric"}`, "count", 2.0},
+				{timestamp, `{"name":"test_metric"}`, "temp", 22.11},
+				{timestamp, `{}`, "preassure", 14.695},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		var columns []string
+		var rows [][]interface{}
+		if c.layout == LayoutNarrow {
+			columns, rows = compileNarrowRows(points)
+		} else {
+			wide := compileWideColumns(points, nil)
+			columns, rows = wide.columns, compileWideRows(points, wide)
+		}
+
+		if !reflect.DeepEqual(columns, c.expectedColumns) {
+			t.Errorf("expected columns %v, got %v", c.expectedColumns, columns)
+		}
+
+		if !reflect.DeepEqual(rows, c.expectedRows) {
+			t.Errorf("expected rows %v, got %v", c.expectedRows, rows)
+		}
+	}
+}
+
+func TestCompileWideConflicts(t *testing.T) {
+	t.Parallel()
+
+	timestamp := time.Unix(1257894000, 0)
+	points := []models.TimeBasedMetrics{
+		{Tags: map[string]string{"state": "on", "time": "noon"}, Timestamp: timestamp},
+		{Metrics: map[string]float64{"state": 1, "level": 3}, Timestamp: timestamp},
+	}
+
+	cases := []struct {
+		name            string
+		known           map[string]string
+		expectedColumns []string
+		expectedRows    [][]interface{}
+	}{
+		{
+			name:            "Success: Field keeps a new name",
+			expectedColumns: []string{"time", "level", "state", "state_tag", "time_tag"},
+			expectedRows: [][]interface{}{
+				{timestamp, nil, nil, "on", "noon"},
+				{timestamp, 3.0, 1.0, nil, nil},
+			},
+		},
+		{
+			name:            "Success: Existing text column",
+			known:           map[string]string{"time": "timestamp with time zone", "state": "text", "level": "text"},
+			expectedColumns: []string{"time", "level_field", "state", "state_field", "time_tag"},
+			expectedRows: [][]interface{}{
+				{timestamp, nil, "on", nil, "noon"},
+				{timestamp, 3.0, nil, 1.0, nil},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		wide := compileWideColumns(points, c.known)
+		if !reflect.DeepEqual(wide.columns, c.expectedColumns) {
+			t.Errorf("expected columns %v, got %v", c.expectedColumns, wide.columns)
+		}
+
+		if rows := compileWideRows(points, wide); !reflect.DeepEqual(rows, c.expectedRows) {
+			t.Errorf("expected rows %v, got %v", c.expectedRows, rows)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"taos-adapter/models"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	AggregateMean  = "mean"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateSum   = "sum"
+	AggregateCount = "count"
+	AggregateLast  = "last"
+)
+
+// AggregateConfig buckets points into tumbling windows per db, table and tag set
+type AggregateConfig struct {
+	Window     time.Duration `yaml:"window"`
+	Grace      time.Duration `yaml:"grace,omitempty"`
+	Aggregates []string      `yaml:"aggregates"`
+	Fields     []string      `yaml:"fields,omitempty"` // fields to aggregate, all when empty
+}
+
+type aggregator struct {
+	window     time.Duration
+	grace      time.Duration
+	aggregates []string
+	fields     map[string]struct{}
+	keepValues bool // percentiles need every value of the window
+
+	windows map[string]*window        // keyed by series and window start
+	series  map[string]*seriesWindows // forgotten once idle without open windows
+	late    uint64
+}
+
+// seriesWindows tracks the windows of a series on its own clock, so devices whose clock lags the adapter still
+// fill their windows
+type seriesWindows struct {
+	emitted   time.Time // end of the last emitted window
+	watermark time.Time // latest point timestamp
+	lastSeen  time.Time // adapter time of the latest point
+	open      int
+}
+
+type window struct {
+	series string
+	start  time.Time
+	db     string
+	table  string
+	topic  string
+	tags   map[string]string
+	fields map[string]*fieldStats
+}
+
+type fieldStats struct {
+	count    int
+	sum      float64
+	min      float64
+	max      float64
+	last     float64
+	lastTime time.Time
+	values   []float64
+}
+
+func compileAggregator(c AggregateConfig) (*aggregator, error) {
+	if c.Window <= 0 {
+		return nil, errors.New("aggregate window must be positive")
+	}
+
+	if c.Grace < 0 {
+		return nil, errors.New("aggregate grace can not be negative")
+	}
+
+	if len(c.Aggregates) == 0 {
+		return nil, errors.New("aggregate requires aggregates")
+	}
+
+	a := &aggregator{
+		window:     c.Window,
+		grace:      c.Grace,
+		aggregates: c.Aggregates,
+		fields:     toSet(c.Fields),
+		windows:    map[string]*window{},
+		series:     map[string]*seriesWindows{},
+	}
+
+	for _, agg := range c.Aggregates {
+		switch agg {
+		case AggregateMean, AggregateMin, AggregateMax, AggregateSum, AggregateCount, AggregateLast:
+		default:
+			if _, err := parsePercentile(agg); err != nil {
+				return nil, err
+			}
+			a.keepValues = true
+		}
+	}
+
+	return a, nil
+}
+
+// parsePercentile reads aggregates such as p50, p95 or p99.9
+func parsePercentile(agg string) (float64, error) {
+	if !strings.HasPrefix(agg, "p") {
+		return 0, fmt.Errorf("unknown aggregate: %q", agg)
+	}
+
+	p, err := strconv.ParseFloat(agg[1:], 64)
+	if err != nil || p <= 0 || p > 100 {
+		return 0, fmt.Errorf("invalid percentile aggregate: %q", agg)
+	}
+
+	return p, nil
+}
+
+// seriesKey identifies a series by db, table and sorted tag set
+func seriesKey(m *models.TimeBasedMetrics) string {
+	keys := make([]string, 0, len(m.Tags))
+	for key := range m.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(m.DB)
+	b.WriteByte(0)
+	b.WriteString(m.Table)
+	for _, key := range keys {
+		b.WriteByte(0)
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(m.Tags[key])
+	}
+
+	return b.String()
+}
+
+/* add puts a point received at now into its window, points for windows that were already emitted are dropped as late */
+func (a *aggregator) add(m models.TimeBasedMetrics, now time.Time) bool {
+	series := seriesKey(&m)
+	start := m.Timestamp.Truncate(a.window)
+
+	s, ok := a.series[series]
+	if !ok {
+		s = &seriesWindows{}
+		a.series[series] = s
+	}
+
+	if start.Before(s.emitted) {
+		a.late++
+		return false
+	}
+
+	if m.Timestamp.After(s.watermark) {
+		s.watermark = m.Timestamp
+	}
+	s.lastSeen = now
+
+	key := fmt.Sprintf("%s\x00%d", series, start.UnixNano())
+	w, ok := a.windows[key]
+	if !ok {
+		// the tags of the point may be changed by the stages after the pipeline
+		var tags map[string]string
+		if m.Tags != nil {
+			tags = make(map[string]string, len(m.Tags))
+			for k, v := range m.Tags {
+				tags[k] = v
+			}
+		}
+
+		w = &window{
+			series: series,
+			start:  start,
+			db:     m.DB,
+			table:  m.Table,
+			topic:  m.Topic,
+			tags:   tags,
+			fields: map[string]*fieldStats{},
+		}
+		a.windows[key] = w
+		s.open++
+	}
+
+	for field, val := range m.Metrics {
+		if _, ok := a.fields[field]; len(a.fields) > 0 && !ok {
+			continue
+		}
+
+		stats, ok := w.fields[field]
+		if !ok {
+			stats = &fieldStats{min: val, max: val}
+			w.fields[field] = stats
+		}
+
+		stats.count++
+		stats.sum += val
+		stats.min = math.Min(stats.min, val)
+		stats.max = math.Max(stats.max, val)
+		if !m.Timestamp.Before(stats.lastTime) {
+			stats.last = val
+			stats.lastTime = m.Timestamp
+		}
+		if a.keepValues {
+			stats.values = append(stats.values, val)
+		}
+	}
+
+	return true
+}
+
+// flush emits the windows whose series sent a point past their end plus grace, the windows of series idle for a
+// window plus grace by now, or every open window when all is set. Idle series without open windows are forgotten.
+func (a *aggregator) flush(now time.Time, all bool) []models.TimeBasedMetrics {
+	idle := a.window + a.grace
+
+	ready := []*window{}
+	for key, w := range a.windows {
+		s := a.series[w.series]
+		end := w.start.Add(a.window)
+		if !all && s.watermark.Before(end.Add(a.grace)) && now.Sub(s.lastSeen) < idle {
+			continue
+		}
+
+		ready = append(ready, w)
+		delete(a.windows, key)
+		s.open--
+
+		if end.After(s.emitted) {
+			s.emitted = end
+		}
+	}
+
+	for key, s := range a.series {
+		if s.open == 0 && now.Sub(s.lastSeen) >= idle {
+			delete(a.series, key)
+		}
+	}
+
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].start.Before(ready[j].start)
+	})
+
+	points := make([]models.TimeBasedMetrics, 0, len(ready))
+	for _, w := range ready {
+		points = append(points, models.TimeBasedMetrics{
+			Metrics:   a.compileAggregates(w),
+			Tags:      w.tags,
+			Timestamp: w.start,
+			DB:        w.db,
+			Table:     w.table,
+			Topic:     w.topic,
+		})
+	}
+
+	return points
+}
+
+// compileAggregates names every aggregate <field>_<aggregate>, e.g. temp_mean or temp_p95
+func (a *aggregator) compileAggregates(w *window) map[string]float64 {
+	metrics := map[string]float64{}
+
+	for field, stats := range w.fields {
+		if a.keepValues {
+			sort.Float64s(stats.values)
+		}
+
+		for _, agg := range a.aggregates {
+			var val float64
+			switch agg {
+			case AggregateMean:
+				val = stats.sum / float64(stats.count)
+			case AggregateMin:
+				val = stats.min
+			case AggregateMax:
+				val = stats.max
+			case AggregateSum:
+				val = stats.sum
+			case AggregateCount:
+				val = float64(stats.count)
+			case AggregateLast:
+				val = stats.last
+			default:
+				p, _ := parsePercentile(agg)
+				val = percentile(stats.values, p)
+			}
+
+			metrics[fmt.Sprintf("%s_%s", field, agg)] = val
+		}
+	}
+
+	return metrics
+}
+
+// percentile uses the nearest rank method on sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
@@ -0,0 +1,230 @@
+package pipeline
+
+import (
+	"reflect"
+	"taos-adapter/models"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestAggregate(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1257894000, 0)
+
+	cases := []struct {
+		name           string
+		config         AggregateConfig
+		points         []models.TimeBasedMetrics
+		expectedPoints []models.TimeBasedMetrics
+	}{
+		{
+			name: "Success: All aggregates",
+			config: AggregateConfig{
+				Window:     time.Second,
+				Aggregates: []string{"mean", "min", "max", "sum", "count", "last", "p50", "p95"},
+			},
+			points: []models.TimeBasedMetrics{
+				{Metrics: map[string]float64{"temp": 3}, Timestamp: start.Add(100 * time.Millisecond)},
+				{Metrics: map[string]float64{"temp": 1}, Timestamp: start.Add(300 * time.Millisecond)},
+				{Metrics: map[string]float64{"temp": 2}, Timestamp: start.Add(200 * time.Millisecond)},
+				{Metrics: map[string]float64{"temp": 4}, Timestamp: start.Add(900 * time.Millisecond)},
+			},
+			expectedPoints: []models.TimeBasedMetrics{
+				{
+					Metrics: map[string]float64{
+						"temp_mean":  2.5,
+						"temp_min":   1,
+						"temp_max":   4,
+						"temp_sum":   10,
+						"temp_count": 4,
+						"temp_last":  4,
+						"temp_p50":   2,
+						"temp_p95":   4,
+					},
+					Timestamp: start,
+				},
+			},
+		},
+		{
+			name: "Success: Separate windows and tag sets",
+			config: AggregateConfig{
+				Window:     time.Second,
+				Aggregates: []string{"count"},
+			},
+			points: []models.TimeBasedMetrics{
+				{Metrics: map[string]float64{"temp": 1}, Tags: map[string]string{"room": "a"}, Timestamp: start},
+				{Metrics: map[string]float64{"temp": 1}, Tags: map[string]string{"room": "a"}, Timestamp: start.Add(time.Second)},
+				{Metrics: map[string]float64{"temp": 1}, Tags: map[string]string{"room": "a"}, Timestamp: start.Add(1500 * time.Millisecond)},
+			},
+			expectedPoints: []models.TimeBasedMetrics{
+				{Metrics: map[string]float64{"temp_count": 1}, Tags: map[string]string{"room": "a"}, Timestamp: start},
+				{Metrics: map[string]float64{"temp_count": 2}, Tags: map[string]string{"room": "a"}, Timestamp: start.Add(time.Second)},
+			},
+		},
+		{
+			name: "Success: Selected fields",
+			config: AggregateConfig{
+				Window:     time.Minute,
+				Aggregates: []string{"max"},
+				Fields:     []string{"temp"},
+			},
+			points: []models.TimeBasedMetrics{
+				{Metrics: map[string]float64{"temp": 1, "count": 9}, Timestamp: start},
+				{Metrics: map[string]float64{"temp": 5, "count": 9}, Timestamp: start.Add(time.Second)},
+			},
+			expectedPoints: []models.TimeBasedMetrics{
+				{Metrics: map[string]float64{"temp_max": 5}, Timestamp: start},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		a, err := compileAggregator(c.config)
+		if err != nil {
+			t.Fatal(errors.Wrap(err, "unexpected error"))
+		}
+
+		for _, point := range c.points {
+			a.add(point, start)
+		}
+
+		points := a.flush(time.Time{}, true)
+
+		if len(points) != len(c.expectedPoints) {
+			t.Fatalf("expected no. of points %d, got %d", len(c.expectedPoints), len(points))
+		}
+
+		for i := range points {
+			if !reflect.DeepEqual(points[i], c.expectedPoints[i]) {
+				t.Errorf("expected point %v, got %v", c.expectedPoints[i], points[i])
+			}
+		}
+	}
+}
+
+func TestAggregateGrace(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1257894000, 0)
+
+	a, err := compileAggregator(AggregateConfig{
+		Window:     time.Second,
+		Grace:      500 * time.Millisecond,
+		Aggregates: []string{"count"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.add(models.TimeBasedMetrics{Metrics: map[string]float64{"temp": 1}, Timestamp: start}, start)
+
+	if points := a.flush(start.Add(1200*time.Millisecond), false); len(points) != 0 {
+		t.Fatalf("expected window to stay open during grace period, got %d points", len(points))
+	}
+
+	// late but within the grace period
+	a.add(models.TimeBasedMetrics{Metrics: map[string]float64{"temp": 1}, Timestamp: start.Add(900 * time.Millisecond)}, start.Add(1200*time.Millisecond))
+
+	// a point past the end plus grace closes the window on the clock of the series
+	a.add(models.TimeBasedMetrics{Metrics: map[string]float64{"temp": 1}, Timestamp: start.Add(1500 * time.Millisecond)}, start.Add(1300*time.Millisecond))
+
+	points := a.flush(start.Add(1300*time.Millisecond), false)
+	if len(points) != 1 {
+		t.Fatalf("expected no. of points %d, got %d", 1, len(points))
+	}
+
+	if points[0].Metrics["temp_count"] != 2 {
+		t.Errorf("expected count %d, got %g", 2, points[0].Metrics["temp_count"])
+	}
+
+	// after the window has been emitted
+	if a.add(models.TimeBasedMetrics{Metrics: map[string]float64{"temp": 1}, Timestamp: start.Add(100 * time.Millisecond)}, start.Add(1300*time.Millisecond)) {
+		t.Error("expected late point to be dropped")
+	}
+
+	if a.late != 1 {
+		t.Errorf("expected late count %d, got %d", 1, a.late)
+	}
+}
+
+func TestAggregateLaggingClock(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1257894000, 0)
+	lagging := now.Add(-time.Hour)
+
+	a, err := compileAggregator(AggregateConfig{Window: time.Second, Aggregates: []string{"count"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := map[string]string{"room": "a"}
+	for _, offset := range []time.Duration{0, 300 * time.Millisecond, 900 * time.Millisecond} {
+		a.add(models.TimeBasedMetrics{Metrics: map[string]float64{"temp": 1}, Tags: tags, Timestamp: lagging.Add(offset)}, now.Add(offset))
+	}
+	tags["room"] = "b"
+
+	if points := a.flush(now.Add(900*time.Millisecond), false); len(points) != 0 {
+		t.Fatalf("expected the window to stay open while its series reports, got %d points", len(points))
+	}
+
+	// the series went idle for a window
+	points := a.flush(now.Add(2*time.Second), false)
+	expected := []models.TimeBasedMetrics{{Metrics: map[string]float64{"temp_count": 3}, Tags: map[string]string{"room": "a"}, Timestamp: lagging}}
+	if !reflect.DeepEqual(points, expected) {
+		t.Errorf("expected points %v, got %v", expected, points)
+	}
+
+	if len(a.series) != 0 {
+		t.Errorf("expected the idle series to be forgotten, got %d", len(a.series))
+	}
+}
+
+func TestCompileAggregator(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name          string
+		config        AggregateConfig
+		expectedError bool
+	}{
+		{
+			name:   "Success: Percentiles",
+			config: AggregateConfig{Window: time.Second, Aggregates: []string{"p50", "p99.9"}},
+		},
+		{
+			name:          "Failure: Missing window",
+			config:        AggregateConfig{Aggregates: []string{"mean"}},
+			expectedError: true,
+		},
+		{
+			name:          "Failure: Missing aggregates",
+			config:        AggregateConfig{Window: time.Second},
+			expectedError: true,
+		},
+		{
+			name:          "Failure: Unknown aggregate",
+			config:        AggregateConfig{Window: time.Second, Aggregates: []string{"median"}},
+			expectedError: true,
+		},
+		{
+			name:          "Failure: Percentile out of range",
+			config:        AggregateConfig{Window: time.Second, Aggregates: []string{"p101"}},
+			expectedError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		_, err := compileAggregator(c.config)
+		if (err != nil) != c.expectedError {
+			t.Errorf("expected error: %t, got: %v", c.expectedError, err)
+		}
+	}
+}
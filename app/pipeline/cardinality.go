@@ -0,0 +1,266 @@
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+	"taos-adapter/models"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CardinalityReject = "reject"
+	CardinalityStrip  = "strip"
+
+	cardinalityLogInterval = 10 * time.Second
+
+	// how often series, fields and tag values that were not seen for the series TTL are forgotten
+	cardinalityPruneInterval = time.Minute
+	defaultSeriesTTL         = 24 * time.Hour
+
+	// labels the violations of points that match no subscription
+	noSubscription = "none"
+)
+
+// CardinalityConfig limits the distinct tag combinations (series) and field names of every database and table,
+// a limit of 0 disables it
+type CardinalityConfig struct {
+	MaxSeriesPerDatabase int    `yaml:"max_series_per_database,omitempty"`
+	MaxSeriesPerTable    int    `yaml:"max_series_per_table,omitempty"`
+	MaxFieldsPerDatabase int    `yaml:"max_fields_per_database,omitempty"`
+	MaxFieldsPerTable    int    `yaml:"max_fields_per_table,omitempty"`
+	Action               string `yaml:"action,omitempty"` // reject (default) or strip
+
+	// series, fields and tag values not seen for this long no longer count against the limits, 24h by default
+	SeriesTTL time.Duration `yaml:"series_ttl,omitempty"`
+}
+
+type cardinalityLimiter struct {
+	config CardinalityConfig
+
+	databases map[string]*cardinalityScope
+	tables    map[string]*cardinalityScope
+	pruned    time.Time
+
+	mu         sync.Mutex
+	violations map[string]uint64 // per subscription topic filter
+	lastLog    map[string]time.Time
+}
+
+// cardinalityScope holds when every series, field and tag value of a database or table was last seen
+type cardinalityScope struct {
+	series    map[string]time.Time
+	fields    map[string]time.Time
+	tagValues map[string]map[string]time.Time // only tracked for tables
+}
+
+func newCardinalityScope() *cardinalityScope {
+	return &cardinalityScope{
+		series:    map[string]time.Time{},
+		fields:    map[string]time.Time{},
+		tagValues: map[string]map[string]time.Time{},
+	}
+}
+
+/* prune forgets what was last seen before cutoff and reports whether nothing is left */
+func (s *cardinalityScope) prune(cutoff time.Time) bool {
+	forget(s.series, cutoff)
+	forget(s.fields, cutoff)
+	for key, values := range s.tagValues {
+		if forget(values, cutoff); len(values) == 0 {
+			delete(s.tagValues, key)
+		}
+	}
+
+	return len(s.series) == 0 && len(s.fields) == 0 && len(s.tagValues) == 0
+}
+
+func forget(seen map[string]time.Time, cutoff time.Time) {
+	for key, last := range seen {
+		if last.Before(cutoff) {
+			delete(seen, key)
+		}
+	}
+}
+
+func compileCardinalityLimiter(c CardinalityConfig) (*cardinalityLimiter, error) {
+	if c.MaxSeriesPerDatabase < 0 || c.MaxSeriesPerTable < 0 || c.MaxFieldsPerDatabase < 0 || c.MaxFieldsPerTable < 0 {
+		return nil, errors.New("cardinality limits can not be negative")
+	}
+
+	if c.SeriesTTL < 0 {
+		return nil, errors.New("cardinality series_ttl can not be negative")
+	}
+	if c.SeriesTTL == 0 {
+		c.SeriesTTL = defaultSeriesTTL
+	}
+
+	switch c.Action {
+	case "":
+		c.Action = CardinalityReject
+	case CardinalityReject, CardinalityStrip:
+	default:
+		return nil, fmt.Errorf("cardinality action must be one of %s, %s, got: %q", CardinalityReject, CardinalityStrip, c.Action)
+	}
+
+	return &cardinalityLimiter{
+		config:     c,
+		databases:  map[string]*cardinalityScope{},
+		tables:     map[string]*cardinalityScope{},
+		violations: map[string]uint64{},
+		lastLog:    map[string]time.Time{},
+	}, nil
+}
+
+/* full reports whether set, with the accepted entries not added yet, has reached limit */
+func full(set map[string]time.Time, accepted, limit int) bool {
+	return limit > 0 && len(set)+accepted >= limit
+}
+
+// check applies the limits to a point and registers its series and fields once accepted, violations are counted
+// for subscription. With the strip action new fields beyond the limits are removed, and a new series beyond the
+// limits falls back to the tags whose values are already known for the table. Points that still exceed a limit are
+// rejected.
+func (l *cardinalityLimiter) check(log *logrus.Entry, m *models.TimeBasedMetrics, subscription string, now time.Time) bool {
+	if now.Sub(l.pruned) >= cardinalityPruneInterval {
+		l.prune(now)
+	}
+
+	db, ok := l.databases[m.DB]
+	if !ok {
+		db = newCardinalityScope()
+		l.databases[m.DB] = db
+	}
+
+	tableKey := m.DB + "\x00" + m.Table
+	table, ok := l.tables[tableKey]
+	if !ok {
+		table = newCardinalityScope()
+		l.tables[tableKey] = table
+	}
+
+	// fields are only registered once the point is accepted, so the new ones accepted so far count against the limits
+	var newFields []string
+	acceptedTable, acceptedDB := 0, 0
+	for field := range m.Metrics {
+		if _, ok := table.fields[field]; ok {
+			continue
+		}
+		_, known := db.fields[field]
+		if !known && full(db.fields, acceptedDB, l.config.MaxFieldsPerDatabase) {
+			newFields = append(newFields, field)
+			continue
+		}
+		if full(table.fields, acceptedTable, l.config.MaxFieldsPerTable) {
+			newFields = append(newFields, field)
+			continue
+		}
+
+		acceptedTable++
+		if !known {
+			acceptedDB++
+		}
+	}
+
+	if len(newFields) > 0 {
+		if l.config.Action == CardinalityReject || len(newFields) == len(m.Metrics) {
+			l.violation(log, subscription, m.Topic, fmt.Sprintf("field limit of %s.%s exceeded, point rejected", m.DB, m.Table))
+			return false
+		}
+
+		for _, field := range newFields {
+			delete(m.Metrics, field)
+		}
+		l.violation(log, subscription, m.Topic, fmt.Sprintf("field limit of %s.%s exceeded, stripped fields %v", m.DB, m.Table, newFields))
+	}
+
+	series := seriesKey(m)
+	if _, ok := table.series[series]; !ok && (full(table.series, 0, l.config.MaxSeriesPerTable) || full(db.series, 0, l.config.MaxSeriesPerDatabase)) {
+		if l.config.Action == CardinalityReject {
+			l.violation(log, subscription, m.Topic, fmt.Sprintf("series limit of %s.%s exceeded, point rejected", m.DB, m.Table))
+			return false
+		}
+
+		tags := map[string]string{}
+		var stripped []string
+		for key, val := range m.Tags {
+			if _, ok := table.tagValues[key][val]; ok {
+				tags[key] = val
+			} else {
+				stripped = append(stripped, key)
+			}
+		}
+
+		m.Tags = tags
+		series = seriesKey(m)
+		if _, ok := table.series[series]; !ok {
+			l.violation(log, subscription, m.Topic, fmt.Sprintf("series limit of %s.%s exceeded, point rejected", m.DB, m.Table))
+			return false
+		}
+
+		l.violation(log, subscription, m.Topic, fmt.Sprintf("series limit of %s.%s exceeded, stripped tags %v", m.DB, m.Table, stripped))
+	}
+
+	db.series[series] = now
+	table.series[series] = now
+	for key, val := range m.Tags {
+		values, ok := table.tagValues[key]
+		if !ok {
+			values = map[string]time.Time{}
+			table.tagValues[key] = values
+		}
+		values[val] = now
+	}
+
+	for field := range m.Metrics {
+		db.fields[field] = now
+		table.fields[field] = now
+	}
+
+	return true
+}
+
+/* prune forgets series, fields and tag values not seen for the series TTL, and databases and tables left empty */
+func (l *cardinalityLimiter) prune(now time.Time) {
+	cutoff := now.Add(-l.config.SeriesTTL)
+	for key, scope := range l.databases {
+		if scope.prune(cutoff) {
+			delete(l.databases, key)
+		}
+	}
+	for key, scope := range l.tables {
+		if scope.prune(cutoff) {
+			delete(l.tables, key)
+		}
+	}
+
+	l.pruned = now
+}
+
+// violation counts a limit violation for the subscription and logs it at most once per interval and subscription,
+// along with the topic of the point so the device causing it can be found
+func (l *cardinalityLimiter) violation(log *logrus.Entry, subscription, topic, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.violations[subscription]++
+	if time.Since(l.lastLog[subscription]) > cardinalityLogInterval {
+		log.WithField("topic", topic).Warnf("%s, %d violations so far", msg, l.violations[subscription])
+		l.lastLog[subscription] = time.Now()
+	}
+}
+
+// Violations returns the number of points rejected or stripped per subscription topic filter
+func (l *cardinalityLimiter) Violations() map[string]uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	violations := make(map[string]uint64, len(l.violations))
+	for subscription, count := range l.violations {
+		violations[subscription] = count
+	}
+
+	return violations
+}
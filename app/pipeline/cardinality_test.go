@@ -0,0 +1,185 @@
+package pipeline
+
+import (
+	"reflect"
+	"taos-adapter/models"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCardinality(t *testing.T) {
+	t.Parallel()
+
+	log := logrus.NewEntry(logrus.New())
+
+	type point struct {
+		metrics  models.TimeBasedMetrics
+		keep     bool
+		expected *models.TimeBasedMetrics // the point after check when it differs from the input
+	}
+
+	newPoint := func(tags map[string]string, metrics map[string]float64) models.TimeBasedMetrics {
+		return models.TimeBasedMetrics{DB: "db", Table: "t", Topic: "db/t", Tags: tags, Metrics: metrics}
+	}
+
+	cases := []struct {
+		name               string
+		config             CardinalityConfig
+		points             []point
+		expectedViolations map[string]uint64
+	}{
+		{
+			name:   "Success: Series per table rejected",
+			config: CardinalityConfig{MaxSeriesPerTable: 2},
+			points: []point{
+				{metrics: newPoint(map[string]string{"id": "a"}, map[string]float64{"v": 1}), keep: true},
+				{metrics: newPoint(map[string]string{"id": "b"}, map[string]float64{"v": 1}), keep: true},
+				{metrics: newPoint(map[string]string{"id": "a"}, map[string]float64{"v": 2}), keep: true},
+				{metrics: newPoint(map[string]string{"id": "c"}, map[string]float64{"v": 1}), keep: false},
+				{metrics: models.TimeBasedMetrics{DB: "db", Table: "u", Topic: "db/u", Tags: map[string]string{"id": "c"}}, keep: true},
+			},
+			expectedViolations: map[string]uint64{"db/#": 1},
+		},
+		{
+			name:   "Success: Series per database rejected",
+			config: CardinalityConfig{MaxSeriesPerDatabase: 1},
+			points: []point{
+				{metrics: newPoint(map[string]string{"id": "a"}, nil), keep: true},
+				{metrics: models.TimeBasedMetrics{DB: "db", Table: "u", Topic: "db/u", Tags: map[string]string{"id": "a"}}, keep: false},
+				{metrics: models.TimeBasedMetrics{DB: "other", Table: "u", Topic: "other/u", Tags: map[string]string{"id": "a"}}, keep: true},
+			},
+			expectedViolations: map[string]uint64{"db/#": 1},
+		},
+		{
+			name:   "Success: Unknown tag values stripped",
+			config: CardinalityConfig{MaxSeriesPerTable: 1, Action: CardinalityStrip},
+			points: []point{
+				{metrics: newPoint(map[string]string{"room": "1"}, map[string]float64{"v": 1}), keep: true},
+				{
+					metrics:  newPoint(map[string]string{"room": "1", "uuid": "f3c1"}, map[string]float64{"v": 1}),
+					keep:     true,
+					expected: &models.TimeBasedMetrics{DB: "db", Table: "t", Topic: "db/t", Tags: map[string]string{"room": "1"}, Metrics: map[string]float64{"v": 1}},
+				},
+				{metrics: newPoint(map[string]string{"room": "2"}, map[string]float64{"v": 1}), keep: false},
+			},
+			expectedViolations: map[string]uint64{"db/#": 2},
+		},
+		{
+			name:   "Success: Fields per table rejected",
+			config: CardinalityConfig{MaxFieldsPerTable: 1},
+			points: []point{
+				{metrics: newPoint(nil, map[string]float64{"v": 1}), keep: true},
+				{metrics: newPoint(nil, map[string]float64{"v": 1, "w": 1}), keep: false},
+			},
+			expectedViolations: map[string]uint64{"db/#": 1},
+		},
+		{
+			name:   "Success: Fields per database stripped",
+			config: CardinalityConfig{MaxFieldsPerDatabase: 1, Action: CardinalityStrip},
+			points: []point{
+				{metrics: newPoint(nil, map[string]float64{"v": 1}), keep: true},
+				{
+					metrics:  newPoint(nil, map[string]float64{"v": 1, "w": 1}),
+					keep:     true,
+					expected: &models.TimeBasedMetrics{DB: "db", Table: "t", Topic: "db/t", Metrics: map[string]float64{"v": 1}},
+				},
+				{metrics: newPoint(nil, map[string]float64{"w": 1}), keep: false},
+			},
+			expectedViolations: map[string]uint64{"db/#": 2},
+		},
+		{
+			name:   "Success: New fields of one point count against the table limit",
+			config: CardinalityConfig{MaxFieldsPerTable: 2},
+			points: []point{
+				{metrics: newPoint(nil, map[string]float64{"u": 1, "v": 1, "w": 1}), keep: false},
+				{metrics: newPoint(nil, map[string]float64{"u": 1, "v": 1}), keep: true},
+			},
+			expectedViolations: map[string]uint64{"db/#": 1},
+		},
+		{
+			name:   "Success: New fields of one point count against the database limit",
+			config: CardinalityConfig{MaxFieldsPerDatabase: 2},
+			points: []point{
+				{metrics: newPoint(nil, map[string]float64{"u": 1}), keep: true},
+				{metrics: models.TimeBasedMetrics{DB: "db", Table: "u", Topic: "db/u", Metrics: map[string]float64{"u": 1, "v": 1, "w": 1}}, keep: false},
+				{metrics: models.TimeBasedMetrics{DB: "db", Table: "u", Topic: "db/u", Metrics: map[string]float64{"u": 1, "v": 1}}, keep: true},
+			},
+			expectedViolations: map[string]uint64{"db/#": 1},
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		l, err := compileCardinalityLimiter(c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, p := range c.points {
+			m := p.metrics
+			if keep := l.check(log, &m, "db/#", time.Now()); keep != p.keep {
+				t.Errorf("point %d: expected keep %t, got %t", i, p.keep, keep)
+			}
+
+			if p.expected != nil && !reflect.DeepEqual(m, *p.expected) {
+				t.Errorf("point %d: expected %v, got %v", i, *p.expected, m)
+			}
+		}
+
+		if violations := l.Violations(); !reflect.DeepEqual(violations, c.expectedViolations) {
+			t.Errorf("expected violations %v, got %v", c.expectedViolations, violations)
+		}
+	}
+}
+
+func TestCardinalitySeriesTTL(t *testing.T) {
+	t.Parallel()
+
+	log := logrus.NewEntry(logrus.New())
+	l, err := compileCardinalityLimiter(CardinalityConfig{MaxSeriesPerTable: 1, SeriesTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1257894000, 0)
+	newPoint := func(id string) *models.TimeBasedMetrics {
+		return &models.TimeBasedMetrics{DB: "db", Table: "t", Topic: "db/t", Tags: map[string]string{"id": id}, Metrics: map[string]float64{"v": 1}}
+	}
+
+	if !l.check(log, newPoint("a"), "db/#", start) {
+		t.Fatal("expected the first series to be kept")
+	}
+
+	if l.check(log, newPoint("b"), "db/#", start.Add(30*time.Minute)) {
+		t.Error("expected a second series within the TTL to be rejected")
+	}
+
+	if !l.check(log, newPoint("b"), "db/#", start.Add(2*time.Hour)) {
+		t.Error("expected a second series to be kept once the first expired")
+	}
+
+	// b is the only series left, a database without points for the TTL is forgotten
+	l.prune(start.Add(4 * time.Hour))
+	if len(l.databases) != 0 || len(l.tables) != 0 {
+		t.Errorf("expected idle scopes to be forgotten, got %d databases and %d tables", len(l.databases), len(l.tables))
+	}
+}
+
+func TestCompileCardinalityLimiter(t *testing.T) {
+	t.Parallel()
+
+	if _, err := compileCardinalityLimiter(CardinalityConfig{Action: "truncate"}); err == nil {
+		t.Error("expected error for unknown action")
+	}
+
+	if _, err := compileCardinalityLimiter(CardinalityConfig{MaxSeriesPerTable: -1}); err == nil {
+		t.Error("expected error for negative limit")
+	}
+
+	if _, err := compileCardinalityLimiter(CardinalityConfig{SeriesTTL: -time.Second}); err == nil {
+		t.Error("expected error for negative series_ttl")
+	}
+}
@@ -0,0 +1,127 @@
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"taos-adapter/models"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDedupWindow     = 10 * time.Minute
+	defaultDedupMaxEntries = 100000
+)
+
+// DedupConfig drops points that were already seen within Window. Points are identified by topic, timestamp and
+// tag set, or by topic, tag set and the value of Field (a tag or field such as a message ID) when set, so devices
+// counting message IDs on their own do not collide.
+type DedupConfig struct {
+	Field      string        `yaml:"field,omitempty"`
+	Window     time.Duration `yaml:"window,omitempty"`
+	MaxEntries int           `yaml:"max_entries,omitempty"`
+}
+
+type deduplicator struct {
+	field      string
+	window     time.Duration
+	maxEntries int
+
+	seen    map[string]struct{}
+	order   []seenKey // oldest first, entries expire in the order they were seen
+	dropped uint64
+}
+
+type seenKey struct {
+	key  string
+	seen time.Time
+}
+
+func compileDeduplicator(c DedupConfig) (*deduplicator, error) {
+	if c.Window < 0 {
+		return nil, errors.New("dedup window can not be negative")
+	}
+
+	if c.MaxEntries < 0 {
+		return nil, errors.New("dedup max_entries can not be negative")
+	}
+
+	d := &deduplicator{
+		field:      c.Field,
+		window:     c.Window,
+		maxEntries: c.MaxEntries,
+		seen:       map[string]struct{}{},
+	}
+
+	if d.window == 0 {
+		d.window = defaultDedupWindow
+	}
+
+	if d.maxEntries == 0 {
+		d.maxEntries = defaultDedupMaxEntries
+	}
+
+	return d, nil
+}
+
+/* identity returns the dedup key of a point, false when the point lacks the configured field */
+func (d *deduplicator) identity(m *models.TimeBasedMetrics) (string, bool) {
+	if d.field == "" {
+		return fmt.Sprintf("%s\x00%d\x00%s", m.Topic, m.Timestamp.UnixNano(), seriesKey(m)), true
+	}
+
+	if val, ok := m.Tags[d.field]; ok {
+		return fmt.Sprintf("%s\x00%s\x00%s", m.Topic, seriesKey(m), val), true
+	}
+
+	if val, ok := m.Metrics[d.field]; ok {
+		return fmt.Sprintf("%s\x00%s\x00%s", m.Topic, seriesKey(m), strconv.FormatFloat(val, 'f', -1, 64)), true
+	}
+
+	return "", false
+}
+
+/* check remembers the point and reports whether it is new, points without an identity are always kept */
+func (d *deduplicator) check(m *models.TimeBasedMetrics, now time.Time) bool {
+	d.expire(now)
+
+	key, ok := d.identity(m)
+	if !ok {
+		return true
+	}
+
+	if _, ok := d.seen[key]; ok {
+		atomic.AddUint64(&d.dropped, 1)
+		return false
+	}
+
+	if len(d.order) >= d.maxEntries {
+		d.evict()
+	}
+
+	d.seen[key] = struct{}{}
+	d.order = append(d.order, seenKey{key: key, seen: now})
+
+	return true
+}
+
+/* expire forgets keys seen longer than the window ago */
+func (d *deduplicator) expire(now time.Time) {
+	cutoff := now.Add(-d.window)
+	for len(d.order) > 0 && !d.order[0].seen.After(cutoff) {
+		d.evict()
+	}
+}
+
+func (d *deduplicator) evict() {
+	delete(d.seen, d.order[0].key)
+	d.order[0] = seenKey{}
+	d.order = d.order[1:]
+}
+
+// Dropped returns the number of duplicates dropped
+func (d *deduplicator) Dropped() uint64 {
+	return atomic.LoadUint64(&d.dropped)
+}
@@ -0,0 +1,100 @@
+package pipeline
+
+import (
+	"taos-adapter/models"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1257894000, 0)
+	ts := now.Add(-time.Second)
+
+	type point struct {
+		metrics models.TimeBasedMetrics
+		at      time.Duration // arrival after now
+		keep    bool
+	}
+
+	cases := []struct {
+		name            string
+		config          DedupConfig
+		points          []point
+		expectedDropped uint64
+	}{
+		{
+			name:   "Success: Topic, timestamp and tag set",
+			config: DedupConfig{},
+			points: []point{
+				{metrics: models.TimeBasedMetrics{Topic: "a/b", Timestamp: ts, Tags: map[string]string{"room": "1"}}, keep: true},
+				{metrics: models.TimeBasedMetrics{Topic: "a/b", Timestamp: ts, Tags: map[string]string{"room": "1"}}, keep: false},
+				{metrics: models.TimeBasedMetrics{Topic: "a/b", Timestamp: ts, Tags: map[string]string{"room": "2"}}, keep: true},
+				{metrics: models.TimeBasedMetrics{Topic: "a/c", Timestamp: ts, Tags: map[string]string{"room": "1"}}, keep: true},
+				{metrics: models.TimeBasedMetrics{Topic: "a/b", Timestamp: ts.Add(time.Second), Tags: map[string]string{"room": "1"}}, keep: true},
+			},
+			expectedDropped: 1,
+		},
+		{
+			name:   "Success: Message ID field",
+			config: DedupConfig{Field: "msg_id"},
+			points: []point{
+				{metrics: models.TimeBasedMetrics{Timestamp: ts, Tags: map[string]string{"msg_id": "x1"}}, keep: true},
+				{metrics: models.TimeBasedMetrics{Timestamp: ts.Add(time.Second), Tags: map[string]string{"msg_id": "x1"}}, keep: false},
+				{metrics: models.TimeBasedMetrics{Timestamp: ts, Metrics: map[string]float64{"msg_id": 7}}, keep: true},
+				{metrics: models.TimeBasedMetrics{Timestamp: ts, Metrics: map[string]float64{"msg_id": 7}}, keep: false},
+				{metrics: models.TimeBasedMetrics{Topic: "a/c", Timestamp: ts, Metrics: map[string]float64{"msg_id": 7}}, keep: true},
+				{metrics: models.TimeBasedMetrics{Timestamp: ts, Metrics: map[string]float64{"msg_id": 7}, Tags: map[string]string{"device": "2"}}, keep: true},
+				{metrics: models.TimeBasedMetrics{Timestamp: ts}, keep: true},
+				{metrics: models.TimeBasedMetrics{Timestamp: ts}, keep: true},
+			},
+			expectedDropped: 2,
+		},
+		{
+			name:   "Success: Expired after window",
+			config: DedupConfig{Window: time.Minute},
+			points: []point{
+				{metrics: models.TimeBasedMetrics{Timestamp: ts}, keep: true},
+				{metrics: models.TimeBasedMetrics{Timestamp: ts}, at: 30 * time.Second, keep: false},
+				{metrics: models.TimeBasedMetrics{Timestamp: ts}, at: time.Minute, keep: true},
+			},
+			expectedDropped: 1,
+		},
+		{
+			name:   "Success: Oldest evicted at max entries",
+			config: DedupConfig{MaxEntries: 2},
+			points: []point{
+				{metrics: models.TimeBasedMetrics{Timestamp: ts}, keep: true},
+				{metrics: models.TimeBasedMetrics{Timestamp: ts.Add(time.Second)}, keep: true},
+				{metrics: models.TimeBasedMetrics{Timestamp: ts.Add(2 * time.Second)}, keep: true},
+				{metrics: models.TimeBasedMetrics{Timestamp: ts}, keep: true},
+				{metrics: models.TimeBasedMetrics{Timestamp: ts.Add(2 * time.Second)}, keep: false},
+			},
+			expectedDropped: 1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		d, err := compileDeduplicator(c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, p := range c.points {
+			if keep := d.check(&p.metrics, now.Add(p.at)); keep != p.keep {
+				t.Errorf("point %d: expected keep %t, got %t", i, p.keep, keep)
+			}
+		}
+
+		if d.Dropped() != c.expectedDropped {
+			t.Errorf("expected dropped %d, got %d", c.expectedDropped, d.Dropped())
+		}
+
+		if len(d.seen) != len(d.order) {
+			t.Errorf("expected seen and order to have the same length, got %d and %d", len(d.seen), len(d.order))
+		}
+	}
+}
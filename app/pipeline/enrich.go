@@ -0,0 +1,197 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"taos-adapter/models"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ProcessorEnrich = "enrich"
+
+	// registryCheckInterval is how often the registry file is checked for changes
+	registryCheckInterval = 5 * time.Second
+)
+
+// reloadable is implemented by processors reading files that can change while running, reload is called from the
+// pipeline goroutine so it does not race with Process
+type reloadable interface {
+	reload(now time.Time) (bool, error)
+}
+
+// enrich adds the registry attributes of a device as tags, tags already on the point are kept
+type enrich struct {
+	path         string
+	key          string
+	topicSegment int // used when key is empty
+
+	registry  map[string]map[string]string
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+}
+
+func compileEnrich(c ProcessorConfig) (Processor, error) {
+	if c.Registry == "" {
+		return nil, errors.New("enrich requires registry")
+	}
+
+	if (c.Key == "") == (c.TopicSegment == nil) {
+		return nil, errors.New("enrich requires exactly one of key or topic_segment")
+	}
+
+	p := &enrich{path: c.Registry, key: c.Key}
+	if c.TopicSegment != nil {
+		if *c.TopicSegment < 0 {
+			return nil, errors.New("enrich topic_segment can not be negative")
+		}
+		p.topicSegment = *c.TopicSegment
+	}
+
+	if _, err := p.reload(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *enrich) Process(m *models.TimeBasedMetrics) (bool, error) {
+	var key string
+	if p.key != "" {
+		key = m.Tags[p.key]
+	} else if segments := strings.Split(m.Topic, "/"); p.topicSegment < len(segments) {
+		key = segments[p.topicSegment]
+	}
+
+	attributes, ok := p.registry[key]
+	if !ok || key == "" {
+		return true, nil
+	}
+
+	if m.Tags == nil {
+		m.Tags = map[string]string{}
+	}
+
+	for name, val := range attributes {
+		if _, ok := m.Tags[name]; !ok {
+			m.Tags[name] = val
+		}
+	}
+
+	return true, nil
+}
+
+/* reload reads the registry again when its modification time or size changed, the old registry is kept on errors */
+func (p *enrich) reload(now time.Time) (bool, error) {
+	if now.Sub(p.lastCheck) < registryCheckInterval && p.registry != nil {
+		return false, nil
+	}
+	p.lastCheck = now
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read registry: %s", p.path)
+	}
+
+	if p.registry != nil && info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return false, nil
+	}
+
+	raw, err := os.ReadFile(p.path)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read registry: %s", p.path)
+	}
+
+	registry, err := parseRegistry(p.path, raw)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to parse registry: %s", p.path)
+	}
+
+	p.registry = registry
+	p.modTime = info.ModTime()
+	p.size = info.Size()
+
+	return true, nil
+}
+
+// parseRegistry reads a registry by file extension. CSV files have a header row and the key in the first column,
+// JSON and YAML files map each key to its attributes.
+func parseRegistry(path string, raw []byte) (map[string]map[string]string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return parseRegistryCSV(raw)
+	case ".json":
+		var entries map[string]map[string]interface{}
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			return nil, err
+		}
+		return stringifyRegistry(entries), nil
+	case ".yaml", ".yml":
+		var entries map[string]map[string]interface{}
+		if err := yaml.Unmarshal(raw, &entries); err != nil {
+			return nil, err
+		}
+		return stringifyRegistry(entries), nil
+	default:
+		return nil, fmt.Errorf("unknown registry format: %q, expected .csv, .json, .yaml or .yml", filepath.Ext(path))
+	}
+}
+
+func parseRegistryCSV(raw []byte) (map[string]map[string]string, error) {
+	r := csv.NewReader(bytes.NewReader(raw))
+
+	// the mqtt payloads use ; so registries exported next to them may too
+	header, _, _ := bytes.Cut(raw, []byte("\n"))
+	if bytes.Contains(header, []byte(";")) && !bytes.Contains(header, []byte(",")) {
+		r.Comma = ';'
+	}
+
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, errors.New("registry is empty")
+	}
+
+	columns := rows[0]
+	registry := make(map[string]map[string]string, len(rows)-1)
+	for _, row := range rows[1:] {
+		attributes := make(map[string]string, len(columns)-1)
+		for i := 1; i < len(columns); i++ {
+			if row[i] != "" {
+				attributes[columns[i]] = row[i]
+			}
+		}
+
+		registry[row[0]] = attributes
+	}
+
+	return registry, nil
+}
+
+func stringifyRegistry(entries map[string]map[string]interface{}) map[string]map[string]string {
+	registry := make(map[string]map[string]string, len(entries))
+	for key, entry := range entries {
+		attributes := make(map[string]string, len(entry))
+		for name, val := range entry {
+			if val != nil {
+				attributes[name] = fmt.Sprint(val)
+			}
+		}
+
+		registry[key] = attributes
+	}
+
+	return registry
+}
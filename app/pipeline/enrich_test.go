@@ -0,0 +1,175 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"taos-adapter/models"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestEnrich(t *testing.T) {
+	t.Parallel()
+
+	segment := 1
+
+	cases := []struct {
+		name         string
+		file         string
+		registry     string
+		config       ProcessorConfig
+		tags         map[string]string
+		topic        string
+		expectedTags map[string]string
+	}{
+		{
+			name:         "Success: CSV by key tag",
+			file:         "registry.csv",
+			registry:     "serial,site,customer\nSN1,berlin,acme\nSN2,paris,\n",
+			config:       ProcessorConfig{Key: "serial"},
+			tags:         map[string]string{"serial": "SN2"},
+			expectedTags: map[string]string{"serial": "SN2", "site": "paris"},
+		},
+		{
+			name:         "Success: Semicolon CSV keeps existing tags",
+			file:         "registry.csv",
+			registry:     "serial;site;model\nSN1;berlin;x1\n",
+			config:       ProcessorConfig{Key: "serial"},
+			tags:         map[string]string{"serial": "SN1", "site": "override"},
+			expectedTags: map[string]string{"serial": "SN1", "site": "override", "model": "x1"},
+		},
+		{
+			name:         "Success: JSON by topic segment",
+			file:         "registry.json",
+			registry:     `{"SN1": {"site": "berlin", "floor": 2}}`,
+			config:       ProcessorConfig{TopicSegment: &segment},
+			topic:        "factory/SN1",
+			expectedTags: map[string]string{"site": "berlin", "floor": "2"},
+		},
+		{
+			name:         "Success: YAML",
+			file:         "registry.yaml",
+			registry:     "SN1:\n  site: berlin\n12345:\n  site: paris\n",
+			config:       ProcessorConfig{Key: "serial"},
+			tags:         map[string]string{"serial": "12345"},
+			expectedTags: map[string]string{"serial": "12345", "site": "paris"},
+		},
+		{
+			name:         "Success: Unknown device",
+			file:         "registry.csv",
+			registry:     "serial,site\nSN1,berlin\n",
+			config:       ProcessorConfig{Key: "serial"},
+			tags:         map[string]string{"serial": "SN9"},
+			expectedTags: map[string]string{"serial": "SN9"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		path := filepath.Join(t.TempDir(), c.file)
+		if err := os.WriteFile(path, []byte(c.registry), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		c.config.Type = ProcessorEnrich
+		c.config.Registry = path
+
+		proc, err := compileProcessor(c.config)
+		if err != nil {
+			t.Fatal(errors.Wrap(err, "unexpected error"))
+		}
+
+		m := models.TimeBasedMetrics{Tags: c.tags, Topic: c.topic}
+		if _, err := proc.Process(&m); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(m.Tags, c.expectedTags) {
+			t.Errorf("expected tags %v, got %v", c.expectedTags, m.Tags)
+		}
+	}
+}
+
+func TestEnrichReload(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "registry.csv")
+	if err := os.WriteFile(path, []byte("serial,site\nSN1,berlin\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	proc, err := compileProcessor(ProcessorConfig{Type: ProcessorEnrich, Registry: path, Key: "serial"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := proc.(*enrich)
+
+	if err := os.WriteFile(path, []byte("serial,site\nSN1,hamburg\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is not checked again before the interval passed
+	if reloaded, err := p.reload(time.Now()); err != nil || reloaded {
+		t.Fatalf("expected no reload, got %t: %v", reloaded, err)
+	}
+
+	later := time.Now().Add(registryCheckInterval)
+	if reloaded, err := p.reload(later); err != nil || !reloaded {
+		t.Fatalf("expected reload, got %t: %v", reloaded, err)
+	}
+
+	m := models.TimeBasedMetrics{Tags: map[string]string{"serial": "SN1"}}
+	if _, err := p.Process(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Tags["site"] != "hamburg" {
+		t.Errorf("expected site %s, got %s", "hamburg", m.Tags["site"])
+	}
+
+	// a broken registry keeps the previous one
+	if err := os.WriteFile(path, []byte("serial,site\nSN1,berlin,extra\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.reload(later.Add(registryCheckInterval)); err == nil {
+		t.Fatal("expected error for broken registry")
+	}
+
+	if p.registry["SN1"]["site"] != "hamburg" {
+		t.Errorf("expected previous registry to be kept, got %v", p.registry)
+	}
+}
+
+func TestCompileEnrichErrors(t *testing.T) {
+	t.Parallel()
+
+	segment := 0
+	path := filepath.Join(t.TempDir(), "registry.txt")
+	if err := os.WriteFile(path, []byte("SN1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		config ProcessorConfig
+	}{
+		{name: "Failure: Missing registry", config: ProcessorConfig{Key: "serial"}},
+		{name: "Failure: Key and topic segment", config: ProcessorConfig{Registry: path, Key: "serial", TopicSegment: &segment}},
+		{name: "Failure: Registry not found", config: ProcessorConfig{Registry: path + ".csv", Key: "serial"}},
+		{name: "Failure: Unknown format", config: ProcessorConfig{Registry: path, Key: "serial"}},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		c.config.Type = ProcessorEnrich
+		if _, err := compileProcessor(c.config); err == nil {
+			t.Error("expected error")
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package pipeline
+
+import (
+	"fmt"
+	"taos-adapter/models"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm"
+	"github.com/pkg/errors"
+)
+
+const (
+	ProcessorDerive = "derive"
+	ProcessorDropIf = "drop_if"
+	ProcessorRoute  = "route"
+)
+
+// names available to expressions next to the point fields, a field with the same name is still reachable through fields
+var reservedNames = map[string]struct{}{
+	"fields":    {},
+	"tags":      {},
+	"timestamp": {},
+	"db":        {},
+	"table":     {},
+	"topic":     {},
+}
+
+// expression is a compiled expression together with the fields it reads
+type expression struct {
+	source  string
+	program *vm.Program
+	fields  []string
+}
+
+// fieldCollector records the free identifiers of the expression while it is compiled, they refer to point fields.
+// Names of functions and let variables are identifiers as well, closures only see their element through #.
+type fieldCollector struct {
+	identifiers []string
+	bound       map[string]struct{}
+}
+
+func (c *fieldCollector) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.IdentifierNode:
+		c.identifiers = append(c.identifiers, n.Value)
+	case *ast.CallNode:
+		if callee, ok := n.Callee.(*ast.IdentifierNode); ok {
+			c.bound[callee.Value] = struct{}{}
+		}
+	case *ast.VariableDeclaratorNode:
+		c.bound[n.Name] = struct{}{}
+	}
+}
+
+/* fields returns the identifiers that are neither reserved nor bound by the expression itself */
+func (c *fieldCollector) fields() []string {
+	fields := []string{}
+	for _, name := range c.identifiers {
+		_, reserved := reservedNames[name]
+		_, bound := c.bound[name]
+		if !reserved && !bound && name != "$env" {
+			fields = append(fields, name)
+		}
+	}
+
+	return fields
+}
+
+func compileExpression(source string, options ...expr.Option) (expression, error) {
+	if source == "" {
+		return expression{}, errors.New("expression is required")
+	}
+
+	collector := &fieldCollector{bound: map[string]struct{}{}}
+	options = append(options, expr.AllowUndefinedVariables(), expr.Patch(collector))
+
+	program, err := expr.Compile(source, options...)
+	if err != nil {
+		return expression{}, fmt.Errorf("invalid expression %q:\n%s", source, err.Error())
+	}
+
+	return expression{source: source, program: program, fields: collector.fields()}, nil
+}
+
+/* applies reports whether every field the expression reads is present, expressions on partial points are skipped */
+func (e expression) applies(m *models.TimeBasedMetrics) bool {
+	for _, field := range e.fields {
+		if _, ok := m.Metrics[field]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (e expression) run(m *models.TimeBasedMetrics) (interface{}, error) {
+	env := make(map[string]interface{}, len(m.Metrics)+len(reservedNames))
+	for key, val := range m.Metrics {
+		env[key] = val
+	}
+
+	env["fields"] = m.Metrics
+	env["tags"] = m.Tags
+	env["timestamp"] = m.Timestamp
+	env["db"] = m.DB
+	env["table"] = m.Table
+	env["topic"] = m.Topic
+
+	out, err := expr.Run(e.program, env)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to evaluate %q", e.source)
+	}
+
+	return out, nil
+}
+
+func compileExpressionProcessor(c ProcessorConfig) (Processor, error) {
+	switch c.Type {
+	case ProcessorDerive:
+		if c.Field == "" {
+			return nil, errors.New("derive requires field")
+		}
+
+		e, err := compileExpression(c.Expression, expr.AsFloat64())
+		if err != nil {
+			return nil, errors.Wrapf(err, "derive %s", c.Field)
+		}
+		return derive{field: c.Field, expression: e}, nil
+	case ProcessorDropIf:
+		e, err := compileExpression(c.Expression, expr.AsBool())
+		if err != nil {
+			return nil, errors.Wrap(err, "drop_if")
+		}
+		return dropIf{expression: e}, nil
+	case ProcessorRoute:
+		e, err := compileExpression(c.Expression)
+		if err != nil {
+			return nil, errors.Wrap(err, "route")
+		}
+		return route{expression: e}, nil
+	}
+
+	return nil, fmt.Errorf("unknown processor type: %q", c.Type)
+}
+
+// derive adds a field computed from the point
+type derive struct {
+	field      string
+	expression expression
+}
+
+func (p derive) Process(m *models.TimeBasedMetrics) (bool, error) {
+	if !p.expression.applies(m) {
+		return true, nil
+	}
+
+	out, err := p.expression.run(m)
+	if err != nil {
+		return false, err
+	}
+
+	if m.Metrics == nil {
+		m.Metrics = map[string]float64{}
+	}
+	m.Metrics[p.field] = out.(float64)
+
+	return true, nil
+}
+
+// dropIf drops points the predicate holds for
+type dropIf struct {
+	expression expression
+}
+
+func (p dropIf) Process(m *models.TimeBasedMetrics) (bool, error) {
+	if !p.expression.applies(m) {
+		return true, nil
+	}
+
+	out, err := p.expression.run(m)
+	if err != nil {
+		return false, err
+	}
+
+	return !out.(bool), nil
+}
+
+// route sets the table to the result of the expression, an empty result keeps the current table
+type route struct {
+	expression expression
+}
+
+func (p route) Process(m *models.TimeBasedMetrics) (bool, error) {
+	if !p.expression.applies(m) {
+		return true, nil
+	}
+
+	out, err := p.expression.run(m)
+	if err != nil {
+		return false, err
+	}
+
+	table, ok := out.(string)
+	if !ok {
+		return false, fmt.Errorf("route expression %q returned %T, expected a table name", p.expression.source, out)
+	}
+
+	if table != "" {
+		m.Table = table
+	}
+
+	return true, nil
+}
@@ -0,0 +1,472 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"taos-adapter/models"
+	"taos-adapter/mqtt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the pipeline configuration, read from its own file or from the pipeline section of the adapter config
+type Config struct {
+	Subscriptions []SubscriptionConfig `yaml:"subscriptions"`
+	Cardinality   *CardinalityConfig   `yaml:"cardinality,omitempty"`
+	RateLimits    []RateLimitConfig    `yaml:"rate_limits,omitempty"`
+}
+
+// SubscriptionConfig holds the processors applied to points received on topics matching Topic
+type SubscriptionConfig struct {
+	Topic      string            `yaml:"topic"`
+	Dedup      *DedupConfig      `yaml:"dedup,omitempty"`
+	Schema     *SchemaConfig     `yaml:"schema,omitempty"`
+	Processors []ProcessorConfig `yaml:"processors"`
+	Aggregate  *AggregateConfig  `yaml:"aggregate,omitempty"`
+}
+
+type subscription struct {
+	config       SubscriptionConfig // kept to reuse the subscription and its state when a reload does not change it
+	topic        string
+	deduplicator *deduplicator
+	schema       *schema
+	processors   []Processor
+	aggregator   *aggregator
+	lateLogged   uint64
+
+	invalid        uint64
+	lastInvalidLog time.Time
+}
+
+// invalidLogInterval limits how often points failing a schema are logged per subscription
+const invalidLogInterval = 10 * time.Second
+
+// flushInterval is how often windows of aggregating subscriptions are checked
+const flushInterval = 100 * time.Millisecond
+
+// state is a compiled configuration, Apply swaps it as a whole and Run picks it up before the next point
+type state struct {
+	subscriptions []*subscription
+	limiter       *cardinalityLimiter
+	rateLimits    *rateLimiters
+
+	cardinality      *CardinalityConfig
+	rateLimitConfigs []RateLimitConfig
+}
+
+var current atomic.Pointer[state]
+
+/* load returns the current state, which is empty until the first Apply */
+func load() *state {
+	if st := current.Load(); st != nil {
+		return st
+	}
+
+	return &state{}
+}
+
+// ReadConfig reads a pipeline configuration file
+func ReadConfig(path string) (Config, error) {
+	var config Config
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return config, errors.Wrapf(err, "failed to read pipeline config: %s", path)
+	}
+
+	if err := yaml.UnmarshalStrict(raw, &config); err != nil {
+		return config, errors.Wrapf(err, "failed to parse pipeline config: %s", path)
+	}
+
+	return config, nil
+}
+
+// Validate compiles the pipeline configuration without applying it
+func Validate(config Config) error {
+	_, err := compileState(config, nil)
+
+	return err
+}
+
+// Apply compiles the pipeline configuration and swaps it in atomically. Subscriptions, cardinality and rate limits
+// whose configuration did not change are kept with their state, like deduplication windows and open aggregates.
+func Apply(config Config) error {
+	st, err := compileState(config, current.Load())
+	if err != nil {
+		return err
+	}
+
+	current.Store(st)
+
+	return nil
+}
+
+/* compileState compiles config, reusing the unchanged parts of prev when it is set */
+func compileState(config Config, prev *state) (*state, error) {
+	if prev == nil {
+		prev = &state{}
+	}
+
+	subs, err := compile(config, prev.subscriptions)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &state{
+		subscriptions:    subs,
+		limiter:          prev.limiter,
+		rateLimits:       prev.rateLimits,
+		cardinality:      config.Cardinality,
+		rateLimitConfigs: config.RateLimits,
+	}
+
+	if !reflect.DeepEqual(config.Cardinality, prev.cardinality) {
+		st.limiter = nil
+		if config.Cardinality != nil {
+			if st.limiter, err = compileCardinalityLimiter(*config.Cardinality); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if st.rateLimits == nil || !reflect.DeepEqual(config.RateLimits, prev.rateLimitConfigs) {
+		if st.rateLimits, err = compileRateLimiters(config.RateLimits); err != nil {
+			return nil, err
+		}
+	}
+
+	return st, nil
+}
+
+func compile(config Config, prev []*subscription) ([]*subscription, error) {
+	compiled := make([]*subscription, 0, len(config.Subscriptions))
+
+	for i, subConfig := range config.Subscriptions {
+		if subConfig.Topic == "" {
+			return nil, fmt.Errorf("subscriptions[%d]: topic is required", i)
+		}
+
+		if sub := unchanged(prev, subConfig); sub != nil {
+			compiled = append(compiled, sub)
+			continue
+		}
+
+		sub := &subscription{config: subConfig, topic: subConfig.Topic}
+
+		if subConfig.Dedup != nil {
+			dedup, err := compileDeduplicator(*subConfig.Dedup)
+			if err != nil {
+				return nil, errors.Wrapf(err, "subscriptions[%d] (%s) dedup", i, subConfig.Topic)
+			}
+
+			sub.deduplicator = dedup
+		}
+
+		if subConfig.Schema != nil {
+			compiledSchema, err := compileSchema(*subConfig.Schema)
+			if err != nil {
+				return nil, errors.Wrapf(err, "subscriptions[%d] (%s) schema", i, subConfig.Topic)
+			}
+
+			sub.schema = compiledSchema
+		}
+
+		for j, procConfig := range subConfig.Processors {
+			proc, err := compileProcessor(procConfig)
+			if err != nil {
+				return nil, errors.Wrapf(err, "subscriptions[%d] (%s) processors[%d]", i, subConfig.Topic, j)
+			}
+
+			sub.processors = append(sub.processors, proc)
+		}
+
+		if subConfig.Aggregate != nil {
+			agg, err := compileAggregator(*subConfig.Aggregate)
+			if err != nil {
+				return nil, errors.Wrapf(err, "subscriptions[%d] (%s) aggregate", i, subConfig.Topic)
+			}
+
+			sub.aggregator = agg
+		}
+
+		compiled = append(compiled, sub)
+	}
+
+	return compiled, nil
+}
+
+/* unchanged returns the subscription of prev compiled from the same configuration, or nil */
+func unchanged(prev []*subscription, config SubscriptionConfig) *subscription {
+	for _, sub := range prev {
+		if reflect.DeepEqual(sub.config, config) {
+			return sub
+		}
+	}
+
+	return nil
+}
+
+/* match returns the first subscription matching topic, or nil */
+func match(subs []*subscription, topic string) *subscription {
+	for _, sub := range subs {
+		if mqtt.TopicMatches(sub.topic, topic) {
+			return sub
+		}
+	}
+
+	return nil
+}
+
+/* process drops duplicates, validates the schema and runs the processors of the subscription in order */
+func (sub *subscription) process(m *models.TimeBasedMetrics) (bool, error) {
+	if sub.deduplicator != nil && !sub.deduplicator.check(m, time.Now()) {
+		return false, nil
+	}
+
+	if sub.schema != nil {
+		if err := sub.schema.validate(m); err != nil {
+			return false, err
+		}
+	}
+
+	for _, proc := range sub.processors {
+		keep, err := proc.Process(m)
+		if err != nil || !keep {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+/* invalidPoint counts and logs a point failing the schema, it returns true when the point is quarantined */
+func (sub *subscription) invalidPoint(log *logrus.Entry, m *models.TimeBasedMetrics, invalid *invalidPointError) bool {
+	count := atomic.AddUint64(&sub.invalid, 1)
+
+	if time.Since(sub.lastInvalidLog) > invalidLogInterval {
+		log.WithField("topic", m.Topic).Warnf("invalid point: %s, %d invalid points so far", invalid, count)
+		sub.lastInvalidLog = time.Now()
+	}
+
+	if !sub.schema.quarantine {
+		return false
+	}
+
+	sub.schema.quarantinePoint(m, invalid)
+
+	return true
+}
+
+/* process runs the processors of the first subscription matching the point topic */
+func process(subs []*subscription, m *models.TimeBasedMetrics) (bool, error) {
+	sub := match(subs, m.Topic)
+	if sub == nil {
+		return true, nil
+	}
+
+	return sub.process(m)
+}
+
+// DroppedDuplicates returns the number of points dropped as duplicates per subscription topic filter
+func DroppedDuplicates() map[string]uint64 {
+	dropped := map[string]uint64{}
+	for _, sub := range load().subscriptions {
+		if sub.deduplicator != nil {
+			dropped[sub.topic] += sub.deduplicator.Dropped()
+		}
+	}
+
+	return dropped
+}
+
+// SchemaViolations returns the number of points failing the schema per subscription topic filter
+func SchemaViolations() map[string]uint64 {
+	violations := map[string]uint64{}
+	for _, sub := range load().subscriptions {
+		if sub.schema != nil {
+			violations[sub.topic] += atomic.LoadUint64(&sub.invalid)
+		}
+	}
+
+	return violations
+}
+
+// CardinalityViolations returns the number of points rejected or stripped by the cardinality limits per
+// subscription topic filter, points matching no subscription are counted as none
+func CardinalityViolations() map[string]uint64 {
+	limiter := load().limiter
+	if limiter == nil {
+		return map[string]uint64{}
+	}
+
+	return limiter.Violations()
+}
+
+// RateLimited returns the number of points dropped per rate limit
+func RateLimited() map[string]uint64 {
+	rateLimits := load().rateLimits
+	if rateLimits == nil {
+		return map[string]uint64{}
+	}
+
+	return rateLimits.Limited()
+}
+
+/* emit applies the cardinality limits for the subscription and sends the point, it returns false once ctx is done */
+func emit(ctx context.Context, log *logrus.Entry, limiter *cardinalityLimiter, out chan models.TimeBasedMetrics, subscription string, m models.TimeBasedMetrics) bool {
+	if limiter != nil && !limiter.check(log, &m, subscription, time.Now()) {
+		return true
+	}
+
+	select {
+	case out <- m:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+/* reloadProcessors lets processors pick up changed files, a failed reload keeps the previous state */
+func reloadProcessors(log *logrus.Entry, subs []*subscription, now time.Time) {
+	for _, sub := range subs {
+		for _, proc := range sub.processors {
+			r, ok := proc.(reloadable)
+			if !ok {
+				continue
+			}
+
+			reloaded, err := r.reload(now)
+			if err != nil {
+				log.Error(errors.Wrapf(err, "failed to reload processor of %s", sub.topic))
+			} else if reloaded {
+				log.Infof("reloaded processor of %s", sub.topic)
+			}
+		}
+	}
+}
+
+/* flushAggregates sends windows that are complete, or all open windows when all is set */
+func flushAggregates(ctx context.Context, log *logrus.Entry, subs []*subscription, limiter *cardinalityLimiter, out chan models.TimeBasedMetrics, all bool) {
+	now := time.Now()
+
+	for _, sub := range subs {
+		if sub.aggregator == nil {
+			continue
+		}
+
+		if late := sub.aggregator.late; late > sub.lateLogged {
+			log.Warnf("dropped %d late points for %s", late-sub.lateLogged, sub.topic)
+			sub.lateLogged = late
+		}
+
+		for _, m := range sub.aggregator.flush(now, all) {
+			if !emit(ctx, log, limiter, out, sub.topic, m) {
+				return
+			}
+		}
+	}
+}
+
+/* swap flushes the open windows of subscriptions that were dropped by a reload */
+func swap(ctx context.Context, log *logrus.Entry, prev, next *state, out chan models.TimeBasedMetrics) {
+	retired := []*subscription{}
+	for _, sub := range prev.subscriptions {
+		kept := false
+		for _, nextSub := range next.subscriptions {
+			kept = kept || sub == nextSub
+		}
+
+		if !kept {
+			retired = append(retired, sub)
+		}
+	}
+
+	flushAggregates(ctx, log, retired, prev.limiter, out, true)
+	log.Infof("pipeline reloaded with %d subscriptions", len(next.subscriptions))
+}
+
+// Run processes points from in and passes the ones that are kept to out, out is closed once in is.
+// A configuration swapped in by Apply is used from the next point on. Open aggregation windows are flushed
+// before returning.
+func Run(ctx context.Context, log *logrus.Entry, in chan models.TimeBasedMetrics, out chan models.TimeBasedMetrics) error {
+	defer close(out)
+
+	st := load()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushAggregates(ctx, log, st.subscriptions, st.limiter, out, true)
+			return nil
+		case now := <-ticker.C:
+			if next := load(); next != st {
+				swap(ctx, log, st, next, out)
+				st = next
+			}
+
+			reloadProcessors(log, st.subscriptions, now)
+			flushAggregates(ctx, log, st.subscriptions, st.limiter, out, false)
+
+			if st.rateLimits != nil {
+				st.rateLimits.prune(now)
+			}
+		case m, ok := <-in:
+			if !ok {
+				flushAggregates(ctx, log, st.subscriptions, st.limiter, out, true)
+				return nil
+			}
+
+			if next := load(); next != st {
+				swap(ctx, log, st, next, out)
+				st = next
+			}
+
+			if st.rateLimits != nil && !st.rateLimits.allow(log, &m, time.Now()) {
+				continue
+			}
+
+			subscription := noSubscription
+			sub := match(st.subscriptions, m.Topic)
+			if sub != nil {
+				subscription = sub.topic
+
+				keep, err := sub.process(&m)
+
+				var invalid *invalidPointError
+				if errors.As(err, &invalid) {
+					if sub.invalidPoint(log, &m, invalid) && !emit(ctx, log, st.limiter, out, sub.topic, m) {
+						return nil
+					}
+					continue
+				}
+
+				if err != nil {
+					log.Error(errors.Wrapf(err, "failed to process point from %s", m.Topic))
+					continue
+				}
+
+				if !keep {
+					continue
+				}
+
+				if sub.aggregator != nil {
+					sub.aggregator.add(m, time.Now())
+					continue
+				}
+			}
+
+			if !emit(ctx, log, st.limiter, out, subscription, m) {
+				return nil
+			}
+		}
+	}
+}
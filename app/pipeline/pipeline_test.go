@@ -0,0 +1,548 @@
+package pipeline
+
+import (
+	"reflect"
+	"strings"
+	"taos-adapter/models"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+func TestProcessors(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name            string
+		config          string
+		metrics         map[string]float64
+		tags            map[string]string
+		expectedMetrics map[string]float64
+		expectedTags    map[string]string
+		expectedDrop    bool
+	}{
+		{
+			name: "Success: Rename fields and tags",
+			config: `
+- type: rename
+  field_map: {preassure: pressure}
+  tag_map: {loc: location}`,
+			metrics:         map[string]float64{"preassure": 10.23, "temp": 12.34},
+			tags:            map[string]string{"loc": "test_location"},
+			expectedMetrics: map[string]float64{"pressure": 10.23, "temp": 12.34},
+			expectedTags:    map[string]string{"location": "test_location"},
+		},
+		{
+			name: "Success: Swap and chain renames",
+			config: `
+- type: rename
+  field_map: {a: b, b: a, x: y, y: z}
+  tag_map: {loc: site, site: region}`,
+			metrics:         map[string]float64{"a": 1, "b": 2, "x": 3, "y": 4},
+			tags:            map[string]string{"loc": "hall", "site": "north"},
+			expectedMetrics: map[string]float64{"a": 2, "b": 1, "y": 3, "z": 4},
+			expectedTags:    map[string]string{"site": "hall", "region": "north"},
+		},
+		{
+			name: "Success: Drop fields and tags",
+			config: `
+- type: drop
+  fields: [count]
+  tags: [fw]`,
+			metrics:         map[string]float64{"count": 9, "temp": 12.34},
+			tags:            map[string]string{"fw": "1.0.2", "name": "test_name"},
+			expectedMetrics: map[string]float64{"temp": 12.34},
+			expectedTags:    map[string]string{"name": "test_name"},
+		},
+		{
+			name: "Success: Whitelist fields only",
+			config: `
+- type: whitelist
+  fields: [temp]`,
+			metrics:         map[string]float64{"count": 9, "temp": 12.34},
+			tags:            map[string]string{"fw": "1.0.2", "name": "test_name"},
+			expectedMetrics: map[string]float64{"temp": 12.34},
+			expectedTags:    map[string]string{"fw": "1.0.2", "name": "test_name"},
+		},
+		{
+			name: "Success: Whitelist with empty tag list",
+			config: `
+- type: whitelist
+  fields: [temp]
+  tags: []`,
+			metrics:         map[string]float64{"count": 9, "temp": 12.34},
+			tags:            map[string]string{"fw": "1.0.2"},
+			expectedMetrics: map[string]float64{"temp": 12.34},
+			expectedTags:    map[string]string{},
+		},
+		{
+			name: "Success: Static tags",
+			config: `
+- type: static_tags
+  values: {site: test_site, name: override}`,
+			metrics:         map[string]float64{"temp": 12.34},
+			tags:            map[string]string{"name": "test_name"},
+			expectedMetrics: map[string]float64{"temp": 12.34},
+			expectedTags:    map[string]string{"name": "override", "site": "test_site"},
+		},
+		{
+			name: "Success: Tag to field",
+			config: `
+- type: tag_to_field
+  tags: [rssi, name]`,
+			metrics:         map[string]float64{},
+			tags:            map[string]string{"rssi": "-71", "name": "test_name"},
+			expectedMetrics: map[string]float64{"rssi": -71},
+			expectedTags:    map[string]string{"name": "test_name"},
+		},
+		{
+			name: "Success: Field to tag",
+			config: `
+- type: field_to_tag
+  fields: [device_id]`,
+			metrics:         map[string]float64{"device_id": 1042, "temp": 12.34},
+			tags:            map[string]string{},
+			expectedMetrics: map[string]float64{"temp": 12.34},
+			expectedTags:    map[string]string{"device_id": "1042"},
+		},
+		{
+			name: "Success: Regex replace field names",
+			config: `
+- type: regex_replace
+  target: field_names
+  pattern: "^sensor_(.*)$"
+  replacement: "$1"`,
+			metrics:         map[string]float64{"sensor_temp": 12.34, "count": 9},
+			tags:            map[string]string{},
+			expectedMetrics: map[string]float64{"temp": 12.34, "count": 9},
+			expectedTags:    map[string]string{},
+		},
+		{
+			name: "Success: Regex replace selected tag values",
+			config: `
+- type: regex_replace
+  target: tag_values
+  tags: [location]
+  pattern: " "
+  replacement: "_"`,
+			metrics:         map[string]float64{},
+			tags:            map[string]string{"location": "test location", "name": "test name"},
+			expectedMetrics: map[string]float64{},
+			expectedTags:    map[string]string{"location": "test_location", "name": "test name"},
+		},
+		{
+			name: "Success: Chained processors",
+			config: `
+- type: field_to_tag
+  fields: [device_id]
+
+- type: rename
+  tag_map: {device_id: device}`,
+			metrics:         map[string]float64{"device_id": 7},
+			tags:            map[string]string{},
+			expectedMetrics: map[string]float64{},
+			expectedTags:    map[string]string{"device": "7"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		var procConfigs []ProcessorConfig
+		if err := yaml.UnmarshalStrict([]byte(c.config), &procConfigs); err != nil {
+			t.Fatal(errors.Wrap(err, "failed to parse test config"))
+		}
+
+		subs, err := compile(Config{Subscriptions: []SubscriptionConfig{{Topic: "#", Processors: procConfigs}}}, nil)
+		if err != nil {
+			t.Fatal(errors.Wrap(err, "unexpected error"))
+		}
+
+		m := models.TimeBasedMetrics{Metrics: c.metrics, Tags: c.tags, Topic: "test_db/room"}
+		keep, err := process(subs, &m)
+		if err != nil {
+			t.Fatal(errors.Wrap(err, "unexpected error"))
+		}
+
+		if keep == c.expectedDrop {
+			t.Errorf("expected drop: %t, got: %t", c.expectedDrop, !keep)
+			continue
+		}
+
+		if !reflect.DeepEqual(m.Metrics, c.expectedMetrics) {
+			t.Errorf("expected metrics %v, got %v", c.expectedMetrics, m.Metrics)
+		}
+
+		if !reflect.DeepEqual(m.Tags, c.expectedTags) {
+			t.Errorf("expected tags %v, got %v", c.expectedTags, m.Tags)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name          string
+		config        string
+		expectedError bool
+	}{
+		{
+			name: "Success: Several subscriptions",
+			config: `
+subscriptions:
+  - topic: factory/+
+    processors:
+      - type: static_tags
+        values: {site: factory}
+  - topic: "#"`,
+		},
+		{
+			name: "Failure: Missing topic",
+			config: `
+subscriptions:
+  - processors:
+      - type: drop
+        fields: [count]`,
+			expectedError: true,
+		},
+		{
+			name: "Failure: Unknown processor",
+			config: `
+subscriptions:
+  - topic: "#"
+    processors:
+      - type: uppercase`,
+			expectedError: true,
+		},
+		{
+			name: "Failure: Invalid regex",
+			config: `
+subscriptions:
+  - topic: "#"
+    processors:
+      - type: regex_replace
+        target: tag_values
+        pattern: "("`,
+			expectedError: true,
+		},
+		{
+			name: "Failure: Missing regex target",
+			config: `
+subscriptions:
+  - topic: "#"
+    processors:
+      - type: regex_replace
+        pattern: "a"`,
+			expectedError: true,
+		},
+		{
+			name: "Failure: Processor without settings",
+			config: `
+subscriptions:
+  - topic: "#"
+    processors:
+      - type: rename`,
+			expectedError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		var config Config
+		if err := yaml.UnmarshalStrict([]byte(c.config), &config); err != nil {
+			t.Fatal(errors.Wrap(err, "failed to parse test config"))
+		}
+
+		_, err := compile(config, nil)
+		if (err != nil) != c.expectedError {
+			t.Errorf("expected error: %t, got: %v", c.expectedError, err)
+		}
+	}
+}
+
+func TestProcessFirstMatchingSubscription(t *testing.T) {
+	t.Parallel()
+
+	subs, err := compile(Config{Subscriptions: []SubscriptionConfig{
+		{
+			Topic:      "factory/+",
+			Processors: []ProcessorConfig{{Type: ProcessorStaticTags, Values: map[string]string{"site": "factory"}}},
+		},
+		{
+			Topic:      "#",
+			Processors: []ProcessorConfig{{Type: ProcessorStaticTags, Values: map[string]string{"site": "other"}}},
+		},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		topic        string
+		expectedSite string
+	}{
+		{topic: "factory/line1", expectedSite: "factory"},
+		{topic: "office/room", expectedSite: "other"},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.topic)
+
+		m := models.TimeBasedMetrics{Topic: c.topic}
+		if _, err := process(subs, &m); err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Tags["site"] != c.expectedSite {
+			t.Errorf("expected site %s, got %s", c.expectedSite, m.Tags["site"])
+		}
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name            string
+		config          string
+		metrics         map[string]float64
+		tags            map[string]string
+		expectedMetrics map[string]float64
+		expectedTable   string
+		expectedDrop    bool
+		expectedError   bool
+	}{
+		{
+			name: "Success: Derived field",
+			config: `
+- type: derive
+  field: temp_f
+  expression: temp * 9 / 5 + 32`,
+			metrics:         map[string]float64{"temp": 20},
+			expectedMetrics: map[string]float64{"temp": 20, "temp_f": 68},
+			expectedTable:   "room",
+		},
+		{
+			name: "Success: Derived field from several fields",
+			config: `
+- type: derive
+  field: power
+  expression: voltage * current`,
+			metrics:         map[string]float64{"voltage": 230, "current": 0.5},
+			expectedMetrics: map[string]float64{"voltage": 230, "current": 0.5, "power": 115},
+			expectedTable:   "room",
+		},
+		{
+			name: "Success: Derived field skipped on missing input",
+			config: `
+- type: derive
+  field: power
+  expression: voltage * current`,
+			metrics:         map[string]float64{"voltage": 230},
+			expectedMetrics: map[string]float64{"voltage": 230},
+			expectedTable:   "room",
+		},
+		{
+			name: "Success: Derived field with let variable and builtin",
+			config: `
+- type: derive
+  field: power
+  expression: let v = voltage; max(v, 0) * current`,
+			metrics:         map[string]float64{"voltage": 230, "current": 0.5},
+			expectedMetrics: map[string]float64{"voltage": 230, "current": 0.5, "power": 115},
+			expectedTable:   "room",
+		},
+		{
+			name: "Success: Derived field with closure",
+			config: `
+- type: derive
+  field: peak
+  expression: 'max(map([a, b], # * 2))'`,
+			metrics:         map[string]float64{"a": 1, "b": 3},
+			expectedMetrics: map[string]float64{"a": 1, "b": 3, "peak": 6},
+			expectedTable:   "room",
+		},
+		{
+			name: "Success: Drop matching point",
+			config: `
+- type: drop_if
+  expression: rssi < -90`,
+			metrics:      map[string]float64{"rssi": -95},
+			expectedDrop: true,
+		},
+		{
+			name: "Success: Keep point not matching",
+			config: `
+- type: drop_if
+  expression: rssi < -90 && tags.name == "test_name"`,
+			metrics:         map[string]float64{"rssi": -71},
+			tags:            map[string]string{"name": "test_name"},
+			expectedMetrics: map[string]float64{"rssi": -71},
+			expectedTable:   "room",
+		},
+		{
+			name: "Success: Route on tag",
+			config: `
+- type: route
+  expression: 'tags.kind == "alarm" ? "alarms" : ""'`,
+			metrics:         map[string]float64{"temp": 90},
+			tags:            map[string]string{"kind": "alarm"},
+			expectedMetrics: map[string]float64{"temp": 90},
+			expectedTable:   "alarms",
+		},
+		{
+			name: "Success: Route with table name",
+			config: `
+- type: route
+  expression: table + "_" + topic[0:7]`,
+			metrics:         map[string]float64{"temp": 90},
+			expectedMetrics: map[string]float64{"temp": 90},
+			expectedTable:   "room_test_db",
+		},
+		{
+			name: "Failure: Route to non string",
+			config: `
+- type: route
+  expression: temp`,
+			metrics:       map[string]float64{"temp": 90},
+			expectedError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		var procConfigs []ProcessorConfig
+		if err := yaml.UnmarshalStrict([]byte(c.config), &procConfigs); err != nil {
+			t.Fatal(errors.Wrap(err, "failed to parse test config"))
+		}
+
+		subs, err := compile(Config{Subscriptions: []SubscriptionConfig{{Topic: "#", Processors: procConfigs}}}, nil)
+		if err != nil {
+			t.Fatal(errors.Wrap(err, "unexpected error"))
+		}
+
+		m := models.TimeBasedMetrics{Metrics: c.metrics, Tags: c.tags, Table: "room", Topic: "test_db/room"}
+		keep, err := process(subs, &m)
+		if err != nil {
+			if !c.expectedError {
+				t.Error(errors.Wrap(err, "unexpected error"))
+			}
+			continue
+		}
+
+		if c.expectedError {
+			t.Error("expected error")
+			continue
+		}
+
+		if keep == c.expectedDrop {
+			t.Errorf("expected drop: %t, got: %t", c.expectedDrop, !keep)
+			continue
+		}
+
+		if !keep {
+			continue
+		}
+
+		if !reflect.DeepEqual(m.Metrics, c.expectedMetrics) {
+			t.Errorf("expected metrics %v, got %v", c.expectedMetrics, m.Metrics)
+		}
+
+		if m.Table != c.expectedTable {
+			t.Errorf("expected table %s, got %s", c.expectedTable, m.Table)
+		}
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name          string
+		config        ProcessorConfig
+		expectedError string
+	}{
+		{
+			name:          "Failure: Syntax error",
+			config:        ProcessorConfig{Type: ProcessorDerive, Field: "temp_f", Expression: "temp * * 9"},
+			expectedError: "subscriptions[0] (#) processors[0]: derive temp_f: invalid expression \"temp * * 9\"",
+		},
+		{
+			name:          "Failure: Missing derived field name",
+			config:        ProcessorConfig{Type: ProcessorDerive, Expression: "temp * 9"},
+			expectedError: "subscriptions[0] (#) processors[0]: derive requires field",
+		},
+		{
+			name:          "Failure: Predicate is not boolean",
+			config:        ProcessorConfig{Type: ProcessorDropIf, Expression: `"yes"`},
+			expectedError: "subscriptions[0] (#) processors[0]: drop_if: invalid expression",
+		},
+		{
+			name:          "Failure: Empty expression",
+			config:        ProcessorConfig{Type: ProcessorRoute},
+			expectedError: "subscriptions[0] (#) processors[0]: route: expression is required",
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		_, err := compile(Config{Subscriptions: []SubscriptionConfig{{Topic: "#", Processors: []ProcessorConfig{c.config}}}}, nil)
+		if err == nil {
+			t.Errorf("expected error %q", c.expectedError)
+			continue
+		}
+
+		if !strings.HasPrefix(err.Error(), c.expectedError) {
+			t.Errorf("expected error %q, got %q", c.expectedError, err.Error())
+		}
+	}
+}
+
+func TestApplyKeepsUnchangedState(t *testing.T) {
+	t.Parallel()
+
+	dedup := SubscriptionConfig{Topic: "factory/#", Dedup: &DedupConfig{Field: "seq"}}
+	rename := SubscriptionConfig{Topic: "#", Processors: []ProcessorConfig{{Type: ProcessorRename, FieldMap: map[string]string{"t": "temp"}}}}
+	limits := []RateLimitConfig{{Topic: "#", Rate: 10, Burst: 10}}
+
+	if err := Apply(Config{Subscriptions: []SubscriptionConfig{dedup}, RateLimits: limits}); err != nil {
+		t.Fatal(err)
+	}
+	prev := load()
+
+	if err := Apply(Config{Subscriptions: []SubscriptionConfig{dedup, rename}, RateLimits: limits}); err != nil {
+		t.Fatal(err)
+	}
+	next := load()
+
+	if next == prev || len(next.subscriptions) != 2 {
+		t.Fatalf("expected a new state with 2 subscriptions, got %d", len(next.subscriptions))
+	}
+
+	if next.subscriptions[0] != prev.subscriptions[0] || next.rateLimits != prev.rateLimits {
+		t.Error("expected unchanged subscription and rate limits to be kept")
+	}
+
+	changed := dedup
+	changed.Dedup = &DedupConfig{Field: "id"}
+	if err := Apply(Config{Subscriptions: []SubscriptionConfig{changed}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if st := load(); st.subscriptions[0] == prev.subscriptions[0] || st.rateLimits == prev.rateLimits {
+		t.Error("expected changed subscription and rate limits to be compiled again")
+	}
+
+	if err := Apply(Config{Subscriptions: []SubscriptionConfig{{}}}); err == nil {
+		t.Error("expected error for invalid config")
+	}
+
+	if st := load(); len(st.subscriptions) != 1 || st.subscriptions[0].config.Dedup.Field != "id" {
+		t.Error("expected an invalid config to keep the current one")
+	}
+}
@@ -0,0 +1,308 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"taos-adapter/models"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ProcessorRename       = "rename"
+	ProcessorDrop         = "drop"
+	ProcessorWhitelist    = "whitelist"
+	ProcessorStaticTags   = "static_tags"
+	ProcessorTagToField   = "tag_to_field"
+	ProcessorFieldToTag   = "field_to_tag"
+	ProcessorRegexReplace = "regex_replace"
+
+	TargetFieldNames = "field_names"
+	TargetTagNames   = "tag_names"
+	TargetTagValues  = "tag_values"
+)
+
+// Processor modifies a point in place, returning false drops the point
+type Processor interface {
+	Process(m *models.TimeBasedMetrics) (bool, error)
+}
+
+// ProcessorConfig is a single processor entry of a subscription, which keys are used depends on Type
+type ProcessorConfig struct {
+	Type         string            `yaml:"type"`
+	Fields       []string          `yaml:"fields,omitempty"`
+	Tags         []string          `yaml:"tags,omitempty"`
+	FieldMap     map[string]string `yaml:"field_map,omitempty"`
+	TagMap       map[string]string `yaml:"tag_map,omitempty"`
+	Values       map[string]string `yaml:"values,omitempty"`
+	Target       string            `yaml:"target,omitempty"`
+	Pattern      string            `yaml:"pattern,omitempty"`
+	Replacement  string            `yaml:"replacement,omitempty"`
+	Field        string            `yaml:"field,omitempty"`
+	Expression   string            `yaml:"expression,omitempty"`
+	Registry     string            `yaml:"registry,omitempty"`
+	Key          string            `yaml:"key,omitempty"`
+	TopicSegment *int              `yaml:"topic_segment,omitempty"`
+	UnitTag      string            `yaml:"unit_tag,omitempty"`
+}
+
+/* compileProcessor validates a processor config and builds the processor */
+func compileProcessor(c ProcessorConfig) (Processor, error) {
+	switch c.Type {
+	case ProcessorRename:
+		if len(c.FieldMap) == 0 && len(c.TagMap) == 0 {
+			return nil, errors.New("rename requires field_map or tag_map")
+		}
+		return rename{fields: sortedPairs(c.FieldMap), tags: sortedPairs(c.TagMap)}, nil
+	case ProcessorDrop:
+		if len(c.Fields) == 0 && len(c.Tags) == 0 {
+			return nil, errors.New("drop requires fields or tags")
+		}
+		return drop{fields: toSet(c.Fields), tags: toSet(c.Tags)}, nil
+	case ProcessorWhitelist:
+		if c.Fields == nil && c.Tags == nil {
+			return nil, errors.New("whitelist requires fields or tags")
+		}
+		return whitelist{fields: toSet(c.Fields), tags: toSet(c.Tags), keepFields: c.Fields == nil, keepTags: c.Tags == nil}, nil
+	case ProcessorStaticTags:
+		if len(c.Values) == 0 {
+			return nil, errors.New("static_tags requires values")
+		}
+		return staticTags{values: c.Values}, nil
+	case ProcessorTagToField:
+		if len(c.Tags) == 0 {
+			return nil, errors.New("tag_to_field requires tags")
+		}
+		return tagToField{tags: c.Tags}, nil
+	case ProcessorFieldToTag:
+		if len(c.Fields) == 0 {
+			return nil, errors.New("field_to_tag requires fields")
+		}
+		return fieldToTag{fields: c.Fields}, nil
+	case ProcessorRegexReplace:
+		switch c.Target {
+		case TargetFieldNames, TargetTagNames, TargetTagValues:
+		default:
+			return nil, fmt.Errorf("regex_replace target must be one of %s, %s, %s, got: %q", TargetFieldNames, TargetTagNames, TargetTagValues, c.Target)
+		}
+
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid regex_replace pattern %q", c.Pattern)
+		}
+		return regexReplace{target: c.Target, re: re, replacement: c.Replacement, tags: toSet(c.Tags)}, nil
+	case ProcessorDerive, ProcessorDropIf, ProcessorRoute:
+		return compileExpressionProcessor(c)
+	case ProcessorEnrich:
+		return compileEnrich(c)
+	case ProcessorNormalizeUnits:
+		return compileNormalizeUnits(c)
+	default:
+		return nil, fmt.Errorf("unknown processor type: %q", c.Type)
+	}
+}
+
+func toSet(keys []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		set[key] = struct{}{}
+	}
+
+	return set
+}
+
+// rename applies every entry to the names the point had before, so renames can swap or chain names. When several
+// names map to the same one, the value of the last name in sorted order wins.
+type rename struct {
+	fields [][2]string
+	tags   [][2]string
+}
+
+func (p rename) Process(m *models.TimeBasedMetrics) (bool, error) {
+	renamedMetrics := map[string]float64{}
+	for _, pair := range p.fields {
+		if val, ok := m.Metrics[pair[0]]; ok {
+			renamedMetrics[pair[1]] = val
+		}
+	}
+	for _, pair := range p.fields {
+		delete(m.Metrics, pair[0])
+	}
+	for key, val := range renamedMetrics {
+		m.Metrics[key] = val
+	}
+
+	renamedTags := map[string]string{}
+	for _, pair := range p.tags {
+		if val, ok := m.Tags[pair[0]]; ok {
+			renamedTags[pair[1]] = val
+		}
+	}
+	for _, pair := range p.tags {
+		delete(m.Tags, pair[0])
+	}
+	for key, val := range renamedTags {
+		m.Tags[key] = val
+	}
+
+	return true, nil
+}
+
+/* sortedPairs returns the from, to pairs of a name map sorted by from */
+func sortedPairs(names map[string]string) [][2]string {
+	pairs := make([][2]string, 0, len(names))
+	for from, to := range names {
+		pairs = append(pairs, [2]string{from, to})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+	return pairs
+}
+
+type drop struct {
+	fields map[string]struct{}
+	tags   map[string]struct{}
+}
+
+func (p drop) Process(m *models.TimeBasedMetrics) (bool, error) {
+	for key := range p.fields {
+		delete(m.Metrics, key)
+	}
+
+	for key := range p.tags {
+		delete(m.Tags, key)
+	}
+
+	return true, nil
+}
+
+// whitelist keeps only the listed fields and tags, an omitted list leaves that side untouched
+type whitelist struct {
+	fields     map[string]struct{}
+	tags       map[string]struct{}
+	keepFields bool
+	keepTags   bool
+}
+
+func (p whitelist) Process(m *models.TimeBasedMetrics) (bool, error) {
+	if !p.keepFields {
+		for key := range m.Metrics {
+			if _, ok := p.fields[key]; !ok {
+				delete(m.Metrics, key)
+			}
+		}
+	}
+
+	if !p.keepTags {
+		for key := range m.Tags {
+			if _, ok := p.tags[key]; !ok {
+				delete(m.Tags, key)
+			}
+		}
+	}
+
+	return true, nil
+}
+
+type staticTags struct {
+	values map[string]string
+}
+
+func (p staticTags) Process(m *models.TimeBasedMetrics) (bool, error) {
+	if m.Tags == nil {
+		m.Tags = map[string]string{}
+	}
+
+	for key, val := range p.values {
+		m.Tags[key] = val
+	}
+
+	return true, nil
+}
+
+// tagToField moves numeric tag values to fields, values that do not parse stay tags
+type tagToField struct {
+	tags []string
+}
+
+func (p tagToField) Process(m *models.TimeBasedMetrics) (bool, error) {
+	for _, key := range p.tags {
+		val, ok := m.Tags[key]
+		if !ok {
+			continue
+		}
+
+		valFloat, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			continue
+		}
+
+		if m.Metrics == nil {
+			m.Metrics = map[string]float64{}
+		}
+
+		delete(m.Tags, key)
+		m.Metrics[key] = valFloat
+	}
+
+	return true, nil
+}
+
+type fieldToTag struct {
+	fields []string
+}
+
+func (p fieldToTag) Process(m *models.TimeBasedMetrics) (bool, error) {
+	for _, key := range p.fields {
+		val, ok := m.Metrics[key]
+		if !ok {
+			continue
+		}
+
+		if m.Tags == nil {
+			m.Tags = map[string]string{}
+		}
+
+		delete(m.Metrics, key)
+		m.Tags[key] = strconv.FormatFloat(val, 'f', -1, 64)
+	}
+
+	return true, nil
+}
+
+// regexReplace rewrites field names, tag names or tag values, tags limits tag_values to the listed tags
+type regexReplace struct {
+	target      string
+	re          *regexp.Regexp
+	replacement string
+	tags        map[string]struct{}
+}
+
+func (p regexReplace) Process(m *models.TimeBasedMetrics) (bool, error) {
+	switch p.target {
+	case TargetFieldNames:
+		metrics := make(map[string]float64, len(m.Metrics))
+		for key, val := range m.Metrics {
+			metrics[p.re.ReplaceAllString(key, p.replacement)] = val
+		}
+		m.Metrics = metrics
+	case TargetTagNames:
+		tags := make(map[string]string, len(m.Tags))
+		for key, val := range m.Tags {
+			tags[p.re.ReplaceAllString(key, p.replacement)] = val
+		}
+		m.Tags = tags
+	case TargetTagValues:
+		for key, val := range m.Tags {
+			if _, ok := p.tags[key]; len(p.tags) > 0 && !ok {
+				continue
+			}
+
+			m.Tags[key] = p.re.ReplaceAllString(val, p.replacement)
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,176 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"taos-adapter/models"
+	"taos-adapter/mqtt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// AnyDatabase gives every database its own bucket
+	AnyDatabase = "*"
+
+	rateLimitLogInterval   = 10 * time.Second
+	rateLimitPruneInterval = time.Minute
+)
+
+// RateLimitConfig is a token bucket of Rate points per second applied to every topic matching Topic,
+// or to Database. Each topic, or each database, gets its own bucket.
+type RateLimitConfig struct {
+	Topic    string  `yaml:"topic,omitempty"`
+	Database string  `yaml:"database,omitempty"`
+	Rate     float64 `yaml:"rate"`
+	Burst    int     `yaml:"burst,omitempty"` // defaults to one second worth of points
+}
+
+type rateLimit struct {
+	name     string
+	topic    string
+	database string
+	rate     rate.Limit
+	burst    int
+	idle     time.Duration // time an empty bucket takes to fill up again
+	buckets  map[string]*rateBucket
+	limited  uint64
+	lastLog  time.Time
+}
+
+type rateBucket struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+type rateLimiters struct {
+	limits []*rateLimit
+	pruned time.Time
+
+	mu sync.Mutex // guards the limited counters
+}
+
+func compileRateLimiters(configs []RateLimitConfig) (*rateLimiters, error) {
+	limiters := &rateLimiters{}
+
+	for i, c := range configs {
+		if (c.Topic == "") == (c.Database == "") {
+			return nil, fmt.Errorf("rate_limits[%d]: exactly one of topic or database is required", i)
+		}
+
+		if c.Rate <= 0 {
+			return nil, fmt.Errorf("rate_limits[%d]: rate must be positive", i)
+		}
+
+		if c.Burst < 0 {
+			return nil, fmt.Errorf("rate_limits[%d]: burst can not be negative", i)
+		}
+
+		burst := c.Burst
+		if burst == 0 {
+			burst = int(math.Ceil(c.Rate))
+		}
+
+		name := "topic " + c.Topic
+		if c.Database != "" {
+			name = "database " + c.Database
+		}
+
+		limiters.limits = append(limiters.limits, &rateLimit{
+			name:     name,
+			topic:    c.Topic,
+			database: c.Database,
+			rate:     rate.Limit(c.Rate),
+			burst:    burst,
+			idle:     time.Duration(float64(burst) / c.Rate * float64(time.Second)),
+			buckets:  map[string]*rateBucket{},
+		})
+	}
+
+	return limiters, nil
+}
+
+/* key returns the bucket of the point, false when the limit does not apply to it */
+func (l *rateLimit) key(m *models.TimeBasedMetrics) (string, bool) {
+	if l.topic != "" {
+		return m.Topic, mqtt.TopicMatches(l.topic, m.Topic)
+	}
+
+	return m.DB, l.database == AnyDatabase || l.database == m.DB
+}
+
+/* allow takes a token from every bucket the point falls into, and none when any of them is empty */
+func (r *rateLimiters) allow(log *logrus.Entry, m *models.TimeBasedMetrics, now time.Time) bool {
+	reservations := make([]*rate.Reservation, 0, len(r.limits))
+
+	for _, l := range r.limits {
+		key, ok := l.key(m)
+		if !ok {
+			continue
+		}
+
+		bucket, ok := l.buckets[key]
+		if !ok {
+			bucket = &rateBucket{limiter: rate.NewLimiter(l.rate, l.burst)}
+			l.buckets[key] = bucket
+		}
+		bucket.lastUsed = now
+
+		reservation := bucket.limiter.ReserveN(now, 1)
+		if reservation.OK() && reservation.DelayFrom(now) == 0 {
+			reservations = append(reservations, reservation)
+			continue
+		}
+
+		// give back the tokens taken so far, a dropped point must not count against the other limits
+		reservation.CancelAt(now)
+		for _, taken := range reservations {
+			taken.CancelAt(now)
+		}
+
+		r.mu.Lock()
+		l.limited++
+		if now.Sub(l.lastLog) > rateLimitLogInterval {
+			log.WithField("topic", m.Topic).Warnf("rate limit of %s exceeded, %d points dropped so far", l.name, l.limited)
+			l.lastLog = now
+		}
+		r.mu.Unlock()
+
+		return false
+	}
+
+	return true
+}
+
+// prune forgets buckets that have been idle long enough to be full again, a new bucket behaves the same.
+// It walks the buckets at most once per rateLimitPruneInterval.
+func (r *rateLimiters) prune(now time.Time) {
+	if now.Sub(r.pruned) < rateLimitPruneInterval {
+		return
+	}
+	r.pruned = now
+
+	for _, l := range r.limits {
+		for key, bucket := range l.buckets {
+			if now.Sub(bucket.lastUsed) >= l.idle {
+				delete(l.buckets, key)
+			}
+		}
+	}
+}
+
+// Limited returns the number of points dropped per rate limit
+func (r *rateLimiters) Limited() map[string]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	limited := make(map[string]uint64, len(r.limits))
+	for _, l := range r.limits {
+		limited[l.name] += l.limited
+	}
+
+	return limited
+}
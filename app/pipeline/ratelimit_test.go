@@ -0,0 +1,144 @@
+package pipeline
+
+import (
+	"reflect"
+	"taos-adapter/models"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	log := logrus.NewEntry(logrus.New())
+	now := time.Unix(1257894000, 0)
+
+	type point struct {
+		metrics models.TimeBasedMetrics
+		at      time.Duration // arrival after now
+		keep    bool
+	}
+
+	cases := []struct {
+		name            string
+		configs         []RateLimitConfig
+		points          []point
+		expectedLimited map[string]uint64
+	}{
+		{
+			name:    "Success: Bucket per topic",
+			configs: []RateLimitConfig{{Topic: "db/+", Rate: 1}},
+			points: []point{
+				{metrics: models.TimeBasedMetrics{DB: "db", Topic: "db/a"}, keep: true},
+				{metrics: models.TimeBasedMetrics{DB: "db", Topic: "db/a"}, keep: false},
+				{metrics: models.TimeBasedMetrics{DB: "db", Topic: "db/b"}, keep: true},
+				{metrics: models.TimeBasedMetrics{DB: "other", Topic: "other/a"}, keep: true},
+				{metrics: models.TimeBasedMetrics{DB: "other", Topic: "other/a"}, keep: true},
+				{metrics: models.TimeBasedMetrics{DB: "db", Topic: "db/a"}, at: time.Second, keep: true},
+			},
+			expectedLimited: map[string]uint64{"topic db/+": 1},
+		},
+		{
+			name:    "Success: Burst",
+			configs: []RateLimitConfig{{Topic: "#", Rate: 1, Burst: 2}},
+			points: []point{
+				{metrics: models.TimeBasedMetrics{Topic: "db/a"}, keep: true},
+				{metrics: models.TimeBasedMetrics{Topic: "db/a"}, keep: true},
+				{metrics: models.TimeBasedMetrics{Topic: "db/a"}, keep: false},
+			},
+			expectedLimited: map[string]uint64{"topic #": 1},
+		},
+		{
+			name:    "Success: Bucket per database",
+			configs: []RateLimitConfig{{Database: AnyDatabase, Rate: 1}, {Database: "db", Rate: 10}},
+			points: []point{
+				{metrics: models.TimeBasedMetrics{DB: "db", Topic: "db/a"}, keep: true},
+				{metrics: models.TimeBasedMetrics{DB: "db", Topic: "db/b"}, keep: false},
+				{metrics: models.TimeBasedMetrics{DB: "other", Topic: "other/a"}, keep: true},
+			},
+			expectedLimited: map[string]uint64{"database *": 1, "database db": 0},
+		},
+		{
+			name:    "Success: Tokens are given back when a later limit drops the point",
+			configs: []RateLimitConfig{{Topic: "db/+", Rate: 1}, {Database: "db", Rate: 10, Burst: 1}},
+			points: []point{
+				{metrics: models.TimeBasedMetrics{DB: "db", Topic: "db/a"}, keep: true},
+				{metrics: models.TimeBasedMetrics{DB: "db", Topic: "db/b"}, keep: false},
+				{metrics: models.TimeBasedMetrics{DB: "db", Topic: "db/b"}, at: 100 * time.Millisecond, keep: true},
+			},
+			expectedLimited: map[string]uint64{"topic db/+": 0, "database db": 1},
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		r, err := compileRateLimiters(c.configs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, p := range c.points {
+			if keep := r.allow(log, &p.metrics, now.Add(p.at)); keep != p.keep {
+				t.Errorf("point %d: expected keep %t, got %t", i, p.keep, keep)
+			}
+		}
+
+		if limited := r.Limited(); !reflect.DeepEqual(limited, c.expectedLimited) {
+			t.Errorf("expected limited %v, got %v", c.expectedLimited, limited)
+		}
+	}
+}
+
+func TestCompileRateLimiters(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name          string
+		configs       []RateLimitConfig
+		expectedError bool
+	}{
+		{name: "Success: Topic", configs: []RateLimitConfig{{Topic: "#", Rate: 0.5}}},
+		{name: "Failure: Topic and database", configs: []RateLimitConfig{{Topic: "#", Database: "db", Rate: 1}}, expectedError: true},
+		{name: "Failure: Neither topic nor database", configs: []RateLimitConfig{{Rate: 1}}, expectedError: true},
+		{name: "Failure: Missing rate", configs: []RateLimitConfig{{Topic: "#"}}, expectedError: true},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if _, err := compileRateLimiters(c.configs); (err != nil) != c.expectedError {
+			t.Errorf("expected error: %t, got: %v", c.expectedError, err)
+		}
+	}
+}
+
+func TestRateLimitPrune(t *testing.T) {
+	t.Parallel()
+
+	log := logrus.NewEntry(logrus.New())
+	now := time.Unix(1257894000, 0)
+
+	r, err := compileRateLimiters([]RateLimitConfig{{Topic: "#", Rate: 1, Burst: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.allow(log, &models.TimeBasedMetrics{Topic: "db/a"}, now)
+	r.allow(log, &models.TimeBasedMetrics{Topic: "db/b"}, now.Add(5*time.Second))
+
+	r.prune(now.Add(10 * time.Second))
+	if _, ok := r.limits[0].buckets["db/a"]; ok {
+		t.Error("expected the bucket of db/a, full again, to be pruned")
+	}
+	if _, ok := r.limits[0].buckets["db/b"]; !ok {
+		t.Error("expected the bucket of db/b, still filling up, to be kept")
+	}
+
+	r.prune(now.Add(20 * time.Second))
+	if _, ok := r.limits[0].buckets["db/b"]; !ok {
+		t.Errorf("expected no prune within %s of the last one", rateLimitPruneInterval)
+	}
+}
@@ -0,0 +1,280 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"taos-adapter/models"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FieldTypeFloat = "float"
+	FieldTypeInt   = "int"
+
+	OnInvalidReject     = "reject"
+	OnInvalidQuarantine = "quarantine"
+
+	defaultQuarantineTable = "quarantine"
+
+	// ReasonTag holds why a quarantined point failed validation
+	ReasonTag = "invalid_reason"
+
+	// unitTagSuffix names the tag a payload can use to state the unit of a field, e.g. temp_unit
+	unitTagSuffix = "_unit"
+)
+
+// SchemaConfig declares the fields and tags expected on the topics of a subscription
+type SchemaConfig struct {
+	Fields          map[string]FieldSchema `yaml:"fields,omitempty"`
+	Tags            map[string]TagSchema   `yaml:"tags,omitempty"`
+	Strict          bool                   `yaml:"strict,omitempty"`     // reject fields and tags that are not declared
+	OnInvalid       string                 `yaml:"on_invalid,omitempty"` // reject (default) or quarantine
+	QuarantineTable string                 `yaml:"quarantine_table,omitempty"`
+}
+
+// FieldSchema describes a single field, Min and Max are inclusive
+type FieldSchema struct {
+	Type     string   `yaml:"type,omitempty"` // float (default) or int
+	Unit     string   `yaml:"unit,omitempty"`
+	Min      *float64 `yaml:"min,omitempty"`
+	Max      *float64 `yaml:"max,omitempty"`
+	Required bool     `yaml:"required,omitempty"`
+}
+
+// TagSchema describes a single tag, Values and Pattern limit the allowed values
+type TagSchema struct {
+	Required bool     `yaml:"required,omitempty"`
+	Values   []string `yaml:"values,omitempty"`
+	Pattern  string   `yaml:"pattern,omitempty"`
+}
+
+type schema struct {
+	fields          map[string]FieldSchema
+	tags            map[string]tagSchema
+	fieldNames      []string // sorted so reasons are reported in a stable order
+	tagNames        []string
+	strict          bool
+	quarantine      bool
+	quarantineTable string
+}
+
+type tagSchema struct {
+	required bool
+	values   map[string]struct{}
+	re       *regexp.Regexp
+}
+
+// invalidPointError is returned by a subscription for points failing its schema
+type invalidPointError struct {
+	reasons []string
+}
+
+func (e *invalidPointError) Error() string {
+	return strings.Join(e.reasons, ", ")
+}
+
+func compileSchema(c SchemaConfig) (*schema, error) {
+	s := &schema{
+		fields:          c.Fields,
+		tags:            map[string]tagSchema{},
+		strict:          c.Strict,
+		quarantineTable: c.QuarantineTable,
+	}
+
+	switch c.OnInvalid {
+	case "", OnInvalidReject:
+	case OnInvalidQuarantine:
+		s.quarantine = true
+		if s.quarantineTable == "" {
+			s.quarantineTable = defaultQuarantineTable
+		}
+	default:
+		return nil, fmt.Errorf("schema on_invalid must be one of %s, %s, got: %q", OnInvalidReject, OnInvalidQuarantine, c.OnInvalid)
+	}
+
+	for name, field := range c.Fields {
+		switch field.Type {
+		case "", FieldTypeFloat, FieldTypeInt:
+		default:
+			return nil, fmt.Errorf("schema field %s: type must be one of %s, %s, got: %q", name, FieldTypeFloat, FieldTypeInt, field.Type)
+		}
+
+		if field.Min != nil && field.Max != nil && *field.Min > *field.Max {
+			return nil, fmt.Errorf("schema field %s: min is above max", name)
+		}
+
+		s.fieldNames = append(s.fieldNames, name)
+	}
+	sort.Strings(s.fieldNames)
+
+	for name, tag := range c.Tags {
+		compiled := tagSchema{required: tag.Required}
+
+		if len(tag.Values) > 0 {
+			compiled.values = toSet(tag.Values)
+		}
+
+		if tag.Pattern != "" {
+			re, err := regexp.Compile(tag.Pattern)
+			if err != nil {
+				return nil, errors.Wrapf(err, "schema tag %s: invalid pattern %q", name, tag.Pattern)
+			}
+			compiled.re = re
+		}
+
+		s.tags[name] = compiled
+		s.tagNames = append(s.tagNames, name)
+	}
+	sort.Strings(s.tagNames)
+
+	return s, nil
+}
+
+/* validate returns an invalidPointError listing every mismatch, reasons leave out point values to keep them usable as tags */
+func (s *schema) validate(m *models.TimeBasedMetrics) error {
+	s.coerce(m)
+	reasons := []string{}
+
+	for _, name := range s.fieldNames {
+		field := s.fields[name]
+
+		val, ok := m.Metrics[name]
+		if !ok {
+			if _, isTag := m.Tags[name]; isTag {
+				reasons = append(reasons, fmt.Sprintf("field %s is not numeric", name))
+			} else if field.Required {
+				reasons = append(reasons, fmt.Sprintf("field %s is missing", name))
+			}
+			continue
+		}
+
+		if field.Type == FieldTypeInt && val != math.Trunc(val) {
+			reasons = append(reasons, fmt.Sprintf("field %s is not an int", name))
+		}
+
+		if field.Min != nil && val < *field.Min {
+			reasons = append(reasons, fmt.Sprintf("field %s is below %g", name, *field.Min))
+		}
+
+		if field.Max != nil && val > *field.Max {
+			reasons = append(reasons, fmt.Sprintf("field %s is above %g", name, *field.Max))
+		}
+
+		if unit, ok := m.Tags[name+unitTagSuffix]; ok && field.Unit != "" && unit != field.Unit {
+			reasons = append(reasons, fmt.Sprintf("field %s is not in %s", name, field.Unit))
+		}
+	}
+
+	for _, name := range s.tagNames {
+		tag := s.tags[name]
+
+		val, ok := m.Tags[name]
+		if !ok {
+			if tag.required {
+				reasons = append(reasons, fmt.Sprintf("tag %s is missing", name))
+			}
+			continue
+		}
+
+		if _, ok := tag.values[val]; tag.values != nil && !ok {
+			reasons = append(reasons, fmt.Sprintf("tag %s has a value that is not allowed", name))
+		}
+
+		if tag.re != nil && !tag.re.MatchString(val) {
+			reasons = append(reasons, fmt.Sprintf("tag %s does not match %s", name, tag.re))
+		}
+	}
+
+	if s.strict {
+		unknown := []string{}
+		for name := range m.Metrics {
+			if _, ok := s.fields[name]; !ok {
+				unknown = append(unknown, name)
+			}
+		}
+
+		for name := range m.Tags {
+			_, isField := s.fields[name]
+			_, isTag := s.tags[name]
+			_, isUnit := s.fields[strings.TrimSuffix(name, unitTagSuffix)]
+			if !isField && !isTag && !(isUnit && strings.HasSuffix(name, unitTagSuffix)) {
+				unknown = append(unknown, name)
+			}
+		}
+
+		sort.Strings(unknown)
+		for _, name := range unknown {
+			reasons = append(reasons, fmt.Sprintf("%s is not declared", name))
+		}
+	}
+
+	if len(reasons) > 0 {
+		return &invalidPointError{reasons: reasons}
+	}
+
+	return nil
+}
+
+// coerce converts values the payload parsers typed differently from the schema: a number declared as a tag, like
+// a numeric serial, becomes a tag and a numeric string declared as a field becomes a field. The maps of the point
+// are copied before they are changed.
+func (s *schema) coerce(m *models.TimeBasedMetrics) {
+	copied := false
+	copyMaps := func() {
+		if copied {
+			return
+		}
+		copied = true
+
+		metrics := make(map[string]float64, len(m.Metrics))
+		for key, val := range m.Metrics {
+			metrics[key] = val
+		}
+		tags := make(map[string]string, len(m.Tags))
+		for key, val := range m.Tags {
+			tags[key] = val
+		}
+		m.Metrics, m.Tags = metrics, tags
+	}
+
+	for _, name := range s.tagNames {
+		val, isField := m.Metrics[name]
+		if _, isTag := m.Tags[name]; !isField || isTag {
+			continue
+		}
+
+		copyMaps()
+		m.Tags[name] = strconv.FormatFloat(val, 'f', -1, 64)
+		delete(m.Metrics, name)
+	}
+
+	for _, name := range s.fieldNames {
+		val, isTag := m.Tags[name]
+		if _, isField := m.Metrics[name]; !isTag || isField {
+			continue
+		}
+
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			copyMaps()
+			m.Metrics[name] = f
+			delete(m.Tags, name)
+		}
+	}
+}
+
+/* quarantine moves an invalid point to the quarantine table of the same database */
+func (s *schema) quarantinePoint(m *models.TimeBasedMetrics, invalid *invalidPointError) {
+	tags := make(map[string]string, len(m.Tags)+1)
+	for key, val := range m.Tags {
+		tags[key] = val
+	}
+	tags[ReasonTag] = invalid.Error()
+
+	m.Tags = tags
+	m.Table = s.quarantineTable
+}
@@ -0,0 +1,179 @@
+package pipeline
+
+import (
+	"reflect"
+	"taos-adapter/models"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const testSchema = `
+fields:
+  temp: {type: float, unit: celsius, min: -50, max: 150, required: true}
+  count: {type: int, min: 0}
+tags:
+  device: {required: true, pattern: "^[a-z0-9-]+$"}
+  state: {values: [on, off]}
+`
+
+func TestSchema(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name            string
+		strict          bool
+		metrics         map[string]float64
+		tags            map[string]string
+		expectedReasons []string
+	}{
+		{
+			name:    "Success: Valid point",
+			metrics: map[string]float64{"temp": 21.5, "count": 3, "extra": 1},
+			tags:    map[string]string{"device": "dev-1", "state": "on", "temp_unit": "celsius"},
+		},
+		{
+			name:    "Success: Coerced types",
+			metrics: map[string]float64{"temp": 21.5, "device": 42},
+			tags:    map[string]string{"count": "3"},
+		},
+		{
+			name:            "Failure: Out of range",
+			metrics:         map[string]float64{"temp": 180, "count": -1},
+			tags:            map[string]string{"device": "dev-1"},
+			expectedReasons: []string{"field count is below 0", "field temp is above 150"},
+		},
+		{
+			name:            "Failure: Wrong types",
+			metrics:         map[string]float64{"count": 1.5},
+			tags:            map[string]string{"device": "dev-1", "temp": "hot"},
+			expectedReasons: []string{"field count is not an int", "field temp is not numeric"},
+		},
+		{
+			name:            "Failure: Missing required",
+			metrics:         map[string]float64{"count": 1},
+			expectedReasons: []string{"field temp is missing", "tag device is missing"},
+		},
+		{
+			name:            "Failure: Tag values",
+			metrics:         map[string]float64{"temp": 20},
+			tags:            map[string]string{"device": "Dev 1", "state": "unknown"},
+			expectedReasons: []string{"tag device does not match ^[a-z0-9-]+$", "tag state has a value that is not allowed"},
+		},
+		{
+			name:            "Failure: Unit",
+			metrics:         map[string]float64{"temp": 70},
+			tags:            map[string]string{"device": "dev-1", "temp_unit": "fahrenheit"},
+			expectedReasons: []string{"field temp is not in celsius"},
+		},
+		{
+			name:            "Failure: Strict",
+			strict:          true,
+			metrics:         map[string]float64{"temp": 20, "extra": 1},
+			tags:            map[string]string{"device": "dev-1", "temp_unit": "celsius", "fw": "1.0"},
+			expectedReasons: []string{"extra is not declared", "fw is not declared"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		var config SchemaConfig
+		if err := yaml.UnmarshalStrict([]byte(testSchema), &config); err != nil {
+			t.Fatal(errors.Wrap(err, "failed to parse test schema"))
+		}
+		config.Strict = c.strict
+
+		s, err := compileSchema(config)
+		if err != nil {
+			t.Fatal(errors.Wrap(err, "unexpected error"))
+		}
+
+		err = s.validate(&models.TimeBasedMetrics{Metrics: c.metrics, Tags: c.tags})
+		if c.expectedReasons == nil {
+			if err != nil {
+				t.Errorf("expected valid point, got: %s", err)
+			}
+			continue
+		}
+
+		var invalid *invalidPointError
+		if !errors.As(err, &invalid) {
+			t.Fatalf("expected invalid point error, got: %v", err)
+		}
+
+		if !reflect.DeepEqual(invalid.reasons, c.expectedReasons) {
+			t.Errorf("expected reasons %q, got %q", c.expectedReasons, invalid.reasons)
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	t.Parallel()
+
+	s, err := compileSchema(SchemaConfig{
+		Fields:    map[string]FieldSchema{"temp": {Required: true}},
+		OnInvalid: OnInvalidQuarantine,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := &subscription{topic: "db/+", schema: s}
+	m := models.TimeBasedMetrics{
+		Metrics: map[string]float64{"hum": 40},
+		Tags:    map[string]string{"device": "dev-1"},
+		DB:      "db",
+		Table:   "t",
+		Topic:   "db/t",
+	}
+
+	_, err = sub.process(&m)
+
+	var invalid *invalidPointError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("expected invalid point error, got: %v", err)
+	}
+
+	if !sub.invalidPoint(logrus.NewEntry(logrus.New()), &m, invalid) {
+		t.Fatal("expected point to be quarantined")
+	}
+
+	expected := models.TimeBasedMetrics{
+		Metrics: map[string]float64{"hum": 40},
+		Tags:    map[string]string{"device": "dev-1", ReasonTag: "field temp is missing"},
+		DB:      "db",
+		Table:   defaultQuarantineTable,
+		Topic:   "db/t",
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected point %v, got %v", expected, m)
+	}
+}
+
+func TestCompileSchemaErrors(t *testing.T) {
+	t.Parallel()
+
+	low := 2.0
+	high := 1.0
+
+	cases := []struct {
+		name   string
+		config SchemaConfig
+	}{
+		{name: "Failure: Unknown type", config: SchemaConfig{Fields: map[string]FieldSchema{"temp": {Type: "string"}}}},
+		{name: "Failure: Min above max", config: SchemaConfig{Fields: map[string]FieldSchema{"temp": {Min: &low, Max: &high}}}},
+		{name: "Failure: Bad pattern", config: SchemaConfig{Tags: map[string]TagSchema{"device": {Pattern: "("}}}},
+		{name: "Failure: Unknown on_invalid", config: SchemaConfig{OnInvalid: "drop"}},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if _, err := compileSchema(c.config); err == nil {
+			t.Error("expected error")
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"taos-adapter/models"
+
+	"github.com/pkg/errors"
+)
+
+const ProcessorNormalizeUnits = "normalize_units"
+
+// unit converts to the base unit of its dimension as value*factor + offset
+type unit struct {
+	dimension string
+	factor    float64
+	offset    float64
+}
+
+var units = map[string]unit{
+	"celsius":    {dimension: "temperature", factor: 1},
+	"fahrenheit": {dimension: "temperature", factor: 5.0 / 9, offset: -32 * 5.0 / 9},
+	"kelvin":     {dimension: "temperature", factor: 1, offset: -273.15},
+
+	"pa":   {dimension: "pressure", factor: 1},
+	"hpa":  {dimension: "pressure", factor: 100},
+	"kpa":  {dimension: "pressure", factor: 1000},
+	"mbar": {dimension: "pressure", factor: 100},
+	"bar":  {dimension: "pressure", factor: 100000},
+	"psi":  {dimension: "pressure", factor: 6894.757293168},
+	"atm":  {dimension: "pressure", factor: 101325},
+
+	"j":   {dimension: "energy", factor: 1},
+	"kj":  {dimension: "energy", factor: 1000},
+	"wh":  {dimension: "energy", factor: 3600},
+	"kwh": {dimension: "energy", factor: 3600000},
+	"mwh": {dimension: "energy", factor: 3600000000},
+
+	"w":  {dimension: "power", factor: 1},
+	"kw": {dimension: "power", factor: 1000},
+	"mw": {dimension: "power", factor: 1000000},
+
+	"mm": {dimension: "length", factor: 0.001},
+	"cm": {dimension: "length", factor: 0.01},
+	"m":  {dimension: "length", factor: 1},
+	"km": {dimension: "length", factor: 1000},
+	"in": {dimension: "length", factor: 0.0254},
+	"ft": {dimension: "length", factor: 0.3048},
+
+	"g":  {dimension: "mass", factor: 0.001},
+	"kg": {dimension: "mass", factor: 1},
+	"lb": {dimension: "mass", factor: 0.45359237},
+
+	"ml":  {dimension: "volume", factor: 0.001},
+	"l":   {dimension: "volume", factor: 1},
+	"m3":  {dimension: "volume", factor: 1000},
+	"gal": {dimension: "volume", factor: 3.785411784},
+}
+
+var unitAliases = map[string]string{
+	"c": "celsius", "°c": "celsius", "degc": "celsius",
+	"f": "fahrenheit", "°f": "fahrenheit", "degf": "fahrenheit",
+	"k": "kelvin",
+}
+
+/* lookupUnit resolves a unit name or alias case insensitively */
+func lookupUnit(name string) (string, unit, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := unitAliases[name]; ok {
+		name = alias
+	}
+
+	u, ok := units[name]
+
+	return name, u, ok
+}
+
+// normalizeUnits converts fields to a canonical unit and records it in a <field>_unit tag. The unit a value is
+// reported in comes from a field name suffix (pressure_psi), a <field>_unit tag or MQTT user property, or a
+// unit tag or user property shared by all fields. Values without a unit are assumed to be canonical.
+type normalizeUnits struct {
+	fields  map[string]string // field to canonical unit
+	unitTag string
+	names   []string // longest first, so energy_total_kwh matches energy_total before energy
+}
+
+func compileNormalizeUnits(c ProcessorConfig) (Processor, error) {
+	if len(c.FieldMap) == 0 {
+		return nil, errors.New("normalize_units requires field_map of field: canonical unit")
+	}
+
+	p := normalizeUnits{fields: map[string]string{}, unitTag: c.UnitTag}
+	for field, canonical := range c.FieldMap {
+		name, _, ok := lookupUnit(canonical)
+		if !ok {
+			return nil, fmt.Errorf("normalize_units: unknown unit %q for field %s", canonical, field)
+		}
+
+		p.fields[field] = name
+		p.names = append(p.names, field)
+	}
+
+	sort.Slice(p.names, func(i, j int) bool {
+		return len(p.names[i]) > len(p.names[j])
+	})
+
+	return p, nil
+}
+
+/* sourceUnit finds the unit of a field that was not reported with a unit suffix */
+func (p normalizeUnits) sourceUnit(m *models.TimeBasedMetrics, field string) string {
+	if val, ok := m.Tags[field+unitTagSuffix]; ok {
+		return val
+	}
+
+	if val, ok := m.Properties[field+unitTagSuffix]; ok {
+		return val
+	}
+
+	if p.unitTag != "" {
+		if val, ok := m.Tags[p.unitTag]; ok {
+			return val
+		}
+
+		if val, ok := m.Properties[p.unitTag]; ok {
+			return val
+		}
+	}
+
+	return ""
+}
+
+func (p normalizeUnits) Process(m *models.TimeBasedMetrics) (bool, error) {
+	converted := map[string]float64{}
+
+	for key, val := range m.Metrics {
+		field, from := key, ""
+		if _, ok := p.fields[key]; !ok {
+			for _, name := range p.names {
+				if suffix := strings.TrimPrefix(key, name+"_"); suffix != key {
+					if _, _, ok := lookupUnit(suffix); ok {
+						field, from = name, suffix
+						break
+					}
+				}
+			}
+
+			if from == "" {
+				continue
+			}
+		} else {
+			from = p.sourceUnit(m, field)
+		}
+
+		canonical := p.fields[field]
+		if from == "" {
+			from = canonical
+		}
+
+		fromName, fromUnit, ok := lookupUnit(from)
+		if !ok {
+			return false, fmt.Errorf("unknown unit %q for field %s", from, field)
+		}
+
+		toUnit := units[canonical]
+		if fromUnit.dimension != toUnit.dimension {
+			return false, fmt.Errorf("can not convert field %s from %s to %s", field, fromName, canonical)
+		}
+
+		delete(m.Metrics, key)
+		converted[field] = ((val*fromUnit.factor + fromUnit.offset) - toUnit.offset) / toUnit.factor
+	}
+
+	if len(converted) == 0 {
+		return true, nil
+	}
+
+	if m.Tags == nil {
+		m.Tags = map[string]string{}
+	}
+
+	for field, val := range converted {
+		m.Metrics[field] = val
+		m.Tags[field+unitTagSuffix] = p.fields[field]
+	}
+
+	return true, nil
+}
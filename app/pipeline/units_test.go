@@ -0,0 +1,114 @@
+package pipeline
+
+import (
+	"math"
+	"reflect"
+	"taos-adapter/models"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestNormalizeUnits(t *testing.T) {
+	t.Parallel()
+
+	config := ProcessorConfig{
+		Type:     ProcessorNormalizeUnits,
+		FieldMap: map[string]string{"temp": "celsius", "pressure": "bar", "energy": "kwh", "energy_total": "kwh"},
+		UnitTag:  "unit",
+	}
+
+	cases := []struct {
+		name            string
+		metrics         map[string]float64
+		tags            map[string]string
+		properties      map[string]string
+		expectedMetrics map[string]float64
+		expectedTags    map[string]string
+		expectedError   bool
+	}{
+		{
+			name:            "Success: Field name suffix",
+			metrics:         map[string]float64{"pressure_psi": 14.503773773, "temp_f": 212, "energy_total_wh": 1500},
+			expectedMetrics: map[string]float64{"pressure": 1, "temp": 100, "energy_total": 1.5},
+			expectedTags:    map[string]string{"pressure_unit": "bar", "temp_unit": "celsius", "energy_total_unit": "kwh"},
+		},
+		{
+			name:            "Success: Field unit tag",
+			metrics:         map[string]float64{"temp": 273.15},
+			tags:            map[string]string{"temp_unit": "K"},
+			expectedMetrics: map[string]float64{"temp": 0},
+			expectedTags:    map[string]string{"temp_unit": "celsius"},
+		},
+		{
+			name:            "Success: Shared unit user property",
+			metrics:         map[string]float64{"energy": 2000000},
+			properties:      map[string]string{"unit": "Wh"},
+			expectedMetrics: map[string]float64{"energy": 2000},
+			expectedTags:    map[string]string{"energy_unit": "kwh"},
+		},
+		{
+			name:            "Success: Canonical unit assumed",
+			metrics:         map[string]float64{"pressure": 2.5, "hum": 40},
+			expectedMetrics: map[string]float64{"pressure": 2.5, "hum": 40},
+			expectedTags:    map[string]string{"pressure_unit": "bar"},
+		},
+		{
+			name:          "Failure: Unknown unit",
+			metrics:       map[string]float64{"pressure": 2.5},
+			tags:          map[string]string{"pressure_unit": "furlong"},
+			expectedError: true,
+		},
+		{
+			name:          "Failure: Wrong dimension",
+			metrics:       map[string]float64{"temp": 2.5},
+			tags:          map[string]string{"temp_unit": "psi"},
+			expectedError: true,
+		},
+	}
+
+	proc, err := compileProcessor(config)
+	if err != nil {
+		t.Fatal(errors.Wrap(err, "unexpected error"))
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		m := models.TimeBasedMetrics{Metrics: c.metrics, Tags: c.tags, Properties: c.properties}
+		_, err := proc.Process(&m)
+		if (err != nil) != c.expectedError {
+			t.Fatalf("expected error: %t, got: %v", c.expectedError, err)
+		}
+
+		if c.expectedError {
+			continue
+		}
+
+		if len(m.Metrics) != len(c.expectedMetrics) {
+			t.Errorf("expected metrics %v, got %v", c.expectedMetrics, m.Metrics)
+		}
+
+		for key, expected := range c.expectedMetrics {
+			if val, ok := m.Metrics[key]; !ok || math.Abs(val-expected) > 1e-6 {
+				t.Errorf("expected %s %g, got %v", key, expected, m.Metrics)
+			}
+		}
+
+		if !reflect.DeepEqual(m.Tags, c.expectedTags) {
+			t.Errorf("expected tags %v, got %v", c.expectedTags, m.Tags)
+		}
+	}
+}
+
+func TestCompileNormalizeUnitsErrors(t *testing.T) {
+	t.Parallel()
+
+	if _, err := compileProcessor(ProcessorConfig{Type: ProcessorNormalizeUnits}); err == nil {
+		t.Error("expected error for missing field_map")
+	}
+
+	if _, err := compileProcessor(ProcessorConfig{Type: ProcessorNormalizeUnits, FieldMap: map[string]string{"temp": "rankine"}}); err == nil {
+		t.Error("expected error for unknown unit")
+	}
+}
@@ -0,0 +1,380 @@
+package protobuf
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// TimestampField is the top-level field read as the timestamp of message types without a configured one, with or
+// without an entry, like the timestamp key of JSON payloads
+const TimestampField = "timestamp"
+
+// timestampMessage is read from its seconds and nanos fields
+const timestampMessage = "google.protobuf.Timestamp"
+
+// units of integer and floating point timestamps
+var units = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+// MessageConfig maps the fields of a message type to a point. Paths are field names joined by dots through nested
+// messages, e.g. env.temperature. Without fields and tags every top-level number, boolean and enum becomes a field
+// and every string a tag.
+type MessageConfig struct {
+	Type          string            `yaml:"type"`
+	Fields        map[string]string `yaml:"fields,omitempty"` // path: name of the field of the point
+	Tags          map[string]string `yaml:"tags,omitempty"`   // path: name of the tag of the point
+	Timestamp     string            `yaml:"timestamp,omitempty"`
+	TimestampUnit string            `yaml:"timestamp_unit,omitempty"` // s, ms, us or ns of numeric timestamps, s when empty
+}
+
+// Registry decodes the message types of a set of descriptor sets. It is not changed after Load.
+type Registry struct {
+	files    *protoregistry.Files
+	messages map[string]*message
+}
+
+/* message is a message type with its paths resolved to field descriptors */
+type message struct {
+	desc      protoreflect.MessageDescriptor
+	fields    []mapping
+	tags      []mapping
+	timestamp []protoreflect.FieldDescriptor // empty when the message has no timestamp
+	unit      time.Duration
+}
+
+type mapping struct {
+	name string
+	path []protoreflect.FieldDescriptor
+}
+
+// Load reads binary descriptor sets, as written by protoc --descriptor_set_out --include_imports, and resolves the
+// paths of the configured message types. Files found in several sets are read once.
+func Load(paths []string, configs []MessageConfig) (*Registry, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := map[string]bool{}
+	for _, path := range paths {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read descriptor set: %s", path)
+		}
+
+		fileSet := &descriptorpb.FileDescriptorSet{}
+		if err := proto.Unmarshal(raw, fileSet); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse descriptor set: %s", path)
+		}
+
+		for _, file := range fileSet.File {
+			if !seen[file.GetName()] {
+				seen[file.GetName()] = true
+				set.File = append(set.File, file)
+			}
+		}
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid descriptor sets, were they written with --include_imports")
+	}
+
+	r := &Registry{files: files, messages: map[string]*message{}}
+	for i, c := range configs {
+		if _, ok := r.messages[c.Type]; ok {
+			return nil, fmt.Errorf("messages[%d]: duplicate type %s", i, c.Type)
+		}
+
+		m, err := r.resolve(c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "messages[%d] (%s)", i, c.Type)
+		}
+		r.messages[c.Type] = m
+	}
+
+	return r, nil
+}
+
+// Has reports whether the descriptor sets define the message type name
+func (r *Registry) Has(name string) bool {
+	_, err := r.descriptor(name)
+	return err == nil
+}
+
+// Decode parses a message of type name, returning the fields, tags and timestamp mapped from it. The timestamp is
+// zero when the message type has none.
+func (r *Registry) Decode(name string, payload []byte) (map[string]float64, map[string]string, time.Time, error) {
+	var timestamp time.Time
+
+	m, ok := r.messages[name]
+	if !ok {
+		desc, err := r.descriptor(name)
+		if err != nil {
+			return nil, nil, timestamp, err
+		}
+		m = defaultMessage(desc)
+	}
+
+	msg := dynamicpb.NewMessage(m.desc)
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return nil, nil, timestamp, errors.Wrapf(err, "failed to parse %s", name)
+	}
+
+	metrics := map[string]float64{}
+	for _, f := range m.fields {
+		if val, fd, ok := get(msg, f.path); ok {
+			metrics[f.name] = number(fd, val)
+		}
+	}
+
+	tags := map[string]string{}
+	for _, t := range m.tags {
+		if val, fd, ok := get(msg, t.path); ok {
+			tags[t.name] = text(fd, val)
+		}
+	}
+
+	// a proto3 timestamp without presence reads as 0 when it is not set
+	if val, fd, ok := get(msg, m.timestamp); ok && (fd.Kind() == protoreflect.MessageKind || number(fd, val) != 0) {
+		timestamp = toTime(fd, val, m.unit)
+	}
+
+	return metrics, tags, timestamp, nil
+}
+
+func (r *Registry) descriptor(name string) (protoreflect.MessageDescriptor, error) {
+	desc, err := r.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("unknown message type: %s", name)
+	}
+
+	msgDesc, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("not a message type: %s", name)
+	}
+
+	return msgDesc, nil
+}
+
+/* resolve checks the paths of c against its message type */
+func (r *Registry) resolve(c MessageConfig) (*message, error) {
+	desc, err := r.descriptor(c.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &message{desc: desc}
+	if len(c.Fields) == 0 && len(c.Tags) == 0 {
+		m = defaultMessage(desc)
+	}
+
+	for _, path := range sortedKeys(c.Fields) {
+		fds, err := resolvePath(desc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !isNumber(fds[len(fds)-1]) {
+			return nil, fmt.Errorf("field %s must be a number, boolean or enum, got: %s", path, fds[len(fds)-1].Kind())
+		}
+		m.fields = append(m.fields, mapping{name: c.Fields[path], path: fds})
+	}
+
+	for _, path := range sortedKeys(c.Tags) {
+		fds, err := resolvePath(desc, path)
+		if err != nil {
+			return nil, err
+		}
+		if kind := fds[len(fds)-1].Kind(); kind == protoreflect.MessageKind || kind == protoreflect.GroupKind || kind == protoreflect.BytesKind {
+			return nil, fmt.Errorf("tag %s must be a string, number, boolean or enum, got: %s", path, kind)
+		}
+		m.tags = append(m.tags, mapping{name: c.Tags[path], path: fds})
+	}
+
+	if c.Timestamp != "" {
+		fds, err := resolvePath(desc, c.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		if !isTimestamp(fds[len(fds)-1]) {
+			return nil, fmt.Errorf("timestamp %s must be an integer, a floating point number or a %s", c.Timestamp, timestampMessage)
+		}
+		m.timestamp = fds
+	} else if fd := desc.Fields().ByName(TimestampField); fd != nil && fd.Cardinality() != protoreflect.Repeated && isTimestamp(fd) {
+		m.timestamp = []protoreflect.FieldDescriptor{fd}
+	}
+
+	m.unit = time.Second
+	if c.TimestampUnit != "" {
+		unit, ok := units[c.TimestampUnit]
+		if !ok {
+			return nil, fmt.Errorf("timestamp_unit must be one of s, ms, us, ns, got: %q", c.TimestampUnit)
+		}
+		m.unit = unit
+	}
+
+	return m, nil
+}
+
+/* defaultMessage maps every top-level number, boolean and enum to a field, every string to a tag */
+func defaultMessage(desc protoreflect.MessageDescriptor) *message {
+	m := &message{desc: desc, unit: time.Second}
+
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.Cardinality() == protoreflect.Repeated {
+			continue
+		}
+
+		name := string(fd.Name())
+		switch {
+		case name == TimestampField && isTimestamp(fd):
+			m.timestamp = []protoreflect.FieldDescriptor{fd}
+		case fd.Kind() == protoreflect.StringKind:
+			m.tags = append(m.tags, mapping{name: name, path: []protoreflect.FieldDescriptor{fd}})
+		case isNumber(fd):
+			m.fields = append(m.fields, mapping{name: name, path: []protoreflect.FieldDescriptor{fd}})
+		}
+	}
+
+	return m
+}
+
+// resolvePath returns the descriptors of the dot separated field names of path, every one but the last must be a
+// message. Repeated fields and maps can not be mapped to a single value.
+func resolvePath(desc protoreflect.MessageDescriptor, path string) ([]protoreflect.FieldDescriptor, error) {
+	fds := []protoreflect.FieldDescriptor{}
+	for i, name := range strings.Split(path, ".") {
+		if i > 0 {
+			prev := fds[i-1]
+			if prev.Kind() != protoreflect.MessageKind && prev.Kind() != protoreflect.GroupKind {
+				return nil, fmt.Errorf("path %s: %s is not a message", path, prev.Name())
+			}
+			desc = prev.Message()
+		}
+
+		fd := desc.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			return nil, fmt.Errorf("path %s: %s has no field %s", path, desc.FullName(), name)
+		}
+		if fd.Cardinality() == protoreflect.Repeated {
+			return nil, fmt.Errorf("path %s: %s is repeated", path, name)
+		}
+		fds = append(fds, fd)
+	}
+
+	return fds, nil
+}
+
+// get follows path from msg. Fields without presence, like proto3 scalars, read as their default when not set,
+// fields with presence and unset parent messages are skipped.
+func get(msg protoreflect.Message, path []protoreflect.FieldDescriptor) (protoreflect.Value, protoreflect.FieldDescriptor, bool) {
+	if len(path) == 0 {
+		return protoreflect.Value{}, nil, false
+	}
+
+	for _, fd := range path[:len(path)-1] {
+		if !msg.Has(fd) {
+			return protoreflect.Value{}, nil, false
+		}
+		msg = msg.Get(fd).Message()
+	}
+
+	fd := path[len(path)-1]
+	if fd.HasPresence() && !msg.Has(fd) {
+		return protoreflect.Value{}, nil, false
+	}
+
+	return msg.Get(fd), fd, true
+}
+
+func isNumber(fd protoreflect.FieldDescriptor) bool {
+	switch fd.Kind() {
+	case protoreflect.StringKind, protoreflect.BytesKind, protoreflect.MessageKind, protoreflect.GroupKind:
+		return false
+	}
+
+	return true
+}
+
+func isTimestamp(fd protoreflect.FieldDescriptor) bool {
+	switch fd.Kind() {
+	case protoreflect.MessageKind:
+		return fd.Message().FullName() == timestampMessage
+	case protoreflect.BoolKind, protoreflect.EnumKind, protoreflect.StringKind, protoreflect.BytesKind, protoreflect.GroupKind:
+		return false
+	}
+
+	return true
+}
+
+func number(fd protoreflect.FieldDescriptor, val protoreflect.Value) float64 {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		if val.Bool() {
+			return 1
+		}
+		return 0
+	case protoreflect.EnumKind:
+		return float64(val.Enum())
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return float64(val.Int())
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return float64(val.Uint())
+	}
+
+	return val.Float()
+}
+
+/* text formats a tag value, enums by the name of their value */
+func text(fd protoreflect.FieldDescriptor, val protoreflect.Value) string {
+	if fd.Kind() == protoreflect.EnumKind {
+		if enumVal := fd.Enum().Values().ByNumber(val.Enum()); enumVal != nil {
+			return string(enumVal.Name())
+		}
+	}
+
+	return val.String()
+}
+
+func toTime(fd protoreflect.FieldDescriptor, val protoreflect.Value, unit time.Duration) time.Time {
+	if fd.Kind() == protoreflect.MessageKind {
+		msg := val.Message()
+		fields := msg.Descriptor().Fields()
+		seconds := msg.Get(fields.ByName("seconds")).Int()
+		nanos := msg.Get(fields.ByName("nanos")).Int()
+		return time.Unix(seconds, nanos)
+	}
+
+	switch fd.Kind() {
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return time.Unix(0, int64(val.Float()*float64(unit)))
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return time.Unix(0, int64(val.Uint())*int64(unit))
+	}
+
+	return time.Unix(0, val.Int()*int64(unit))
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
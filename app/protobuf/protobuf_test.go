@@ -0,0 +1,325 @@
+package protobuf
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func field(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+	f := &descriptorpb.FieldDescriptorProto{
+		Name:   proto.String(name),
+		Number: proto.Int32(number),
+		Type:   typ.Enum(),
+		Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+	}
+	if typeName != "" {
+		f.TypeName = proto.String(typeName)
+	}
+
+	return f
+}
+
+/* writeDescriptorSet writes the descriptor set protoc would write for devices.proto with --include_imports */
+func writeDescriptorSet(t *testing.T, includeImports bool) string {
+	t.Helper()
+
+	samples := field("samples", 7, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, "")
+	samples.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("devices.proto"),
+		Package:    proto.String("factory.v1"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("State"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("STATE_UNKNOWN"), Number: proto.Int32(0)},
+				{Name: proto.String("RUNNING"), Number: proto.Int32(1)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("Env"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("temperature", 1, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, ""),
+				field("humidity", 2, descriptorpb.FieldDescriptorProto_TYPE_FLOAT, ""),
+			}},
+			{Name: proto.String("Reading"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("device_id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("env", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".factory.v1.Env"),
+				field("state", 3, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".factory.v1.State"),
+				field("count", 4, descriptorpb.FieldDescriptorProto_TYPE_SINT32, ""),
+				field("on", 5, descriptorpb.FieldDescriptorProto_TYPE_BOOL, ""),
+				field("time", 6, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.Timestamp"),
+				samples,
+				field("timestamp", 8, descriptorpb.FieldDescriptorProto_TYPE_INT64, ""),
+			}},
+			{Name: proto.String("Compact"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("t", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT64, ""),
+				field("v", 2, descriptorpb.FieldDescriptorProto_TYPE_FLOAT, ""),
+			}},
+		},
+	}
+
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}}
+	if includeImports {
+		set.File = append([]*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(timestamppb.File_google_protobuf_timestamp_proto)}, set.File...)
+	}
+
+	raw, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "devices.pb")
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+/* encode builds a message of type name with set filling its fields */
+func encode(t *testing.T, r *Registry, name string, set func(msg protoreflect.Message, fields protoreflect.FieldDescriptors)) []byte {
+	t.Helper()
+
+	desc, err := r.descriptor(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := dynamicpb.NewMessage(desc)
+	set(msg, desc.Fields())
+
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	path := writeDescriptorSet(t, true)
+	r, err := Load([]string{path, path}, []MessageConfig{
+		{
+			Type:      "factory.v1.Reading",
+			Fields:    map[string]string{"env.temperature": "temp", "env.humidity": "humidity", "state": "state", "on": "on"},
+			Tags:      map[string]string{"device_id": "device", "state": "state_name"},
+			Timestamp: "time",
+		},
+		{Type: "factory.v1.Compact", Fields: map[string]string{"v": "value"}, Timestamp: "t", TimestampUnit: "ms"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reading := func(withEnv bool) func(msg protoreflect.Message, fields protoreflect.FieldDescriptors) {
+		return func(msg protoreflect.Message, fields protoreflect.FieldDescriptors) {
+			msg.Set(fields.ByName("device_id"), protoreflect.ValueOfString("pump-1"))
+			msg.Set(fields.ByName("state"), protoreflect.ValueOfEnum(1))
+			msg.Set(fields.ByName("count"), protoreflect.ValueOfInt32(-3))
+			msg.Set(fields.ByName("on"), protoreflect.ValueOfBool(true))
+			msg.Set(fields.ByName("timestamp"), protoreflect.ValueOfInt64(1700000000))
+
+			ts := msg.Mutable(fields.ByName("time")).Message()
+			ts.Set(ts.Descriptor().Fields().ByName("seconds"), protoreflect.ValueOfInt64(1700000000))
+			ts.Set(ts.Descriptor().Fields().ByName("nanos"), protoreflect.ValueOfInt32(500))
+
+			if withEnv {
+				env := msg.Mutable(fields.ByName("env")).Message()
+				env.Set(env.Descriptor().Fields().ByName("temperature"), protoreflect.ValueOfFloat64(21.5))
+			}
+		}
+	}
+
+	cases := []struct {
+		name              string
+		messageType       string
+		payload           []byte
+		expectedMetrics   map[string]float64
+		expectedTags      map[string]string
+		expectedTimestamp time.Time
+		expectedError     string
+	}{
+		{
+			name: "Success: Configured paths", messageType: "factory.v1.Reading", payload: encode(t, r, "factory.v1.Reading", reading(true)),
+			expectedMetrics:   map[string]float64{"temp": 21.5, "humidity": 0, "state": 1, "on": 1},
+			expectedTags:      map[string]string{"device": "pump-1", "state_name": "RUNNING"},
+			expectedTimestamp: time.Unix(1700000000, 500),
+		},
+		{
+			name: "Success: Unset parent message", messageType: "factory.v1.Reading", payload: encode(t, r, "factory.v1.Reading", reading(false)),
+			expectedMetrics:   map[string]float64{"state": 1, "on": 1},
+			expectedTags:      map[string]string{"device": "pump-1", "state_name": "RUNNING"},
+			expectedTimestamp: time.Unix(1700000000, 500),
+		},
+		{
+			name: "Success: Timestamp unit", messageType: "factory.v1.Compact",
+			payload: encode(t, r, "factory.v1.Compact", func(msg protoreflect.Message, fields protoreflect.FieldDescriptors) {
+				msg.Set(fields.ByName("t"), protoreflect.ValueOfUint64(1700000000123))
+				msg.Set(fields.ByName("v"), protoreflect.ValueOfFloat32(0.5))
+			}),
+			expectedMetrics: map[string]float64{"value": 0.5}, expectedTags: map[string]string{}, expectedTimestamp: time.UnixMilli(1700000000123),
+		},
+		{
+			name: "Success: Unset timestamp", messageType: "factory.v1.Compact",
+			payload: encode(t, r, "factory.v1.Compact", func(msg protoreflect.Message, fields protoreflect.FieldDescriptors) {
+				msg.Set(fields.ByName("v"), protoreflect.ValueOfFloat32(0.5))
+			}),
+			expectedMetrics: map[string]float64{"value": 0.5}, expectedTags: map[string]string{},
+		},
+		{
+			name: "Success: Default mapping of an unconfigured type", messageType: "factory.v1.Env",
+			payload: encode(t, r, "factory.v1.Env", func(msg protoreflect.Message, fields protoreflect.FieldDescriptors) {
+				msg.Set(fields.ByName("temperature"), protoreflect.ValueOfFloat64(19))
+			}),
+			expectedMetrics: map[string]float64{"temperature": 19, "humidity": 0}, expectedTags: map[string]string{},
+		},
+		{name: "Failure: Unknown type", messageType: "factory.v1.Missing", payload: []byte{}, expectedError: "unknown message type"},
+		{name: "Failure: Invalid payload", messageType: "factory.v1.Compact", payload: []byte{0x0a, 0x05}, expectedError: "failed to parse factory.v1.Compact"},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		metrics, tags, timestamp, err := r.Decode(c.messageType, c.payload)
+		if c.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), c.expectedError) {
+				t.Errorf("expected error containing %q, got %v", c.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(metrics, c.expectedMetrics) || !reflect.DeepEqual(tags, c.expectedTags) {
+			t.Errorf("expected %v and %v, got %v and %v", c.expectedMetrics, c.expectedTags, metrics, tags)
+		}
+
+		if !timestamp.Equal(c.expectedTimestamp) {
+			t.Errorf("expected timestamp %s, got %s", c.expectedTimestamp, timestamp)
+		}
+	}
+}
+
+func TestDefaultMapping(t *testing.T) {
+	t.Parallel()
+
+	r, err := Load([]string{writeDescriptorSet(t, true)}, []MessageConfig{{Type: "factory.v1.Reading"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := encode(t, r, "factory.v1.Reading", func(msg protoreflect.Message, fields protoreflect.FieldDescriptors) {
+		msg.Set(fields.ByName("device_id"), protoreflect.ValueOfString("pump-1"))
+		msg.Set(fields.ByName("count"), protoreflect.ValueOfInt32(-3))
+		msg.Set(fields.ByName("timestamp"), protoreflect.ValueOfInt64(1700000000))
+	})
+
+	metrics, tags, timestamp, err := r.Decode("factory.v1.Reading", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// messages, repeated fields and the timestamp are not mapped to fields
+	expectedMetrics := map[string]float64{"state": 0, "count": -3, "on": 0}
+	if !reflect.DeepEqual(metrics, expectedMetrics) || !reflect.DeepEqual(tags, map[string]string{"device_id": "pump-1"}) {
+		t.Errorf("expected %v and device_id tag, got %v and %v", expectedMetrics, metrics, tags)
+	}
+
+	if !timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("expected timestamp from the timestamp field, got %s", timestamp)
+	}
+}
+
+func TestTimestampFallback(t *testing.T) {
+	t.Parallel()
+
+	r, err := Load([]string{writeDescriptorSet(t, true)}, []MessageConfig{
+		{Type: "factory.v1.Reading", Tags: map[string]string{"device_id": "device"}, TimestampUnit: "ms"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := encode(t, r, "factory.v1.Reading", func(msg protoreflect.Message, fields protoreflect.FieldDescriptors) {
+		msg.Set(fields.ByName("device_id"), protoreflect.ValueOfString("pump-1"))
+		msg.Set(fields.ByName("timestamp"), protoreflect.ValueOfInt64(1700000000123))
+	})
+
+	_, tags, timestamp, err := r.Decode("factory.v1.Reading", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tags["device"] != "pump-1" {
+		t.Errorf("expected the configured tag, got %v", tags)
+	}
+
+	if !timestamp.Equal(time.UnixMilli(1700000000123)) {
+		t.Errorf("expected timestamp from the timestamp field, got %s", timestamp)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Parallel()
+
+	path := writeDescriptorSet(t, true)
+	garbage := filepath.Join(t.TempDir(), "garbage.pb")
+	if err := os.WriteFile(garbage, []byte("not a descriptor set"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name          string
+		paths         []string
+		config        MessageConfig
+		expectedError string
+	}{
+		{name: "Failure: Missing file", paths: []string{filepath.Join(t.TempDir(), "missing.pb")}, expectedError: "failed to read descriptor set"},
+		{name: "Failure: Not a descriptor set", paths: []string{garbage}, expectedError: "failed to parse descriptor set"},
+		{name: "Failure: Missing import", paths: []string{writeDescriptorSet(t, false)}, expectedError: "--include_imports"},
+		{name: "Failure: Unknown type", paths: []string{path}, config: MessageConfig{Type: "factory.v1.Missing"}, expectedError: "unknown message type"},
+		{name: "Failure: Enum type", paths: []string{path}, config: MessageConfig{Type: "factory.v1.State"}, expectedError: "not a message type"},
+		{name: "Failure: Unknown field", paths: []string{path}, config: MessageConfig{Type: "factory.v1.Reading", Fields: map[string]string{"env.pressure": "p"}}, expectedError: "factory.v1.Env has no field pressure"},
+		{name: "Failure: Path through a scalar", paths: []string{path}, config: MessageConfig{Type: "factory.v1.Reading", Fields: map[string]string{"count.value": "c"}}, expectedError: "count is not a message"},
+		{name: "Failure: Repeated field", paths: []string{path}, config: MessageConfig{Type: "factory.v1.Reading", Fields: map[string]string{"samples": "s"}}, expectedError: "samples is repeated"},
+		{name: "Failure: String field", paths: []string{path}, config: MessageConfig{Type: "factory.v1.Reading", Fields: map[string]string{"device_id": "d"}}, expectedError: "must be a number"},
+		{name: "Failure: Message tag", paths: []string{path}, config: MessageConfig{Type: "factory.v1.Reading", Tags: map[string]string{"env": "e"}}, expectedError: "tag env must be"},
+		{name: "Failure: String timestamp", paths: []string{path}, config: MessageConfig{Type: "factory.v1.Reading", Timestamp: "device_id"}, expectedError: "timestamp device_id must be"},
+		{name: "Failure: Unknown unit", paths: []string{path}, config: MessageConfig{Type: "factory.v1.Compact", TimestampUnit: "m"}, expectedError: "timestamp_unit must be one of"},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		configs := []MessageConfig{}
+		if c.config.Type != "" {
+			configs = append(configs, c.config)
+		}
+
+		_, err := Load(c.paths, configs)
+		if err == nil || !strings.Contains(err.Error(), c.expectedError) {
+			t.Errorf("expected error containing %q, got %v", c.expectedError, err)
+		}
+	}
+
+	_, err := Load([]string{path}, []MessageConfig{{Type: "factory.v1.Env"}, {Type: "factory.v1.Env"}})
+	if err == nil || !strings.Contains(err.Error(), "duplicate type") {
+		t.Errorf("expected duplicate type error, got %v", err)
+	}
+}
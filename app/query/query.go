@@ -0,0 +1,270 @@
+package query
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"taos-adapter/config"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+
+	// timestampColumn is the first column of every table created by the schemaless insert of the tdengine sink
+	timestampColumn = "_ts"
+)
+
+// QueryFunc runs a statement with ? placeholders and returns the column names and the rows
+type QueryFunc func(query string, args ...interface{}) ([]string, [][]interface{}, error)
+
+// API serves read-only endpoints returning the recent points of a table, so data can be checked without TDengine
+// client access. Every request is translated into a single SELECT whose values are passed as arguments.
+type API struct {
+	Clients      []config.QueryClientConfig
+	MaxRows      int
+	MaxRange     time.Duration
+	DefaultRange time.Duration
+	Query        QueryFunc
+}
+
+// Register adds GET /query/<db>/<table>
+func (a *API) Register(r gin.IRouter) {
+	r.GET("/query/:db/:table", a.authorize, a.query)
+}
+
+/* authorize finds the client sending the bearer token and refuses databases it may not read */
+func (a *API) authorize(ctx *gin.Context) {
+	token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+
+	var client *config.QueryClientConfig
+	for i := range a.Clients {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.Clients[i].Token)) == 1 {
+			client = &a.Clients[i]
+		}
+	}
+	if token == "" || client == nil {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid query token"})
+		return
+	}
+
+	if !Allowed(client.Databases, ctx.Param("db")) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("not allowed to read database %s", ctx.Param("db"))})
+		return
+	}
+
+	ctx.Next()
+}
+
+// query answers with the newest rows between from and to, at most limit of them. The response says when more rows
+// matched, in the truncated field of JSON and the X-Truncated header of CSV.
+func (a *API) query(ctx *gin.Context) {
+	db, table := ctx.Param("db"), ctx.Param("table")
+	for _, name := range []string{db, table} {
+		if err := ValidateName(name); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	from, to, err := a.timeRange(ctx.Query("from"), ctx.Query("to"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tags, err := parseTags(ctx.QueryArray("tags"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit := a.MaxRows
+	if val := ctx.Query("limit"); val != "" {
+		if limit, err = strconv.Atoi(val); err != nil || limit <= 0 || limit > a.MaxRows {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d, got: %s", a.MaxRows, val)})
+			return
+		}
+	}
+
+	format := ctx.DefaultQuery("format", FormatJSON)
+	if ctx.Query("format") == "" && strings.Contains(ctx.GetHeader("Accept"), "text/csv") {
+		format = FormatCSV
+	}
+	if format != FormatJSON && format != FormatCSV {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("format must be one of %s, %s, got: %q", FormatJSON, FormatCSV, format)})
+		return
+	}
+
+	// one row more than the limit tells whether the result was cut off
+	statement, args := buildQuery(db, table, from, to, tags, limit+1)
+	columns, rows, err := a.Query(statement, args...)
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	truncated := len(rows) > limit
+	if truncated {
+		rows = rows[:limit]
+	}
+
+	if format == FormatCSV {
+		ctx.Header("X-Truncated", strconv.FormatBool(truncated))
+		writeCSV(ctx, columns, rows)
+		return
+	}
+
+	points := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		points[i] = map[string]interface{}{}
+		for j, column := range columns {
+			points[i][column] = row[j]
+		}
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"from": from, "to": to, "rows": points, "truncated": truncated})
+}
+
+/* timeRange parses from and to, defaulting to the last DefaultRange, and enforces MaxRange */
+func (a *API) timeRange(fromVal, toVal string) (time.Time, time.Time, error) {
+	to := time.Now()
+	if toVal != "" {
+		var err error
+		if to, err = parseTime(toVal); err != nil {
+			return to, to, errors.Wrap(err, "invalid to")
+		}
+	}
+
+	from := to.Add(-a.DefaultRange)
+	if fromVal != "" {
+		var err error
+		if from, err = parseTime(fromVal); err != nil {
+			return from, to, errors.Wrap(err, "invalid from")
+		}
+	}
+
+	if !from.Before(to) {
+		return from, to, errors.New("from must be before to")
+	}
+
+	if to.Sub(from) > a.MaxRange {
+		return from, to, fmt.Errorf("time range must not exceed %s, got: %s", a.MaxRange, to.Sub(from))
+	}
+
+	return from, to, nil
+}
+
+// buildQuery returns the SELECT of the rows of db.table in the time range carrying every tag. Names are quoted as
+// identifiers after ValidateName, every value is an argument.
+func buildQuery(db, table string, from, to time.Time, tags [][2]string, limit int) (string, []interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "SELECT * FROM `%s`.`%s` WHERE %s >= ? AND %s < ?", db, table, timestampColumn, timestampColumn)
+	args := []interface{}{from, to}
+
+	for _, tag := range tags {
+		fmt.Fprintf(&b, " AND `%s` = ?", tag[0])
+		args = append(args, tag[1])
+	}
+
+	fmt.Fprintf(&b, " ORDER BY %s DESC LIMIT ?", timestampColumn)
+	args = append(args, limit)
+
+	return b.String(), args
+}
+
+// parseTags reads name:value pairs, separated by commas or given as repeated parameters
+func parseTags(params []string) ([][2]string, error) {
+	tags := [][2]string{}
+	for _, param := range params {
+		for _, pair := range strings.Split(param, ",") {
+			if pair == "" {
+				continue
+			}
+
+			name, val, ok := strings.Cut(pair, ":")
+			if !ok {
+				return nil, fmt.Errorf("tags must be name:value pairs, got: %q", pair)
+			}
+
+			if err := ValidateName(name); err != nil {
+				return nil, err
+			}
+			tags = append(tags, [2]string{name, val})
+		}
+	}
+
+	return tags, nil
+}
+
+// parseTime accepts RFC 3339 times and unix timestamps in seconds
+func parseTime(val string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, val)
+}
+
+// ValidateName refuses names that can not be quoted as identifiers. The driver replaces every ? of the statement,
+// so they are refused as well.
+func ValidateName(name string) error {
+	if name == "" || len(name) > 192 || strings.ContainsAny(name, "`?\\") {
+		return fmt.Errorf("invalid name: %q", name)
+	}
+
+	for _, r := range name {
+		if r < ' ' {
+			return fmt.Errorf("invalid name: %q", name)
+		}
+	}
+
+	return nil
+}
+
+// Allowed reports whether db is listed in databases or * is
+func Allowed(databases []string, db string) bool {
+	for _, d := range databases {
+		if d == "*" || d == db {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* writeCSV writes the same ; separated layout as the csv archive, with the column names as header */
+func writeCSV(ctx *gin.Context, columns []string, rows [][]interface{}) {
+	ctx.Header("Content-Type", "text/csv; charset=utf-8")
+	ctx.Status(http.StatusOK)
+
+	w := csv.NewWriter(ctx.Writer)
+	w.Comma = ';'
+	_ = w.Write(columns)
+
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, val := range row {
+			switch v := val.(type) {
+			case nil:
+				record[i] = ""
+			case time.Time:
+				record[i] = v.Format(time.RFC3339Nano)
+			case []byte:
+				record[i] = string(v)
+			default:
+				record[i] = fmt.Sprint(v)
+			}
+		}
+		_ = w.Write(record)
+	}
+
+	w.Flush()
+}
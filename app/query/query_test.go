@@ -0,0 +1,121 @@
+package query
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"taos-adapter/config"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	ts := time.Unix(1700000000, 0).UTC()
+	rows := [][]interface{}{{ts, 21.5, "kitchen"}, {ts.Add(-time.Second), nil, "kitchen"}, {ts.Add(-2 * time.Second), 20.5, "kitchen"}}
+
+	cases := []struct {
+		name              string
+		url               string
+		token             string
+		accept            string
+		queryErr          error
+		status            int
+		contains          string
+		expectedStatement string
+		expectedArgs      []interface{}
+	}{
+		{name: "Failure: Missing token", url: "/query/factory/sensor", status: http.StatusUnauthorized},
+		{name: "Failure: Wrong token", url: "/query/factory/sensor", token: "guess", status: http.StatusUnauthorized},
+		{name: "Failure: Database not allowed", url: "/query/office/sensor", token: "device-team", status: http.StatusForbidden, contains: "office"},
+		{
+			name: "Success: Time range and tags", url: "/query/factory/sensor?from=1699999000&to=2023-11-14T22:13:20Z&tags=room:kitchen,floor:1&tags=note:it's", token: "device-team",
+			status: http.StatusOK, contains: `"truncated":false`,
+			expectedStatement: "SELECT * FROM `factory`.`sensor` WHERE _ts >= ? AND _ts < ? AND `room` = ? AND `floor` = ? AND `note` = ? ORDER BY _ts DESC LIMIT ?",
+			expectedArgs:      []interface{}{time.Unix(1699999000, 0), ts, "kitchen", "1", "it's", 4},
+		},
+		{
+			name: "Success: Limit truncates", url: "/query/factory/sensor?limit=2", token: "device-team",
+			status: http.StatusOK, contains: `"temp":null}],"to":`, expectedArgs: []interface{}{3},
+		},
+		{
+			name: "Success: CSV", url: "/query/factory/sensor?format=csv", token: "device-team",
+			status: http.StatusOK, contains: "_ts;temp;room\n2023-11-14T22:13:20Z;21.5;kitchen\n2023-11-14T22:13:19Z;;kitchen\n",
+		},
+		{name: "Success: CSV from Accept", url: "/query/office/sensor", token: "ops", accept: "text/csv", status: http.StatusOK, contains: "_ts;temp;room\n"},
+		{name: "Failure: Unknown format", url: "/query/factory/sensor?format=xml", token: "device-team", status: http.StatusBadRequest, contains: "format must be one of"},
+		{name: "Failure: Limit above maximum", url: "/query/factory/sensor?limit=4", token: "device-team", status: http.StatusBadRequest, contains: "limit must be between 1 and 3"},
+		{name: "Failure: Range too long", url: "/query/factory/sensor?from=1699900000&to=1700000000", token: "device-team", status: http.StatusBadRequest, contains: "time range must not exceed 24h0m0s"},
+		{name: "Failure: Reversed range", url: "/query/factory/sensor?from=1700000000&to=1699990000", token: "device-team", status: http.StatusBadRequest, contains: "from must be before to"},
+		{name: "Failure: Invalid time", url: "/query/factory/sensor?from=yesterday", token: "device-team", status: http.StatusBadRequest, contains: "invalid from"},
+		{name: "Failure: Invalid table", url: "/query/factory/sen%60sor", token: "device-team", status: http.StatusBadRequest, contains: "invalid name"},
+		{name: "Failure: Invalid tag name", url: "/query/factory/sensor?tags=ro%3Fom:kitchen", token: "device-team", status: http.StatusBadRequest, contains: "invalid name"},
+		{name: "Failure: Tag without value", url: "/query/factory/sensor?tags=room", token: "device-team", status: http.StatusBadRequest, contains: "name:value pairs"},
+		{name: "Failure: Query error", url: "/query/factory/sensor", token: "device-team", queryErr: errors.New("table does not exist"), status: http.StatusBadGateway, contains: "table does not exist"},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			t.Logf("starting test case: %s", c.name)
+
+			var statement string
+			var args []interface{}
+			api := &API{
+				Clients: []config.QueryClientConfig{
+					{Name: "device team", Token: "device-team", Databases: []string{"factory"}},
+					{Name: "ops", Token: "ops", Databases: []string{"*"}},
+				},
+				MaxRows:      3,
+				MaxRange:     24 * time.Hour,
+				DefaultRange: time.Hour,
+				Query: func(query string, queryArgs ...interface{}) ([]string, [][]interface{}, error) {
+					statement, args = query, queryArgs
+					limit := queryArgs[len(queryArgs)-1].(int)
+					if limit > len(rows) {
+						limit = len(rows)
+					}
+					return []string{"_ts", "temp", "room"}, rows[:limit], c.queryErr
+				},
+			}
+
+			r := gin.New()
+			api.Register(r)
+
+			req := httptest.NewRequest(http.MethodGet, c.url, nil)
+			if c.token != "" {
+				req.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			if c.accept != "" {
+				req.Header.Set("Accept", c.accept)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != c.status {
+				t.Errorf("expected status %d, got %d: %s", c.status, w.Code, w.Body.String())
+			}
+
+			if !strings.Contains(w.Body.String(), c.contains) {
+				t.Errorf("expected body to contain %s, got %s", c.contains, w.Body.String())
+			}
+
+			if c.expectedStatement != "" && statement != c.expectedStatement {
+				t.Errorf("expected statement %s, got %s", c.expectedStatement, statement)
+			}
+
+			if c.expectedArgs != nil {
+				// only the trailing arguments are compared when the time range defaults to now
+				if len(args) < len(c.expectedArgs) || !reflect.DeepEqual(args[len(args)-len(c.expectedArgs):], c.expectedArgs) {
+					t.Errorf("expected arguments %v, got %v", c.expectedArgs, args)
+				}
+			}
+		})
+	}
+}
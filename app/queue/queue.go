@@ -0,0 +1,171 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"taos-adapter/models"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PolicyBlock      = "block"
+	PolicyDropNewest = "drop_newest"
+	PolicyDropOldest = "drop_oldest"
+	PolicySpill      = "spill"
+
+	dropLogInterval = 10 * time.Second
+)
+
+// Queue buffers points between two stages, Policy decides what happens once Size points are buffered
+type Queue struct {
+	Size     int
+	Policy   string // PolicyBlock, PolicyDropNewest, PolicyDropOldest or PolicySpill
+	SpillDir string // directory of the spill file, required for PolicySpill
+
+	depth   int64
+	spilled int64
+	dropped uint64
+}
+
+// Depth returns the number of points waiting in memory and in the spill file
+func (q *Queue) Depth() int64 {
+	return atomic.LoadInt64(&q.depth)
+}
+
+// Spilled returns the number of points waiting in the spill file
+func (q *Queue) Spilled() int64 {
+	return atomic.LoadInt64(&q.spilled)
+}
+
+// Dropped returns the number of points discarded because the queue was full
+func (q *Queue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Validate checks the queue settings
+func (q *Queue) Validate() error {
+	if q.Size <= 0 {
+		return fmt.Errorf("queue size must be positive, got: %d", q.Size)
+	}
+
+	switch q.Policy {
+	case PolicyBlock, PolicyDropNewest, PolicyDropOldest:
+	case PolicySpill:
+		if q.SpillDir == "" {
+			return errors.New("spill policy requires a spill directory")
+		}
+	default:
+		return fmt.Errorf("queue policy must be one of %s, %s, %s, %s, got: %q", PolicyBlock, PolicyDropNewest, PolicyDropOldest, PolicySpill, q.Policy)
+	}
+
+	return nil
+}
+
+// Run moves points from in to out, out is closed once in is closed and the queue is drained.
+// With PolicySpill points still in memory are written to the front of the spill file when ctx is done and
+// replayed on the next start, ahead of the spilled points that were not read.
+func (q *Queue) Run(ctx context.Context, log *logrus.Entry, in chan models.TimeBasedMetrics, out chan models.TimeBasedMetrics) error {
+	defer close(out)
+
+	if err := q.Validate(); err != nil {
+		return err
+	}
+
+	var s *spill
+	if q.Policy == PolicySpill {
+		var err error
+		s, err = openSpill(q.SpillDir)
+		if err != nil {
+			return err
+		}
+		defer s.close()
+
+		if s.pending > 0 {
+			log.Infof("replaying %d spilled points", s.pending)
+		}
+	}
+
+	buf := make([]models.TimeBasedMetrics, 0, q.Size)
+	inClosed := false
+	var lastDropLog time.Time
+
+	drop := func(reason string) {
+		dropped := atomic.AddUint64(&q.dropped, 1)
+		if time.Since(lastDropLog) > dropLogInterval {
+			log.Warnf("%s, %d points dropped so far", reason, dropped)
+			lastDropLog = time.Now()
+		}
+	}
+
+	for {
+		// refill from the spill file so the oldest points are sent first
+		for s != nil && s.pending > 0 && len(buf) < q.Size {
+			m, err := s.read()
+			if err != nil {
+				drop(errors.Wrap(err, "failed to read spilled point").Error())
+				continue
+			}
+			buf = append(buf, m)
+		}
+
+		spilled := 0
+		if s != nil {
+			spilled = s.pending
+		}
+		atomic.StoreInt64(&q.spilled, int64(spilled))
+		atomic.StoreInt64(&q.depth, int64(len(buf)+spilled))
+
+		recv := in
+		if inClosed || (q.Policy == PolicyBlock && len(buf) >= q.Size) {
+			recv = nil
+		}
+
+		var send chan models.TimeBasedMetrics
+		var head models.TimeBasedMetrics
+		if len(buf) > 0 {
+			send = out
+			head = buf[0]
+		}
+
+		if inClosed && send == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if s != nil {
+				if err := s.compact(buf); err != nil {
+					return errors.Wrap(err, "failed to spill queued points")
+				}
+			}
+			return nil
+		case send <- head:
+			buf[0] = models.TimeBasedMetrics{}
+			buf = buf[1:]
+		case m, ok := <-recv:
+			if !ok {
+				inClosed = true
+				continue
+			}
+
+			switch {
+			case s != nil && (len(buf) >= q.Size || s.pending > 0):
+				if err := s.write(m); err != nil {
+					drop(errors.Wrap(err, "failed to spill point").Error())
+				}
+			case len(buf) < q.Size:
+				buf = append(buf, m)
+			case q.Policy == PolicyDropOldest:
+				buf[0] = models.TimeBasedMetrics{}
+				buf = append(buf[1:], m)
+				drop("queue full, dropped oldest point")
+			default:
+				drop("queue full, dropped newest point")
+			}
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package queue
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"taos-adapter/models"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newPoints(n int) []models.TimeBasedMetrics {
+	points := make([]models.TimeBasedMetrics, n)
+	for i := range points {
+		points[i] = models.TimeBasedMetrics{
+			Metrics:   map[string]float64{"v": float64(i)},
+			Tags:      map[string]string{"id": strconv.Itoa(i)},
+			Timestamp: time.Unix(int64(1257894000+i), 0).UTC(),
+			DB:        "db",
+			Table:     "t",
+			Topic:     "db/t",
+		}
+	}
+
+	return points
+}
+
+func TestQueue(t *testing.T) {
+	t.Parallel()
+
+	points := newPoints(5)
+
+	cases := []struct {
+		name            string
+		policy          string
+		expectedPoints  []models.TimeBasedMetrics
+		expectedDropped uint64
+	}{
+		{
+			name:           "Success: Block",
+			policy:         PolicyBlock,
+			expectedPoints: points,
+		},
+		{
+			name:            "Success: Drop newest",
+			policy:          PolicyDropNewest,
+			expectedPoints:  points[:2],
+			expectedDropped: 3,
+		},
+		{
+			name:            "Success: Drop oldest",
+			policy:          PolicyDropOldest,
+			expectedPoints:  points[3:],
+			expectedDropped: 3,
+		},
+		{
+			name:           "Success: Spill",
+			policy:         PolicySpill,
+			expectedPoints: points,
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		q := &Queue{Size: 2, Policy: c.policy, SpillDir: t.TempDir()}
+		in := make(chan models.TimeBasedMetrics)
+		out := make(chan models.TimeBasedMetrics)
+
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- q.Run(context.Background(), logrus.NewEntry(logrus.New()), in, out)
+		}()
+
+		// nothing reads out yet, so the queue fills up
+		go func() {
+			for _, m := range points {
+				in <- m
+			}
+			close(in)
+		}()
+
+		if c.policy != PolicyBlock {
+			deadline := time.Now().Add(time.Second)
+			for q.Depth()+int64(q.Dropped()) < int64(len(points)) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		received := []models.TimeBasedMetrics{}
+		for m := range out {
+			received = append(received, m)
+		}
+
+		if err := <-errChan; err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(received, c.expectedPoints) {
+			t.Errorf("expected points %v, got %v", c.expectedPoints, received)
+		}
+
+		if q.Dropped() != c.expectedDropped {
+			t.Errorf("expected dropped %d, got %d", c.expectedDropped, q.Dropped())
+		}
+
+		if q.Depth() != 0 {
+			t.Errorf("expected empty queue, got depth %d", q.Depth())
+		}
+	}
+}
+
+func TestSpillReplay(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	points := newPoints(3)
+
+	q := &Queue{Size: 1, Policy: PolicySpill, SpillDir: dir}
+	in := make(chan models.TimeBasedMetrics)
+	out := make(chan models.TimeBasedMetrics)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- q.Run(ctx, logrus.NewEntry(logrus.New()), in, out)
+	}()
+
+	for _, m := range points {
+		in <- m
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for q.Depth() < int64(len(points)) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the point held in memory is spilled ahead of the others on shutdown
+	cancel()
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	q = &Queue{Size: 1, Policy: PolicySpill, SpillDir: dir}
+	in = make(chan models.TimeBasedMetrics)
+	out = make(chan models.TimeBasedMetrics)
+	close(in)
+
+	go func() {
+		errChan <- q.Run(context.Background(), logrus.NewEntry(logrus.New()), in, out)
+	}()
+
+	received := []models.TimeBasedMetrics{}
+	for m := range out {
+		received = append(received, m)
+	}
+
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(received, points) {
+		t.Errorf("expected points %v, got %v", points, received)
+	}
+}
+
+func TestSpillReplayAfterReads(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	points := newPoints(3)
+
+	q := &Queue{Size: 1, Policy: PolicySpill, SpillDir: dir}
+	in := make(chan models.TimeBasedMetrics)
+	out := make(chan models.TimeBasedMetrics)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- q.Run(ctx, logrus.NewEntry(logrus.New()), in, out)
+	}()
+
+	for _, m := range points {
+		in <- m
+	}
+
+	// the first point is delivered and the second one read back from the spill file into memory
+	if m := <-out; !reflect.DeepEqual(m, points[0]) {
+		t.Fatalf("expected the first point, got %v", m)
+	}
+	deadline := time.Now().Add(time.Second)
+	for (q.Spilled() != 1 || q.Depth() != 2) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	q = &Queue{Size: 1, Policy: PolicySpill, SpillDir: dir}
+	in = make(chan models.TimeBasedMetrics)
+	out = make(chan models.TimeBasedMetrics)
+	close(in)
+
+	go func() {
+		errChan <- q.Run(context.Background(), logrus.NewEntry(logrus.New()), in, out)
+	}()
+
+	received := []models.TimeBasedMetrics{}
+	for m := range out {
+		received = append(received, m)
+	}
+
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	// the delivered point is not replayed
+	if !reflect.DeepEqual(received, points[1:]) {
+		t.Errorf("expected points %v, got %v", points[1:], received)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name          string
+		queue         Queue
+		expectedError bool
+	}{
+		{name: "Success: Block", queue: Queue{Size: 1, Policy: PolicyBlock}},
+		{name: "Failure: Size", queue: Queue{Policy: PolicyBlock}, expectedError: true},
+		{name: "Failure: Unknown policy", queue: Queue{Size: 1, Policy: "drop"}, expectedError: true},
+		{name: "Failure: Spill without dir", queue: Queue{Size: 1, Policy: PolicySpill}, expectedError: true},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if err := c.queue.Validate(); (err != nil) != c.expectedError {
+			t.Errorf("expected error: %t, got: %v", c.expectedError, err)
+		}
+	}
+}
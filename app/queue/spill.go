@@ -0,0 +1,154 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"taos-adapter/models"
+
+	"github.com/pkg/errors"
+)
+
+const spillFile = "queue.ndjson"
+
+// spill is an append only NDJSON file read from the front, it is truncated once fully read and compacted on
+// shutdown so the next start only replays the points that were not read
+type spill struct {
+	path    string
+	writer  *os.File
+	reader  *os.File
+	buf     *bufio.Reader
+	pending int
+	offset  int64 // bytes of the points already read
+}
+
+/* openSpill opens the spill file in dir, counting points left over from a previous run */
+func openSpill(dir string) (*spill, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create spill directory: %s", dir)
+	}
+
+	path := filepath.Join(dir, spillFile)
+
+	raw, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to read spill file: %s", path)
+	}
+
+	// a partial line is left behind when the adapter was killed while writing
+	complete := bytes.LastIndexByte(raw, '\n') + 1
+	if complete < len(raw) {
+		if err := os.Truncate(path, int64(complete)); err != nil {
+			return nil, errors.Wrapf(err, "failed to truncate spill file: %s", path)
+		}
+	}
+
+	writer, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open spill file: %s", path)
+	}
+
+	reader, err := os.Open(path)
+	if err != nil {
+		writer.Close()
+		return nil, errors.Wrapf(err, "failed to open spill file: %s", path)
+	}
+
+	return &spill{
+		path:    path,
+		writer:  writer,
+		reader:  reader,
+		buf:     bufio.NewReader(reader),
+		pending: bytes.Count(raw[:complete], []byte("\n")),
+	}, nil
+}
+
+func (s *spill) write(m models.TimeBasedMetrics) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.writer.Write(append(line, '\n')); err != nil {
+		return errors.Wrapf(err, "failed to write spill file: %s", s.path)
+	}
+
+	s.pending++
+
+	return nil
+}
+
+func (s *spill) read() (models.TimeBasedMetrics, error) {
+	var m models.TimeBasedMetrics
+
+	line, err := s.buf.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return m, errors.Wrapf(err, "failed to read spill file: %s", s.path)
+	}
+
+	s.pending--
+	s.offset += int64(len(line))
+	if s.pending == 0 {
+		if err := s.reset(); err != nil {
+			return m, err
+		}
+	}
+
+	return m, json.Unmarshal(line, &m)
+}
+
+/* reset truncates the fully read spill file so it does not grow forever */
+func (s *spill) reset() error {
+	if err := s.writer.Truncate(0); err != nil {
+		return errors.Wrapf(err, "failed to truncate spill file: %s", s.path)
+	}
+
+	if _, err := s.reader.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "failed to rewind spill file: %s", s.path)
+	}
+
+	s.buf.Reset(s.reader)
+	s.offset = 0
+
+	return nil
+}
+
+/* compact replaces the spill file with front followed by the points not read yet, the spill must be closed next */
+func (s *spill) compact(front []models.TimeBasedMetrics) error {
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read spill file: %s", s.path)
+	}
+
+	var b bytes.Buffer
+	for _, m := range front {
+		line, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		b.Write(append(line, '\n'))
+	}
+	b.Write(raw[s.offset:])
+
+	// written aside and renamed, so a crash while compacting leaves the previous file
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b.Bytes(), 0o644); err != nil {
+		return errors.Wrapf(err, "failed to write spill file: %s", tmp)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return errors.Wrapf(err, "failed to replace spill file: %s", s.path)
+	}
+
+	s.pending += len(front)
+	s.offset = 0
+
+	return nil
+}
+
+func (s *spill) close() {
+	s.writer.Close()
+	s.reader.Close()
+}
@@ -0,0 +1,229 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"taos-adapter/batch"
+	"taos-adapter/models"
+	"taos-adapter/telemetry"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const dbLabel string = "db"
+
+// Sink is a Prometheus remote-write endpoint, Name labels its metrics
+type Sink struct {
+	Name          string
+	URL           string
+	User          string
+	Pass          string
+	Tenant        string // sent as X-Scope-OrgID when set
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	Timeout       time.Duration
+}
+
+/* RemoteWrite batches metrics and pushes them to a prometheus remote-write endpoint until tbMetrics closes or ctx is done */
+func (s *Sink) RemoteWrite(ctx context.Context, log *logrus.Entry, tbMetrics chan models.TimeBasedMetrics) error {
+	client := &http.Client{Timeout: s.Timeout}
+
+	log.Infof("writing to %s", s.URL)
+
+	batch.Consume(ctx, tbMetrics, s.BatchSize, s.FlushInterval, func(points []models.TimeBasedMetrics) {
+		body := snappy.Encode(nil, encodeWriteRequest(points))
+
+		started := time.Now()
+		err := batch.Retry(ctx, s.MaxRetries, time.Second, func() error {
+			return s.send(client, body)
+		})
+		if err != nil {
+			log.Error(errors.Wrapf(err, "failed to remote write %d points", len(points)))
+		}
+		telemetry.ObserveWrite(s.Name, points, started, err)
+	})
+
+	return nil
+}
+
+func (s *Sink) send(client *http.Client, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return batch.Permanent(errors.Wrap(err, "failed to build remote write request"))
+	}
+
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if s.Tenant != "" {
+		req.Header.Set("X-Scope-OrgID", s.Tenant)
+	}
+	if s.User != "" {
+		req.SetBasicAuth(s.User, s.Pass)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send remote write request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("remote write returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+
+	// client errors will fail the same way again, except for rate limiting
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return batch.Permanent(err)
+	}
+
+	return err
+}
+
+type label struct {
+	name, value string
+}
+
+/* encodeWriteRequest builds a prometheus.WriteRequest protobuf, one series per <table>_<field> */
+func encodeWriteRequest(points []models.TimeBasedMetrics) []byte {
+	var req []byte
+
+	for _, point := range points {
+		labels := compileLabels(point)
+		timestamp := point.Timestamp.UnixMilli()
+
+		for field, value := range point.Metrics {
+			name := sanitizeMetricName(fmt.Sprintf("%s_%s", point.Table, field))
+
+			var series []byte
+			for _, l := range withName(labels, name) {
+				series = protowire.AppendTag(series, 1, protowire.BytesType)
+				series = protowire.AppendBytes(series, encodeLabel(l))
+			}
+
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(timestamp))
+
+			series = protowire.AppendTag(series, 2, protowire.BytesType)
+			series = protowire.AppendBytes(series, sample)
+
+			req = protowire.AppendTag(req, 1, protowire.BytesType)
+			req = protowire.AppendBytes(req, series)
+		}
+	}
+
+	return req
+}
+
+func encodeLabel(l label) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, l.name)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, l.value)
+
+	return b
+}
+
+/* compileLabels turns tags into sanitized labels sorted by name, as remote-write receivers expect */
+func compileLabels(point models.TimeBasedMetrics) []label {
+	labelMap := map[string]string{}
+	if point.DB != "" {
+		labelMap[dbLabel] = point.DB
+	}
+
+	// tags win over the db label if a device sends a tag with the same name
+	for key, val := range point.Tags {
+		name := sanitizeLabelName(key)
+		if name == "" || val == "" {
+			continue
+		}
+
+		labelMap[name] = val
+	}
+
+	labels := make([]label, 0, len(labelMap))
+	for name, value := range labelMap {
+		labels = append(labels, label{name: name, value: value})
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].name < labels[j].name
+	})
+
+	return labels
+}
+
+// withName adds the __name__ label in its sorted place, upper case label names sort before it
+func withName(labels []label, name string) []label {
+	named := make([]label, 0, len(labels)+1)
+	named = append(named, labels...)
+	named = append(named, label{name: "__name__", value: name})
+
+	sort.Slice(named, func(i, j int) bool {
+		return named[i].name < named[j].name
+	})
+
+	return named
+}
+
+// sanitizeMetricName maps name onto [a-zA-Z_:][a-zA-Z0-9_:]*
+func sanitizeMetricName(name string) string {
+	return sanitize(name, true)
+}
+
+// sanitizeLabelName maps name onto [a-zA-Z_][a-zA-Z0-9_]*, names starting with __ are reserved by prometheus
+func sanitizeLabelName(name string) string {
+	name = sanitize(name, false)
+	for strings.HasPrefix(name, "__") {
+		name = name[1:]
+	}
+
+	if name == "_" {
+		return ""
+	}
+
+	return name
+}
+
+func sanitize(name string, allowColon bool) string {
+	if name == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			b.WriteRune(r)
+		case r == ':' && allowColon:
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,155 @@
+package remotewrite
+
+import (
+	"math"
+	"taos-adapter/models"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestSanitizeNames(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name           string
+		raw            string
+		expectedMetric string
+		expectedLabel  string
+	}{
+		{
+			name:           "Success: Valid name",
+			raw:            "temp_sensor",
+			expectedMetric: "temp_sensor",
+			expectedLabel:  "temp_sensor",
+		},
+		{
+			name:           "Success: Leading digit",
+			raw:            "1wire",
+			expectedMetric: "_1wire",
+			expectedLabel:  "_1wire",
+		},
+		{
+			name:           "Success: MQTT style separators",
+			raw:            "room/1-temp.c",
+			expectedMetric: "room_1_temp_c",
+			expectedLabel:  "room_1_temp_c",
+		},
+		{
+			name:           "Success: Colon only valid in metric names",
+			raw:            "job:rate",
+			expectedMetric: "job:rate",
+			expectedLabel:  "job_rate",
+		},
+		{
+			name:           "Success: Reserved label prefix",
+			raw:            "__name__",
+			expectedMetric: "__name__",
+			expectedLabel:  "_name__",
+		},
+		{
+			name:           "Success: Empty name",
+			raw:            "",
+			expectedMetric: "",
+			expectedLabel:  "",
+		},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if metric := sanitizeMetricName(c.raw); metric != c.expectedMetric {
+			t.Errorf("expected metric name %q, got %q", c.expectedMetric, metric)
+		}
+
+		if label := sanitizeLabelName(c.raw); label != c.expectedLabel {
+			t.Errorf("expected label name %q, got %q", c.expectedLabel, label)
+		}
+	}
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	t.Parallel()
+
+	point := models.TimeBasedMetrics{
+		Metrics: map[string]float64{
+			"temp": 22.11,
+		},
+		Tags: map[string]string{
+			"name":     "test_metric",
+			"location": "test location",
+			"db":       "override",
+			"Zone":     "north",
+		},
+		Timestamp: time.Unix(1257894000, 0),
+		DB:        "test_db",
+		Table:     "room-1",
+	}
+
+	req := encodeWriteRequest([]models.TimeBasedMetrics{point})
+
+	// WriteRequest -> TimeSeries
+	num, typ, n := protowire.ConsumeTag(req)
+	if num != 1 || typ != protowire.BytesType {
+		t.Fatalf("unexpected write request field %d type %d", num, typ)
+	}
+	series, m := protowire.ConsumeBytes(req[n:])
+	if n+m != len(req) {
+		t.Fatalf("expected a single time series")
+	}
+
+	labels := []label{}
+	var value float64
+	var timestamp int64
+
+	for len(series) > 0 {
+		num, _, n := protowire.ConsumeTag(series)
+		body, m := protowire.ConsumeBytes(series[n:])
+		series = series[n+m:]
+
+		switch num {
+		case 1:
+			_, _, n := protowire.ConsumeTag(body)
+			name, m := protowire.ConsumeString(body[n:])
+			body = body[n+m:]
+			_, _, n = protowire.ConsumeTag(body)
+			val, _ := protowire.ConsumeString(body[n:])
+			labels = append(labels, label{name: name, value: val})
+		case 2:
+			_, _, n := protowire.ConsumeTag(body)
+			bits, m := protowire.ConsumeFixed64(body[n:])
+			body = body[n+m:]
+			_, _, n = protowire.ConsumeTag(body)
+			ts, _ := protowire.ConsumeVarint(body[n:])
+			value = math.Float64frombits(bits)
+			timestamp = int64(ts)
+		}
+	}
+
+	expectedLabels := []label{
+		{name: "Zone", value: "north"},
+		{name: "__name__", value: "room_1_temp"},
+		{name: "db", value: "override"},
+		{name: "location", value: "test location"},
+		{name: "name", value: "test_metric"},
+	}
+
+	if len(labels) != len(expectedLabels) {
+		t.Fatalf("expected no. of labels %d, got %d", len(expectedLabels), len(labels))
+	}
+
+	for i := range labels {
+		if labels[i] != expectedLabels[i] {
+			t.Errorf("expected label %v, got %v", expectedLabels[i], labels[i])
+		}
+	}
+
+	if value != 22.11 {
+		t.Errorf("expected value: %g got: %g", 22.11, value)
+	}
+
+	if timestamp != point.Timestamp.UnixMilli() {
+		t.Errorf("expected timestamp: %d got: %d", point.Timestamp.UnixMilli(), timestamp)
+	}
+}
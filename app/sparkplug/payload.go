@@ -0,0 +1,211 @@
+package sparkplug
+
+import (
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// data types of the Sparkplug B specification that need converting, the others are read by their value field
+const (
+	typeInt8  = 1
+	typeInt16 = 2
+	typeInt32 = 3
+	typeInt64 = 4
+
+	typeBoolean = 11
+)
+
+// field numbers of the value oneof of a metric
+const (
+	fieldIntValue    = 10
+	fieldLongValue   = 11
+	fieldFloatValue  = 12
+	fieldDoubleValue = 13
+	fieldBoolValue   = 14
+	fieldStringValue = 15
+)
+
+/* payload holds the fields of a Sparkplug B Payload message the adapter uses */
+type payload struct {
+	timestamp uint64 // milliseconds, 0 when not set
+	metrics   []metric
+}
+
+/* metric holds the fields of a Sparkplug B Metric, the value is kept as read until its data type is known */
+type metric struct {
+	name      string
+	alias     uint64
+	hasAlias  bool
+	timestamp uint64 // milliseconds, 0 when not set
+	datatype  uint64
+	isNull    bool
+
+	valueField protowire.Number // 0 when the metric has no value the adapter reads
+	raw        uint64
+	float      float64
+	str        string
+}
+
+// encodeRebirth builds the payload of the NCMD that asks a node to publish its births again
+func encodeRebirth(now time.Time) []byte {
+	var m []byte
+	m = protowire.AppendTag(m, 1, protowire.BytesType)
+	m = protowire.AppendString(m, rebirthMetric)
+	m = protowire.AppendTag(m, 4, protowire.VarintType)
+	m = protowire.AppendVarint(m, typeBoolean)
+	m = protowire.AppendTag(m, fieldBoolValue, protowire.VarintType)
+	m = protowire.AppendVarint(m, 1)
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(now.UnixMilli()))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// decodePayload reads a Sparkplug B Payload message. Fields the adapter does not use, like datasets, templates and
+// properties, are skipped.
+func decodePayload(b []byte) (payload, error) {
+	var p payload
+
+	err := walk(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			p.timestamp = v
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+
+			m, err := decodeMetric(v)
+			if err != nil {
+				return 0, errors.Wrapf(err, "invalid metric %d", len(p.metrics))
+			}
+			p.metrics = append(p.metrics, m)
+			return n, nil
+		}
+
+		return 0, nil
+	})
+
+	return p, errors.Wrap(err, "invalid sparkplug payload")
+}
+
+func decodeMetric(b []byte) (metric, error) {
+	var m metric
+
+	err := walk(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			switch num {
+			case 2:
+				m.alias, m.hasAlias = v, true
+			case 3:
+				m.timestamp = v
+			case 4:
+				m.datatype = v
+			case 7:
+				m.isNull = v != 0
+			case fieldIntValue, fieldLongValue, fieldBoolValue:
+				m.valueField, m.raw = num, v
+			}
+			return n, nil
+		case protowire.Fixed32Type:
+			if num != fieldFloatValue {
+				return 0, nil
+			}
+			v, n := protowire.ConsumeFixed32(b)
+			m.valueField, m.float = num, float64(math.Float32frombits(v))
+			return n, nil
+		case protowire.Fixed64Type:
+			if num != fieldDoubleValue {
+				return 0, nil
+			}
+			v, n := protowire.ConsumeFixed64(b)
+			m.valueField, m.float = num, math.Float64frombits(v)
+			return n, nil
+		case protowire.BytesType:
+			if num != 1 && num != fieldStringValue {
+				return 0, nil
+			}
+			v, n := protowire.ConsumeString(b)
+			if num == 1 {
+				m.name = v
+			} else {
+				m.valueField, m.str = num, v
+			}
+			return n, nil
+		}
+
+		return 0, nil
+	})
+
+	return m, err
+}
+
+// number returns the value of a numeric or boolean metric, signed integers are sent as their two's complement in
+// the unsigned fields
+func (m metric) number() (float64, bool) {
+	if m.isNull {
+		return 0, false
+	}
+
+	switch m.valueField {
+	case fieldIntValue:
+		switch m.datatype {
+		case typeInt8:
+			return float64(int8(m.raw)), true
+		case typeInt16:
+			return float64(int16(m.raw)), true
+		case typeInt32:
+			return float64(int32(m.raw)), true
+		}
+		return float64(uint32(m.raw)), true
+	case fieldLongValue:
+		if m.datatype == typeInt64 {
+			return float64(int64(m.raw)), true
+		}
+		return float64(m.raw), true
+	case fieldFloatValue, fieldDoubleValue:
+		return m.float, true
+	case fieldBoolValue:
+		if m.raw != 0 {
+			return 1, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+/* walk calls visit for every field of the message b, visit returns the length of the value it read or 0 to skip it */
+func walk(b []byte, visit func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n, err := visit(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package sparkplug
+
+import (
+	"math"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+/* encodePayload builds a Sparkplug B Payload message, the inverse of decodePayload */
+func encodePayload(timestamp uint64, metrics ...metric) []byte {
+	var b []byte
+	if timestamp != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, timestamp)
+	}
+
+	for _, m := range metrics {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeMetric(m))
+	}
+
+	// a seq the decoder skips
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	return protowire.AppendVarint(b, 7)
+}
+
+func encodeMetric(m metric) []byte {
+	var b []byte
+	if m.name != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.name)
+	}
+	if m.hasAlias {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.alias)
+	}
+	if m.timestamp != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.timestamp)
+	}
+	if m.datatype != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.datatype)
+	}
+	if m.isNull {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+
+	switch m.valueField {
+	case fieldIntValue, fieldLongValue, fieldBoolValue:
+		b = protowire.AppendTag(b, m.valueField, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.raw)
+	case fieldFloatValue:
+		b = protowire.AppendTag(b, m.valueField, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(float32(m.float)))
+	case fieldDoubleValue:
+		b = protowire.AppendTag(b, m.valueField, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(m.float))
+	case fieldStringValue:
+		b = protowire.AppendTag(b, m.valueField, protowire.BytesType)
+		b = protowire.AppendString(b, m.str)
+	}
+
+	// a property set the decoder skips
+	b = protowire.AppendTag(b, 9, protowire.BytesType)
+	return protowire.AppendBytes(b, []byte{0x0a, 0x01, 'x'})
+}
+
+func TestDecodePayload(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name          string
+		metric        metric
+		expected      float64
+		expectedValue bool
+	}{
+		{name: "Success: Int8", metric: metric{datatype: typeInt8, valueField: fieldIntValue, raw: uint64(uint32(0xFFFFFFFB))}, expected: -5, expectedValue: true},
+		{name: "Success: Int16", metric: metric{datatype: typeInt16, valueField: fieldIntValue, raw: uint64(uint32(0xFFFFFF9C))}, expected: -100, expectedValue: true},
+		{name: "Success: Int32", metric: metric{datatype: typeInt32, valueField: fieldIntValue, raw: uint64(uint32(0xFFFFFFF9))}, expected: -7, expectedValue: true},
+		{name: "Success: UInt32", metric: metric{datatype: 7, valueField: fieldIntValue, raw: 4000000000}, expected: 4000000000, expectedValue: true},
+		{name: "Success: Int64", metric: metric{datatype: typeInt64, valueField: fieldLongValue, raw: math.MaxUint64 - 8}, expected: -9, expectedValue: true},
+		{name: "Success: UInt64", metric: metric{datatype: 8, valueField: fieldLongValue, raw: 1 << 40}, expected: 1 << 40, expectedValue: true},
+		{name: "Success: Float", metric: metric{datatype: 9, valueField: fieldFloatValue, float: 1.5}, expected: 1.5, expectedValue: true},
+		{name: "Success: Double", metric: metric{datatype: 10, valueField: fieldDoubleValue, float: 2.25}, expected: 2.25, expectedValue: true},
+		{name: "Success: Boolean", metric: metric{datatype: 11, valueField: fieldBoolValue, raw: 1}, expected: 1, expectedValue: true},
+		{name: "Success: String has no number", metric: metric{datatype: 12, valueField: fieldStringValue, str: "on"}},
+		{name: "Success: Null", metric: metric{datatype: 10, isNull: true}},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		c.metric.name = "value"
+		p, err := decodePayload(encodePayload(1700000000000, c.metric))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.timestamp != 1700000000000 || len(p.metrics) != 1 || p.metrics[0].name != "value" {
+			t.Fatalf("expected the timestamp and a metric named value, got %+v", p)
+		}
+
+		val, ok := p.metrics[0].number()
+		if ok != c.expectedValue || val != c.expected {
+			t.Errorf("expected %g (%t), got %g (%t)", c.expected, c.expectedValue, val, ok)
+		}
+	}
+}
+
+func TestDecodePayloadInvalid(t *testing.T) {
+	t.Parallel()
+
+	valid := encodePayload(1700000000000, metric{name: "temp", datatype: 10, valueField: fieldDoubleValue, float: 21.5})
+
+	for _, b := range [][]byte{valid[:len(valid)-3], {0x12, 0x05, 0x0a}, {0xff}} {
+		if _, err := decodePayload(b); err == nil {
+			t.Errorf("expected an error for %x", b)
+		}
+	}
+}
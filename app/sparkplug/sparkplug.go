@@ -0,0 +1,354 @@
+package sparkplug
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"taos-adapter/models"
+	"time"
+)
+
+// Namespace is the first level of every Sparkplug B topic: spBv1.0/<group>/<message type>/<node>[/<device>]
+const Namespace = "spBv1.0"
+
+const (
+	NBIRTH = "NBIRTH"
+	NDEATH = "NDEATH"
+	DBIRTH = "DBIRTH"
+	DDEATH = "DDEATH"
+	NDATA  = "NDATA"
+	DDATA  = "DDATA"
+	NCMD   = "NCMD"
+	DCMD   = "DCMD"
+	STATE  = "STATE"
+)
+
+const (
+	// StaleField is set to 1 on the points written when a node or device dies and to 0 when it is born
+	StaleField = "stale"
+
+	// DeviceTag holds the device of the points of DBIRTH and DDATA messages
+	DeviceTag = "device"
+
+	// bdSeqMetric numbers the sessions of a node, it is not written as a point
+	bdSeqMetric = "bdSeq"
+
+	// rebirthMetric of an NCMD asks the node to publish its births again
+	rebirthMetric = "Node Control/Rebirth"
+
+	// how long to wait for the births of a node before asking again
+	rebirthInterval = 30 * time.Second
+)
+
+// IsTopic reports whether topic is in the Sparkplug B namespace
+func IsTopic(topic string) bool {
+	return strings.HasPrefix(topic, Namespace+"/")
+}
+
+/* topic is a parsed Sparkplug B topic, device is empty for node messages */
+type topic struct {
+	group, messageType, node, device string
+}
+
+func parseTopic(name string) (topic, error) {
+	levels := strings.Split(name, "/")
+	if levels[0] != Namespace || len(levels) < 4 || len(levels) > 5 {
+		return topic{}, fmt.Errorf("expected %s/<group>/<message type>/<node>[/<device>], got: %s", Namespace, name)
+	}
+
+	t := topic{group: levels[1], messageType: levels[2], node: levels[3]}
+	if len(levels) == 5 {
+		t.device = levels[4]
+	}
+
+	return t, nil
+}
+
+func (t topic) nodeKey() string {
+	return t.group + "/" + t.node
+}
+
+/* key identifies the node or device the message is about */
+func (t topic) key() string {
+	if t.device == "" {
+		return t.nodeKey()
+	}
+
+	return t.nodeKey() + "/" + t.device
+}
+
+// Decoder turns Sparkplug B messages into points. Births declare the aliases later data messages may send instead
+// of metric names, deaths mark the node or device stale until it is born again. The group is the db, the node the
+// table and the device a tag. A Decoder keeps the state of one MQTT session and is not safe for concurrent use.
+type Decoder struct {
+	// string metrics with these names become tags, the others are skipped as every value would start a new series
+	StringTags map[string]bool
+
+	aliases  map[string]map[uint64]string // by node or device key
+	bdSeq    map[string]uint64            // of the last NBIRTH by node key
+	stale    map[string]bool              // node and device keys that died and were not born again
+	devices  map[string]map[string]bool   // device keys born by node key
+	rebirths map[string]time.Time         // when a rebirth was last requested by node key
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{
+		StringTags: map[string]bool{},
+		aliases:    map[string]map[uint64]string{},
+		bdSeq:      map[string]uint64{},
+		stale:      map[string]bool{},
+		devices:    map[string]map[string]bool{},
+		rebirths:   map[string]time.Time{},
+	}
+}
+
+// UnknownAliasesError reports the metrics of a data message sent by aliases that no birth declared, which happens
+// when the adapter subscribed after the births of the node
+type UnknownAliasesError struct {
+	Aliases []string
+	topic   topic
+}
+
+func (e *UnknownAliasesError) Error() string {
+	return fmt.Sprintf("unknown aliases %s of %s, waiting for its birth", strings.Join(e.Aliases, ", "), e.topic.key())
+}
+
+// Rebirth returns the topic and payload of the NCMD asking the node of err to publish its births again. It returns
+// false when a rebirth of the node was requested within the last rebirthInterval and its births are still awaited.
+func (d *Decoder) Rebirth(err *UnknownAliasesError, now time.Time) (string, []byte, bool) {
+	key := err.topic.nodeKey()
+	if requested, ok := d.rebirths[key]; ok && now.Sub(requested) < rebirthInterval {
+		return "", nil, false
+	}
+	d.rebirths[key] = now
+
+	return strings.Join([]string{Namespace, err.topic.group, NCMD, err.topic.node}, "/"), encodeRebirth(now), true
+}
+
+// Decode returns the points of a message received on topicName, now is their timestamp when the payload has none.
+// Commands and host state messages have no points. When some metrics could not be resolved the points of the
+// others are returned along with the error.
+func (d *Decoder) Decode(topicName string, raw []byte, now time.Time) ([]models.TimeBasedMetrics, error) {
+	levels := strings.Split(topicName, "/")
+	if len(levels) > 1 && levels[1] == STATE {
+		return nil, nil
+	}
+
+	t, err := parseTopic(topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.messageType == NCMD || t.messageType == DCMD {
+		return nil, nil
+	}
+
+	p, err := decodePayload(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := now
+	if p.timestamp != 0 {
+		timestamp = time.UnixMilli(int64(p.timestamp))
+	}
+
+	key := t.key()
+	switch t.messageType {
+	case NBIRTH, DBIRTH:
+		if t.messageType == NBIRTH && t.device != "" || t.messageType == DBIRTH && t.device == "" {
+			return nil, fmt.Errorf("unexpected %s on %s", t.messageType, topicName)
+		}
+
+		if t.messageType == DBIRTH && d.stale[t.nodeKey()] {
+			return nil, fmt.Errorf("%s of device %s while node %s is dead", DBIRTH, key, t.nodeKey())
+		}
+
+		d.birth(t, p)
+
+		// a point written separately with the same timestamp would replace the row of the birth values
+		points, err := d.points(t, topicName, p, timestamp)
+		for i := range points {
+			if points[i].Timestamp.Equal(timestamp) {
+				points[i].Metrics[StaleField] = 0
+				return points, err
+			}
+		}
+		return append(points, d.stalePoint(t, topicName, timestamp, false)), err
+	case NDATA, DDATA:
+		if t.messageType == NDATA && t.device != "" || t.messageType == DDATA && t.device == "" {
+			return nil, fmt.Errorf("unexpected %s on %s", t.messageType, topicName)
+		}
+
+		if d.stale[key] || d.stale[t.nodeKey()] {
+			return nil, fmt.Errorf("%s of %s is dropped, it is stale until its next birth", t.messageType, key)
+		}
+
+		return d.points(t, topicName, p, timestamp)
+	case NDEATH:
+		// the will message of an older session arrives after the node was born again
+		if bdSeq, ok := findBdSeq(p); ok {
+			if current, born := d.bdSeq[key]; born && current != bdSeq {
+				return nil, nil
+			}
+		}
+
+		points := []models.TimeBasedMetrics{d.stalePoint(t, topicName, timestamp, true)}
+		for _, device := range sortedKeys(d.devices[key]) {
+			deviceTopic := t
+			deviceTopic.device = strings.TrimPrefix(device, key+"/")
+			if !d.stale[device] {
+				points = append(points, d.stalePoint(deviceTopic, topicName, timestamp, true))
+			}
+			d.stale[device] = true
+			delete(d.aliases, device)
+		}
+		d.stale[key] = true
+		delete(d.aliases, key)
+
+		return points, nil
+	case DDEATH:
+		d.stale[key] = true
+		delete(d.aliases, key)
+
+		return []models.TimeBasedMetrics{d.stalePoint(t, topicName, timestamp, true)}, nil
+	default:
+		return nil, fmt.Errorf("unknown message type %s on %s", t.messageType, topicName)
+	}
+}
+
+/* birth replaces the aliases of the node or device, a node birth also forgets its devices until they are born */
+func (d *Decoder) birth(t topic, p payload) {
+	key := t.key()
+
+	if t.device == "" {
+		for device := range d.devices[key] {
+			delete(d.aliases, device)
+			delete(d.stale, device)
+		}
+		delete(d.devices, key)
+
+		if bdSeq, ok := findBdSeq(p); ok {
+			d.bdSeq[key] = bdSeq
+		}
+		delete(d.rebirths, key)
+	} else {
+		if d.devices[t.nodeKey()] == nil {
+			d.devices[t.nodeKey()] = map[string]bool{}
+		}
+		d.devices[t.nodeKey()][key] = true
+	}
+
+	aliases := map[uint64]string{}
+	for _, m := range p.metrics {
+		if m.hasAlias && m.name != "" {
+			aliases[m.alias] = m.name
+		}
+	}
+	d.aliases[key] = aliases
+	delete(d.stale, key)
+}
+
+// points groups the metrics of a payload by timestamp. Numbers and booleans become metrics and strings listed in
+// StringTags become tags, other strings and data types like datasets and templates are skipped.
+func (d *Decoder) points(t topic, topicName string, p payload, timestamp time.Time) ([]models.TimeBasedMetrics, error) {
+	byTimestamp := map[time.Time]*models.TimeBasedMetrics{}
+	timestamps := []time.Time{}
+	unresolved := []string{}
+
+	for _, m := range p.metrics {
+		name := m.name
+		if name == "" && m.hasAlias {
+			name = d.aliases[t.key()][m.alias]
+		}
+		if name == "" {
+			unresolved = append(unresolved, fmt.Sprint(m.alias))
+			continue
+		}
+		if name == bdSeqMetric {
+			continue
+		}
+
+		ts := timestamp
+		if m.timestamp != 0 {
+			ts = time.UnixMilli(int64(m.timestamp))
+		}
+
+		point, ok := byTimestamp[ts]
+		if !ok {
+			point = d.newPoint(t, topicName, ts)
+			byTimestamp[ts] = point
+			timestamps = append(timestamps, ts)
+		}
+
+		if val, ok := m.number(); ok {
+			point.Metrics[name] = val
+		} else if m.valueField == fieldStringValue && !m.isNull && d.StringTags[name] {
+			point.Tags[name] = m.str
+		}
+	}
+
+	// null metrics leave points without values
+	emptyTags := len(d.newPoint(t, topicName, timestamp).Tags)
+	points := []models.TimeBasedMetrics{}
+	for _, ts := range timestamps {
+		if point := byTimestamp[ts]; len(point.Metrics) > 0 || len(point.Tags) > emptyTags {
+			points = append(points, *point)
+		}
+	}
+
+	if len(unresolved) > 0 {
+		return points, &UnknownAliasesError{Aliases: unresolved, topic: t}
+	}
+
+	return points, nil
+}
+
+/* stalePoint marks the node or device stale or alive */
+func (d *Decoder) stalePoint(t topic, topicName string, timestamp time.Time, stale bool) models.TimeBasedMetrics {
+	point := d.newPoint(t, topicName, timestamp)
+	point.Metrics[StaleField] = 0
+	if stale {
+		point.Metrics[StaleField] = 1
+	}
+
+	return *point
+}
+
+func (d *Decoder) newPoint(t topic, topicName string, timestamp time.Time) *models.TimeBasedMetrics {
+	point := &models.TimeBasedMetrics{
+		Metrics:   map[string]float64{},
+		Tags:      map[string]string{},
+		Timestamp: timestamp,
+		DB:        t.group,
+		Table:     t.node,
+		Topic:     topicName,
+	}
+	if t.device != "" {
+		point.Tags[DeviceTag] = t.device
+	}
+
+	return point
+}
+
+/* findBdSeq returns the bdSeq metric of an NBIRTH or NDEATH */
+func findBdSeq(p payload) (uint64, bool) {
+	for _, m := range p.metrics {
+		if m.name == bdSeqMetric {
+			val, ok := m.number()
+			return uint64(val), ok
+		}
+	}
+
+	return 0, false
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
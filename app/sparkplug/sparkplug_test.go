@@ -0,0 +1,195 @@
+package sparkplug
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"taos-adapter/models"
+	"testing"
+	"time"
+)
+
+func double(name string, alias uint64, val float64) metric {
+	return metric{name: name, alias: alias, hasAlias: true, datatype: 10, valueField: fieldDoubleValue, float: val}
+}
+
+func aliased(alias uint64, val float64) metric {
+	return metric{alias: alias, hasAlias: true, datatype: 10, valueField: fieldDoubleValue, float: val}
+}
+
+func bdSeq(val uint64) metric {
+	return metric{name: bdSeqMetric, datatype: 8, valueField: fieldLongValue, raw: val}
+}
+
+func TestDecoder(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	later := time.UnixMilli(1700000001000)
+
+	point := func(table, device string, ts time.Time, metrics map[string]float64, tags map[string]string, topic string) models.TimeBasedMetrics {
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		if device != "" {
+			tags[DeviceTag] = device
+		}
+		return models.TimeBasedMetrics{Metrics: metrics, Tags: tags, Timestamp: ts, DB: "plant", Table: table, Topic: topic}
+	}
+
+	d := NewDecoder()
+	d.StringTags["firmware"] = true
+
+	// the steps run in order, each one sees the state left by the previous ones
+	cases := []struct {
+		name          string
+		topic         string
+		payload       []byte
+		expected      []models.TimeBasedMetrics
+		expectedError string
+	}{
+		{
+			name: "Success: Data with names before a birth", topic: "spBv1.0/plant/NDATA/gw1",
+			payload:  encodePayload(0, double("temp", 0, 20)),
+			expected: []models.TimeBasedMetrics{point("gw1", "", now, map[string]float64{"temp": 20}, nil, "spBv1.0/plant/NDATA/gw1")},
+		},
+		{
+			name: "Failure: Alias before a birth", topic: "spBv1.0/plant/NDATA/gw1",
+			payload: encodePayload(0, aliased(1, 20)), expected: []models.TimeBasedMetrics{}, expectedError: "unknown aliases 1 of plant/gw1",
+		},
+		{
+			name: "Success: Node birth", topic: "spBv1.0/plant/NBIRTH/gw1",
+			payload: encodePayload(uint64(now.UnixMilli()), bdSeq(3), double("temp", 1, 21.5),
+				metric{name: "Node Control/Rebirth", alias: 2, hasAlias: true, datatype: 11, valueField: fieldBoolValue},
+				metric{name: "firmware", alias: 3, hasAlias: true, datatype: 12, valueField: fieldStringValue, str: "1.2.0"},
+				metric{name: "status", alias: 4, hasAlias: true, datatype: 12, valueField: fieldStringValue, str: "running since 08:00"}),
+			expected: []models.TimeBasedMetrics{point("gw1", "", now, map[string]float64{"temp": 21.5, "Node Control/Rebirth": 0, StaleField: 0},
+				map[string]string{"firmware": "1.2.0"}, "spBv1.0/plant/NBIRTH/gw1")},
+		},
+		{
+			name: "Success: Device birth with metric timestamps", topic: "spBv1.0/plant/DBIRTH/gw1/pump",
+			payload: encodePayload(uint64(now.UnixMilli()), metric{name: "pressure", alias: 1, hasAlias: true, timestamp: uint64(later.UnixMilli()),
+				datatype: 9, valueField: fieldFloatValue, float: 1.5}),
+			expected: []models.TimeBasedMetrics{
+				point("gw1", "pump", later, map[string]float64{"pressure": 1.5}, nil, "spBv1.0/plant/DBIRTH/gw1/pump"),
+				point("gw1", "pump", now, map[string]float64{StaleField: 0}, nil, "spBv1.0/plant/DBIRTH/gw1/pump"),
+			},
+		},
+		{
+			name: "Success: Device data by alias", topic: "spBv1.0/plant/DDATA/gw1/pump",
+			payload:  encodePayload(uint64(later.UnixMilli()), aliased(1, 1.75)),
+			expected: []models.TimeBasedMetrics{point("gw1", "pump", later, map[string]float64{"pressure": 1.75}, nil, "spBv1.0/plant/DDATA/gw1/pump")},
+		},
+		{
+			name: "Success: Node data by alias", topic: "spBv1.0/plant/NDATA/gw1",
+			payload:  encodePayload(0, aliased(1, 22), metric{alias: 3, hasAlias: true, datatype: 12, isNull: true}),
+			expected: []models.TimeBasedMetrics{point("gw1", "", now, map[string]float64{"temp": 22}, nil, "spBv1.0/plant/NDATA/gw1")},
+		},
+		{
+			name: "Success: Death of an older session is ignored", topic: "spBv1.0/plant/NDEATH/gw1",
+			payload: encodePayload(0, bdSeq(2)),
+		},
+		{
+			name: "Success: Node death", topic: "spBv1.0/plant/NDEATH/gw1",
+			payload: encodePayload(0, bdSeq(3)),
+			expected: []models.TimeBasedMetrics{
+				point("gw1", "", now, map[string]float64{StaleField: 1}, nil, "spBv1.0/plant/NDEATH/gw1"),
+				point("gw1", "pump", now, map[string]float64{StaleField: 1}, nil, "spBv1.0/plant/NDEATH/gw1"),
+			},
+		},
+		{
+			name: "Failure: Device data while stale", topic: "spBv1.0/plant/DDATA/gw1/pump",
+			payload: encodePayload(0, double("pressure", 0, 2)), expectedError: "is stale until its next birth",
+		},
+		{
+			name: "Failure: Device birth while the node is dead", topic: "spBv1.0/plant/DBIRTH/gw1/pump",
+			payload: encodePayload(0, double("pressure", 1, 2)), expectedError: "while node plant/gw1 is dead",
+		},
+		{
+			name: "Success: Node born again", topic: "spBv1.0/plant/NBIRTH/gw1",
+			payload:  encodePayload(0, bdSeq(4), double("temp", 1, 23)),
+			expected: []models.TimeBasedMetrics{point("gw1", "", now, map[string]float64{"temp": 23, StaleField: 0}, nil, "spBv1.0/plant/NBIRTH/gw1")},
+		},
+		{
+			name: "Failure: Device aliases forgotten by the node birth", topic: "spBv1.0/plant/DDATA/gw1/pump",
+			payload: encodePayload(0, aliased(1, 2)), expected: []models.TimeBasedMetrics{}, expectedError: "unknown aliases 1 of plant/gw1/pump",
+		},
+		{
+			name: "Success: Device death", topic: "spBv1.0/plant/DDEATH/gw1/pump",
+			payload:  encodePayload(uint64(later.UnixMilli())),
+			expected: []models.TimeBasedMetrics{point("gw1", "pump", later, map[string]float64{StaleField: 1}, nil, "spBv1.0/plant/DDEATH/gw1/pump")},
+		},
+		{name: "Success: Commands are ignored", topic: "spBv1.0/plant/NCMD/gw1", payload: encodePayload(0, double("Node Control/Rebirth", 0, 1))},
+		{name: "Success: Host state is ignored", topic: "spBv1.0/STATE/scada", payload: []byte(`{"online": true}`)},
+		{name: "Failure: Missing node", topic: "spBv1.0/plant/NDATA", payload: encodePayload(0), expectedError: "expected spBv1.0/<group>/<message type>/<node>"},
+		{name: "Failure: Device on a node message", topic: "spBv1.0/plant/NDATA/gw1/pump", payload: encodePayload(0), expectedError: "unexpected NDATA"},
+		{name: "Failure: Unknown message type", topic: "spBv1.0/plant/NPING/gw1", payload: encodePayload(0), expectedError: "unknown message type NPING"},
+		{name: "Failure: Invalid payload", topic: "spBv1.0/plant/NDATA/gw1", payload: []byte{0xff}, expectedError: "invalid sparkplug payload"},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		points, err := d.Decode(c.topic, c.payload, now)
+		if c.expectedError == "" && err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		if c.expectedError != "" && (err == nil || !strings.Contains(err.Error(), c.expectedError)) {
+			t.Errorf("expected error containing %q, got %v", c.expectedError, err)
+		}
+
+		if len(points) != 0 || len(c.expected) != 0 {
+			if !reflect.DeepEqual(points, c.expected) {
+				t.Errorf("expected points:\n%+v\ngot:\n%+v", c.expected, points)
+			}
+		}
+	}
+}
+
+func TestIsTopic(t *testing.T) {
+	t.Parallel()
+
+	if !IsTopic("spBv1.0/plant/NDATA/gw1") || IsTopic("plant/gw1") || IsTopic("spBv1.0") {
+		t.Error("expected only topics under spBv1.0/ to be sparkplug topics")
+	}
+}
+
+func TestRebirth(t *testing.T) {
+	t.Parallel()
+
+	now := time.UnixMilli(1700000000000)
+	d := NewDecoder()
+
+	_, err := d.Decode("spBv1.0/plant/DDATA/gw1/pump", encodePayload(0, aliased(1, 2)), now)
+	var unknown *UnknownAliasesError
+	if !errors.As(err, &unknown) {
+		t.Fatalf("expected unknown aliases, got %v", err)
+	}
+
+	topic, payload, ok := d.Rebirth(unknown, now)
+	if !ok || topic != "spBv1.0/plant/NCMD/gw1" {
+		t.Fatalf("expected a rebirth request on spBv1.0/plant/NCMD/gw1, got %q %t", topic, ok)
+	}
+
+	p, err := decodePayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := p.metrics[0].number(); len(p.metrics) != 1 || p.metrics[0].name != rebirthMetric || !ok || val != 1 {
+		t.Errorf("expected %s set to true, got %+v", rebirthMetric, p.metrics)
+	}
+
+	if _, _, ok := d.Rebirth(unknown, now.Add(time.Second)); ok {
+		t.Error("expected no second request while the births are awaited")
+	}
+
+	if _, _, ok := d.Rebirth(unknown, now.Add(rebirthInterval)); !ok {
+		t.Error("expected a request once the interval passed")
+	}
+
+	if _, err := d.Decode("spBv1.0/plant/NBIRTH/gw1", encodePayload(0, bdSeq(1)), now); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := d.Rebirth(unknown, now.Add(rebirthInterval+time.Second)); !ok {
+		t.Error("expected a request after the node was born again")
+	}
+}
@@ -0,0 +1,203 @@
+package telemetry
+
+import (
+	"sync"
+	"taos-adapter/models"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "taos_adapter"
+
+var (
+	// MessagesReceived counts MQTT messages per topic before they are parsed
+	MessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "MQTT messages received per topic.",
+	}, []string{"topic"})
+
+	// ParseFailures counts messages that could not be parsed per parser
+	ParseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "parse_failures_total",
+		Help:      "Messages that failed to parse per parser.",
+	}, []string{"parser"})
+
+	// Reconnects counts connections that were opened again after the first one, per target
+	Reconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconnects_total",
+		Help:      "Connections reopened after the first one per target.",
+	}, []string{"target"})
+
+	// SinkRestarts counts sinks restarted by fanout after failing
+	SinkRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_restarts_total",
+		Help:      "Sink restarts after a failure.",
+	}, []string{"sink"})
+
+	pointsWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "points_written_total",
+		Help:      "Points written per sink and database.",
+	}, []string{"sink", "db"})
+
+	writeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "write_errors_total",
+		Help:      "Points that failed to be written per sink and database.",
+	}, []string{"sink", "db"})
+
+	writeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "write_duration_seconds",
+		Help:      "Time taken by a single write of a batch per sink, including retries.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"sink"})
+
+	lastWrite = &lastWriteCollector{
+		desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "seconds_since_last_write"),
+			"Seconds since the last successful write per sink.", []string{"sink"}, nil),
+		times: map[string]time.Time{},
+		now:   time.Now,
+	}
+
+	queues = &queueCollector{
+		desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "queue_depth"),
+			"Points or messages waiting in a queue.", []string{"queue"}, nil),
+		depths: map[string]func() int{},
+	}
+)
+
+func init() {
+	prometheus.MustRegister(MessagesReceived, ParseFailures, Reconnects, SinkRestarts, pointsWritten, writeErrors,
+		writeDuration, lastWrite, queues)
+}
+
+// ObserveWrite records a write of points to sink that started at started, err is nil when it succeeded.
+// Points are counted per database, so sinks writing a batch per database call it once per batch.
+func ObserveWrite(sink string, points []models.TimeBasedMetrics, started time.Time, err error) {
+	writeDuration.WithLabelValues(sink).Observe(time.Since(started).Seconds())
+
+	counter := pointsWritten
+	if err != nil {
+		counter = writeErrors
+	}
+
+	perDB := map[string]int{}
+	for _, point := range points {
+		perDB[point.DB]++
+	}
+
+	for db, n := range perDB {
+		counter.WithLabelValues(sink, db).Add(float64(n))
+	}
+
+	if err == nil {
+		lastWrite.set(sink, time.Now())
+	}
+}
+
+// RegisterQueue exposes the depth of a channel or queue under the queue_depth metric, registering a name again
+// replaces the previous depth function
+func RegisterQueue(name string, depth func() int) {
+	queues.mu.Lock()
+	defer queues.mu.Unlock()
+
+	queues.depths[name] = depth
+}
+
+// UnregisterQueue stops exposing a queue, like the queue of a sink removed by a reload
+func UnregisterQueue(name string) {
+	queues.mu.Lock()
+	defer queues.mu.Unlock()
+
+	delete(queues.depths, name)
+}
+
+// RegisterCounter exposes a counter kept elsewhere, like the drop counters of the pipeline and queues, through
+// registerer, usually prometheus.DefaultRegisterer
+func RegisterCounter(registerer prometheus.Registerer, name, help string, value func() uint64) {
+	registerer.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, func() float64 {
+		return float64(value())
+	}))
+}
+
+// RegisterCounterMap exposes a counter kept elsewhere as a map of label value to count through registerer,
+// usually prometheus.DefaultRegisterer
+func RegisterCounterMap(registerer prometheus.Registerer, name, help, label string, values func() map[string]uint64) {
+	registerer.MustRegister(&mapCollector{
+		desc:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, []string{label}, nil),
+		values: values,
+	})
+}
+
+type mapCollector struct {
+	desc   *prometheus.Desc
+	values func() map[string]uint64
+}
+
+func (c *mapCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *mapCollector) Collect(ch chan<- prometheus.Metric) {
+	for label, val := range c.values() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(val), label)
+	}
+}
+
+// lastWriteCollector reports the age of the last successful write at scrape time
+type lastWriteCollector struct {
+	desc  *prometheus.Desc
+	mu    sync.Mutex
+	times map[string]time.Time
+	now   func() time.Time
+}
+
+func (c *lastWriteCollector) set(sink string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.times[sink] = t
+}
+
+func (c *lastWriteCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *lastWriteCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for sink, t := range c.times {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, now.Sub(t).Seconds(), sink)
+	}
+}
+
+type queueCollector struct {
+	desc   *prometheus.Desc
+	mu     sync.Mutex
+	depths map[string]func() int
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, depth := range c.depths {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(depth()), name)
+	}
+}
@@ -0,0 +1,100 @@
+package telemetry
+
+import (
+	"strings"
+	"taos-adapter/models"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveWrite(t *testing.T) {
+	t.Parallel()
+
+	// the counters are global, start from zero when the test runs more than once
+	pointsWritten.DeleteLabelValues("test", "a")
+	pointsWritten.DeleteLabelValues("test", "b")
+	writeErrors.DeleteLabelValues("test", "a")
+
+	points := []models.TimeBasedMetrics{{DB: "a"}, {DB: "a"}, {DB: "b"}}
+
+	ObserveWrite("test", points, time.Now(), nil)
+	ObserveWrite("test", points[:1], time.Now(), errors.New("failed"))
+
+	cases := []struct {
+		name     string
+		counter  prometheus.Counter
+		expected float64
+	}{
+		{name: "Success: Written per database", counter: pointsWritten.WithLabelValues("test", "a"), expected: 2},
+		{name: "Success: Written other database", counter: pointsWritten.WithLabelValues("test", "b"), expected: 1},
+		{name: "Success: Errors per database", counter: writeErrors.WithLabelValues("test", "a"), expected: 1},
+	}
+
+	for _, c := range cases {
+		t.Logf("starting test case: %s", c.name)
+
+		if val := testutil.ToFloat64(c.counter); val != c.expected {
+			t.Errorf("expected %g, got %g", c.expected, val)
+		}
+	}
+
+	if n := testutil.CollectAndCount(writeDuration, "taos_adapter_write_duration_seconds"); n != 1 {
+		t.Errorf("expected one histogram, got %d", n)
+	}
+}
+
+func TestLastWrite(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1257894000, 0)
+	c := &lastWriteCollector{desc: lastWrite.desc, times: map[string]time.Time{}, now: func() time.Time { return now }}
+	c.set("test", now.Add(-90*time.Second))
+
+	expected := `
+# HELP taos_adapter_seconds_since_last_write Seconds since the last successful write per sink.
+# TYPE taos_adapter_seconds_since_last_write gauge
+taos_adapter_seconds_since_last_write{sink="test"} 90
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	t.Parallel()
+
+	queue := make(chan int, 5)
+	queue <- 1
+	queue <- 2
+
+	RegisterQueue("test", func() int { return len(queue) })
+	RegisterQueue("pending", func() int { return 1 })
+
+	expected := `
+# HELP taos_adapter_queue_depth Points or messages waiting in a queue.
+# TYPE taos_adapter_queue_depth gauge
+taos_adapter_queue_depth{queue="pending"} 1
+taos_adapter_queue_depth{queue="test"} 2
+`
+	if err := testutil.CollectAndCompare(queues, strings.NewReader(expected), "taos_adapter_queue_depth"); err != nil {
+		t.Error(err)
+	}
+
+	registry := prometheus.NewRegistry()
+	RegisterCounterMap(registry, "test_dropped_total", "Test drops.", "topic", func() map[string]uint64 {
+		return map[string]uint64{"a/b": 3}
+	})
+
+	expected = `
+# HELP taos_adapter_test_dropped_total Test drops.
+# TYPE taos_adapter_test_dropped_total counter
+taos_adapter_test_dropped_total{topic="a/b"} 3
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "taos_adapter_test_dropped_total"); err != nil {
+		t.Error(err)
+	}
+}